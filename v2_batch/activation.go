@@ -0,0 +1,81 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// listenFdsStart is the first file descriptor passed by systemd. It is a
+// variable for tests.
+var listenFdsStart = 3
+
+// SystemdListeners returns the listeners passed by systemd socket
+// activation (LISTEN_PID, LISTEN_FDS and LISTEN_FDNAMES), keyed by their
+// FileDescriptorName. Unnamed sockets are keyed by "unknown", as systemd
+// does.
+//
+// The environment variables are unset so that child processes don't inherit
+// them. It returns an empty map when the process was not socket activated,
+// and closes the listeners already built when one of the descriptors isn't
+// a listener.
+// The listeners can be wrapped in HTTPListener and passed to Serve.
+func SystemdListeners() (map[string][]net.Listener, error) {
+	defer func() {
+		os.Unsetenv("LISTEN_PID")
+		os.Unsetenv("LISTEN_FDS")
+		os.Unsetenv("LISTEN_FDNAMES")
+	}()
+	listeners := make(map[string][]net.Listener)
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return listeners, nil
+	}
+	nfds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || nfds <= 0 {
+		return listeners, nil
+	}
+	var names []string
+	if env := os.Getenv("LISTEN_FDNAMES"); env != "" {
+		names = strings.Split(env, ":")
+	}
+	for i := 0; i < nfds; i++ {
+		name := "unknown"
+		if i < len(names) && names[i] != "" {
+			name = names[i]
+		}
+		l, err := FileListener(uintptr(listenFdsStart+i), name)
+		if err != nil {
+			for _, ls := range listeners {
+				for _, l := range ls {
+					l.Close()
+				}
+			}
+			return nil, err
+		}
+		listeners[name] = append(listeners[name], l)
+	}
+	return listeners, nil
+}
+
+// FileListener returns a listener for an inherited, already listening file
+// descriptor, e.g. one passed by a parent process during a zero-downtime
+// restart. The descriptor is closed; the listener uses a duplicate.
+func FileListener(fd uintptr, name string) (net.Listener, error) {
+	f := os.NewFile(fd, name)
+	if f == nil {
+		return nil, fmt.Errorf("rpc: invalid file descriptor %d", fd)
+	}
+	defer f.Close()
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("rpc: file descriptor %d (%s) is not a listener: %v", fd, name, err)
+	}
+	return l, nil
+}
@@ -0,0 +1,89 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+//go:build unix
+
+package rpc
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+	"testing"
+)
+
+// inheritListener returns the raw descriptor of a new listener, as passed
+// by systemd, along with its address. The descriptors of files, if any,
+// are then duplicated too, after it.
+func inheritListener(t *testing.T, files ...*os.File) (int, string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	f, err := ln.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	fd, err := syscall.Dup(int(f.Fd()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, file := range files {
+		next, err := syscall.Dup(int(file.Fd()))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if next != fd+1+i {
+			t.Skip("descriptors not consecutive")
+		}
+	}
+	return fd, ln.Addr().String()
+}
+
+func TestSystemdListeners(t *testing.T) {
+	defer func(start int) { listenFdsStart = start }(listenFdsStart)
+
+	// Not activated: the variables are for another process.
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()+1))
+	t.Setenv("LISTEN_FDS", "1")
+	listeners, err := SystemdListeners()
+	if err != nil || len(listeners) != 0 {
+		t.Errorf("Expected no listeners, got %v, %v", listeners, err)
+	}
+	if _, ok := os.LookupEnv("LISTEN_FDS"); ok {
+		t.Error("Expected the variables to be unset")
+	}
+
+	fd, addr := inheritListener(t)
+	listenFdsStart = fd
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "1")
+	t.Setenv("LISTEN_FDNAMES", "api")
+	listeners, err = SystemdListeners()
+	if err != nil || len(listeners["api"]) != 1 || listeners["api"][0].Addr().String() != addr {
+		t.Fatalf("Expected the api listener on %s, got %v, %v", addr, listeners, err)
+	}
+	listeners["api"][0].Close()
+
+	// A descriptor that isn't a listener fails, closing the others.
+	null, err := os.Open(os.DevNull)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer null.Close()
+	fd, addr = inheritListener(t, null)
+	listenFdsStart = fd
+	t.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	t.Setenv("LISTEN_FDS", "2")
+	if _, err := SystemdListeners(); err == nil {
+		t.Fatal("Expected an error for a descriptor that isn't a listener")
+	}
+	if conn, err := net.Dial("tcp", addr); err == nil {
+		conn.Close()
+		t.Error("Expected the listener built before the error to be closed")
+	}
+}
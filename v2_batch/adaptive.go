@@ -0,0 +1,181 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Adaptive batch limits
+// ----------------------------------------------------------------------------
+
+// AdaptiveBatchLimits are the bounds within which the server adapts the
+// batch limits of each caller to its recent behavior, see
+// SetAdaptiveBatchLimits.
+type AdaptiveBatchLimits struct {
+	// MinBatchSize and MaxBatchSize bound the number of requests in a
+	// batch. A MaxBatchSize of 0 leaves the batch size unadapted.
+	MinBatchSize int
+	MaxBatchSize int
+	// MinConcurrency and MaxConcurrency bound the number of requests of
+	// a batch served at once. A MaxConcurrency of 0 leaves the batch
+	// concurrency unadapted.
+	MinConcurrency int
+	MaxConcurrency int
+	// MaxErrorRate is the rate of failed calls above which the limits of
+	// a caller shrink. It defaults to 0.1.
+	MaxErrorRate float64
+	// MaxPayloadSize is the average size of the requests, in bytes, above
+	// which the limits of a caller shrink. Zero ignores sizes.
+	MaxPayloadSize int
+	// Step is the fraction of the range between the bounds gained with
+	// each well-behaved batch. It defaults to 0.05.
+	Step float64
+	// Window is how long the behavior of an idle caller is remembered.
+	// It defaults to ten minutes.
+	Window time.Duration
+}
+
+// adaptiveLimits holds the behavior of the callers.
+type adaptiveLimits struct {
+	mutex     sync.Mutex
+	limits    AdaptiveBatchLimits
+	enabled   bool
+	callers   map[string]*callerBehavior
+	lastPrune time.Time
+}
+
+// callerBehavior is the recent behavior of a caller.
+type callerBehavior struct {
+	// level places the limits of the caller between the bounds, from 0 at
+	// the minimums to 1 at the maximums.
+	level float64
+	// errorRate and payload are moving averages.
+	errorRate float64
+	payload   float64
+	seen      time.Time
+}
+
+// behaviorWeight is the weight of the latest batch in the moving averages.
+const behaviorWeight = 0.2
+
+// SetAdaptiveBatchLimits adapts the batch size and concurrency limits of
+// each caller, as identified by Caller, to its recent behavior: callers
+// start at the minimums and gain with each batch as long as their error
+// rate and request sizes stay below the limits, while a batch crossing
+// them halves their gains.
+//
+// Batches over the adapted size are rejected as with SetMaxBatchSize,
+// which remains a hard limit, including those processed in chunks (see
+// SetBatchChunking). A zero AdaptiveBatchLimits turns adaptation off.
+func (s *Server) SetAdaptiveBatchLimits(limits AdaptiveBatchLimits) {
+	if limits.MinBatchSize < 1 {
+		limits.MinBatchSize = 1
+	}
+	if limits.MaxBatchSize > 0 && limits.MaxBatchSize < limits.MinBatchSize {
+		limits.MaxBatchSize = limits.MinBatchSize
+	}
+	if limits.MinConcurrency < 1 {
+		limits.MinConcurrency = 1
+	}
+	if limits.MaxConcurrency > 0 && limits.MaxConcurrency < limits.MinConcurrency {
+		limits.MaxConcurrency = limits.MinConcurrency
+	}
+	if limits.MaxErrorRate <= 0 {
+		limits.MaxErrorRate = 0.1
+	}
+	if limits.Step <= 0 {
+		limits.Step = 0.05
+	}
+	if limits.Window <= 0 {
+		limits.Window = 10 * time.Minute
+	}
+	a := &s.adaptive
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.limits = limits
+	a.enabled = limits.MaxBatchSize > 0 || limits.MaxConcurrency > 0
+	a.callers = nil
+}
+
+// BatchLimits returns the batch size and concurrency limits adapted to a
+// caller, 0 for those not adapted.
+func (s *Server) BatchLimits(caller string) (size, concurrency int) {
+	a := &s.adaptive
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.enabled {
+		return 0, 0
+	}
+	level := 0.0
+	if c := a.callers[caller]; c != nil && s.clock.Now().Sub(c.seen) < a.limits.Window {
+		level = c.level
+	}
+	return a.bound(level)
+}
+
+// bound returns the limits at level.
+func (a *adaptiveLimits) bound(level float64) (size, concurrency int) {
+	between := func(min, max int) int {
+		if max == 0 {
+			return 0
+		}
+		return min + int(math.Floor(level*float64(max-min)+1e-9))
+	}
+	return between(a.limits.MinBatchSize, a.limits.MaxBatchSize),
+		between(a.limits.MinConcurrency, a.limits.MaxConcurrency)
+}
+
+// recordBatch updates the behavior of a caller with a batch of calls, of
+// which failed failed, and a body of size bytes, negative if unknown.
+func (s *Server) recordBatch(caller string, calls, failed int, size int64) {
+	a := &s.adaptive
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if !a.enabled || calls == 0 {
+		return
+	}
+	now := s.clock.Now()
+	a.prune(now)
+	c := a.callers[caller]
+	if c == nil {
+		if a.callers == nil {
+			a.callers = make(map[string]*callerBehavior)
+		}
+		c = &callerBehavior{errorRate: float64(failed) / float64(calls)}
+		if size >= 0 {
+			c.payload = float64(size) / float64(calls)
+		}
+		a.callers[caller] = c
+	} else {
+		c.errorRate += behaviorWeight * (float64(failed)/float64(calls) - c.errorRate)
+		if size >= 0 {
+			c.payload += behaviorWeight * (float64(size)/float64(calls) - c.payload)
+		}
+	}
+	c.seen = now
+	if c.errorRate > a.limits.MaxErrorRate || (a.limits.MaxPayloadSize > 0 && c.payload > float64(a.limits.MaxPayloadSize)) {
+		c.level /= 2
+	} else {
+		c.level = math.Min(1, c.level+a.limits.Step)
+	}
+}
+
+// prune forgets the callers idle for longer than the window, at most once
+// per window.
+func (a *adaptiveLimits) prune(now time.Time) {
+	if now.Sub(a.lastPrune) < a.limits.Window {
+		return
+	}
+	a.lastPrune = now
+	for caller, c := range a.callers {
+		if now.Sub(c.seen) >= a.limits.Window {
+			delete(a.callers, caller)
+		}
+	}
+}
@@ -0,0 +1,262 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Admin service
+// ----------------------------------------------------------------------------
+
+// adminServiceName is the name of the admin service.
+const adminServiceName = "admin"
+
+// EnableAdmin registers the built-in "admin" service controlling the server
+// at runtime. Every call is passed to authorize first, and answered with a
+// CodeUnauthorized error if it returns false. Admin calls are admitted even
+// in maintenance mode or while draining. Use AdminHandler to serve them on
+// their own address instead of the public API.
+//
+// The methods are, in lowerCamel as in "admin.setLogLevel":
+//
+//	status              returns an AdminStatus
+//	setLogLevel         sets the log level: "debug", "info", "warn" or "error"
+//	setMaintenance      turns maintenance mode on or off
+//	setRateLimit        sets or removes the rate limit of a method
+//	setProfileSampling  sets the profile sampling rate of a method
+//	drain               stops admitting calls and waits for those in flight
+//	resume              admits calls again
+func (s *Server) EnableAdmin(authorize func(*http.Request) bool) error {
+	s.admin = &AdminService{server: s, authorize: authorize}
+	return s.RegisterService(s.admin, adminServiceName)
+}
+
+// adminTransportKey marks the requests received through the AdminHandler.
+type adminTransportKey struct{}
+
+// AdminHandler returns a handler serving the admin service and the admin
+// endpoints, to be bound to a separate address or Unix socket than the
+// public API, e.g. with ListenAdmin. Once it is called, the admin methods
+// are only found through this handler, and it only serves admin methods:
+//
+//	/              admin.* calls, as ServeHTTP
+//	/usage         the UsageHandler
+//	/dependencies  the DependencyGraphHandler
+//	/error-codes   the ErrorCodesHandler
+//	/ready         the ReadyHandler
+//	/health        the HealthHandler
+func (s *Server) AdminHandler() http.Handler {
+	s.adminSeparate = true
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			http.NotFound(w, r)
+			return
+		}
+		s.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), adminTransportKey{}, true)))
+	})
+	mux.Handle("/usage", s.UsageHandler())
+	mux.Handle("/dependencies", s.DependencyGraphHandler())
+	mux.Handle("/error-codes", ErrorCodesHandler())
+	mux.Handle("/ready", s.ReadyHandler())
+	mux.Handle("/health", s.HealthHandler())
+	return mux
+}
+
+// ListenAdmin listens on network and address, as in net.Listen, and returns
+// a listener serving the AdminHandler, to be run with Serve along with the
+// public listeners.
+func (s *Server) ListenAdmin(network, address string) (*HTTPListener, error) {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPListener{Listener: l, Handler: s.AdminHandler()}, nil
+}
+
+// adminRouteError returns an error if method can't be reached through the
+// transport of r, when the admin service has its own handler.
+func (s *Server) adminRouteError(r *http.Request, method string) error {
+	if !s.adminSeparate {
+		return nil
+	}
+	admin, _ := r.Context().Value(adminTransportKey{}).(bool)
+	if admin != strings.HasPrefix(method, adminServiceName+".") {
+		return &Error{Code: CodeMethodNotFound, Message: fmt.Sprintf("rpc: can't find method %q", method)}
+	}
+	return nil
+}
+
+// AdminService implements the admin service. See EnableAdmin.
+type AdminService struct {
+	server    *Server
+	authorize func(*http.Request) bool
+}
+
+// AdminStatus is the state reported by admin.status.
+type AdminStatus struct {
+	LogLevel    string               `json:"log_level"`
+	Ready       bool                 `json:"ready"`
+	Maintenance bool                 `json:"maintenance"`
+	Message     string               `json:"message,omitempty"`
+	Draining    bool                 `json:"draining"`
+	InFlight    int                  `json:"in_flight"`
+	RateLimits  map[string]RateLimit `json:"rate_limits,omitempty"`
+	// The profile sampling rates, by method.
+	ProfileSampling map[string]float64 `json:"profile_sampling,omitempty"`
+}
+
+// AdminLogLevelArgs are the args of admin.setLogLevel.
+type AdminLogLevelArgs struct {
+	Level string `json:"level"`
+}
+
+// AdminMaintenanceArgs are the args of admin.setMaintenance.
+type AdminMaintenanceArgs struct {
+	Enabled bool   `json:"enabled"`
+	Message string `json:"message"`
+}
+
+// AdminRateLimitArgs are the args of admin.setRateLimit. A zero Rate
+// removes the limit.
+type AdminRateLimitArgs struct {
+	Method string  `json:"method"`
+	Rate   float64 `json:"rate"`
+	Burst  int     `json:"burst"`
+}
+
+// AdminProfileSamplingArgs are the args of admin.setProfileSampling. A zero
+// Rate disables sampling.
+type AdminProfileSamplingArgs struct {
+	Method string  `json:"method"`
+	Rate   float64 `json:"rate"`
+}
+
+// AdminDrainArgs are the args of admin.drain. Timeout bounds the wait for
+// the calls in flight, as in "30s"; drain returns immediately without it.
+type AdminDrainArgs struct {
+	Timeout string `json:"timeout"`
+}
+
+// AdminEmpty is the args or reply of admin methods without any.
+type AdminEmpty struct{}
+
+func (a *AdminService) check(r *http.Request) error {
+	if a.authorize == nil || !a.authorize(r) {
+		return &Error{Code: CodeUnauthorized, Message: "rpc: unauthorized"}
+	}
+	return nil
+}
+
+// Status reports the state of the server.
+func (a *AdminService) Status(r *http.Request, args *AdminEmpty, reply *AdminStatus) error {
+	if err := a.check(r); err != nil {
+		return err
+	}
+	s := a.server
+	reply.LogLevel = s.LogLevel().String()
+	reply.Ready = s.Ready()
+	reply.ProfileSampling = s.ProfileSampling()
+	s.admission.mutex.Lock()
+	defer s.admission.mutex.Unlock()
+	reply.Maintenance = s.admission.maintenance
+	reply.Message = s.admission.message
+	reply.Draining = s.admission.draining
+	reply.InFlight = s.admission.inflight
+	reply.RateLimits = make(map[string]RateLimit, len(s.admission.limits))
+	for method, limit := range s.admission.limits {
+		reply.RateLimits[method] = limit.RateLimit
+	}
+	return nil
+}
+
+// SetLogLevel sets the log level.
+func (a *AdminService) SetLogLevel(r *http.Request, args *AdminLogLevelArgs, reply *AdminEmpty) error {
+	if err := a.check(r); err != nil {
+		return err
+	}
+	var level slog.Level
+	if err := level.UnmarshalText([]byte(args.Level)); err != nil {
+		return &Error{Code: CodeInvalidParams, Message: "rpc: " + err.Error()}
+	}
+	a.server.SetLogLevel(LogLevel(level))
+	return nil
+}
+
+// SetMaintenance turns maintenance mode on or off.
+func (a *AdminService) SetMaintenance(r *http.Request, args *AdminMaintenanceArgs, reply *AdminEmpty) error {
+	if err := a.check(r); err != nil {
+		return err
+	}
+	a.server.SetMaintenance(args.Enabled, args.Message)
+	return nil
+}
+
+// SetRateLimit sets or removes the rate limit of a method.
+func (a *AdminService) SetRateLimit(r *http.Request, args *AdminRateLimitArgs, reply *AdminEmpty) error {
+	if err := a.check(r); err != nil {
+		return err
+	}
+	if args.Method == "" {
+		return &Error{Code: CodeInvalidParams, Message: "rpc: missing method"}
+	}
+	a.server.SetRateLimit(args.Method, args.Rate, args.Burst)
+	return nil
+}
+
+// SetProfileSampling sets the profile sampling rate of a method.
+func (a *AdminService) SetProfileSampling(r *http.Request, args *AdminProfileSamplingArgs, reply *AdminEmpty) error {
+	if err := a.check(r); err != nil {
+		return err
+	}
+	if args.Method == "" {
+		return &Error{Code: CodeInvalidParams, Message: "rpc: missing method"}
+	}
+	if args.Rate > 1 {
+		return &Error{Code: CodeInvalidParams, Message: "rpc: rate must be between 0 and 1"}
+	}
+	a.server.SetProfileSampling(args.Method, args.Rate)
+	return nil
+}
+
+// Drain stops admitting calls and waits up to the timeout for those in
+// flight to finish.
+func (a *AdminService) Drain(r *http.Request, args *AdminDrainArgs, reply *AdminEmpty) error {
+	if err := a.check(r); err != nil {
+		return err
+	}
+	ctx := r.Context()
+	if args.Timeout == "" {
+		a.server.stopAdmitting()
+		return nil
+	}
+	timeout, err := time.ParseDuration(args.Timeout)
+	if err != nil {
+		return &Error{Code: CodeInvalidParams, Message: "rpc: " + err.Error()}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := a.server.Drain(ctx); err != nil {
+		return &Error{Code: CodeUnavailable, Message: "rpc: calls still in flight: " + err.Error()}
+	}
+	return nil
+}
+
+// Resume admits calls again.
+func (a *AdminService) Resume(r *http.Request, args *AdminEmpty, reply *AdminEmpty) error {
+	if err := a.check(r); err != nil {
+		return err
+	}
+	a.server.Resume()
+	return nil
+}
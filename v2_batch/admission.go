@@ -0,0 +1,170 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Admission control
+// ----------------------------------------------------------------------------
+
+// admission decides which calls are served: maintenance mode, draining and
+// rate limits. Calls to the admin service are always admitted.
+type admission struct {
+	mutex       sync.Mutex
+	maintenance bool
+	message     string
+	draining    bool
+	inflight    int
+	idle        []chan struct{}
+	limits      map[string]*tokenBucket
+}
+
+// RateLimit is a rate limit: Rate calls per second with bursts of Burst
+// calls.
+type RateLimit struct {
+	Rate  float64 `json:"rate"`
+	Burst int     `json:"burst"`
+}
+
+// tokenBucket enforces a RateLimit.
+type tokenBucket struct {
+	RateLimit
+	tokens float64
+	last   time.Time
+}
+
+// SetMaintenance turns maintenance mode on or off. In maintenance mode,
+// calls are answered with a CodeUnavailable error carrying message.
+func (s *Server) SetMaintenance(enabled bool, message string) {
+	s.admission.mutex.Lock()
+	defer s.admission.mutex.Unlock()
+	s.admission.maintenance = enabled
+	s.admission.message = message
+}
+
+// SetRateLimit limits the calls to method, or to every method without its
+// own limit with "*", to rate calls per second with bursts of burst calls.
+// Calls over the limit are answered with a CodeRateLimited error carrying
+// a RetryInfo detail. A rate of 0 removes the limit.
+func (s *Server) SetRateLimit(method string, rate float64, burst int) {
+	s.admission.mutex.Lock()
+	defer s.admission.mutex.Unlock()
+	if rate <= 0 {
+		delete(s.admission.limits, method)
+		return
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	if s.admission.limits == nil {
+		s.admission.limits = make(map[string]*tokenBucket)
+	}
+	s.admission.limits[method] = &tokenBucket{
+		RateLimit: RateLimit{Rate: rate, Burst: burst},
+		tokens:    float64(burst),
+		last:      s.clock.Now(),
+	}
+}
+
+// Drain stops admitting calls, which are answered with a CodeUnavailable
+// error, and waits for the calls in flight, then for the background work
+// of their groups (see Group), to finish or ctx to be done. In the latter
+// case, the groups are cancelled, and those not returning reported by
+// Leaks. Resume admits calls again.
+func (s *Server) Drain(ctx context.Context) error {
+	s.admission.mutex.Lock()
+	s.admission.draining = true
+	if s.admission.inflight == 0 {
+		s.admission.mutex.Unlock()
+		return s.awaitGroups(ctx)
+	}
+	idle := make(chan struct{})
+	s.admission.idle = append(s.admission.idle, idle)
+	s.admission.mutex.Unlock()
+	select {
+	case <-idle:
+		return s.awaitGroups(ctx)
+	case <-ctx.Done():
+		s.cancelGroups()
+		return ctx.Err()
+	}
+}
+
+// stopAdmitting stops admitting calls, as Drain without waiting.
+func (s *Server) stopAdmitting() {
+	s.admission.mutex.Lock()
+	defer s.admission.mutex.Unlock()
+	s.admission.draining = true
+}
+
+// Resume admits calls again after Drain.
+func (s *Server) Resume() {
+	s.admission.mutex.Lock()
+	defer s.admission.mutex.Unlock()
+	s.admission.draining = false
+}
+
+// admit decides whether a call to method is served. If it is, the returned
+// function must be called once the call is done.
+func (s *Server) admit(method string) (func(), error) {
+	if s.admin != nil && strings.HasPrefix(method, adminServiceName+".") {
+		return func() {}, nil
+	}
+	a := &s.admission
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	switch {
+	case a.maintenance:
+		message := a.message
+		if message == "" {
+			message = "rpc: server in maintenance"
+		}
+		return nil, &Error{Code: CodeUnavailable, Message: message}
+	case a.draining:
+		return nil, &Error{Code: CodeUnavailable, Message: "rpc: server draining"}
+	}
+	limit := a.limits[method]
+	if limit == nil {
+		limit = a.limits["*"]
+	}
+	if limit != nil {
+		now := s.clock.Now()
+		limit.tokens += now.Sub(limit.last).Seconds() * limit.Rate
+		if max := float64(limit.Burst); limit.tokens > max {
+			limit.tokens = max
+		}
+		limit.last = now
+		if limit.tokens < 1 {
+			wait := time.Duration((1 - limit.tokens) / limit.Rate * float64(time.Second))
+			return nil, NewErrorWithDetails(CodeRateLimited,
+				fmt.Sprintf("rpc: rate limit of %q exceeded", method),
+				&RetryInfo{RetryDelay: wait})
+		}
+		limit.tokens--
+	}
+	a.inflight++
+	return s.release, nil
+}
+
+// release ends an admitted call.
+func (s *Server) release() {
+	a := &s.admission
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.inflight--
+	if a.inflight == 0 {
+		for _, idle := range a.idle {
+			close(idle)
+		}
+		a.idle = nil
+	}
+}
@@ -0,0 +1,218 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// AMQP
+// ----------------------------------------------------------------------------
+
+// AMQPDelivery is a message delivered by an AMQPChannel.
+type AMQPDelivery struct {
+	// DeliveryTag identifies the delivery to Ack and Nack.
+	DeliveryTag uint64
+	// Body holds the request.
+	Body []byte
+	// ContentType selects the codec, if set.
+	ContentType string
+	// ReplyTo is the queue of the response, if any.
+	ReplyTo string
+	// CorrelationID is copied to the response.
+	CorrelationID string
+}
+
+// AMQPPublishing is a message published by AMQPListener.
+type AMQPPublishing struct {
+	Body          []byte
+	ContentType   string
+	CorrelationID string
+}
+
+// AMQPChannel is the part of an AMQP 0-9-1 channel used by AMQPListener,
+// e.g. an adapter of a RabbitMQ client. Implementations must be safe for
+// concurrent use.
+type AMQPChannel interface {
+	// Consume delivers the messages of queue, with manual acknowledgement,
+	// until ctx is done, then closes the channel of deliveries.
+	Consume(ctx context.Context, queue string) (<-chan *AMQPDelivery, error)
+	// Ack acknowledges a delivery.
+	Ack(tag uint64) error
+	// Nack rejects a delivery, requeueing it or not.
+	Nack(tag uint64, requeue bool) error
+	// Publish publishes msg to exchange with a routing key.
+	Publish(ctx context.Context, exchange, key string, msg AMQPPublishing) error
+}
+
+// AMQPListener serves a Server over AMQP, in the RPC pattern of RabbitMQ:
+// requests consumed from Queue are dispatched through the server, and the
+// responses published through the default exchange to the queue named by
+// their reply_to property, with the same correlation_id. A delivery is
+// acknowledged once served, and requeued if cancelled by Shutdown.
+type AMQPListener struct {
+	// Channel is opened on the broker.
+	Channel AMQPChannel
+	// Queue is the name of the queue of requests.
+	Queue string
+	// Concurrency is the number of requests served at once; it should
+	// match the prefetch count of the channel. Defaults to 1.
+	Concurrency int
+	// ContentType selects the codec of deliveries without one. Defaults
+	// to "application/json".
+	ContentType string
+	// OnError is called when a response can't be published or a delivery
+	// can't be acknowledged.
+	OnError func(d *AMQPDelivery, err error)
+
+	mutex    sync.Mutex
+	closed   bool
+	cancel   context.CancelFunc
+	calls    context.CancelFunc
+	inflight sync.WaitGroup
+}
+
+// Serve implements Listener.
+func (l *AMQPListener) Serve(s *Server) error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls, cancelCalls := context.WithCancel(context.Background())
+	l.cancel, l.calls = cancel, cancelCalls
+	l.mutex.Unlock()
+	defer cancel()
+
+	deliveries, err := l.Channel.Consume(ctx, l.Queue)
+	if err != nil {
+		return err
+	}
+	concurrency := l.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	for {
+		var d *AMQPDelivery
+		var ok bool
+		select {
+		case d, ok = <-deliveries:
+		case <-ctx.Done():
+			return nil
+		}
+		if !ok {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return fmt.Errorf("rpc: AMQP deliveries of %q closed", l.Queue)
+		}
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			l.nack(d)
+			return nil
+		}
+		l.mutex.Lock()
+		if l.closed {
+			l.mutex.Unlock()
+			l.nack(d)
+			return nil
+		}
+		l.inflight.Add(1)
+		l.mutex.Unlock()
+		go func() {
+			defer func() { <-slots }()
+			l.serve(calls, s, d)
+		}()
+	}
+}
+
+// serve dispatches the request of a delivery, publishes its response and
+// acknowledges it.
+func (l *AMQPListener) serve(ctx context.Context, s *Server, d *AMQPDelivery) {
+	defer l.inflight.Done()
+	r, err := http.NewRequest("POST", "amqp://"+l.Queue, bytes.NewReader(d.Body))
+	if err != nil {
+		l.nack(d)
+		return
+	}
+	contentType := d.ContentType
+	if contentType == "" {
+		contentType = l.ContentType
+	}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	r.Header.Set("Content-Type", contentType)
+	r.RemoteAddr = d.ReplyTo
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r.WithContext(ctx))
+	if ctx.Err() != nil {
+		// Cancelled by Shutdown: the request is delivered again.
+		l.nack(d)
+		return
+	}
+	if d.ReplyTo != "" && w.Body.Len() > 0 {
+		msg := AMQPPublishing{
+			Body:          w.Body.Bytes(),
+			ContentType:   contentType,
+			CorrelationID: d.CorrelationID,
+		}
+		if err := l.Channel.Publish(ctx, "", d.ReplyTo, msg); err != nil {
+			l.report(d, err)
+		}
+	}
+	if err := l.Channel.Ack(d.DeliveryTag); err != nil {
+		l.report(d, err)
+	}
+}
+
+// nack requeues a delivery.
+func (l *AMQPListener) nack(d *AMQPDelivery) {
+	if err := l.Channel.Nack(d.DeliveryTag, true); err != nil {
+		l.report(d, err)
+	}
+}
+
+func (l *AMQPListener) report(d *AMQPDelivery, err error) {
+	if l.OnError != nil {
+		l.OnError(d, err)
+	}
+}
+
+// Shutdown implements Listener. It stops consuming and waits for the
+// requests in flight, cancelling and requeueing them once ctx is done.
+func (l *AMQPListener) Shutdown(ctx context.Context) error {
+	l.mutex.Lock()
+	l.closed = true
+	cancel, calls := l.cancel, l.calls
+	l.mutex.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	idle := make(chan struct{})
+	go func() {
+		l.inflight.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+		calls()
+		return nil
+	case <-ctx.Done():
+		calls()
+		<-idle
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,195 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Archiving
+// ----------------------------------------------------------------------------
+
+// ObjectStore stores archive objects, e.g. in an S3-compatible bucket.
+// Implementations must be safe for concurrent use.
+type ObjectStore interface {
+	PutObject(ctx context.Context, key string, body io.Reader, size int64) error
+}
+
+// ArchiverOptions configures an Archiver. Zero fields take their defaults.
+type ArchiverOptions struct {
+	// Prefix is prepended to the object keys.
+	Prefix string
+	// Interval is the time span of the records of an object. Defaults to
+	// one hour.
+	Interval time.Duration
+	// MaxRecords rotates an object early once it holds this many records.
+	// Defaults to 10000.
+	MaxRecords int
+	// Retries is the number of retries of a failed upload. Defaults to 3.
+	Retries int
+	// RetryDelay is the delay before the first retry, doubled after each.
+	// Defaults to one second.
+	RetryDelay time.Duration
+	// Clock is used to wait between retries and in Run. Defaults to
+	// SystemClock.
+	Clock Clock
+	// OnError is called when an upload fails after all retries. The object
+	// is kept and uploaded again on the next rotation.
+	OnError func(key string, err error)
+}
+
+// Archiver is a Recorder batching records into time-bucketed, gzipped
+// NDJSON objects uploaded to an ObjectStore, for long-term retention. Use it
+// with Server.SetRecorder.
+//
+// Objects are named "<prefix><bucket start>-<seq>.ndjson.gz", with the start
+// of the bucket in UTC as in "2006/01/02/15-04-05".
+type Archiver struct {
+	store ObjectStore
+	opts  ArchiverOptions
+
+	mutex  sync.Mutex
+	bucket time.Time
+	seq    int
+	buf    *bytes.Buffer
+	zw     *gzip.Writer
+	enc    *json.Encoder
+	count  int
+	failed []archiveObject
+
+	uploads sync.WaitGroup
+}
+
+// archiveObject is a rotated object.
+type archiveObject struct {
+	key  string
+	data []byte
+}
+
+// NewArchiver returns an Archiver uploading to store.
+func NewArchiver(store ObjectStore, opts ArchiverOptions) *Archiver {
+	if opts.Interval <= 0 {
+		opts.Interval = time.Hour
+	}
+	if opts.MaxRecords <= 0 {
+		opts.MaxRecords = 10000
+	}
+	if opts.Retries <= 0 {
+		opts.Retries = 3
+	}
+	if opts.RetryDelay <= 0 {
+		opts.RetryDelay = time.Second
+	}
+	if opts.Clock == nil {
+		opts.Clock = SystemClock
+	}
+	return &Archiver{store: store, opts: opts}
+}
+
+// Record implements Recorder. Records are bucketed by their time.
+func (a *Archiver) Record(rec *Record) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	bucket := rec.Time.Truncate(a.opts.Interval)
+	if a.zw != nil && (!bucket.Equal(a.bucket) || a.count >= a.opts.MaxRecords) {
+		a.rotate()
+	}
+	if a.zw == nil {
+		if bucket.Equal(a.bucket) {
+			a.seq++
+		} else {
+			a.bucket, a.seq = bucket, 0
+		}
+		a.buf = new(bytes.Buffer)
+		a.zw = gzip.NewWriter(a.buf)
+		a.enc = json.NewEncoder(a.zw)
+	}
+	a.enc.Encode(rec)
+	a.count++
+}
+
+// Flush rotates the current object, uploading it in the background along
+// with the objects whose upload failed.
+func (a *Archiver) Flush() {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.rotate()
+}
+
+// Close flushes the archiver and waits for the uploads to finish. It
+// returns an error if objects couldn't be uploaded.
+func (a *Archiver) Close() error {
+	a.Flush()
+	a.uploads.Wait()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if n := len(a.failed); n > 0 {
+		return fmt.Errorf("rpc: %d archive objects not uploaded", n)
+	}
+	return nil
+}
+
+// Run flushes the archiver at the end of each interval until ctx is done,
+// so that objects are uploaded even when no more records come.
+func (a *Archiver) Run(ctx context.Context) {
+	for {
+		now := a.opts.Clock.Now()
+		next := now.Truncate(a.opts.Interval).Add(a.opts.Interval)
+		select {
+		case <-a.opts.Clock.After(next.Sub(now)):
+			a.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// rotate closes the current object and uploads it, with the failed ones.
+// It must be called with the mutex held.
+func (a *Archiver) rotate() {
+	objects := a.failed
+	a.failed = nil
+	if a.zw != nil {
+		a.zw.Close()
+		key := fmt.Sprintf("%s%s-%d.ndjson.gz", a.opts.Prefix, a.bucket.UTC().Format("2006/01/02/15-04-05"), a.seq)
+		objects = append(objects, archiveObject{key: key, data: a.buf.Bytes()})
+		a.buf, a.zw, a.enc, a.count = nil, nil, nil, 0
+	}
+	for _, obj := range objects {
+		a.uploads.Add(1)
+		go a.upload(obj)
+	}
+}
+
+// upload puts an object in the store, retrying on failure.
+func (a *Archiver) upload(obj archiveObject) {
+	defer a.uploads.Done()
+	delay := a.opts.RetryDelay
+	var err error
+	for attempt := 0; attempt <= a.opts.Retries; attempt++ {
+		if attempt > 0 {
+			<-a.opts.Clock.After(delay)
+			delay *= 2
+		}
+		err = a.store.PutObject(context.Background(), obj.key, bytes.NewReader(obj.data), int64(len(obj.data)))
+		if err == nil {
+			return
+		}
+	}
+	a.mutex.Lock()
+	a.failed = append(a.failed, obj)
+	a.mutex.Unlock()
+	if a.opts.OnError != nil {
+		a.opts.OnError(obj.key, err)
+	}
+}
@@ -0,0 +1,68 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Binary params
+// ----------------------------------------------------------------------------
+
+// Bytes is binary data in args and replies, encoded by each codec in its
+// own way, so that the same types serve every codec without per-codec tags:
+// a base64 string in JSON, a byte string in CBOR, a bytes field in protobuf
+// messages.
+//
+// Unlike []byte in JSON, Bytes are decoded from the base64 forms of
+// DecodeBase64, and CBOR decodes base64 text strings into byte slices too.
+type Bytes []byte
+
+var bytesType = reflect.TypeOf(Bytes(nil))
+
+// MarshalJSON encodes b as a standard base64 string, or null if b is nil.
+func (b Bytes) MarshalJSON() ([]byte, error) {
+	if b == nil {
+		return []byte("null"), nil
+	}
+	return json.Marshal([]byte(b))
+}
+
+// UnmarshalJSON decodes a base64 string, as in DecodeBase64, or null.
+func (b *Bytes) UnmarshalJSON(data []byte) error {
+	if bytes.Equal(data, []byte("null")) {
+		*b = nil
+		return nil
+	}
+	var s string
+	if err := json.Unmarshal(data, &s); err != nil {
+		return fmt.Errorf("rpc: binary data must be a base64 string")
+	}
+	decoded, err := DecodeBase64(s)
+	if err != nil {
+		return fmt.Errorf("rpc: invalid base64 data: %v", err)
+	}
+	*b = decoded
+	return nil
+}
+
+// DecodeBase64 decodes s in any of the forms of base64 sent by clients: with
+// the standard or the URL alphabet, padded or not.
+func DecodeBase64(s string) ([]byte, error) {
+	encoding := base64.StdEncoding
+	if strings.ContainsAny(s, "-_") {
+		encoding = base64.URLEncoding
+	}
+	if !strings.HasSuffix(s, "=") && len(s)%4 != 0 {
+		encoding = encoding.WithPadding(base64.NoPadding)
+	}
+	return encoding.DecodeString(s)
+}
@@ -0,0 +1,127 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Reply caching
+// ----------------------------------------------------------------------------
+
+// CacheKeyer is implemented by codec requests able to identify requests
+// with the same method and params, for the reply cache.
+type CacheKeyer interface {
+	CacheKey() (string, bool)
+}
+
+// SetCacheTTL marks the reply of a handler as cacheable for ttl, with ctx
+// the context of the request passed to it. Only successful replies are
+// cached.
+//
+// The directive is consumed uniformly: the reply is emitted with a
+// "Cache-Control: private, max-age" header (see SetResponseHeader) and, if
+// enabled with SetReplyCache, stored in the server reply cache for the
+// caller.
+func SetCacheTTL(ctx context.Context, ttl time.Duration) {
+	h, ok := ctx.Value(directivesKey{}).(*replyDirectives)
+	if !ok {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.cacheTTL = ttl
+}
+
+// SetReplyCache enables a server-side cache of up to maxEntries replies
+// marked cacheable with SetCacheTTL, keyed by caller, method and params.
+// Requests answered from the cache don't reach the handler. It requires
+// codec requests implementing CacheKeyer.
+//
+// A maxEntries of 0 disables the cache, which is the default.
+func (s *Server) SetReplyCache(maxEntries int) {
+	if maxEntries <= 0 {
+		s.replyCache = nil
+		return
+	}
+	s.replyCache = &replyCache{
+		max:     maxEntries,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+// replyCache is a bounded LRU cache of replies.
+type replyCache struct {
+	mutex   sync.Mutex
+	max     int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key     string
+	reply   interface{}
+	expires time.Time
+}
+
+// get returns the cached reply for key and its remaining TTL.
+func (c *replyCache) get(key string, now time.Time) (interface{}, time.Duration, bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	elem, ok := c.entries[key]
+	if !ok {
+		return nil, 0, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if !now.Before(entry.expires) {
+		c.lru.Remove(elem)
+		delete(c.entries, key)
+		return nil, 0, false
+	}
+	c.lru.MoveToFront(elem)
+	return entry.reply, entry.expires.Sub(now), true
+}
+
+// put caches reply for key until expires, evicting the least recently used
+// entry if the cache is full.
+func (c *replyCache) put(key string, reply interface{}, expires time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if elem, ok := c.entries[key]; ok {
+		elem.Value = &cacheEntry{key: key, reply: reply, expires: expires}
+		c.lru.MoveToFront(elem)
+		return
+	}
+	if c.lru.Len() >= c.max {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+	c.entries[key] = c.lru.PushFront(&cacheEntry{key: key, reply: reply, expires: expires})
+}
+
+// cacheKey returns the reply cache key of a request, if the cache is
+// enabled and the codec supports it. Replies are cached per caller, as
+// returned by Caller, since the handler isn't called to check access.
+func (s *Server) cacheKey(r *http.Request, codecReq CodecRequest) (string, bool) {
+	if s.replyCache == nil {
+		return "", false
+	}
+	keyer, ok := codecReq.(CacheKeyer)
+	if !ok {
+		return "", false
+	}
+	key, ok := keyer.CacheKey()
+	if !ok {
+		return "", false
+	}
+	return s.Caller(r) + "\x00" + key, true
+}
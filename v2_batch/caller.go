@@ -0,0 +1,31 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net"
+	"net/http"
+)
+
+// SetCallerFunc sets the function identifying the caller of a request, e.g.
+// from an API key or tenant header. The caller identity is used in profiler
+// labels and per-caller features.
+//
+// By default the caller is the remote host of the connection.
+func (s *Server) SetCallerFunc(caller func(*http.Request) string) {
+	s.callerFunc = caller
+}
+
+// Caller returns the identity of the caller of r.
+func (s *Server) Caller(r *http.Request) string {
+	if s.callerFunc != nil {
+		return s.callerFunc(r)
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
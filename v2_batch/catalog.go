@@ -0,0 +1,82 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"reflect"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// Catalog changes
+// ----------------------------------------------------------------------------
+
+// CatalogChangedMethod is the method of the reserved notification pushed to
+// every client of the EventsHandler, whatever its topics, of the
+// SubscriptionHandler, and of the raw connections and streams served with a
+// JSON codec, as by ConnListener and ServeStdio, when the methods served
+// change, so that dynamic clients can refresh their stubs without polling.
+// Its params are a CatalogChange.
+const CatalogChangedMethod = "rpc.catalogChanged"
+
+// catalogTopic is the event type of the CatalogChangedMethod notification.
+const catalogTopic = "rpc.catalog"
+
+// CatalogChange is the params of the CatalogChangedMethod notification.
+type CatalogChange struct {
+	// Version increases with each change.
+	Version uint64 `json:"version"`
+	// Methods are the sorted names of the methods served, without the
+	// retired ones.
+	Methods []string `json:"methods"`
+}
+
+// catalog is the last catalog pushed to the clients.
+type catalog struct {
+	mutex   sync.Mutex
+	version uint64
+	methods []string
+}
+
+// NotifyCatalogChanged pushes the catalog to the connected clients, e.g.
+// once a feature flag changes the methods an application accepts. Method
+// registrations and retirements, and configs changing the feature flags,
+// push it already.
+func (s *Server) NotifyCatalogChanged() {
+	s.catalogChanged(true)
+}
+
+// catalogChanged pushes the catalog if it changed since it was last pushed,
+// or anyway if force is true.
+func (s *Server) catalogChanged(force bool) {
+	var methods []string
+	s.retiredMutex.Lock()
+	for _, method := range s.Methods() {
+		if _, retired := s.retired[method]; !retired {
+			methods = append(methods, method)
+		}
+	}
+	s.retiredMutex.Unlock()
+
+	s.catalog.mutex.Lock()
+	defer s.catalog.mutex.Unlock()
+	if !force && reflect.DeepEqual(methods, s.catalog.methods) {
+		return
+	}
+	s.catalog.version++
+	s.catalog.methods = methods
+	data, err := json.Marshal(&notification{
+		Version: "2.0",
+		Method:  CatalogChangedMethod,
+		Params:  &CatalogChange{Version: s.catalog.version, Methods: methods},
+	})
+	if err != nil {
+		return
+	}
+	s.events.broadcast(catalogTopic, data)
+	s.subscriptions.broadcast(data)
+	s.streams.broadcast(data)
+}
@@ -0,0 +1,368 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbor
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+	"github.com/agronomhidden/rpc/v2_batch/codectest"
+)
+
+// Examples of RFC 8949, Appendix A.
+func TestEncoding(t *testing.T) {
+	for _, test := range []struct {
+		value interface{}
+		hex   string
+	}{
+		{0, "00"},
+		{23, "17"},
+		{24, "1818"},
+		{1000, "1903e8"},
+		{1000000, "1a000f4240"},
+		{uint64(1000000000000), "1b000000e8d4a51000"},
+		{-1, "20"},
+		{-1000, "3903e7"},
+		{1.1, "fb3ff199999999999a"},
+		{false, "f4"},
+		{true, "f5"},
+		{nil, "f6"},
+		{"", "60"},
+		{"IETF", "6449455446"},
+		{[]byte{1, 2, 3, 4}, "4401020304"},
+		{[]int{1, 2, 3}, "83010203"},
+		{map[string]interface{}{"a": 1, "b": []int{2, 3}}, "a26161016162820203"},
+	} {
+		b, err := Marshal(test.value)
+		if err != nil || hex.EncodeToString(b) != test.hex {
+			t.Errorf("Marshal(%#v): expected %s, got %x (%v)", test.value, test.hex, b, err)
+		}
+	}
+
+	for _, test := range []struct {
+		hex   string
+		value interface{}
+	}{
+		{"1b000000e8d4a51000", int64(1000000000000)},
+		{"3903e7", int64(-1000)},
+		{"f93c00", 1.0},
+		{"f97bff", 65504.0},
+		{"fa47c35000", 100000.0},
+		{"5f42010243030405ff", []byte{1, 2, 3, 4, 5}},
+		{"7f657374726561646d696e67ff", "streaming"},
+		{"9fff", []interface{}{}},
+		{"bf61610161629f0203ffff", map[string]interface{}{"a": int64(1), "b": []interface{}{int64(2), int64(3)}}},
+		{"a201020304", map[interface{}]interface{}{int64(1): int64(2), int64(3): int64(4)}},
+		{"c074323031332d30332d32315432303a30343a30305a", time.Date(2013, 3, 21, 20, 4, 0, 0, time.UTC)},
+		{"d74401020304", []byte{1, 2, 3, 4}},
+	} {
+		b, _ := hex.DecodeString(test.hex)
+		var v interface{}
+		if err := Unmarshal(b, &v); err != nil {
+			t.Errorf("Unmarshal(%s): %v", test.hex, err)
+			continue
+		}
+		if tm, ok := v.(time.Time); ok {
+			v = tm.UTC()
+		}
+		if !reflect.DeepEqual(v, test.value) {
+			t.Errorf("Unmarshal(%s): expected %#v, got %#v", test.hex, test.value, v)
+		}
+	}
+
+	for _, h := range []string{"", "18", "62ff", "9f01", "ff", "a1", "1c", "5f01ff"} {
+		b, _ := hex.DecodeString(h)
+		var v interface{}
+		if err := Unmarshal(b, &v); err == nil {
+			t.Errorf("Unmarshal(%s): expected an error", h)
+		}
+	}
+	var small int8
+	if err := Unmarshal([]byte{0x19, 0x03, 0xe8}, &small); err == nil {
+		t.Error("Expected an error decoding 1000 into an int8")
+	}
+}
+
+type Inner struct {
+	Tags []string `json:"tags,omitempty"`
+}
+
+type Record struct {
+	Inner
+	Name    string            `cbor:"name"`
+	Count   uint16            `json:"count"`
+	Ratio   float32           `json:"ratio"`
+	Payload []byte            `json:"payload"`
+	When    time.Time         `json:"when"`
+	Attrs   map[string]string `json:"attrs,omitempty"`
+	Next    *Record           `json:"next"`
+	Skipped string            `json:"-"`
+}
+
+func TestRoundTrip(t *testing.T) {
+	in := Record{
+		Inner:   Inner{Tags: []string{"a", "b"}},
+		Name:    "sensor",
+		Count:   3,
+		Ratio:   0.5,
+		Payload: []byte{0, 1, 2},
+		When:    time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC),
+		Next:    &Record{Name: "next", Attrs: map[string]string{"k": "v"}},
+		Skipped: "skipped",
+	}
+	b, err := Marshal(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out Record
+	if err := Unmarshal(b, &out); err != nil {
+		t.Fatal(err)
+	}
+	in.Skipped = ""
+	out.When = out.When.UTC()
+	out.Next.When = out.Next.When.UTC()
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("Expected %+v, got %+v", in, out)
+	}
+
+	var generic map[string]interface{}
+	if err := Unmarshal(b, &generic); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := generic["tags"]; !ok || generic["name"] != "sensor" {
+		t.Errorf("Expected the fields named by their tags, got %v", generic)
+	}
+}
+
+func TestBinary(t *testing.T) {
+	type Blob struct {
+		Data rpc.Bytes `json:"data"`
+		Raw  []byte    `json:"raw"`
+	}
+	in := Blob{Data: rpc.Bytes{0xfb, 0xff}, Raw: []byte{1}}
+	b := mustMarshal(t, &in)
+	if expected := "a2646461746142fbff637261774101"; hex.EncodeToString(b) != expected {
+		t.Errorf("Expected byte strings %s, got %x", expected, b)
+	}
+	var out Blob
+	if err := Unmarshal(b, &out); err != nil || !reflect.DeepEqual(in, out) {
+		t.Errorf("Expected %v, got %v %v", in, out, err)
+	}
+
+	// Base64 text, as sent by clients of the JSON codec.
+	b = mustMarshal(t, map[string]string{"data": "-_8", "raw": "AQ=="})
+	out = Blob{}
+	if err := Unmarshal(b, &out); err != nil || !reflect.DeepEqual(in, out) {
+		t.Errorf("Expected %v, got %v %v", in, out, err)
+	}
+	if err := Unmarshal(mustMarshal(t, map[string]string{"data": "%%"}), &out); err == nil {
+		t.Error("Expected invalid base64 text rejected")
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+type MultiplyArgs struct {
+	A, B int
+}
+
+type Arith struct{}
+
+func (a *Arith) Multiply(r *http.Request, args *MultiplyArgs, reply *int) error {
+	*reply = args.A * args.B
+	return nil
+}
+
+func (a *Arith) Fail(r *http.Request, args *MultiplyArgs, reply *int) error {
+	return &rpc.Error{Code: rpc.CodePreconditionFailed, Message: "failed", Data: "data"}
+}
+
+func (a *Arith) Plain(r *http.Request, args *MultiplyArgs, reply *int) error {
+	return errors.New("plain")
+}
+
+func newServer(t *testing.T) *rpc.Server {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), ContentType)
+	if err := s.RegisterService(new(Arith), ""); err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func post(s *rpc.Server, body []byte) *httptest.ResponseRecorder {
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", ContentType)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func mustMarshal(t *testing.T, v interface{}) []byte {
+	b, err := Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func TestCodec(t *testing.T) {
+	s := newServer(t)
+
+	req, err := EncodeClientRequest("Arith.Multiply", &MultiplyArgs{A: 6, B: 7})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := post(s, req)
+	if w.Code != 200 || w.Header().Get("Content-Type") != ContentType {
+		t.Fatalf("Expected a CBOR reply, got %d %q", w.Code, w.Body.String())
+	}
+	var product int
+	if err := DecodeClientResponse(w.Body, &product); err != nil || product != 42 {
+		t.Errorf("Expected 42, got %d (%v)", product, err)
+	}
+
+	for _, test := range []struct {
+		method string
+		code   int
+		data   interface{}
+	}{
+		{"Arith.Fail", rpc.CodePreconditionFailed, "data"},
+		{"Arith.Plain", codeServerError, nil},
+		{"Arith.Divide", rpc.CodeMethodNotFound, nil},
+	} {
+		req, _ := EncodeClientRequest(test.method, &MultiplyArgs{})
+		err := DecodeClientResponse(post(s, req).Body, new(int))
+		e, ok := err.(*Error)
+		if !ok || e.Code != test.code || !reflect.DeepEqual(e.Data, test.data) {
+			t.Errorf("%s: expected code %d and data %v, got %#v", test.method, test.code, test.data, err)
+		}
+	}
+
+	req = mustMarshal(t, map[string]interface{}{"jsonrpc": "2.0", "method": "Arith.Multiply", "params": "six", "id": 1})
+	if err := DecodeClientResponse(post(s, req).Body, new(int)); err == nil || err.(*Error).Code != rpc.CodeInvalidParams {
+		t.Errorf("Expected invalid params, got %v", err)
+	}
+	if err := DecodeClientResponse(post(s, []byte{0x9f, 0x01}).Body, new(int)); err == nil || err.(*Error).Code != CodeParseError {
+		t.Errorf("Expected a parse error, got %v", err)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	s := newServer(t)
+	call := func(id interface{}, a, b int) map[string]interface{} {
+		req := map[string]interface{}{"jsonrpc": "2.0", "method": "Arith.Multiply", "params": &MultiplyArgs{a, b}}
+		if id != nil {
+			req["id"] = id
+		}
+		return req
+	}
+
+	w := post(s, mustMarshal(t, []interface{}{
+		call("a", 2, 3),
+		call(nil, 4, 5),
+		map[string]interface{}{"jsonrpc": "1.0", "method": "Arith.Multiply", "params": &MultiplyArgs{}},
+		call(7, 6, 7),
+	}))
+	var replies []struct {
+		Result *int        `cbor:"result"`
+		Error  *Error      `cbor:"error"`
+		Id     interface{} `cbor:"id"`
+	}
+	if err := Unmarshal(w.Body.Bytes(), &replies); err != nil {
+		t.Fatal(err)
+	}
+	if len(replies) != 3 {
+		t.Fatalf("Expected 3 replies, the notification omitted, got %d", len(replies))
+	}
+	if replies[0].Id != "a" || *replies[0].Result != 6 {
+		t.Errorf("Expected 6 for id a, got %+v", replies[0])
+	}
+	if replies[1].Id != nil || replies[1].Error == nil || replies[1].Error.Code != rpc.CodeInvalidRequest {
+		t.Errorf("Expected an invalid request of null id, got %+v", replies[1])
+	}
+	if replies[2].Id != int64(7) || *replies[2].Result != 42 {
+		t.Errorf("Expected 42 for id 7, got %+v", replies[2])
+	}
+
+	w = post(s, mustMarshal(t, []interface{}{call(nil, 1, 2), call(nil, 3, 4)}))
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("Expected 204 for notifications only, got %d %x", w.Code, w.Body.Bytes())
+	}
+
+	if err := DecodeClientResponse(post(s, []byte{0x80}).Body, new(int)); err == nil || err.(*Error).Code != rpc.CodeInvalidRequest {
+		t.Errorf("Expected an invalid request for an empty batch, got %v", err)
+	}
+}
+
+// wire is the codectest.Wire of the codec.
+type wire struct{}
+
+func (wire) EncodeRequest(method string, params interface{}, id *uint64) ([]byte, error) {
+	if id == nil {
+		return Marshal(map[string]interface{}{"jsonrpc": Version, "method": method, "params": params})
+	}
+	return Marshal(&clientRequest{Version: Version, Method: method, Params: params, Id: *id})
+}
+
+func (wire) EncodeBatch(requests [][]byte) ([]byte, error) {
+	batch := make([]RawMessage, len(requests))
+	for i, req := range requests {
+		batch[i] = req
+	}
+	return Marshal(batch)
+}
+
+func (wire) DecodeResponses(body []byte) ([]codectest.Response, error) {
+	if len(body) == 0 {
+		return nil, nil
+	}
+	var responses []clientResponse
+	if body[0]>>5 == 4 {
+		if err := Unmarshal(body, &responses); err != nil {
+			return nil, err
+		}
+	} else {
+		responses = make([]clientResponse, 1)
+		if err := Unmarshal(body, &responses[0]); err != nil {
+			return nil, err
+		}
+	}
+	decoded := make([]codectest.Response, len(responses))
+	for i, res := range responses {
+		var id *uint64
+		if res.Id != nil {
+			if err := Unmarshal(res.Id, &id); err != nil {
+				return nil, err
+			}
+		}
+		decoded[i] = codectest.Response{ID: id, Result: res.Result}
+		if res.Error != nil {
+			decoded[i].Error = &codectest.ResponseError{Code: res.Error.Code, Message: res.Error.Message}
+		}
+	}
+	return decoded, nil
+}
+
+func (wire) DecodeResult(result []byte, v interface{}) error {
+	return Unmarshal(result, v)
+}
+
+func TestConformance(t *testing.T) {
+	codectest.Run(t, codectest.Suite{
+		Codec:       NewCodec(),
+		ContentType: ContentType,
+		Wire:        wire{},
+	})
+}
@@ -0,0 +1,60 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbor
+
+import (
+	"io"
+	"math/rand"
+)
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// clientRequest represents a JSON-RPC request sent by a client.
+type clientRequest struct {
+	Version string      `cbor:"jsonrpc"`
+	Method  string      `cbor:"method"`
+	Params  interface{} `cbor:"params"`
+	Id      uint64      `cbor:"id"`
+}
+
+// clientResponse represents a JSON-RPC response returned to a client.
+type clientResponse struct {
+	Version string     `cbor:"jsonrpc"`
+	Result  RawMessage `cbor:"result"`
+	Error   *Error     `cbor:"error"`
+	Id      RawMessage `cbor:"id"`
+}
+
+// EncodeClientRequest encodes parameters for a JSON-RPC client request.
+func EncodeClientRequest(method string, args interface{}) ([]byte, error) {
+	return Marshal(&clientRequest{
+		Version: Version,
+		Method:  method,
+		Params:  args,
+		Id:      uint64(rand.Int63()),
+	})
+}
+
+// DecodeClientResponse decodes the response body of a client request into
+// the interface reply.
+func DecodeClientResponse(r io.Reader, reply interface{}) error {
+	body, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	var c clientResponse
+	if err := Unmarshal(body, &c); err != nil {
+		return err
+	}
+	if c.Error != nil {
+		return c.Error
+	}
+	if c.Result == nil {
+		return Unmarshal([]byte{simpleNull}, reply)
+	}
+	return Unmarshal(c.Result, reply)
+}
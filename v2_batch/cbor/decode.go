@@ -0,0 +1,618 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package cbor
+
+import (
+	"encoding"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+)
+
+// maxDepth is the maximum nesting of the decoded data items.
+const maxDepth = 1000
+
+var errUnexpectedEnd = errors.New("cbor: unexpected end of data")
+
+// ----------------------------------------------------------------------------
+// Decoding
+// ----------------------------------------------------------------------------
+
+// Unmarshal decodes the single data item of data into v, which must be a
+// non-nil pointer, following the conventions of Marshal.
+//
+// Decoded into an interface{}, integers are int64, or uint64 beyond its
+// range, floats float64, byte strings []byte, arrays []interface{} and maps
+// map[string]interface{}, or map[interface{}]interface{} if not all their
+// keys are text. Other tags than the time tags are ignored. Byte slices,
+// such as rpc.Bytes, are decoded from byte strings or base64 text strings.
+func Unmarshal(data []byte, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("cbor: Unmarshal(non-pointer %T)", v)
+	}
+	d := &decoder{data: data}
+	if err := d.decode(rv.Elem()); err != nil {
+		return err
+	}
+	if d.off != len(data) {
+		return fmt.Errorf("cbor: %d bytes after the data item", len(data)-d.off)
+	}
+	return nil
+}
+
+// Valid reports whether data is a single well-formed data item.
+func Valid(data []byte) bool {
+	d := &decoder{data: data}
+	return d.skip() == nil && d.off == len(data)
+}
+
+// decoder reads data items from data, at off.
+type decoder struct {
+	data  []byte
+	off   int
+	depth int
+}
+
+// head reads the initial byte and argument of a data item. For
+// indefinite-length items, indefinite is true.
+func (d *decoder) head() (major byte, info byte, n uint64, indefinite bool, err error) {
+	if d.off >= len(d.data) {
+		return 0, 0, 0, false, errUnexpectedEnd
+	}
+	b := d.data[d.off]
+	d.off++
+	major, info = b>>5, b&0x1f
+	switch {
+	case info < 24:
+		return major, info, uint64(info), false, nil
+	case info <= 27:
+		size := 1 << (info - 24)
+		if len(d.data)-d.off < size {
+			return 0, 0, 0, false, errUnexpectedEnd
+		}
+		for _, c := range d.data[d.off : d.off+size] {
+			n = n<<8 | uint64(c)
+		}
+		d.off += size
+		return major, info, n, false, nil
+	case info == 31 && major >= majorBytes && major <= majorMap:
+		return major, info, 0, true, nil
+	case info == 31 && major == majorSimple:
+		return 0, 0, 0, false, errors.New("cbor: unexpected break")
+	}
+	return 0, 0, 0, false, fmt.Errorf("cbor: invalid initial byte 0x%02x", b)
+}
+
+// peek returns the initial byte of the next data item.
+func (d *decoder) peek() (byte, error) {
+	if d.off >= len(d.data) {
+		return 0, errUnexpectedEnd
+	}
+	return d.data[d.off], nil
+}
+
+// atBreak consumes the break ending an indefinite-length item, returning
+// true if the next byte is one.
+func (d *decoder) atBreak() (bool, error) {
+	b, err := d.peek()
+	if err != nil {
+		return false, err
+	}
+	if b == breakCode {
+		d.off++
+		return true, nil
+	}
+	return false, nil
+}
+
+// length checks that n items of at least size bytes fit in the remaining
+// data, not to allocate for lengths the data can't hold.
+func (d *decoder) length(n uint64, size int) (int, error) {
+	if n > uint64(len(d.data)-d.off)/uint64(size) {
+		return 0, errUnexpectedEnd
+	}
+	return int(n), nil
+}
+
+// skip skips the next data item, checking it is well-formed.
+func (d *decoder) skip() error {
+	_, err := d.value()
+	return err
+}
+
+// str reads the contents of a byte or text string of major type.
+func (d *decoder) str(major byte, n uint64, indefinite bool) ([]byte, error) {
+	if !indefinite {
+		l, err := d.length(n, 1)
+		if err != nil {
+			return nil, err
+		}
+		b := d.data[d.off : d.off+l]
+		d.off += l
+		return b, nil
+	}
+	var b []byte
+	for {
+		if end, err := d.atBreak(); err != nil || end {
+			return b, err
+		}
+		m, _, n, indefinite, err := d.head()
+		if err != nil {
+			return nil, err
+		}
+		if m != major || indefinite {
+			return nil, errors.New("cbor: invalid chunk of indefinite-length string")
+		}
+		chunk, err := d.str(major, n, false)
+		if err != nil {
+			return nil, err
+		}
+		b = append(b, chunk...)
+	}
+}
+
+// text reads the contents of a text string, checking it is valid UTF-8.
+func (d *decoder) text(n uint64, indefinite bool) (string, error) {
+	b, err := d.str(majorText, n, indefinite)
+	if err != nil {
+		return "", err
+	}
+	if !utf8.Valid(b) {
+		return "", errors.New("cbor: invalid UTF-8 in text string")
+	}
+	return string(b), nil
+}
+
+// nested is called entering an array or map, and its result when leaving.
+func (d *decoder) nested() (func(), error) {
+	d.depth++
+	if d.depth > maxDepth {
+		return nil, errors.New("cbor: exceeded max depth")
+	}
+	return func() { d.depth-- }, nil
+}
+
+// items calls item for each item of an array, or each entry of a map.
+func (d *decoder) items(n uint64, indefinite bool, item func(i int) error) error {
+	leave, err := d.nested()
+	if err != nil {
+		return err
+	}
+	defer leave()
+	for i := 0; indefinite || uint64(i) < n; i++ {
+		if indefinite {
+			if end, err := d.atBreak(); err != nil || end {
+				return err
+			}
+		}
+		if err := item(i); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// value decodes the next data item as an interface{}.
+func (d *decoder) value() (interface{}, error) {
+	major, info, n, indefinite, err := d.head()
+	if err != nil {
+		return nil, err
+	}
+	switch major {
+	case majorUint:
+		if n > math.MaxInt64 {
+			return n, nil
+		}
+		return int64(n), nil
+	case majorNegInt:
+		if n > math.MaxInt64 {
+			return nil, errors.New("cbor: negative integer overflows int64")
+		}
+		return -1 - int64(n), nil
+	case majorBytes:
+		b, err := d.str(major, n, indefinite)
+		return append([]byte(nil), b...), err
+	case majorText:
+		return d.text(n, indefinite)
+	case majorArray:
+		var a []interface{}
+		if !indefinite {
+			l, err := d.length(n, 1)
+			if err != nil {
+				return nil, err
+			}
+			a = make([]interface{}, 0, l)
+		}
+		err := d.items(n, indefinite, func(int) error {
+			v, err := d.value()
+			a = append(a, v)
+			return err
+		})
+		if a == nil {
+			a = []interface{}{}
+		}
+		return a, err
+	case majorMap:
+		m := make(map[interface{}]interface{})
+		text := true
+		err := d.items(n, indefinite, func(int) error {
+			k, err := d.value()
+			if err != nil {
+				return err
+			}
+			if !reflect.TypeOf(k).Comparable() {
+				return fmt.Errorf("cbor: invalid map key of type %T", k)
+			}
+			_, isText := k.(string)
+			text = text && isText
+			m[k], err = d.value()
+			return err
+		})
+		if err != nil || !text {
+			return m, err
+		}
+		sm := make(map[string]interface{}, len(m))
+		for k, v := range m {
+			sm[k.(string)] = v
+		}
+		return sm, nil
+	case majorTag:
+		v, err := d.value()
+		if err != nil {
+			return nil, err
+		}
+		if n == tagDateTime || n == tagEpoch {
+			return toTime(n, v)
+		}
+		return v, nil
+	}
+	return d.simple(info, n)
+}
+
+// simple returns the simple value or float of a data item of major type 7.
+func (d *decoder) simple(info byte, n uint64) (interface{}, error) {
+	switch info {
+	case 25:
+		return float16(uint16(n)), nil
+	case 26:
+		return float64(math.Float32frombits(uint32(n))), nil
+	case 27:
+		return math.Float64frombits(n), nil
+	}
+	switch byte(n) {
+	case simpleFalse & 0x1f:
+		return false, nil
+	case simpleTrue & 0x1f:
+		return true, nil
+	case simpleNull & 0x1f, simpleUndefined & 0x1f:
+		return nil, nil
+	}
+	return nil, fmt.Errorf("cbor: unsupported simple value %d", n)
+}
+
+// float16 converts an IEEE 754 half-precision float.
+func float16(h uint16) float64 {
+	exp := int(h>>10) & 0x1f
+	mant := float64(h & 0x3ff)
+	var f float64
+	switch exp {
+	case 0:
+		f = math.Ldexp(mant, -24)
+	case 31:
+		if mant == 0 {
+			f = math.Inf(1)
+		} else {
+			f = math.NaN()
+		}
+	default:
+		f = math.Ldexp(mant+1024, exp-25)
+	}
+	if h&0x8000 != 0 {
+		f = -f
+	}
+	return f
+}
+
+// toTime converts the content of a time tag.
+func toTime(tag uint64, v interface{}) (time.Time, error) {
+	switch v := v.(type) {
+	case string:
+		if tag == tagDateTime {
+			return time.Parse(time.RFC3339Nano, v)
+		}
+	case int64:
+		if tag == tagEpoch {
+			return time.Unix(v, 0), nil
+		}
+	case float64:
+		if tag == tagEpoch {
+			sec, frac := math.Modf(v)
+			return time.Unix(int64(sec), int64(frac*1e9)), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("cbor: invalid content of tag %d", tag)
+}
+
+// decode decodes the next data item into v.
+func (d *decoder) decode(v reflect.Value) error {
+	start := d.off
+	if v.CanAddr() && reflect.PtrTo(v.Type()).Implements(unmarshalerType) {
+		if err := d.skip(); err != nil {
+			return err
+		}
+		return v.Addr().Interface().(Unmarshaler).UnmarshalCBOR(d.data[start:d.off])
+	}
+	b, err := d.peek()
+	if err != nil {
+		return err
+	}
+	if b == simpleNull || b == simpleUndefined {
+		d.off++
+		switch v.Kind() {
+		case reflect.Interface, reflect.Ptr, reflect.Map, reflect.Slice:
+			v.Set(reflect.Zero(v.Type()))
+		}
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Ptr:
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return d.decode(v.Elem())
+	case reflect.Interface:
+		if v.NumMethod() != 0 {
+			return fmt.Errorf("cbor: can't decode into %s", v.Type())
+		}
+		x, err := d.value()
+		if err != nil {
+			return err
+		}
+		if x != nil {
+			v.Set(reflect.ValueOf(x))
+		}
+		return nil
+	}
+	if v.Type() == timeType || v.CanAddr() && reflect.PtrTo(v.Type()).Implements(textUnmarshalerType) {
+		x, err := d.value()
+		if err != nil {
+			return err
+		}
+		if v.Type() == timeType {
+			if t, ok := x.(time.Time); ok {
+				v.Set(reflect.ValueOf(t))
+				return nil
+			}
+		}
+		s, ok := x.(string)
+		if !ok {
+			return mismatch(x, v.Type())
+		}
+		return v.Addr().Interface().(encoding.TextUnmarshaler).UnmarshalText([]byte(s))
+	}
+
+	major, _, n, indefinite, err := d.head()
+	if err != nil {
+		return err
+	}
+	for major == majorTag {
+		if major, _, n, indefinite, err = d.head(); err != nil {
+			return err
+		}
+	}
+	switch major {
+	case majorArray:
+		return d.array(v, n, indefinite)
+	case majorMap:
+		return d.mapping(v, n, indefinite)
+	case majorBytes:
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			b, err := d.str(major, n, indefinite)
+			if err != nil {
+				return err
+			}
+			v.SetBytes(append([]byte(nil), b...))
+			return nil
+		}
+	}
+	// Scalars are decoded as an interface{} and converted.
+	d.off = start
+	x, err := d.value()
+	if err != nil {
+		return err
+	}
+	return assign(v, x)
+}
+
+// assign sets v to the scalar x.
+func assign(v reflect.Value, x interface{}) error {
+	switch x := x.(type) {
+	case bool:
+		if v.Kind() == reflect.Bool {
+			v.SetBool(x)
+			return nil
+		}
+	case string:
+		if v.Kind() == reflect.String {
+			v.SetString(x)
+			return nil
+		}
+		if v.Kind() == reflect.Slice && v.Type().Elem().Kind() == reflect.Uint8 {
+			// Binary data sent as base64 text, as in JSON.
+			b, err := rpc.DecodeBase64(x)
+			if err != nil {
+				return fmt.Errorf("cbor: invalid base64 data: %v", err)
+			}
+			v.SetBytes(b)
+			return nil
+		}
+	case []byte:
+		if v.Kind() == reflect.String {
+			v.SetString(string(x))
+			return nil
+		}
+	case int64:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if v.OverflowInt(x) {
+				return fmt.Errorf("cbor: %d overflows %s", x, v.Type())
+			}
+			v.SetInt(x)
+			return nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+			if x < 0 || v.OverflowUint(uint64(x)) {
+				return fmt.Errorf("cbor: %d overflows %s", x, v.Type())
+			}
+			v.SetUint(uint64(x))
+			return nil
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(float64(x))
+			return nil
+		}
+	case uint64:
+		switch v.Kind() {
+		case reflect.Uint, reflect.Uint64, reflect.Uintptr:
+			if v.OverflowUint(x) {
+				return fmt.Errorf("cbor: %d overflows %s", x, v.Type())
+			}
+			v.SetUint(x)
+			return nil
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(float64(x))
+			return nil
+		}
+		return fmt.Errorf("cbor: %d overflows %s", x, v.Type())
+	case float64:
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			v.SetFloat(x)
+			return nil
+		}
+	}
+	return mismatch(x, v.Type())
+}
+
+func mismatch(x interface{}, t reflect.Type) error {
+	return fmt.Errorf("cbor: can't decode %T into %s", x, t)
+}
+
+// array decodes the items of an array into a slice or array.
+func (d *decoder) array(v reflect.Value, n uint64, indefinite bool) error {
+	switch v.Kind() {
+	case reflect.Slice:
+		l := 0
+		if !indefinite {
+			var err error
+			if l, err = d.length(n, 1); err != nil {
+				return err
+			}
+		}
+		v.Set(reflect.MakeSlice(v.Type(), 0, l))
+		return d.items(n, indefinite, func(i int) error {
+			v.Set(reflect.Append(v, reflect.Zero(v.Type().Elem())))
+			return d.decode(v.Index(i))
+		})
+	case reflect.Array:
+		err := d.items(n, indefinite, func(i int) error {
+			if i >= v.Len() {
+				return d.skip()
+			}
+			return d.decode(v.Index(i))
+		})
+		if err != nil {
+			return err
+		}
+		for i := int(n); !indefinite && i < v.Len(); i++ {
+			v.Index(i).Set(reflect.Zero(v.Type().Elem()))
+		}
+		return nil
+	}
+	return fmt.Errorf("cbor: can't decode array into %s", v.Type())
+}
+
+// mapping decodes the entries of a map into a map or struct.
+func (d *decoder) mapping(v reflect.Value, n uint64, indefinite bool) error {
+	switch v.Kind() {
+	case reflect.Map:
+		t := v.Type()
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(t))
+		}
+		return d.items(n, indefinite, func(int) error {
+			key := reflect.New(t.Key()).Elem()
+			if err := d.decode(key); err != nil {
+				return err
+			}
+			elem := reflect.New(t.Elem()).Elem()
+			if err := d.decode(elem); err != nil {
+				return err
+			}
+			v.SetMapIndex(key, elem)
+			return nil
+		})
+	case reflect.Struct:
+		fields := cachedFields(v.Type())
+		return d.items(n, indefinite, func(int) error {
+			k, err := d.value()
+			if err != nil {
+				return err
+			}
+			name, ok := k.(string)
+			if !ok {
+				return d.skip()
+			}
+			f := lookupField(fields, name)
+			if f == nil {
+				return d.skip()
+			}
+			fv, err := fieldForSet(v, f.index)
+			if err != nil {
+				return err
+			}
+			return d.decode(fv)
+		})
+	}
+	return fmt.Errorf("cbor: can't decode map into %s", v.Type())
+}
+
+// lookupField returns the field named name, preferring an exact match to a
+// case-insensitive one, as encoding/json.
+func lookupField(fields []field, name string) *field {
+	var fold *field
+	for i := range fields {
+		if fields[i].name == name {
+			return &fields[i]
+		}
+		if fold == nil && strings.EqualFold(fields[i].name, name) {
+			fold = &fields[i]
+		}
+	}
+	return fold
+}
+
+// fieldForSet returns the field of v at index, allocating the embedded
+// pointers on the way.
+func fieldForSet(v reflect.Value, index []int) (reflect.Value, error) {
+	for i, x := range index {
+		if i > 0 && v.Kind() == reflect.Ptr {
+			if v.IsNil() {
+				if !v.CanSet() {
+					return reflect.Value{}, fmt.Errorf("cbor: can't set embedded pointer to unexported struct %s", v.Type().Elem())
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+		v = v.Field(x)
+	}
+	return v, nil
+}
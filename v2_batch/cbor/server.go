@@ -0,0 +1,319 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package cbor provides a codec for JSON-RPC 2.0 messages encoded in CBOR
+(RFC 8949), for constrained clients for which JSON is too verbose.
+
+The messages have the members of their JSON-RPC counterparts, and the
+batches the same semantics as with the json2 codec: an array of requests
+is a batch, replied with an array of responses, the replies to
+notifications are omitted, and a batch of notifications only is replied
+with a 204 status:
+
+	s := rpc.NewServer()
+	s.RegisterCodec(cbor.NewCodec(), cbor.ContentType)
+
+Params are decoded into the method args with Unmarshal, and results
+encoded with Marshal, following the conventions of encoding/json, field
+tags included. The package implements CBOR itself and has no
+dependencies.
+*/
+package cbor
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"reflect"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+)
+
+// ContentType is the content type of the codec.
+const ContentType = "application/cbor"
+
+// Version is the JSON-RPC version of the messages.
+const Version = "2.0"
+
+// CodeParseError is replied for bodies which aren't well-formed CBOR.
+const CodeParseError = -32700
+
+// codeServerError is the code of the errors not carrying one.
+const codeServerError = -32000
+
+// ----------------------------------------------------------------------------
+// Request and Response
+// ----------------------------------------------------------------------------
+
+// serverRequest represents a JSON-RPC request received by the server.
+type serverRequest struct {
+	Version string     `cbor:"jsonrpc"`
+	Method  string     `cbor:"method"`
+	Params  RawMessage `cbor:"params"`
+	// The request id, copied as it is, and nil for notifications.
+	Id RawMessage `cbor:"id"`
+}
+
+// serverResponse represents a JSON-RPC response returned by the server.
+type serverResponse struct {
+	// The encoded result, if there is no error.
+	Result RawMessage
+	Error  *Error
+	Id     RawMessage
+
+	// Replies to notifications are omitted from the response.
+	notification bool
+}
+
+// MarshalCBOR encodes the response with either its result or its error.
+func (r *serverResponse) MarshalCBOR() ([]byte, error) {
+	e := &encoder{}
+	e.head(majorMap, 3)
+	e.text("jsonrpc")
+	e.text(Version)
+	if r.Error != nil {
+		e.text("error")
+		if err := e.encode(reflect.ValueOf(r.Error)); err != nil {
+			return nil, err
+		}
+	} else {
+		e.text("result")
+		e.buf.Write(r.Result)
+	}
+	e.text("id")
+	if r.Id == nil {
+		e.buf.WriteByte(simpleNull)
+	} else {
+		e.buf.Write(r.Id)
+	}
+	return e.buf.Bytes(), nil
+}
+
+// Error is a JSON-RPC error object.
+type Error struct {
+	Code    int         `cbor:"code"`
+	Message string      `cbor:"message"`
+	Data    interface{} `cbor:"data,omitempty"`
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorCode returns the error code, for server metrics.
+func (e *Error) ErrorCode() int {
+	return e.Code
+}
+
+// newError converts err to an *Error, keeping the code and data of errors
+// carrying them, such as *rpc.Error.
+func newError(err error) *Error {
+	if e, ok := err.(*Error); ok {
+		return e
+	}
+	e := &Error{Code: codeServerError, Message: err.Error()}
+	if code, ok := rpc.ErrorCode(err); ok {
+		e.Code = code
+	}
+	if d, ok := err.(interface{ ErrorData() interface{} }); ok {
+		e.Data = d.ErrorData()
+		if _, err := Marshal(e.Data); err != nil {
+			// Better an error without data than no reply.
+			e.Data = nil
+		}
+	}
+	return e
+}
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+// NewCodec returns a new CBOR Codec.
+func NewCodec() *Codec {
+	return &Codec{}
+}
+
+// Codec creates a CodecRequest to process each request.
+type Codec struct{}
+
+// NewRequest returns the CodecRequests of r, one per request of a batch.
+func (c *Codec) NewRequest(r *http.Request) ([]rpc.CodecRequest, error) {
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	if !Valid(body) {
+		// Answered with a single error reply, as for a request without id.
+		return []rpc.CodecRequest{&CodecRequest{
+			err:  &Error{Code: CodeParseError, Message: "rpc: invalid CBOR body"},
+			body: body,
+		}}, nil
+	}
+	if body[0]>>5 != majorArray {
+		return []rpc.CodecRequest{newCodecRequest(body, body)}, nil
+	}
+	var batch []RawMessage
+	if err := Unmarshal(body, &batch); err != nil {
+		return nil, err
+	}
+	if len(batch) == 0 {
+		return []rpc.CodecRequest{&CodecRequest{
+			err:  &Error{Code: rpc.CodeInvalidRequest, Message: "rpc: empty batch"},
+			body: body,
+		}}, nil
+	}
+	reqs := make([]rpc.CodecRequest, len(batch))
+	for i, msg := range batch {
+		reqs[i] = newCodecRequest(msg, body)
+	}
+	return reqs, nil
+}
+
+// WriteBatchedReply writes the replies of a request: a single response,
+// an array for a batch, or nothing with a 204 status if all were
+// notifications.
+func (c *Codec) WriteBatchedReply(r *http.Request, w http.ResponseWriter, replyArray []interface{}) {
+	single := len(replyArray) == 1
+	replies := make([]interface{}, 0, len(replyArray))
+	for _, reply := range replyArray {
+		if res, ok := reply.(*serverResponse); ok && res.notification {
+			continue
+		}
+		replies = append(replies, reply)
+	}
+	if len(replies) == 0 && len(replyArray) > 0 {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	var b []byte
+	var err error
+	if single {
+		b, err = Marshal(replies[0])
+	} else {
+		b, err = Marshal(replies)
+	}
+	if err != nil {
+		rpc.WriteError(w, http.StatusInternalServerError, "rpc: can't encode the reply: "+err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", ContentType)
+	w.Write(b)
+}
+
+// ErrorReply implements rpc.ErrorReplier, answering a whole request with an
+// error of null id.
+func (c *Codec) ErrorReply(err error) interface{} {
+	return &serverResponse{Error: newError(err)}
+}
+
+// ----------------------------------------------------------------------------
+// CodecRequest
+// ----------------------------------------------------------------------------
+
+// newCodecRequest returns the CodecRequest of a request msg of body.
+func newCodecRequest(msg RawMessage, body []byte) *CodecRequest {
+	c := &CodecRequest{request: new(serverRequest), body: body}
+	if err := Unmarshal(msg, c.request); err != nil {
+		c.err = &Error{Code: rpc.CodeInvalidRequest, Message: "rpc: invalid request: " + err.Error()}
+	} else if c.request.Version != Version {
+		c.err = &Error{Code: rpc.CodeInvalidRequest, Message: "jsonrpc must be " + Version}
+	}
+	// An invalid request is answered even without id.
+	c.notification = c.request.Id == nil && c.err == nil
+	return c
+}
+
+// CodecRequest decodes and encodes a single request.
+type CodecRequest struct {
+	request      *serverRequest
+	notification bool
+	err          error
+	body         []byte
+}
+
+// Method returns the RPC method for the current request.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (c *CodecRequest) Method() (string, error) {
+	if c.err == nil {
+		return c.request.Method, nil
+	}
+	return "", c.err
+}
+
+// RenameMethod sets the registered name of the method, called in
+// lowerCamel, so that the settings of the method apply.
+func (c *CodecRequest) RenameMethod(method string) {
+	c.request.Method = method
+}
+
+// ReadRequest fills the request object for the RPC method.
+func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.request.Params == nil {
+		c.err = &Error{Code: rpc.CodeInvalidRequest, Message: "rpc: method request ill-formed: missing params field"}
+	} else if err := Unmarshal(c.request.Params, args); err != nil {
+		c.err = &Error{Code: rpc.CodeInvalidParams, Message: "rpc: invalid params: " + err.Error()}
+	}
+	return c.err
+}
+
+// ResponseReply returns the reply of a result, encoded right away so that
+// encoding errors are replied as such.
+func (c *CodecRequest) ResponseReply(reply interface{}) interface{} {
+	b, err := Marshal(reply)
+	if err != nil {
+		return c.ErrorReply(&Error{Code: rpc.CodeInternalError, Message: "rpc: can't encode the result: " + err.Error()})
+	}
+	return &serverResponse{
+		Result:       b,
+		Id:           c.id(),
+		notification: c.notification,
+	}
+}
+
+// ErrorReply returns the reply of an error.
+func (c *CodecRequest) ErrorReply(err error) interface{} {
+	return &serverResponse{
+		Error:        newError(err),
+		Id:           c.id(),
+		notification: c.notification,
+	}
+}
+
+func (c *CodecRequest) id() RawMessage {
+	if c.request == nil {
+		return nil
+	}
+	return c.request.Id
+}
+
+// Body returns the request body.
+func (c *CodecRequest) Body() []byte {
+	return c.body
+}
+
+// Error returns the error decoding the request, if any.
+func (c *CodecRequest) Error() error {
+	return c.err
+}
+
+// CacheKey identifies the request by its method and params, for the server
+// reply cache. The encoding of equal params may differ, in which case they
+// are cached apart.
+func (c *CodecRequest) CacheKey() (string, bool) {
+	if c.err != nil || c.request.Params == nil {
+		return "", false
+	}
+	var key bytes.Buffer
+	key.WriteString(c.request.Method)
+	key.WriteByte(0)
+	key.Write(c.request.Params)
+	return key.String(), true
+}
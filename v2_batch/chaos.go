@@ -0,0 +1,131 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Chaos
+// ----------------------------------------------------------------------------
+
+// Fault describes the failures injected into calls to a method. Each kind of
+// failure is injected independently with its own probability, between 0 and
+// 1.
+type Fault struct {
+	// Latency is added before the method is called.
+	LatencyProbability float64
+	Latency            time.Duration
+	// An Error with ErrorCode and ErrorMessage is replied instead of
+	// calling the method.
+	ErrorProbability float64
+	ErrorCode        int
+	ErrorMessage     string
+	// The reply is dropped from the response, as if the request was lost.
+	DropProbability float64
+	// The HTTP response body is cut in half.
+	TruncateProbability float64
+}
+
+// Chaos injects faults into calls for client resilience testing. It is
+// disabled when created and must be explicitly enabled, e.g. from an admin
+// endpoint of a staging deployment; production servers should not install
+// it at all.
+type Chaos struct {
+	mutex   sync.Mutex
+	enabled bool
+	faults  map[string]Fault
+	rand    *rand.Rand
+}
+
+// NewChaos returns a disabled Chaos. The seed makes fault injection
+// reproducible.
+func NewChaos(seed int64) *Chaos {
+	return &Chaos{
+		faults: make(map[string]Fault),
+		rand:   rand.New(rand.NewSource(seed)),
+	}
+}
+
+// SetFault sets the faults injected into calls to method, in dotted
+// notation. The method "*" applies to methods without a fault of their own.
+func (c *Chaos) SetFault(method string, fault Fault) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.faults[method] = fault
+}
+
+// ClearFaults removes all faults.
+func (c *Chaos) ClearFaults() {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.faults = make(map[string]Fault)
+}
+
+// Enable turns fault injection on or off.
+func (c *Chaos) Enable(enabled bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.enabled = enabled
+}
+
+// Enabled reports whether fault injection is on.
+func (c *Chaos) Enabled() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.enabled
+}
+
+// SetChaos installs fault injection on the server. A nil Chaos removes it.
+func (s *Server) SetChaos(c *Chaos) {
+	s.chaos = c
+}
+
+// roll reports, for each kind of failure, whether it must be injected into
+// a call to method.
+func (c *Chaos) roll(method string) (latency time.Duration, err error, drop, truncate bool) {
+	if c == nil {
+		return
+	}
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if !c.enabled {
+		return
+	}
+	fault, ok := c.faults[method]
+	if !ok {
+		if fault, ok = c.faults["*"]; !ok {
+			return
+		}
+	}
+	if c.rand.Float64() < fault.LatencyProbability {
+		latency = fault.Latency
+	}
+	if c.rand.Float64() < fault.ErrorProbability {
+		err = &Error{Code: fault.ErrorCode, Message: fault.ErrorMessage}
+	}
+	drop = c.rand.Float64() < fault.DropProbability
+	truncate = c.rand.Float64() < fault.TruncateProbability
+	return
+}
+
+// truncatingWriter writes only the first half of the first body write and
+// discards the rest.
+type truncatingWriter struct {
+	http.ResponseWriter
+	done bool
+}
+
+func (w *truncatingWriter) Write(p []byte) (int, error) {
+	if !w.done {
+		w.done = true
+		w.ResponseWriter.Write(p[:len(p)/2])
+	}
+	return len(p), nil
+}
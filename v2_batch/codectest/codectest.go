@@ -0,0 +1,402 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package codectest is a conformance suite for rpc.Codec implementations
+// following JSON-RPC 2.0 semantics, whatever their encoding: single
+// requests, batches, notifications, errors and edge cases are checked to
+// behave as with the json2 codec. Codec authors run it from their tests,
+// describing their encoding with a Wire:
+//
+//	func TestConformance(t *testing.T) {
+//		codectest.Run(t, codectest.Suite{
+//			Codec:       NewCodec(),
+//			ContentType: "application/json",
+//			Wire:        codectest.JSONWire{},
+//		})
+//	}
+package codectest
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync/atomic"
+	"testing"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+)
+
+// ----------------------------------------------------------------------------
+// Wire
+// ----------------------------------------------------------------------------
+
+// Wire encodes the requests and decodes the responses of a codec for the
+// suite.
+type Wire interface {
+	// EncodeRequest returns a request calling method with params, with id,
+	// or a notification if id is nil.
+	EncodeRequest(method string, params interface{}, id *uint64) ([]byte, error)
+	// EncodeBatch returns a batch of requests returned by EncodeRequest.
+	EncodeBatch(requests [][]byte) ([]byte, error)
+	// DecodeResponses returns the responses of a body: one for a single
+	// response, and none for an empty body.
+	DecodeResponses(body []byte) ([]Response, error)
+	// DecodeResult decodes the result of a Response into v, a pointer.
+	DecodeResult(result []byte, v interface{}) error
+}
+
+// Response is a response decoded by a Wire.
+type Response struct {
+	// ID is the id of the request, nil if it is null.
+	ID *uint64
+	// Error is the error of the response, if any, and Result its encoded
+	// result otherwise.
+	Error  *ResponseError
+	Result []byte
+}
+
+// ResponseError is the error of a Response.
+type ResponseError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+// JSONWire is the Wire of JSON-RPC 2.0 over JSON.
+type JSONWire struct{}
+
+// EncodeRequest implements Wire.
+func (JSONWire) EncodeRequest(method string, params interface{}, id *uint64) ([]byte, error) {
+	return json.Marshal(struct {
+		Version string      `json:"jsonrpc"`
+		Method  string      `json:"method"`
+		Params  interface{} `json:"params"`
+		ID      *uint64     `json:"id,omitempty"`
+	}{"2.0", method, params, id})
+}
+
+// EncodeBatch implements Wire.
+func (JSONWire) EncodeBatch(requests [][]byte) ([]byte, error) {
+	return append(append([]byte("["), bytes.Join(requests, []byte(","))...), ']'), nil
+}
+
+// DecodeResponses implements Wire.
+func (JSONWire) DecodeResponses(body []byte) ([]Response, error) {
+	type response struct {
+		ID     *uint64         `json:"id"`
+		Error  *ResponseError  `json:"error"`
+		Result json.RawMessage `json:"result"`
+	}
+	body = bytes.TrimSpace(body)
+	var responses []response
+	switch {
+	case len(body) == 0:
+		return nil, nil
+	case body[0] == '[':
+		if err := json.Unmarshal(body, &responses); err != nil {
+			return nil, err
+		}
+	default:
+		responses = make([]response, 1)
+		if err := json.Unmarshal(body, &responses[0]); err != nil {
+			return nil, err
+		}
+	}
+	decoded := make([]Response, len(responses))
+	for i, res := range responses {
+		decoded[i] = Response{ID: res.ID, Error: res.Error, Result: res.Result}
+	}
+	return decoded, nil
+}
+
+// DecodeResult implements Wire.
+func (JSONWire) DecodeResult(result []byte, v interface{}) error {
+	return json.Unmarshal(result, v)
+}
+
+// ----------------------------------------------------------------------------
+// Service
+// ----------------------------------------------------------------------------
+
+// Args are the args of the methods of the Service.
+type Args struct {
+	A, B  int
+	Text  string
+	Ratio float64
+	Data  rpc.Bytes
+	List  []string
+	Attrs map[string]string
+	Next  *Args
+}
+
+// Service is the service the suite calls.
+type Service struct {
+	notified int32
+}
+
+// Multiply replies A*B.
+func (s *Service) Multiply(r *http.Request, args *Args, reply *int) error {
+	*reply = args.A * args.B
+	return nil
+}
+
+// Echo replies its args.
+func (s *Service) Echo(r *http.Request, args *Args, reply *Args) error {
+	*reply = *args
+	return nil
+}
+
+// Fail replies an error with a code.
+func (s *Service) Fail(r *http.Request, args *Args, reply *int) error {
+	return &rpc.Error{Code: rpc.CodePreconditionFailed, Message: "failed"}
+}
+
+// Plain replies an error without a code.
+func (s *Service) Plain(r *http.Request, args *Args, reply *int) error {
+	return errors.New("plain")
+}
+
+// Notify counts its calls.
+func (s *Service) Notify(r *http.Request, args *Args, reply *int) error {
+	atomic.AddInt32(&s.notified, 1)
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// Suite
+// ----------------------------------------------------------------------------
+
+// Suite is the conformance suite of a codec.
+type Suite struct {
+	Codec       rpc.Codec
+	ContentType string
+	Wire        Wire
+	// NoBatches skips the cases of batches, for codecs without.
+	NoBatches bool
+}
+
+// Run runs the suite as subtests of t.
+func Run(t *testing.T, suite Suite) {
+	for _, test := range []struct {
+		name  string
+		batch bool
+		run   func(*testing.T, *harness)
+	}{
+		{"Single", false, testSingle},
+		{"Echo", false, testEcho},
+		{"Errors", false, testErrors},
+		{"MethodNotFound", false, testMethodNotFound},
+		{"InvalidParams", false, testInvalidParams},
+		{"Malformed", false, testMalformed},
+		{"Notification", false, testNotification},
+		{"Batch", true, testBatch},
+		{"BatchNotifications", true, testBatchNotifications},
+	} {
+		if test.batch && suite.NoBatches {
+			continue
+		}
+		t.Run(test.name, func(t *testing.T) {
+			h := newHarness(t, suite)
+			test.run(t, h)
+		})
+	}
+}
+
+// harness serves the Service with the codec of a suite.
+type harness struct {
+	t       *testing.T
+	suite   Suite
+	server  *rpc.Server
+	service *Service
+}
+
+func newHarness(t *testing.T, suite Suite) *harness {
+	h := &harness{t: t, suite: suite, server: rpc.NewServer(), service: new(Service)}
+	h.server.RegisterCodec(suite.Codec, suite.ContentType)
+	if err := h.server.RegisterService(h.service, ""); err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+// request returns a request calling method with params, with id unless it
+// is zero.
+func (h *harness) request(method string, params interface{}, id uint64) []byte {
+	var idPtr *uint64
+	if id != 0 {
+		idPtr = &id
+	}
+	b, err := h.suite.Wire.EncodeRequest(method, params, idPtr)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return b
+}
+
+// batch returns a batch of requests.
+func (h *harness) batch(requests ...[]byte) []byte {
+	b, err := h.suite.Wire.EncodeBatch(requests)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	return b
+}
+
+// post serves body and returns the status and the responses.
+func (h *harness) post(body []byte) (int, []Response) {
+	r := httptest.NewRequest("POST", "/", bytes.NewReader(body))
+	r.Header.Set("Content-Type", h.suite.ContentType)
+	w := httptest.NewRecorder()
+	h.server.ServeHTTP(w, r)
+	if w.Code >= 400 {
+		return w.Code, nil
+	}
+	responses, err := h.suite.Wire.DecodeResponses(w.Body.Bytes())
+	if err != nil {
+		h.t.Fatalf("Can't decode the response %q: %v", w.Body, err)
+	}
+	return w.Code, responses
+}
+
+// call serves a single request and returns its response.
+func (h *harness) call(method string, params interface{}, id uint64) Response {
+	status, responses := h.post(h.request(method, params, id))
+	if status != http.StatusOK || len(responses) != 1 {
+		h.t.Fatalf("Expected a single response with status 200, got %d and %d responses", status, len(responses))
+	}
+	res := responses[0]
+	if res.ID == nil || *res.ID != id {
+		h.t.Errorf("Expected the id %d, got %v", id, res.ID)
+	}
+	return res
+}
+
+// result decodes the result of res into v.
+func (h *harness) result(res Response, v interface{}) {
+	if res.Error != nil {
+		h.t.Fatalf("Expected a result, got the error %+v", res.Error)
+	}
+	if err := h.suite.Wire.DecodeResult(res.Result, v); err != nil {
+		h.t.Fatalf("Can't decode the result: %v", err)
+	}
+}
+
+func testSingle(t *testing.T, h *harness) {
+	var product int
+	h.result(h.call("Service.Multiply", &Args{A: 6, B: 7}, 1), &product)
+	if product != 42 {
+		t.Errorf("Expected 42, got %d", product)
+	}
+}
+
+func testEcho(t *testing.T, h *harness) {
+	args := Args{
+		A:     -1 << 40,
+		Text:  "héllo, 世界   \"quoted\" \\ \x00",
+		Ratio: 0.1,
+		Data:  rpc.Bytes{0, 0xfb, 0xff},
+		List:  []string{"a", ""},
+		Attrs: map[string]string{"k": "v"},
+		Next:  &Args{B: 1},
+	}
+	var reply Args
+	h.result(h.call("Service.Echo", &args, 2), &reply)
+	if !reflect.DeepEqual(reply, args) {
+		t.Errorf("Expected %+v, got %+v", args, reply)
+	}
+}
+
+func testErrors(t *testing.T, h *harness) {
+	res := h.call("Service.Fail", &Args{}, 3)
+	if res.Error == nil || res.Error.Code != rpc.CodePreconditionFailed || res.Error.Message != "failed" {
+		t.Errorf("Expected the code and message of the error, got %+v", res.Error)
+	}
+	res = h.call("Service.Plain", &Args{}, 4)
+	if res.Error == nil || res.Error.Message != "plain" {
+		t.Errorf("Expected the message of the error, got %+v", res.Error)
+	}
+}
+
+func testMethodNotFound(t *testing.T, h *harness) {
+	res := h.call("Service.Missing", &Args{}, 5)
+	if res.Error == nil {
+		t.Error("Expected an error for an unknown method")
+	}
+}
+
+func testInvalidParams(t *testing.T, h *harness) {
+	res := h.call("Service.Multiply", "six", 6)
+	if res.Error == nil {
+		t.Error("Expected an error for invalid params")
+	}
+}
+
+func testMalformed(t *testing.T, h *harness) {
+	status, responses := h.post([]byte("\xff\x00garbage"))
+	if status < 400 && (len(responses) != 1 || responses[0].Error == nil) {
+		t.Errorf("Expected a 4xx status or an error response, got %d %+v", status, responses)
+	}
+}
+
+func testNotification(t *testing.T, h *harness) {
+	status, responses := h.post(h.request("Service.Notify", &Args{}, 0))
+	if status >= 300 || len(responses) != 0 {
+		t.Errorf("Expected no response to a notification, got %d %+v", status, responses)
+	}
+	if n := atomic.LoadInt32(&h.service.notified); n != 1 {
+		t.Errorf("Expected the notification served once, got %d", n)
+	}
+}
+
+func testBatch(t *testing.T, h *harness) {
+	status, responses := h.post(h.batch(
+		h.request("Service.Multiply", &Args{A: 2, B: 3}, 10),
+		h.request("Service.Fail", &Args{}, 11),
+		h.request("Service.Multiply", &Args{A: 4, B: 5}, 12),
+	))
+	if status != http.StatusOK || len(responses) != 3 {
+		t.Fatalf("Expected 3 responses with status 200, got %d and %d responses", status, len(responses))
+	}
+	byID := make(map[uint64]Response)
+	for _, res := range responses {
+		if res.ID == nil {
+			t.Fatalf("Expected the ids of the requests, got %+v", res)
+		}
+		byID[*res.ID] = res
+	}
+	for id, expected := range map[uint64]int{10: 6, 12: 20} {
+		var product int
+		h.result(byID[id], &product)
+		if product != expected {
+			t.Errorf("%d: expected %d, got %d", id, expected, product)
+		}
+	}
+	if res := byID[11]; res.Error == nil || res.Error.Code != rpc.CodePreconditionFailed {
+		t.Errorf("Expected the error of the failing call, got %+v", res)
+	}
+}
+
+func testBatchNotifications(t *testing.T, h *harness) {
+	status, responses := h.post(h.batch(
+		h.request("Service.Notify", &Args{}, 0),
+		h.request("Service.Multiply", &Args{A: 2, B: 3}, 20),
+		h.request("Service.Notify", &Args{}, 0),
+	))
+	if status != http.StatusOK || len(responses) != 1 || responses[0].ID == nil || *responses[0].ID != 20 {
+		t.Errorf("Expected the response of the call only, got %d %+v", status, responses)
+	}
+
+	status, responses = h.post(h.batch(
+		h.request("Service.Notify", &Args{}, 0),
+		h.request("Service.Notify", &Args{}, 0),
+	))
+	if status >= 300 || len(responses) != 0 {
+		t.Errorf("Expected no response to a batch of notifications, got %d %+v", status, responses)
+	}
+	if n := atomic.LoadInt32(&h.service.notified); n != 4 {
+		t.Errorf("Expected 4 notifications served, got %d", n)
+	}
+}
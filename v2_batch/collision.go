@@ -0,0 +1,126 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Name collisions
+// ----------------------------------------------------------------------------
+
+// Conflict is a problem with the name of a method: two methods whose names
+// only differ in case, which callers using lowerCamel or case-insensitive
+// names can't tell apart, or a retirement pointing to no method.
+type Conflict struct {
+	// Method is the method name, in dotted notation as in "Service.Method".
+	Method string
+	// With is the other method involved, if any.
+	With string
+	// Problem describes the conflict.
+	Problem string
+}
+
+func (c Conflict) String() string {
+	if c.With == "" {
+		return fmt.Sprintf("%s: %s", c.Method, c.Problem)
+	}
+	return fmt.Sprintf("%s: %s %s", c.Method, c.Problem, c.With)
+}
+
+// ConflictError reports the conflicts found by Validate or at registration.
+type ConflictError struct {
+	Conflicts []Conflict
+}
+
+func (e *ConflictError) Error() string {
+	lines := make([]string, len(e.Conflicts))
+	for i, c := range e.Conflicts {
+		lines[i] = "\n\t" + c.String()
+	}
+	return fmt.Sprintf("rpc: %d method name conflicts:%s", len(e.Conflicts), strings.Join(lines, ""))
+}
+
+// SetConflictHandler sets the function called with each name conflict found
+// when registering methods. If it returns nil, the methods are registered
+// anyway, e.g. after logging a warning; otherwise the registration fails with
+// its error.
+//
+// By default the registration fails with a *ConflictError.
+func (s *Server) SetConflictHandler(h func(Conflict) error) {
+	s.services.mutex.Lock()
+	defer s.services.mutex.Unlock()
+	s.services.onConflict = h
+}
+
+// Validate checks the registered methods and retirements without changing
+// anything, returning a *ConflictError reporting all the conflicts found:
+// methods whose names only differ in case and retirements whose replacement
+// isn't registered.
+func (s *Server) Validate() error {
+	names := s.services.names()
+	conflicts := nameConflicts(nil, names)
+	s.retiredMutex.Lock()
+	for method, retirement := range s.retired {
+		if retirement.Replacement != "" && !s.HasMethod(retirement.Replacement) {
+			conflicts = append(conflicts, Conflict{Method: method, With: retirement.Replacement, Problem: "is retired for the unregistered"})
+		}
+	}
+	s.retiredMutex.Unlock()
+	if len(conflicts) == 0 {
+		return nil
+	}
+	sort.Slice(conflicts, func(i, j int) bool {
+		return conflicts[i].String() < conflicts[j].String()
+	})
+	return &ConflictError{Conflicts: conflicts}
+}
+
+// nameConflicts returns the conflicts of the added method names with each
+// other and with the registered ones.
+func nameConflicts(registered, added []string) []Conflict {
+	var conflicts []Conflict
+	seen := make(map[string]string, len(registered)+len(added))
+	for _, name := range registered {
+		seen[strings.ToLower(name)] = name
+	}
+	for _, name := range added {
+		key := strings.ToLower(name)
+		if other, ok := seen[key]; ok && other != name {
+			conflicts = append(conflicts, Conflict{Method: name, With: other, Problem: "only differs in case from"})
+			continue
+		}
+		seen[key] = name
+	}
+	return conflicts
+}
+
+// checkConflicts passes the conflicts of the added method names to the
+// conflict handler. It must be called with the mutex held.
+func (m *serviceMap) checkConflicts(added []string) error {
+	var registered []string
+	for serviceName, service := range m.services {
+		for methodName := range service.methods {
+			registered = append(registered, serviceName+"."+methodName)
+		}
+	}
+	sort.Strings(added)
+	conflicts := nameConflicts(registered, added)
+	if len(conflicts) == 0 {
+		return nil
+	}
+	if m.onConflict == nil {
+		return &ConflictError{Conflicts: conflicts}
+	}
+	for _, c := range conflicts {
+		if err := m.onConflict(c); err != nil {
+			return err
+		}
+	}
+	return nil
+}
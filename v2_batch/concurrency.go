@@ -0,0 +1,96 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// SetBatchConcurrency makes the server dispatch the requests of a batch to
+// up to n workers, so that a slow method doesn't hold up the rest of the
+// batch. Replies are still written in the order of the requests.
+//
+// Handlers of a batch then run concurrently and must not depend on each
+// other. A value of n below 2 processes batches sequentially, which is the
+// default.
+func (s *Server) SetBatchConcurrency(n int) {
+	s.batchConcurrency = n
+}
+
+// serveRequests processes the requests of a batch and returns their replies
+// in order. It returns false if processing of the batch must be aborted,
+// including when the client went away: the remaining requests are skipped.
+func (s *Server) serveRequests(r *http.Request, codecReqArray []CodecRequest, b *batch) ([]interface{}, bool) {
+	replies := make([]interface{}, len(codecReqArray))
+	n := s.batchConcurrency
+	if b.concurrency > 0 {
+		n = b.concurrency
+	}
+	if n > len(codecReqArray) {
+		n = len(codecReqArray)
+	}
+	if n < 2 {
+		for i, codecReq := range codecReqArray {
+			if r.Context().Err() != nil {
+				return nil, false
+			}
+			reply, ok := s.serveRequest(r, codecReq, b)
+			if !ok {
+				return nil, false
+			}
+			replies[i] = reply
+		}
+		return replies, true
+	}
+
+	var aborted int32
+	var wg sync.WaitGroup
+	next := make(chan int)
+	for w := 0; w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				// Each request gets its own copy of r.
+				reply, ok := s.serveWorkerRequest(r.WithContext(r.Context()), codecReqArray[i], b)
+				if !ok {
+					atomic.StoreInt32(&aborted, 1)
+				}
+				replies[i] = reply
+			}
+		}()
+	}
+	for i := range codecReqArray {
+		if atomic.LoadInt32(&aborted) != 0 || r.Context().Err() != nil {
+			break
+		}
+		select {
+		case next <- i:
+		case <-r.Context().Done():
+		}
+	}
+	close(next)
+	wg.Wait()
+	return replies, aborted == 0 && r.Context().Err() == nil
+}
+
+// serveWorkerRequest serves a request of a batch on a worker goroutine. A
+// panic outside the handler, e.g. in middleware or the codec, is answered
+// with an error reply, as it would otherwise crash the process rather than
+// be recovered by net/http.
+func (s *Server) serveWorkerRequest(r *http.Request, codecReq CodecRequest, b *batch) (reply interface{}, ok bool) {
+	method, _ := codecReq.Method()
+	var err error
+	defer func() {
+		if err != nil {
+			atomic.AddInt32(&b.failed, 1)
+			reply, ok = codecReq.ErrorReply(&Error{Code: CodeInternalError, Message: err.Error()}), true
+		}
+	}()
+	defer s.recoverPanic(r, method, &err)
+	return s.serveRequest(r, codecReq, b)
+}
@@ -0,0 +1,202 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"reflect"
+	"strings"
+	"syscall"
+)
+
+// ----------------------------------------------------------------------------
+// Config
+// ----------------------------------------------------------------------------
+
+// Config holds the server settings that can be reloaded at runtime.
+//
+// The limits, auth keys and log level are applied by SetConfig. A setting
+// left out of a config is not changed, unless a previous config set it: a
+// rate limit the new config drops is removed and a batch size limit it
+// drops is lifted, while the settings made with SetRateLimit and the like
+// are kept.
+type Config struct {
+	// MaxBatchSize limits the number of requests in a batch, as
+	// SetMaxBatchSize. Zero means no limit.
+	MaxBatchSize int `json:"max_batch_size"`
+	// RateLimits are the rate limits per method, or "*", as SetRateLimit.
+	RateLimits map[string]RateLimit `json:"rate_limits"`
+	// AuthKeys, if not empty, are the keys accepted as bearer tokens in the
+	// Authorization header of the calls. Calls without one of them are
+	// answered with a CodeUnauthorized error. Admin calls are authorized
+	// by EnableAdmin instead.
+	AuthKeys []string `json:"auth_keys"`
+	// LogLevel is the minimum level of the logged entries, as SetLogLevel,
+	// e.g. "debug" or "warn". Empty leaves the level unchanged.
+	LogLevel string `json:"log_level"`
+	// Flags are feature flags, queried with Server.FeatureEnabled.
+	Flags map[string]bool `json:"flags"`
+	// Settings holds application-defined sections. They are decoded and
+	// checked by config validators.
+	Settings map[string]json.RawMessage `json:"settings"`
+}
+
+// validate checks the settings applied by the server, returning the log
+// level.
+func (cfg *Config) validate() (LogLevel, error) {
+	if cfg.MaxBatchSize < 0 {
+		return 0, fmt.Errorf("negative max_batch_size %d", cfg.MaxBatchSize)
+	}
+	for method, limit := range cfg.RateLimits {
+		if limit.Rate < 0 || limit.Burst < 0 {
+			return 0, fmt.Errorf("negative rate limit for %q", method)
+		}
+	}
+	for i, key := range cfg.AuthKeys {
+		if key == "" {
+			return 0, fmt.Errorf("empty auth key %d", i)
+		}
+	}
+	var level slog.Level
+	if cfg.LogLevel != "" {
+		if err := level.UnmarshalText([]byte(cfg.LogLevel)); err != nil {
+			return 0, fmt.Errorf("invalid log_level: %v", err)
+		}
+	}
+	return LogLevel(level), nil
+}
+
+// LoadConfig reads a JSON config file.
+func LoadConfig(path string) (*Config, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	cfg := new(Config)
+	if err := json.Unmarshal(b, cfg); err != nil {
+		return nil, fmt.Errorf("rpc: invalid config %s: %v", path, err)
+	}
+	return cfg, nil
+}
+
+// AddConfigValidator adds a function checking every config before it is
+// applied. A validator returning an error rejects the config.
+func (s *Server) AddConfigValidator(validate func(*Config) error) {
+	s.configMutex.Lock()
+	defer s.configMutex.Unlock()
+	s.configValidators = append(s.configValidators, validate)
+}
+
+// SetConfig validates cfg, then makes it the current config and applies
+// its settings. If validation fails the current config and settings are
+// kept.
+func (s *Server) SetConfig(cfg *Config) error {
+	s.configMutex.Lock()
+	level, err := cfg.validate()
+	if err != nil {
+		s.configMutex.Unlock()
+		return fmt.Errorf("rpc: config rejected: %v", err)
+	}
+	for _, validate := range s.configValidators {
+		if err := validate(cfg); err != nil {
+			s.configMutex.Unlock()
+			return fmt.Errorf("rpc: config rejected: %v", err)
+		}
+	}
+	old := s.config
+	if cfg.MaxBatchSize != old.MaxBatchSize {
+		s.SetMaxBatchSize(cfg.MaxBatchSize)
+	}
+	for method := range old.RateLimits {
+		if _, ok := cfg.RateLimits[method]; !ok {
+			s.SetRateLimit(method, 0, 0)
+		}
+	}
+	for method, limit := range cfg.RateLimits {
+		if previous, ok := old.RateLimits[method]; !ok || previous != limit {
+			s.SetRateLimit(method, limit.Rate, limit.Burst)
+		}
+	}
+	if cfg.LogLevel != "" {
+		s.SetLogLevel(level)
+	}
+	flagsChanged := !reflect.DeepEqual(old.Flags, cfg.Flags)
+	s.config = cfg
+	s.configMutex.Unlock()
+	if flagsChanged {
+		// Applications gating methods on the flags, with FeatureEnabled,
+		// may accept other methods.
+		s.catalogChanged(true)
+	}
+	return nil
+}
+
+// Config returns the current config. It must not be modified.
+func (s *Server) Config() *Config {
+	s.configMutex.RLock()
+	defer s.configMutex.RUnlock()
+	return s.config
+}
+
+// FeatureEnabled reports whether the named feature flag is set in the
+// current config.
+func (s *Server) FeatureEnabled(name string) bool {
+	return s.Config().Flags[name]
+}
+
+// authError returns the error replied for a call to method not carrying
+// one of the AuthKeys of the current config, or nil.
+func (s *Server) authError(r *http.Request, method string) error {
+	cfg := s.Config()
+	if len(cfg.AuthKeys) == 0 {
+		return nil
+	}
+	if s.admin != nil && strings.HasPrefix(method, adminServiceName+".") {
+		return nil
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	for _, key := range cfg.AuthKeys {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(key)) == 1 {
+			return nil
+		}
+	}
+	return &Error{Code: CodeUnauthorized, Message: "rpc: unauthorized"}
+}
+
+// ReloadOnSignal reloads the config file at path each time the process
+// receives SIGHUP, until ctx is done. It doesn't block.
+//
+// Connections are not affected by a reload. A config that can't be read or
+// is rejected by a validator is reported to onError, if not nil, and the
+// current config is kept.
+func (s *Server) ReloadOnSignal(ctx context.Context, path string, onError func(error)) {
+	sighup := make(chan os.Signal, 1)
+	signal.Notify(sighup, syscall.SIGHUP)
+	go func() {
+		defer signal.Stop(sighup)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sighup:
+			}
+			cfg, err := LoadConfig(path)
+			if err == nil {
+				err = s.SetConfig(cfg)
+			}
+			if err != nil && onError != nil {
+				onError(err)
+			}
+		}
+	}()
+}
@@ -0,0 +1,378 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Raw connections
+// ----------------------------------------------------------------------------
+
+// Framing tells how messages are delimited on a raw connection.
+type Framing int
+
+const (
+	// FrameNewline delimits messages with newlines, as in NDJSON. This is
+	// the default.
+	FrameNewline Framing = iota
+	// FrameLength prefixes messages with their length, as a 4-byte
+	// big-endian integer.
+	FrameLength
+	// FrameHeader precedes messages with a block of headers holding their
+	// Content-Length, as in the Language Server Protocol:
+	//
+	//	Content-Length: 42\r\n
+	//	\r\n
+	//	{"jsonrpc":"2.0", ...}
+	FrameHeader
+)
+
+// DefaultMaxFrameSize is the default size limit of the messages read from a
+// raw connection.
+const DefaultMaxFrameSize = 1 << 20
+
+// ConnListener serves a Server over raw connections, e.g. plain TCP or Unix
+// sockets, without HTTP. Each message read from a connection is a request,
+// served as a POST body, and its response, if any, is written back with the
+// same framing. The requests of a connection are served in order.
+type ConnListener struct {
+	// Listener accepts the connections.
+	Listener net.Listener
+	// Framing delimits the messages.
+	Framing Framing
+	// ContentType selects the codec. Defaults to "application/json".
+	ContentType string
+	// MaxFrameSize bounds the size of a request; larger ones close the
+	// connection. Defaults to DefaultMaxFrameSize.
+	MaxFrameSize int
+
+	mutex  sync.Mutex
+	closed bool
+	conns  map[net.Conn]context.CancelFunc
+	active sync.WaitGroup
+}
+
+// ServeConn serves newline-delimited JSON requests read from conn until it
+// is closed by the client or fails. It closes conn.
+func (s *Server) ServeConn(conn net.Conn) error {
+	return new(ConnListener).serveConn(context.Background(), s, conn)
+}
+
+// Serve implements Listener.
+func (l *ConnListener) Serve(s *Server) error {
+	for {
+		conn, err := l.Listener.Accept()
+		if err != nil {
+			l.mutex.Lock()
+			closed := l.closed
+			l.mutex.Unlock()
+			if closed {
+				return nil
+			}
+			return err
+		}
+		l.mutex.Lock()
+		if l.closed {
+			l.mutex.Unlock()
+			conn.Close()
+			return nil
+		}
+		if l.conns == nil {
+			l.conns = make(map[net.Conn]context.CancelFunc)
+		}
+		ctx, cancel := context.WithCancel(context.Background())
+		l.conns[conn] = cancel
+		l.active.Add(1)
+		l.mutex.Unlock()
+		go func() {
+			defer l.active.Done()
+			defer cancel()
+			l.serveConn(ctx, s, conn)
+			l.mutex.Lock()
+			delete(l.conns, conn)
+			l.mutex.Unlock()
+		}()
+	}
+}
+
+// Shutdown implements Listener. It stops accepting connections and closes
+// each connection once its request in flight is answered, or cancels the
+// requests and closes the connections when ctx is done.
+func (l *ConnListener) Shutdown(ctx context.Context) error {
+	l.mutex.Lock()
+	l.closed = true
+	for conn := range l.conns {
+		// Wake up the connections waiting for a request.
+		conn.SetReadDeadline(time.Now())
+	}
+	l.mutex.Unlock()
+	err := l.Listener.Close()
+	idle := make(chan struct{})
+	go func() {
+		l.active.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		l.mutex.Lock()
+		for conn, cancel := range l.conns {
+			cancel()
+			conn.Close()
+		}
+		l.mutex.Unlock()
+		<-idle
+		err = ctx.Err()
+	}
+	return err
+}
+
+// serveConn serves the requests read from conn, with ctx as their context,
+// then closes it.
+func (l *ConnListener) serveConn(ctx context.Context, s *Server, conn net.Conn) error {
+	defer conn.Close()
+	return l.serveStream(ctx, s, conn, conn, "conn://"+conn.LocalAddr().String(), conn.RemoteAddr().String())
+}
+
+// serveStream serves the requests read from in, writing the responses to
+// out, with url and remoteAddr identifying the stream in the requests.
+func (l *ConnListener) serveStream(ctx context.Context, s *Server, in io.Reader, out io.Writer, url, remoteAddr string) error {
+	contentType := l.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	st := &stream{listener: l, out: out}
+	if strings.Contains(contentType, "json") {
+		// Pushes the JSON notifications, e.g. CatalogChangedMethod.
+		st.events = make(chan []byte, EventBufferSize)
+		pushed := make(chan struct{})
+		go func() {
+			defer close(pushed)
+			for data := range st.events {
+				st.write(data)
+			}
+		}()
+		s.streams.add(st)
+		defer func() {
+			s.streams.remove(st)
+			<-pushed
+		}()
+	}
+	rd := bufio.NewReader(in)
+	for {
+		msg, err := l.readFrame(rd)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(msg) == 0 {
+			continue
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		r, err := http.NewRequest("POST", url, bytes.NewReader(msg))
+		if err != nil {
+			return err
+		}
+		r.Header.Set("Content-Type", contentType)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r.WithContext(ctx))
+		if response := bytes.TrimRight(w.Body.Bytes(), "\n"); len(response) > 0 {
+			if err := st.write(response); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// stream is a connection served by serveStream.
+type stream struct {
+	listener *ConnListener
+	mutex    sync.Mutex // serializes the frames written to out
+	out      io.Writer
+	events   chan []byte // notifications to push, nil if not pushed
+}
+
+// write writes a message to the stream.
+func (st *stream) write(msg []byte) error {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.listener.writeFrame(st.out, msg)
+}
+
+// streamHub tracks the streams served, to push them notifications.
+type streamHub struct {
+	mutex   sync.Mutex
+	streams map[*stream]struct{}
+}
+
+func (h *streamHub) add(st *stream) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.streams == nil {
+		h.streams = make(map[*stream]struct{})
+	}
+	h.streams[st] = struct{}{}
+}
+
+// remove stops pushing notifications to the stream.
+func (h *streamHub) remove(st *stream) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.streams, st)
+	close(st.events)
+}
+
+// broadcast pushes a notification to every stream, dropping it for those
+// too slow to keep up, as EventBufferSize notifications are pending.
+func (h *streamHub) broadcast(data []byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for st := range h.streams {
+		select {
+		case st.events <- data:
+		default:
+		}
+	}
+}
+
+func (l *ConnListener) maxFrameSize() int {
+	if l.MaxFrameSize > 0 {
+		return l.MaxFrameSize
+	}
+	return DefaultMaxFrameSize
+}
+
+// readFrame reads a message.
+func (l *ConnListener) readFrame(rd *bufio.Reader) ([]byte, error) {
+	max := l.maxFrameSize()
+	switch l.Framing {
+	case FrameHeader:
+		return readHeaderFrame(rd, max)
+	case FrameLength:
+		var size uint32
+		if err := binary.Read(rd, binary.BigEndian, &size); err != nil {
+			return nil, err
+		}
+		if int64(size) > int64(max) {
+			return nil, fmt.Errorf("rpc: frame of %d bytes exceeds %d", size, max)
+		}
+		msg := make([]byte, size)
+		_, err := io.ReadFull(rd, msg)
+		return msg, err
+	}
+	var msg []byte
+	for {
+		line, isPrefix, err := rd.ReadLine()
+		if err != nil {
+			if err == io.EOF && len(msg) > 0 {
+				return msg, nil
+			}
+			return nil, err
+		}
+		msg = append(msg, line...)
+		if len(msg) > max {
+			return nil, fmt.Errorf("rpc: frame exceeds %d bytes", max)
+		}
+		if !isPrefix {
+			return bytes.TrimSpace(msg), nil
+		}
+	}
+}
+
+// writeFrame writes a message.
+func (l *ConnListener) writeFrame(w io.Writer, msg []byte) error {
+	var buf bytes.Buffer
+	switch l.Framing {
+	case FrameHeader:
+		fmt.Fprintf(&buf, "Content-Length: %d\r\n\r\n", len(msg))
+		buf.Write(msg)
+	case FrameLength:
+		binary.Write(&buf, binary.BigEndian, uint32(len(msg)))
+		buf.Write(msg)
+	default:
+		buf.Write(msg)
+		buf.WriteByte('\n')
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// maxHeaderSize bounds the size of the headers of a FrameHeader message.
+const maxHeaderSize = 4 << 10
+
+// readHeaderFrame reads a message preceded by its headers, as in
+// FrameHeader. Headers other than Content-Length are ignored.
+func readHeaderFrame(rd *bufio.Reader, max int) ([]byte, error) {
+	size := -1
+	total := 0
+	for n := 0; ; n++ {
+		var b []byte
+		for {
+			part, isPrefix, err := rd.ReadLine()
+			if err != nil {
+				if err == io.EOF && (n > 0 || len(b) > 0) {
+					err = io.ErrUnexpectedEOF
+				}
+				return nil, err
+			}
+			total += len(part) + 1
+			if total > maxHeaderSize {
+				return nil, fmt.Errorf("rpc: headers exceed %d bytes", maxHeaderSize)
+			}
+			b = append(b, part...)
+			if !isPrefix {
+				break
+			}
+		}
+		line := string(b)
+		if line == "" {
+			break
+		}
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			return nil, fmt.Errorf("rpc: malformed header %q", line)
+		}
+		if strings.EqualFold(strings.TrimSpace(name), "Content-Length") {
+			length, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil || length < 0 {
+				return nil, fmt.Errorf("rpc: invalid Content-Length %q", value)
+			}
+			size = length
+		}
+	}
+	if size < 0 {
+		return nil, fmt.Errorf("rpc: missing Content-Length header")
+	}
+	if size > max {
+		return nil, fmt.Errorf("rpc: frame of %d bytes exceeds %d", size, max)
+	}
+	msg := make([]byte, size)
+	if _, err := io.ReadFull(rd, msg); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return msg, nil
+}
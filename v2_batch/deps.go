@@ -0,0 +1,134 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// In-process calls
+// ----------------------------------------------------------------------------
+
+// callFrameKey is the context key of the method being called.
+type callFrameKey struct{}
+
+// CurrentMethod returns the method whose handler runs with ctx, in dotted
+// notation.
+func CurrentMethod(ctx context.Context) (string, bool) {
+	method, ok := ctx.Value(callFrameKey{}).(string)
+	return method, ok
+}
+
+// Call invokes a registered method in-process, without any codec. args must
+// be a non-nil pointer to the method's args type, or a value of it, and
+// reply a non-nil pointer to its reply type.
+//
+// When ctx comes from a handler (r.Context()), the call is recorded as a
+// dependency of the calling method in the server dependency graph.
+func (s *Server) Call(ctx context.Context, method string, args, reply interface{}) error {
+	method = s.services.canonical(method)
+	serviceSpec, methodSpec, err := s.services.get(method)
+	if err != nil {
+		return err
+	}
+	argsValue := reflect.ValueOf(args)
+	if !argsValue.IsValid() || argsValue.Kind() == reflect.Ptr && argsValue.IsNil() {
+		return fmt.Errorf("rpc: nil args for %q", method)
+	}
+	if argsValue.Type() == methodSpec.argsType {
+		ptr := reflect.New(methodSpec.argsType)
+		ptr.Elem().Set(argsValue)
+		argsValue = ptr
+	}
+	if argsValue.Type() != reflect.PtrTo(methodSpec.argsType) {
+		return fmt.Errorf("rpc: wrong args type %T for %q, need *%s", args, method, methodSpec.argsType)
+	}
+	replyValue := reflect.ValueOf(reply)
+	if !replyValue.IsValid() || replyValue.Kind() == reflect.Ptr && replyValue.IsNil() {
+		return fmt.Errorf("rpc: nil reply for %q", method)
+	}
+	if replyValue.Type() != reflect.PtrTo(methodSpec.replyType) {
+		return fmt.Errorf("rpc: wrong reply type %T for %q, need *%s", reply, method, methodSpec.replyType)
+	}
+	if caller, ok := CurrentMethod(ctx); ok {
+		s.deps.add(caller, method)
+	}
+	r, err := http.NewRequest("POST", "/", nil)
+	if err != nil {
+		return err
+	}
+	return s.call(r.WithContext(ctx), method, serviceSpec, methodSpec, argsValue, replyValue)
+}
+
+// ----------------------------------------------------------------------------
+// Dependency graph
+// ----------------------------------------------------------------------------
+
+// Dependency is an edge of the dependency graph: calls made in-process by
+// the Caller method to the Callee method.
+type Dependency struct {
+	Caller string `json:"caller"`
+	Callee string `json:"callee"`
+	Calls  int64  `json:"calls"`
+}
+
+// dependencyGraph aggregates the in-process calls between methods.
+type dependencyGraph struct {
+	mutex sync.Mutex
+	edges map[[2]string]int64
+}
+
+func (g *dependencyGraph) add(caller, callee string) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.edges == nil {
+		g.edges = make(map[[2]string]int64)
+	}
+	g.edges[[2]string{caller, callee}]++
+}
+
+// Dependencies returns the dependency graph between methods recorded from
+// in-process calls made with Server.Call, sorted by caller and callee.
+func (s *Server) Dependencies() []Dependency {
+	s.deps.mutex.Lock()
+	defer s.deps.mutex.Unlock()
+	deps := make([]Dependency, 0, len(s.deps.edges))
+	for edge, calls := range s.deps.edges {
+		deps = append(deps, Dependency{Caller: edge[0], Callee: edge[1], Calls: calls})
+	}
+	sort.Slice(deps, func(i, j int) bool {
+		if deps[i].Caller != deps[j].Caller {
+			return deps[i].Caller < deps[j].Caller
+		}
+		return deps[i].Callee < deps[j].Callee
+	})
+	return deps
+}
+
+// DependencyGraphHandler returns an admin handler serving the dependency
+// graph as JSON, or in Graphviz DOT format with the query "?format=dot".
+func (s *Server) DependencyGraphHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		deps := s.Dependencies()
+		if r.URL.Query().Get("format") == "dot" {
+			w.Header().Set("Content-Type", "text/vnd.graphviz; charset=utf-8")
+			fmt.Fprintln(w, "digraph rpc {")
+			for _, dep := range deps {
+				fmt.Fprintf(w, "\t%q -> %q [label=\"%d\"];\n", dep.Caller, dep.Callee, dep.Calls)
+			}
+			fmt.Fprintln(w, "}")
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(deps)
+	})
+}
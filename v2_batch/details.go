@@ -0,0 +1,242 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Error details
+// ----------------------------------------------------------------------------
+
+// detailTypePrefix is the type URL prefix of the well-known error details.
+const detailTypePrefix = "type.googleapis.com/google.rpc."
+
+// ErrorDetail is a typed error detail. Details are serialized as in
+// gRPC-gateway, as objects with their type URL in an "@type" member.
+type ErrorDetail interface {
+	TypeURL() string
+}
+
+// FieldViolation describes a single invalid request field.
+type FieldViolation struct {
+	Field       string `json:"field"`
+	Description string `json:"description"`
+}
+
+// BadRequest describes the invalid fields of a request.
+type BadRequest struct {
+	FieldViolations []FieldViolation `json:"fieldViolations"`
+}
+
+// TypeURL returns the type URL of google.rpc.BadRequest.
+func (*BadRequest) TypeURL() string { return detailTypePrefix + "BadRequest" }
+
+// Error lists the violations, so that a BadRequest can be returned by
+// Validator.Validate.
+func (b *BadRequest) Error() string {
+	var msgs []string
+	for _, v := range b.FieldViolations {
+		if v.Field == "" {
+			msgs = append(msgs, v.Description)
+			continue
+		}
+		msgs = append(msgs, v.Field+": "+v.Description)
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// RetryInfo tells the client when it may retry the request.
+type RetryInfo struct {
+	RetryDelay time.Duration
+}
+
+// TypeURL returns the type URL of google.rpc.RetryInfo.
+func (*RetryInfo) TypeURL() string { return detailTypePrefix + "RetryInfo" }
+
+// MarshalJSON encodes the delay in seconds, as in "1.5s".
+func (d *RetryInfo) MarshalJSON() ([]byte, error) {
+	delay := strconv.FormatFloat(d.RetryDelay.Seconds(), 'f', -1, 64) + "s"
+	return json.Marshal(struct {
+		RetryDelay string `json:"retryDelay"`
+	}{delay})
+}
+
+// UnmarshalJSON decodes a delay in seconds, as in "1.5s".
+func (d *RetryInfo) UnmarshalJSON(b []byte) error {
+	var v struct {
+		RetryDelay string `json:"retryDelay"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	secs, err := strconv.ParseFloat(strings.TrimSuffix(v.RetryDelay, "s"), 64)
+	if err != nil {
+		return fmt.Errorf("rpc: invalid retry delay %q", v.RetryDelay)
+	}
+	d.RetryDelay = time.Duration(secs * float64(time.Second))
+	return nil
+}
+
+// QuotaViolation describes a single exceeded quota.
+type QuotaViolation struct {
+	Subject     string `json:"subject"`
+	Description string `json:"description"`
+}
+
+// QuotaFailure describes the quotas exceeded by a request.
+type QuotaFailure struct {
+	Violations []QuotaViolation `json:"violations"`
+}
+
+// TypeURL returns the type URL of google.rpc.QuotaFailure.
+func (*QuotaFailure) TypeURL() string { return detailTypePrefix + "QuotaFailure" }
+
+// PreconditionViolation describes a single failed precondition.
+type PreconditionViolation struct {
+	Type        string `json:"type"`
+	Subject     string `json:"subject"`
+	Description string `json:"description"`
+}
+
+// PreconditionFailure describes the preconditions failed by a request.
+type PreconditionFailure struct {
+	Violations []PreconditionViolation `json:"violations"`
+}
+
+// TypeURL returns the type URL of google.rpc.PreconditionFailure.
+func (*PreconditionFailure) TypeURL() string { return detailTypePrefix + "PreconditionFailure" }
+
+// UnknownDetail is a detail of a type not known to this package, kept as
+// received.
+type UnknownDetail struct {
+	Type string
+	Raw  json.RawMessage
+}
+
+// TypeURL returns the type URL of the detail.
+func (d *UnknownDetail) TypeURL() string { return d.Type }
+
+// MarshalJSON returns the detail as received.
+func (d *UnknownDetail) MarshalJSON() ([]byte, error) {
+	return d.Raw, nil
+}
+
+// ErrorDetails is the error data carrying typed details, serialized as
+// {"details": [...]}.
+type ErrorDetails struct {
+	Details []ErrorDetail
+}
+
+// NewErrorWithDetails returns an Error whose data holds the given details.
+func NewErrorWithDetails(code int, message string, details ...ErrorDetail) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+		Data:    &ErrorDetails{Details: details},
+	}
+}
+
+// MarshalJSON encodes each detail with its "@type" member.
+func (d *ErrorDetails) MarshalJSON() ([]byte, error) {
+	details := make([]json.RawMessage, len(d.Details))
+	for i, detail := range d.Details {
+		if u, ok := detail.(*UnknownDetail); ok {
+			details[i] = u.Raw
+			continue
+		}
+		b, err := json.Marshal(detail)
+		if err != nil {
+			return nil, err
+		}
+		b = bytes.TrimSpace(b)
+		if len(b) < 2 || b[0] != '{' {
+			return nil, fmt.Errorf("rpc: error detail %s is not an object", detail.TypeURL())
+		}
+		typ, _ := json.Marshal(detail.TypeURL())
+		var buf bytes.Buffer
+		buf.WriteString(`{"@type":`)
+		buf.Write(typ)
+		if rest := bytes.TrimSpace(b[1:]); len(rest) > 0 && rest[0] != '}' {
+			buf.WriteByte(',')
+		}
+		buf.Write(b[1:])
+		details[i] = buf.Bytes()
+	}
+	return json.Marshal(struct {
+		Details []json.RawMessage `json:"details"`
+	}{details})
+}
+
+// UnmarshalJSON decodes the details, keeping those of unknown types as
+// UnknownDetail.
+func (d *ErrorDetails) UnmarshalJSON(b []byte) error {
+	var v struct {
+		Details []json.RawMessage `json:"details"`
+	}
+	if err := json.Unmarshal(b, &v); err != nil {
+		return err
+	}
+	d.Details = make([]ErrorDetail, 0, len(v.Details))
+	for _, raw := range v.Details {
+		var typ struct {
+			Type string `json:"@type"`
+		}
+		if err := json.Unmarshal(raw, &typ); err != nil {
+			return err
+		}
+		var detail ErrorDetail
+		switch typ.Type {
+		case detailTypePrefix + "BadRequest":
+			detail = new(BadRequest)
+		case detailTypePrefix + "RetryInfo":
+			detail = new(RetryInfo)
+		case detailTypePrefix + "QuotaFailure":
+			detail = new(QuotaFailure)
+		case detailTypePrefix + "PreconditionFailure":
+			detail = new(PreconditionFailure)
+		default:
+			d.Details = append(d.Details, &UnknownDetail{Type: typ.Type, Raw: raw})
+			continue
+		}
+		if err := json.Unmarshal(raw, detail); err != nil {
+			return err
+		}
+		d.Details = append(d.Details, detail)
+	}
+	return nil
+}
+
+// ParseErrorDetails decodes the details from the data of an error, as
+// received by a client. data may be the raw JSON data or its decoded value.
+func ParseErrorDetails(data interface{}) ([]ErrorDetail, error) {
+	var b []byte
+	switch v := data.(type) {
+	case nil:
+		return nil, nil
+	case *ErrorDetails:
+		return v.Details, nil
+	case json.RawMessage:
+		b = v
+	case []byte:
+		b = v
+	default:
+		var err error
+		if b, err = json.Marshal(v); err != nil {
+			return nil, err
+		}
+	}
+	var details ErrorDetails
+	if err := json.Unmarshal(b, &details); err != nil {
+		return nil, err
+	}
+	return details.Details, nil
+}
@@ -0,0 +1,237 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"compress/flate"
+	"container/heap"
+	"crypto/sha256"
+	"encoding/base64"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Shared-dictionary compression
+// ----------------------------------------------------------------------------
+
+const (
+	// DictionaryEncoding is the content coding of replies compressed with
+	// a shared dictionary: deflate with the dictionary preset, as read by
+	// NewDictionaryReader.
+	DictionaryEncoding = "deflate-dict"
+	// DictionaryHeader is the request header naming the dictionary held by
+	// the client, by its ID.
+	DictionaryHeader = "Available-Dictionary"
+	// MaxDictionarySize is the size of the deflate window: dictionary bytes
+	// beyond it are never referenced.
+	MaxDictionarySize = 32 << 10
+)
+
+// Dictionary is a compression dictionary shared by the server and its
+// clients, e.g. trained offline with TrainDictionary from sample replies
+// and shipped with the clients. It is identified by the SHA-256 of its
+// content.
+type Dictionary struct {
+	data []byte
+	id   string
+}
+
+// NewDictionary returns the dictionary of data. Only its last
+// MaxDictionarySize bytes are used.
+func NewDictionary(data []byte) *Dictionary {
+	if len(data) > MaxDictionarySize {
+		data = data[len(data)-MaxDictionarySize:]
+	}
+	sum := sha256.Sum256(data)
+	return &Dictionary{data: data, id: ":" + base64.StdEncoding.EncodeToString(sum[:]) + ":"}
+}
+
+// ID returns the identifier of the dictionary, sent by clients in the
+// DictionaryHeader: its base64 SHA-256 between colons, as in the Compression
+// Dictionary Transport of HTTP.
+func (d *Dictionary) ID() string {
+	return d.id
+}
+
+// Bytes returns the content of the dictionary.
+func (d *Dictionary) Bytes() []byte {
+	return d.data
+}
+
+// ServeHTTP serves the content of the dictionary, for clients to download
+// it once.
+func (d *Dictionary) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+	w.Header().Set("ETag", `"`+strings.Trim(d.id, ":")+`"`)
+	w.Write(d.data)
+}
+
+// NewDictionaryReader returns a reader decompressing a reply encoded with
+// DictionaryEncoding and d.
+func NewDictionaryReader(r io.Reader, d *Dictionary) io.ReadCloser {
+	return flate.NewReaderDict(r, d.data)
+}
+
+// DictionarySelector is an EncoderSelector compressing replies with a shared
+// dictionary when the client accepts DictionaryEncoding and names one of
+// Dictionaries in the DictionaryHeader, and deferring to Fallback
+// otherwise. Replies that repeat the same member names and values compress
+// much better than with generic compression.
+type DictionarySelector struct {
+	Dictionaries []*Dictionary
+	// Fallback selects the encoder of the other requests. Defaults to a
+	// CompressionSelector.
+	Fallback EncoderSelector
+}
+
+// Select implements EncoderSelector.
+func (s *DictionarySelector) Select(r *http.Request) Encoder {
+	if id := r.Header.Get(DictionaryHeader); id != "" && acceptsEncoding(r, DictionaryEncoding) {
+		for _, d := range s.Dictionaries {
+			if d.id == id {
+				return &dictionaryEncoder{d}
+			}
+		}
+	}
+	if s.Fallback != nil {
+		return s.Fallback.Select(r)
+	}
+	return new(CompressionSelector).Select(r)
+}
+
+// acceptsEncoding returns true if the "Accept-Encoding" header of r lists
+// encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, enc := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		if name, _, _ := strings.Cut(enc, ";"); strings.TrimSpace(name) == encoding {
+			return true
+		}
+	}
+	return false
+}
+
+// dictionaryEncoder implements the shared-dictionary http encoder.
+type dictionaryEncoder struct {
+	d *Dictionary
+}
+
+func (enc *dictionaryEncoder) Encode(w http.ResponseWriter) io.Writer {
+	fw, err := flate.NewWriterDict(w, flate.DefaultCompression, enc.d.data)
+	if err != nil {
+		return w
+	}
+	w.Header().Set("Content-Encoding", DictionaryEncoding)
+	w.Header().Add("Vary", DictionaryHeader)
+	return &flateWriter{fw}
+}
+
+// ----------------------------------------------------------------------------
+// Dictionary training
+// ----------------------------------------------------------------------------
+
+// dictionaryKmer is the length of the substrings counted by TrainDictionary.
+const dictionaryKmer = 8
+
+// dictionarySegment is the length of the segments TrainDictionary picks.
+const dictionarySegment = 64
+
+// TrainDictionary builds a dictionary of up to size bytes, at most
+// MaxDictionarySize, from samples of typical replies. It picks the segments
+// of the samples whose substrings occur in the most samples, avoiding
+// repetition, and puts the most valuable last, where deflate references
+// them most cheaply. Samples should be numerous and representative: a few
+// hundred replies of each method is a good start.
+func TrainDictionary(samples [][]byte, size int) []byte {
+	if size > MaxDictionarySize || size <= 0 {
+		size = MaxDictionarySize
+	}
+	// Count the samples holding each k-mer.
+	freq := make(map[string]int)
+	for _, sample := range samples {
+		seen := make(map[string]bool)
+		for i := 0; i+dictionaryKmer <= len(sample); i++ {
+			kmer := string(sample[i : i+dictionaryKmer])
+			if !seen[kmer] {
+				seen[kmer] = true
+				freq[kmer]++
+			}
+		}
+	}
+	score := func(segment []byte) int {
+		total := 0
+		for i := 0; i+dictionaryKmer <= len(segment); i++ {
+			if n := freq[string(segment[i:i+dictionaryKmer])]; n > 1 {
+				total += n
+			}
+		}
+		return total
+	}
+	candidates := &segmentHeap{}
+	for _, sample := range samples {
+		for i := 0; i < len(sample); i += dictionarySegment / 2 {
+			end := i + dictionarySegment
+			if end > len(sample) {
+				end = len(sample)
+			}
+			if s := score(sample[i:end]); s > 0 {
+				*candidates = append(*candidates, scoredSegment{sample[i:end], s})
+			}
+			if end == len(sample) {
+				break
+			}
+		}
+	}
+	heap.Init(candidates)
+	// Pick the best segments, rescoring them lazily as the k-mers of the
+	// picked ones stop counting.
+	var picked [][]byte
+	total := 0
+	for candidates.Len() > 0 && total < size {
+		best := heap.Pop(candidates).(scoredSegment)
+		if s := score(best.data); s < best.score {
+			if s > 0 {
+				heap.Push(candidates, scoredSegment{best.data, s})
+			}
+			continue
+		}
+		segment := best.data
+		if total+len(segment) > size {
+			segment = segment[:size-total]
+		}
+		picked = append(picked, segment)
+		total += len(segment)
+		for i := 0; i+dictionaryKmer <= len(segment); i++ {
+			delete(freq, string(segment[i:i+dictionaryKmer]))
+		}
+	}
+	dict := make([]byte, 0, total)
+	for i := len(picked) - 1; i >= 0; i-- {
+		dict = append(dict, picked[i]...)
+	}
+	return dict
+}
+
+// scoredSegment is a candidate segment of TrainDictionary.
+type scoredSegment struct {
+	data  []byte
+	score int
+}
+
+// segmentHeap is a max-heap of segments by score.
+type segmentHeap []scoredSegment
+
+func (h segmentHeap) Len() int            { return len(h) }
+func (h segmentHeap) Less(i, j int) bool  { return h[i].score > h[j].score }
+func (h segmentHeap) Swap(i, j int)       { h[i], h[j] = h[j], h[i] }
+func (h *segmentHeap) Push(x interface{}) { *h = append(*h, x.(scoredSegment)) }
+func (h *segmentHeap) Pop() interface{} {
+	old := *h
+	x := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return x
+}
@@ -0,0 +1,100 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Body readers and digests
+// ----------------------------------------------------------------------------
+
+// BodyReader returns the body of a request, read from r.Body, e.g. verified
+// against a checksum or decrypted. An error rejects the request with a 400
+// status.
+type BodyReader func(r *http.Request) ([]byte, error)
+
+// SetBodyReader sets the reader of the request bodies, run before the
+// request rewriters and the codec, so that the body is checked as received.
+func (s *Server) SetBodyReader(br BodyReader) {
+	s.bodyReader = br
+}
+
+// digestAlgorithms are the algorithms of the Digest header, as registered
+// by RFC 3230 and RFC 5843, by lowercase name.
+var digestAlgorithms = map[string]func() hash.Hash{
+	"md5":     md5.New,
+	"sha":     sha1.New,
+	"sha-256": sha256.New,
+	"sha-512": sha512.New,
+}
+
+// VerifyDigest is a BodyReader rejecting the bodies not matching their
+// Content-MD5 header or the digests of their Digest header, as in
+// "sha-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=". The algorithms
+// of the Digest header other than md5, sha, sha-256 and sha-512 are
+// ignored, and bodies without these headers are accepted.
+func VerifyDigest(r *http.Request) ([]byte, error) {
+	body, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	if value := r.Header.Get("Content-MD5"); value != "" {
+		if err := checkDigest(md5.New, value, body); err != nil {
+			return nil, fmt.Errorf("Content-MD5 %v", err)
+		}
+	}
+	for _, header := range r.Header.Values("Digest") {
+		for _, digest := range strings.Split(header, ",") {
+			algorithm, value, _ := strings.Cut(strings.TrimSpace(digest), "=")
+			newHash := digestAlgorithms[strings.ToLower(algorithm)]
+			if newHash == nil {
+				continue
+			}
+			if err := checkDigest(newHash, value, body); err != nil {
+				return nil, fmt.Errorf("Digest %s %v", algorithm, err)
+			}
+		}
+	}
+	return body, nil
+}
+
+// checkDigest checks body against value, its base64 digest.
+func checkDigest(newHash func() hash.Hash, value string, body []byte) error {
+	expected, err := base64.StdEncoding.DecodeString(value)
+	if err != nil {
+		return fmt.Errorf("malformed: %v", err)
+	}
+	h := newHash()
+	h.Write(body)
+	if !bytes.Equal(h.Sum(nil), expected) {
+		return fmt.Errorf("mismatch")
+	}
+	return nil
+}
+
+// SetResponseDigest enables setting the Digest header of the responses to
+// the SHA-256 digest of their body, for clients to verify. Streamed and
+// flushed responses, whose body isn't known before it is sent, have none.
+func (s *Server) SetResponseDigest(enabled bool) {
+	s.responseDigest = enabled
+}
+
+// bodyDigest returns the value of the Digest header of body.
+func bodyDigest(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha-256=" + base64.StdEncoding.EncodeToString(sum[:])
+}
@@ -74,6 +74,15 @@ and make available the ones that follow these rules:
 
 All other methods are ignored.
 
+Methods can also take the context of the request, before or instead of the
+request itself:
+
+	func (h *HelloService) Say(ctx context.Context, args *HelloArgs, reply *HelloReply) error
+
+and return their reply instead of filling it:
+
+	func (h *HelloService) Say(ctx context.Context, args *HelloArgs) (*HelloReply, error)
+
 Gorilla has packages with common RPC codecs. Check out their documentation:
 
 	JSON: http://gorilla-web.appspot.com/pkg/rpc/json
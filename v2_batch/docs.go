@@ -0,0 +1,128 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"reflect"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Method documentation
+// ----------------------------------------------------------------------------
+
+// MethodDoc holds the documentation metadata of a method.
+type MethodDoc struct {
+	// Description is a free-form description of the method.
+	Description string
+	// Examples are sample calls of the method.
+	Examples []MethodExample
+	// Tags group related methods, e.g. "accounts" or "deprecated".
+	Tags []string
+}
+
+// MethodExample is a sample call of a method: the params sent and the result
+// expected back.
+type MethodExample struct {
+	Name   string
+	Params interface{}
+	Result interface{}
+}
+
+// MethodDocumenter can be implemented by a service receiver to document its
+// methods at registration. The map is keyed by method name, without the
+// service prefix.
+type MethodDocumenter interface {
+	MethodDocs() map[string]MethodDoc
+}
+
+// SchemaProvider is implemented by args types describing their params with
+// a JSON Schema, e.g. JSONPatch and MergePatch. The schema is exported in
+// the method documentation.
+type SchemaProvider interface {
+	JSONSchema() json.RawMessage
+}
+
+// ParamsSchema returns the JSON Schema of the params of a registered method,
+// if its args type implements SchemaProvider.
+func (s *Server) ParamsSchema(method string) (json.RawMessage, bool) {
+	_, methodSpec, err := s.services.get(method)
+	if err != nil {
+		return nil, false
+	}
+	provider, ok := reflect.New(methodSpec.argsType).Interface().(SchemaProvider)
+	if !ok {
+		return nil, false
+	}
+	return provider.JSONSchema(), true
+}
+
+// DescribeMethod sets the documentation of a registered method, replacing
+// anything set before.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) DescribeMethod(method string, doc MethodDoc) error {
+	return s.services.describe(method, doc)
+}
+
+// MethodDoc returns the documentation of a registered method.
+func (s *Server) MethodDoc(method string) (MethodDoc, bool) {
+	return s.services.doc(method)
+}
+
+// Methods returns the sorted names of all registered methods, in dotted
+// notation.
+func (s *Server) Methods() []string {
+	return s.services.names()
+}
+
+// WriteMarkdown writes the documentation of all registered methods as a
+// Markdown document.
+func (s *Server) WriteMarkdown(w io.Writer) error {
+	bw := bufio.NewWriter(w)
+	fmt.Fprintln(bw, "# Methods")
+	for _, method := range s.Methods() {
+		doc, _ := s.MethodDoc(method)
+		fmt.Fprintf(bw, "\n## %s\n", method)
+		if len(doc.Tags) > 0 {
+			fmt.Fprintf(bw, "\nTags: %s\n", strings.Join(doc.Tags, ", "))
+		}
+		if doc.Description != "" {
+			fmt.Fprintf(bw, "\n%s\n", doc.Description)
+		}
+		if schema, ok := s.ParamsSchema(method); ok {
+			if err := writeMarkdownJSON(bw, "Params schema", schema); err != nil {
+				return err
+			}
+		}
+		for _, example := range doc.Examples {
+			title := example.Name
+			if title == "" {
+				title = "Example"
+			}
+			fmt.Fprintf(bw, "\n### %s\n", title)
+			if err := writeMarkdownJSON(bw, "Params", example.Params); err != nil {
+				return err
+			}
+			if err := writeMarkdownJSON(bw, "Result", example.Result); err != nil {
+				return err
+			}
+		}
+	}
+	return bw.Flush()
+}
+
+func writeMarkdownJSON(w io.Writer, label string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return fmt.Errorf("rpc: can't encode example %s: %v", strings.ToLower(label), err)
+	}
+	_, err = fmt.Fprintf(w, "\n%s:\n\n```json\n%s\n```\n", label, b)
+	return err
+}
@@ -0,0 +1,71 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+// Error codes of the errors generated by the server. Those specific to this
+// package are in the range reserved for implementation-defined server errors.
+const (
+	// CodeInvalidRequest is replied for requests rejected as a whole.
+	CodeInvalidRequest = -32600
+	// CodeMethodNotFound is replied for unknown methods.
+	CodeMethodNotFound = -32601
+	// CodeInvalidParams is replied for params rejected by the server.
+	CodeInvalidParams = -32602
+	// CodeInternalError is replied for replies failing strict checks.
+	CodeInternalError = -32603
+	// CodeMethodRetired is replied for methods retired with RetireMethod
+	// during their grace period.
+	CodeMethodRetired = -32001
+	// CodeUnavailable is replied in maintenance mode and while draining.
+	CodeUnavailable = -32002
+	// CodeRateLimited is replied for calls over a rate limit.
+	CodeRateLimited = -32003
+	// CodeUnauthorized is replied for unauthorized calls, see EnableAdmin
+	// and Config.AuthKeys.
+	CodeUnauthorized = -32004
+	// CodePreconditionFailed is replied by handlers for calls whose
+	// expected entity version doesn't match, as with CheckVersion.
+	CodePreconditionFailed = -32005
+	// CodeDeadlineExceeded is replied for calls abandoned past their
+	// deadline, see SetHardTimeout.
+	CodeDeadlineExceeded = -32006
+	// CodeResourceExhausted is replied for calls exceeding the resource
+	// policy of their method, see SetResourcePolicy.
+	CodeResourceExhausted = -32007
+	// CodeServiceUnhealthy is replied for calls to services found
+	// unhealthy, see SetHealthGate.
+	CodeServiceUnhealthy = -32008
+	// CodeReadOnlyReplica is replied by read-only replicas for calls to
+	// methods mutating state, see SetReplicaOf.
+	CodeReadOnlyReplica = -32009
+	// CodePartialFailure is replied for operations failing partway whose
+	// done steps couldn't all be undone, see Saga.
+	CodePartialFailure = -32010
+)
+
+// Error is a codec-independent error carrying a protocol error code. Codecs
+// reply it with its code, message and data.
+//
+// Services can return it, as can the server for the errors it generates
+// itself.
+type Error struct {
+	Code    int
+	Message string
+	Data    interface{}
+}
+
+func (e *Error) Error() string {
+	return e.Message
+}
+
+// ErrorCode returns the error code.
+func (e *Error) ErrorCode() int {
+	return e.Code
+}
+
+// ErrorData returns the additional information about the error.
+func (e *Error) ErrorData() interface{} {
+	return e.Data
+}
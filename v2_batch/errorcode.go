@@ -0,0 +1,187 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// Error code registry
+// ----------------------------------------------------------------------------
+
+// ErrorCodeRange is a range of error codes reserved to a namespace.
+type ErrorCodeRange struct {
+	Namespace   string `json:"namespace"`
+	Min         int    `json:"min"`
+	Max         int    `json:"max"`
+	Description string `json:"description,omitempty"`
+}
+
+// ErrorCodeInfo describes a registered error code.
+type ErrorCodeInfo struct {
+	Code        int    `json:"code"`
+	Namespace   string `json:"namespace"`
+	Name        string `json:"name"`
+	Description string `json:"description,omitempty"`
+}
+
+// errorCodes is the registry of error codes.
+var errorCodes struct {
+	mutex  sync.RWMutex
+	ranges []ErrorCodeRange
+	codes  map[int]ErrorCodeInfo
+}
+
+// rpcNamespace is the namespace of the codes of the protocol and this
+// package.
+const rpcNamespace = "rpc"
+
+func init() {
+	ReserveErrorCodes(rpcNamespace, -32768, -32000, "JSON-RPC reserved codes")
+	for _, c := range []ErrorCodeInfo{
+		{Code: -32700, Name: "ParseError", Description: "the message isn't valid"},
+		{Code: CodeInvalidRequest, Name: "InvalidRequest", Description: "the request is rejected as a whole"},
+		{Code: CodeMethodNotFound, Name: "MethodNotFound", Description: "the method doesn't exist"},
+		{Code: CodeInvalidParams, Name: "InvalidParams", Description: "the params are rejected"},
+		{Code: CodeInternalError, Name: "InternalError", Description: "the server failed"},
+		{Code: -32000, Name: "ServerError", Description: "the method failed with an uncoded error"},
+		{Code: CodeMethodRetired, Name: "MethodRetired", Description: "the method is retired"},
+		{Code: CodeUnavailable, Name: "Unavailable", Description: "the server is in maintenance or draining"},
+		{Code: CodeRateLimited, Name: "RateLimited", Description: "the call is over a rate limit"},
+		{Code: CodeUnauthorized, Name: "Unauthorized", Description: "the call is unauthorized"},
+		{Code: CodePreconditionFailed, Name: "PreconditionFailed", Description: "the entity version doesn't match"},
+		{Code: CodeDeadlineExceeded, Name: "DeadlineExceeded", Description: "the handler was abandoned past its deadline"},
+		{Code: CodeResourceExhausted, Name: "ResourceExhausted", Description: "the call exceeds the resource policy of its method"},
+		{Code: CodeServiceUnhealthy, Name: "ServiceUnhealthy", Description: "the service is unhealthy"},
+		{Code: CodeReadOnlyReplica, Name: "ReadOnlyReplica", Description: "the method is served by the primary"},
+		{Code: CodePartialFailure, Name: "PartialFailure", Description: "the operation failed partway and couldn't be undone"},
+	} {
+		RegisterErrorCode(rpcNamespace, c.Code, c.Name, c.Description)
+	}
+}
+
+// ReserveErrorCodes reserves the codes from min to max to namespace, for a
+// team or service declaring its codes with RegisterErrorCode. It is meant
+// to be called at init and, like expvar.Publish, panics if the range
+// overlaps one of another namespace.
+func ReserveErrorCodes(namespace string, min, max int, description string) {
+	if min > max {
+		panic(fmt.Sprintf("rpc: invalid error code range %d..%d", min, max))
+	}
+	errorCodes.mutex.Lock()
+	defer errorCodes.mutex.Unlock()
+	for _, r := range errorCodes.ranges {
+		if r.Namespace != namespace && min <= r.Max && r.Min <= max {
+			panic(fmt.Sprintf("rpc: error codes %d..%d of %q overlap %d..%d of %q", min, max, namespace, r.Min, r.Max, r.Namespace))
+		}
+	}
+	errorCodes.ranges = append(errorCodes.ranges, ErrorCodeRange{Namespace: namespace, Min: min, Max: max, Description: description})
+	sort.Slice(errorCodes.ranges, func(i, j int) bool {
+		return errorCodes.ranges[i].Min < errorCodes.ranges[j].Min
+	})
+}
+
+// RegisterErrorCode declares an application error code of namespace and
+// returns it, for use in a variable:
+//
+//	var CodeNoFunds = rpc.RegisterErrorCode("billing", 4001, "NoFunds", "the balance is too low")
+//
+// It is meant to be called at init and panics if the code is registered
+// already, if it is in a range of another namespace, or if namespace has
+// ranges and the code isn't in one of them.
+func RegisterErrorCode(namespace string, code int, name, description string) int {
+	errorCodes.mutex.Lock()
+	defer errorCodes.mutex.Unlock()
+	if c, ok := errorCodes.codes[code]; ok {
+		panic(fmt.Sprintf("rpc: error code %d of %q registered already as %s of %q", code, namespace, c.Name, c.Namespace))
+	}
+	owned, inOwn := false, false
+	for _, r := range errorCodes.ranges {
+		in := r.Min <= code && code <= r.Max
+		if r.Namespace == namespace {
+			owned = true
+			inOwn = inOwn || in
+		} else if in {
+			panic(fmt.Sprintf("rpc: error code %d of %q is in the range of %q", code, namespace, r.Namespace))
+		}
+	}
+	if owned && !inOwn {
+		panic(fmt.Sprintf("rpc: error code %d is outside the ranges of %q", code, namespace))
+	}
+	if errorCodes.codes == nil {
+		errorCodes.codes = make(map[int]ErrorCodeInfo)
+	}
+	errorCodes.codes[code] = ErrorCodeInfo{Code: code, Namespace: namespace, Name: name, Description: description}
+	return code
+}
+
+// LookupErrorCode returns the registration of code.
+func LookupErrorCode(code int) (ErrorCodeInfo, bool) {
+	errorCodes.mutex.RLock()
+	defer errorCodes.mutex.RUnlock()
+	c, ok := errorCodes.codes[code]
+	return c, ok
+}
+
+// ErrorCodes returns the registered error codes, in ascending order.
+func ErrorCodes() []ErrorCodeInfo {
+	errorCodes.mutex.RLock()
+	defer errorCodes.mutex.RUnlock()
+	codes := make([]ErrorCodeInfo, 0, len(errorCodes.codes))
+	for _, c := range errorCodes.codes {
+		codes = append(codes, c)
+	}
+	sort.Slice(codes, func(i, j int) bool { return codes[i].Code < codes[j].Code })
+	return codes
+}
+
+// ErrorCodeRanges returns the reserved ranges of error codes, in ascending
+// order.
+func ErrorCodeRanges() []ErrorCodeRange {
+	errorCodes.mutex.RLock()
+	defer errorCodes.mutex.RUnlock()
+	return append([]ErrorCodeRange(nil), errorCodes.ranges...)
+}
+
+// ErrorCodesHandler returns a handler serving the registry as JSON, with
+// the "ranges" and "codes" members.
+func ErrorCodesHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"ranges": ErrorCodeRanges(),
+			"codes":  ErrorCodes(),
+		})
+	})
+}
+
+// SetStrictErrorCodes enables checking the codes of the errors returned by
+// handlers, for development: an error whose code isn't registered with
+// RegisterErrorCode is replaced by a CodeInternalError error naming the
+// code. Errors without a code are left as they are.
+func (s *Server) SetStrictErrorCodes(strict bool) {
+	s.strictErrorCodes = strict
+}
+
+// checkErrorCode returns err, or the error replacing it if its code isn't
+// registered.
+func checkErrorCode(err error) error {
+	code, ok := ErrorCode(err)
+	if !ok {
+		return err
+	}
+	if _, ok := LookupErrorCode(code); ok {
+		return err
+	}
+	return &Error{
+		Code:    CodeInternalError,
+		Message: fmt.Sprintf("rpc: unregistered error code %d: %v", code, err),
+	}
+}
@@ -0,0 +1,152 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// Server-Sent Events
+// ----------------------------------------------------------------------------
+
+// EventBufferSize is the number of notifications buffered for each client of
+// the EventsHandler. Notifications to a client whose buffer is full are
+// dropped, so that Notify never blocks.
+var EventBufferSize = 64
+
+// eventHub dispatches notifications to the clients of the EventsHandler.
+type eventHub struct {
+	mutex       sync.Mutex
+	seq         uint64
+	subscribers map[*subscriber]bool
+}
+
+// subscriber is a client of the EventsHandler.
+type subscriber struct {
+	topics []string // empty for all topics
+	events chan []byte
+}
+
+// notification is a JSON-RPC notification pushed to the subscribers.
+type notification struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+}
+
+// EventsHandler returns a handler streaming the notifications pushed with
+// Notify to its clients, as Server-Sent Events whose event type is the
+// topic. Clients choose their topics with "topic" query parameters, either
+// exact or ending with "*" to match a prefix, as in:
+//
+//	GET /events?topic=jobs.*&topic=alerts
+//
+// Clients without topics receive every notification.
+func (s *Server) EventsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			WriteError(w, 500, "rpc: streaming unsupported")
+			return
+		}
+		sub := &subscriber{
+			topics: r.URL.Query()["topic"],
+			events: make(chan []byte, EventBufferSize),
+		}
+		s.events.subscribe(sub)
+		defer s.events.unsubscribe(sub)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(200)
+		flusher.Flush()
+		for {
+			select {
+			case event := <-sub.events:
+				if _, err := w.Write(event); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
+
+// Notify pushes a JSON-RPC notification calling method with params to the
+// clients of the EventsHandler subscribed to topic, e.g. to report the
+// progress of a long-running method.
+func (s *Server) Notify(topic, method string, params interface{}) error {
+	data, err := json.Marshal(&notification{Version: "2.0", Method: method, Params: params})
+	if err != nil {
+		return fmt.Errorf("rpc: can't encode notification: %v", err)
+	}
+	s.events.publish(topic, data)
+	return nil
+}
+
+func (h *eventHub) subscribe(sub *subscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.subscribers == nil {
+		h.subscribers = make(map[*subscriber]bool)
+	}
+	h.subscribers[sub] = true
+}
+
+func (h *eventHub) unsubscribe(sub *subscriber) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.subscribers, sub)
+}
+
+// publish sends an event to the subscribers of topic.
+func (h *eventHub) publish(topic string, data []byte) {
+	h.send(topic, data, false)
+}
+
+// broadcast sends an event to all the subscribers, whatever their topics.
+func (h *eventHub) broadcast(topic string, data []byte) {
+	h.send(topic, data, true)
+}
+
+func (h *eventHub) send(topic string, data []byte, all bool) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.seq++
+	event := []byte(fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", h.seq, topic, data))
+	for sub := range h.subscribers {
+		if !all && !sub.matches(topic) {
+			continue
+		}
+		select {
+		case sub.events <- event:
+		default:
+		}
+	}
+}
+
+// matches returns true if the subscriber receives the events of topic.
+func (sub *subscriber) matches(topic string) bool {
+	if len(sub.topics) == 0 {
+		return true
+	}
+	for _, filter := range sub.topics {
+		if prefix := strings.TrimSuffix(filter, "*"); prefix != filter {
+			if strings.HasPrefix(topic, prefix) {
+				return true
+			}
+		} else if filter == topic {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+)
+
+// ----------------------------------------------------------------------------
+// Envelope extensions
+// ----------------------------------------------------------------------------
+
+// ExtensionReader is implemented by codec requests exposing the members of
+// the request envelope unknown to the protocol, e.g. "traceparent" or vendor
+// extensions.
+type ExtensionReader interface {
+	Extensions() map[string]json.RawMessage
+}
+
+// ExtensionReplier is implemented by codec requests able to add members to
+// the reply envelope. Members of the protocol can't be replaced.
+type ExtensionReplier interface {
+	// WithExtensions returns reply, as returned by ResponseReply or
+	// ErrorReply, carrying the extension members.
+	WithExtensions(reply interface{}, extensions map[string]interface{}) interface{}
+}
+
+// extensionsKey is the context key of the request envelope extensions.
+type extensionsKey struct{}
+
+// RequestExtensions returns the members of the request envelope unknown to
+// the protocol, with ctx the context of the request passed to a handler, or
+// nil if there are none or the codec doesn't expose them (see
+// ExtensionReader).
+func RequestExtensions(ctx context.Context) map[string]json.RawMessage {
+	extensions, _ := ctx.Value(extensionsKey{}).(map[string]json.RawMessage)
+	return extensions
+}
+
+// SetResponseExtension adds a member to the reply envelope from a handler,
+// with ctx the context of the request passed to it, if the codec supports it
+// (see ExtensionReplier). Clients ignoring unknown members are unaffected.
+//
+// It does nothing if ctx doesn't come from a handler served over HTTP.
+func SetResponseExtension(ctx context.Context, name string, value interface{}) {
+	h, ok := ctx.Value(directivesKey{}).(*replyDirectives)
+	if !ok {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.extensions == nil {
+		h.extensions = make(map[string]interface{})
+	}
+	h.extensions[name] = value
+}
+
+// withExtensions returns r carrying the request envelope extensions exposed
+// by codecReq, along with them.
+func withExtensions(r *http.Request, codecReq CodecRequest) (*http.Request, map[string]json.RawMessage) {
+	e, ok := codecReq.(ExtensionReader)
+	if !ok {
+		return r, nil
+	}
+	extensions := e.Extensions()
+	if len(extensions) == 0 {
+		return r, nil
+	}
+	return r.WithContext(context.WithValue(r.Context(), extensionsKey{}, extensions)), extensions
+}
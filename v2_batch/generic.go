@@ -0,0 +1,83 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+)
+
+// ----------------------------------------------------------------------------
+// Generic registration
+// ----------------------------------------------------------------------------
+
+// Register adds fn as a method, in dotted notation as in "Service.Method",
+// like Server.RegisterFunc but with the args and reply types checked at
+// compile time:
+//
+//	rpc.Register(s, "Math.Double", func(ctx context.Context, args *int) (*int, error) {
+//		n := *args * 2
+//		return &n, nil
+//	})
+//
+// The function is called directly rather than through reflection.
+func Register[Args, Reply interface{}](s *Server, method string, fn func(context.Context, *Args) (*Reply, error)) error {
+	spec := &serviceMethod{
+		argsType:  reflect.TypeOf((*Args)(nil)).Elem(),
+		replyType: reflect.TypeOf((*Reply)(nil)).Elem(),
+		ctx:       true,
+		returns:   true,
+		call: func(ctx context.Context, args, reply interface{}) error {
+			r, err := fn(ctx, args.(*Args))
+			if r != nil {
+				*reply.(*Reply) = *r
+			}
+			return err
+		},
+	}
+	if err := s.services.add(method, spec); err != nil {
+		return err
+	}
+	s.catalogChanged(false)
+	return nil
+}
+
+// RegisterInterface adds impl as a service exposing only the methods of the
+// interface T, rather than all the exported methods of impl, so that helper
+// methods aren't exposed by accident:
+//
+//	type Arith interface {
+//		Multiply(ctx context.Context, args *Args) (*Reply, error)
+//	}
+//
+//	rpc.RegisterInterface[Arith](s, arith, "")
+//
+// Each method of T must follow the rules of RegisterService. The name is
+// inferred from the name of T if empty.
+func RegisterInterface[T interface{}](s *Server, impl T, name string) error {
+	iface := reflect.TypeOf((*T)(nil)).Elem()
+	if iface.Kind() != reflect.Interface {
+		return fmt.Errorf("rpc: %s is not an interface type", iface)
+	}
+	if interface{}(impl) == nil {
+		return fmt.Errorf("rpc: nil implementation of %s", iface)
+	}
+	if name == "" {
+		name = iface.Name()
+	}
+	if name == "" {
+		return fmt.Errorf("rpc: no service name for interface type %s", iface)
+	}
+	methods := make([]string, iface.NumMethod())
+	for i := range methods {
+		methods[i] = iface.Method(i).Name
+	}
+	if err := s.services.register(impl, name, serviceOptions{include: methods}); err != nil {
+		return err
+	}
+	s.catalogChanged(false)
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Background work
+// ----------------------------------------------------------------------------
+
+// serverKey is the context key of the server running a handler.
+type serverKey struct{}
+
+// CallGroup is a group of goroutines started by a handler, which may
+// outlive the call. The server tracks the groups with goroutines running:
+// Drain waits for them, or cancels them when its context is done.
+//
+// As with errgroup, the first goroutine of the group returning an error
+// cancels the group context, and Wait returns this error.
+type CallGroup struct {
+	server  *Server
+	method  string
+	started time.Time
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+
+	mutex     sync.Mutex
+	running   int
+	err       error
+	cancelled bool // by the server
+}
+
+// GroupLeak describes a group cancelled by Drain whose goroutines didn't
+// return.
+type GroupLeak struct {
+	// Method is the method whose handler started the group.
+	Method  string
+	Started time.Time
+	// Running is the number of goroutines of the group still running.
+	Running int
+}
+
+// groupTracker holds the groups with goroutines running.
+type groupTracker struct {
+	mutex sync.Mutex
+	live  map[*CallGroup]struct{}
+	idle  []chan struct{}
+}
+
+// Group returns a new group for the background work of the handler running
+// with ctx, and the context of the goroutines of the group. This context
+// carries the values of ctx but isn't cancelled when the call is done, only
+// when the group is:
+//
+//	func (s *Mailer) Send(ctx context.Context, args *Args) (*Reply, error) {
+//		g, ctx := rpc.Group(ctx)
+//		g.Go(func() error { return s.deliver(ctx, args) })
+//		return &Reply{Queued: true}, nil
+//	}
+//
+// Outside a handler, the group isn't tracked.
+func Group(ctx context.Context) (*CallGroup, context.Context) {
+	g := &CallGroup{}
+	if s, ok := ctx.Value(serverKey{}).(*Server); ok {
+		g.server = s
+		g.started = s.clock.Now()
+	}
+	g.method, _ = CurrentMethod(ctx)
+	g.ctx, g.cancel = context.WithCancel(context.WithoutCancel(ctx))
+	return g, g.ctx
+}
+
+// Go runs f in a new goroutine of the group.
+func (g *CallGroup) Go(f func() error) {
+	g.mutex.Lock()
+	first := g.running == 0
+	g.running++
+	g.mutex.Unlock()
+	if first && g.server != nil {
+		g.server.groups.add(g)
+	}
+
+	g.wg.Add(1)
+	go func() {
+		defer g.done()
+		if err := f(); err != nil {
+			g.mutex.Lock()
+			if g.err == nil {
+				g.err = err
+				g.cancel()
+			}
+			g.mutex.Unlock()
+		}
+	}()
+}
+
+// Wait waits for the goroutines of the group to return, cancels the group
+// context and returns the first error returned by one of them.
+func (g *CallGroup) Wait() error {
+	g.wg.Wait()
+	g.cancel()
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return g.err
+}
+
+// done ends a goroutine of the group.
+func (g *CallGroup) done() {
+	g.mutex.Lock()
+	g.running--
+	idle := g.running == 0
+	g.mutex.Unlock()
+	if idle && g.server != nil {
+		g.server.groups.remove(g)
+	}
+	g.wg.Done()
+}
+
+// Leaks returns the groups cancelled by Drain whose goroutines are still
+// running.
+func (s *Server) Leaks() []GroupLeak {
+	t := &s.groups
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	var leaks []GroupLeak
+	for g := range t.live {
+		g.mutex.Lock()
+		if g.cancelled && g.running > 0 {
+			leaks = append(leaks, GroupLeak{Method: g.method, Started: g.started, Running: g.running})
+		}
+		g.mutex.Unlock()
+	}
+	return leaks
+}
+
+func (t *groupTracker) add(g *CallGroup) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	if t.live == nil {
+		t.live = make(map[*CallGroup]struct{})
+	}
+	t.live[g] = struct{}{}
+}
+
+func (t *groupTracker) remove(g *CallGroup) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	// The group may have started a goroutine again.
+	g.mutex.Lock()
+	running := g.running
+	g.mutex.Unlock()
+	if running > 0 {
+		return
+	}
+	delete(t.live, g)
+	if len(t.live) == 0 {
+		for _, idle := range t.idle {
+			close(idle)
+		}
+		t.idle = nil
+	}
+}
+
+// awaitGroups waits for the tracked groups to be done. If ctx is done
+// first, the groups are cancelled and those still running are logged.
+func (s *Server) awaitGroups(ctx context.Context) error {
+	t := &s.groups
+	t.mutex.Lock()
+	if len(t.live) == 0 {
+		t.mutex.Unlock()
+		return nil
+	}
+	idle := make(chan struct{})
+	t.idle = append(t.idle, idle)
+	t.mutex.Unlock()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		s.cancelGroups()
+		return ctx.Err()
+	}
+}
+
+// cancelGroups cancels the tracked groups.
+func (s *Server) cancelGroups() {
+	t := &s.groups
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+	for g := range t.live {
+		g.mutex.Lock()
+		g.cancelled = true
+		running := g.running
+		g.mutex.Unlock()
+		g.cancel()
+		s.log(LevelWarn, "rpc: background work cancelled",
+			Field{"rpc.method", g.method}, Field{"rpc.goroutines", running})
+	}
+}
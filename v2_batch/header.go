@@ -0,0 +1,104 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Response headers
+// ----------------------------------------------------------------------------
+
+// MetaReplier is implemented by codec requests able to attach metadata to
+// a reply, in an extension member of the reply envelope.
+type MetaReplier interface {
+	// WithMeta returns reply, as returned by ResponseReply or ErrorReply,
+	// carrying meta.
+	WithMeta(reply interface{}, meta map[string]interface{}) interface{}
+}
+
+// directivesKey is the context key of the reply directives of a handler.
+type directivesKey struct{}
+
+// replyDirectives collects the directives given by a handler about its
+// reply: response headers, caching and envelope extensions, along with the
+// ID of the profile of the call, if sampled.
+type replyDirectives struct {
+	mutex      sync.Mutex
+	header     http.Header
+	cacheTTL   time.Duration
+	extensions map[string]interface{}
+	profileID  string
+}
+
+// SetResponseHeader sets a response header from a handler, with ctx the
+// context of the request passed to it, e.g. for cache-control or
+// deprecation headers.
+//
+// For a single request the header is set on the HTTP response. In a batch
+// it is attached to the reply of the request, in the "headers" member of
+// the reply meta, if the codec supports it (see MetaReplier).
+//
+// It does nothing if ctx doesn't come from a handler served over HTTP.
+func SetResponseHeader(ctx context.Context, key, value string) {
+	h, ok := ctx.Value(directivesKey{}).(*replyDirectives)
+	if !ok {
+		return
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.header == nil {
+		h.header = make(http.Header)
+	}
+	h.header.Set(key, value)
+}
+
+// withDirectives returns r with a collector of the reply directives given
+// by the handler.
+func withDirectives(r *http.Request) (*http.Request, *replyDirectives) {
+	h := new(replyDirectives)
+	return r.WithContext(context.WithValue(r.Context(), directivesKey{}, h)), h
+}
+
+// applyDirectives emits the headers collected for a request: in the batch
+// for a single request, in the reply meta otherwise. A cache TTL is emitted
+// as a Cache-Control header, unless the handler set one. Envelope extensions
+// are added to the reply.
+func applyDirectives(h *replyDirectives, codecReq CodecRequest, reply interface{}, b *batch) interface{} {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if e, ok := codecReq.(ExtensionReplier); ok && len(h.extensions) > 0 {
+		reply = e.WithExtensions(reply, h.extensions)
+	}
+	if h.cacheTTL > 0 && h.header.Get("Cache-Control") == "" {
+		if h.header == nil {
+			h.header = make(http.Header)
+		}
+		h.header.Set("Cache-Control", fmt.Sprintf("private, max-age=%d", int64(h.cacheTTL/time.Second)))
+	}
+	if len(h.header) == 0 {
+		return reply
+	}
+	if b.single {
+		b.mutex.Lock()
+		defer b.mutex.Unlock()
+		if b.header == nil {
+			b.header = make(http.Header)
+		}
+		for k, v := range h.header {
+			b.header[k] = v
+		}
+		return reply
+	}
+	if m, ok := codecReq.(MetaReplier); ok {
+		return m.WithMeta(reply, map[string]interface{}{"headers": h.header})
+	}
+	return reply
+}
@@ -0,0 +1,155 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Service health
+// ----------------------------------------------------------------------------
+
+// HealthChecker can be implemented by a service receiver to report whether
+// it can serve calls, e.g. whether its database is reachable.
+type HealthChecker interface {
+	Healthy(ctx context.Context) error
+}
+
+// HealthReport is the health of the server, as served by HealthHandler.
+type HealthReport struct {
+	// Healthy is set if every service is.
+	Healthy bool `json:"healthy"`
+	// Services holds the health of the services implementing
+	// HealthChecker, by name.
+	Services map[string]ServiceHealth `json:"services,omitempty"`
+}
+
+// ServiceHealth is the health of a service at its last check.
+type ServiceHealth struct {
+	Healthy bool      `json:"healthy"`
+	Error   string    `json:"error,omitempty"`
+	Checked time.Time `json:"checked"`
+}
+
+// serviceHealth holds the last check of a service implementing
+// HealthChecker.
+type serviceHealth struct {
+	mutex   sync.Mutex
+	err     error
+	checked time.Time
+}
+
+// newServiceHealth returns the health state of rcvr, or nil if it doesn't
+// report its health.
+func newServiceHealth(rcvr interface{}) *serviceHealth {
+	if _, ok := rcvr.(HealthChecker); !ok {
+		return nil
+	}
+	return new(serviceHealth)
+}
+
+// SetHealthGate enables answering the calls to the methods of a service
+// found unhealthy by its last check with a CodeServiceUnhealthy error, until
+// a check finds it healthy again. The services are checked by Health, e.g.
+// through the HealthHandler, and by WatchHealth.
+func (s *Server) SetHealthGate(enabled bool) {
+	s.healthGate = enabled
+}
+
+// Health checks the services implementing HealthChecker concurrently and
+// returns the report. The checks cut short by ctx, e.g. by a health probe
+// disconnecting, are ignored, keeping the result of the previous ones.
+func (s *Server) Health(ctx context.Context) HealthReport {
+	s.services.mutex.Lock()
+	var services []*service
+	for _, service := range s.services.services {
+		if service.health != nil {
+			services = append(services, service)
+		}
+	}
+	s.services.mutex.Unlock()
+
+	var wg sync.WaitGroup
+	for _, svc := range services {
+		wg.Add(1)
+		go func(svc *service) {
+			defer wg.Done()
+			err := svc.rcvr.Interface().(HealthChecker).Healthy(ctx)
+			if ctx.Err() != nil {
+				return
+			}
+			svc.health.mutex.Lock()
+			svc.health.err = err
+			svc.health.checked = s.clock.Now()
+			svc.health.mutex.Unlock()
+		}(svc)
+	}
+	wg.Wait()
+
+	report := HealthReport{Healthy: true}
+	if len(services) > 0 {
+		report.Services = make(map[string]ServiceHealth, len(services))
+	}
+	for _, service := range services {
+		service.health.mutex.Lock()
+		health := ServiceHealth{Healthy: service.health.err == nil, Checked: service.health.checked}
+		if service.health.err != nil {
+			health.Error = service.health.err.Error()
+			report.Healthy = false
+		}
+		service.health.mutex.Unlock()
+		report.Services[service.name] = health
+	}
+	return report
+}
+
+// WatchHealth checks the services every interval, as Health, until ctx is
+// done. It is meant to be run in its own goroutine along with Serve, so
+// that the health gate follows the services without a health probe.
+func (s *Server) WatchHealth(ctx context.Context, interval time.Duration) {
+	for {
+		s.Health(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.clock.After(interval):
+		}
+	}
+}
+
+// HealthHandler returns a handler checking the services and serving the
+// HealthReport as JSON, with a 503 status if a service is unhealthy.
+func (s *Server) HealthHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		report := s.Health(r.Context())
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		if !report.Healthy {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		json.NewEncoder(w).Encode(report)
+	})
+}
+
+// healthError returns an error if the service is gated by the health gate.
+func (s *Server) healthError(service *service) error {
+	if !s.healthGate || service.health == nil {
+		return nil
+	}
+	service.health.mutex.Lock()
+	defer service.health.mutex.Unlock()
+	if service.health.err == nil {
+		return nil
+	}
+	return &Error{
+		Code:    CodeServiceUnhealthy,
+		Message: fmt.Sprintf("rpc: service %q unhealthy: %v", service.name, service.health.err),
+	}
+}
@@ -0,0 +1,103 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+// ----------------------------------------------------------------------------
+// IDGenerator
+// ----------------------------------------------------------------------------
+
+// IDGenerator generates the identifiers handed out by the server, such as
+// subscription ids, continuation tokens and correlation ids.
+type IDGenerator interface {
+	NewID() string
+}
+
+// randomIDGenerator generates 128-bit random hex ids.
+type randomIDGenerator struct {
+}
+
+func (randomIDGenerator) NewID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[:]); err != nil {
+		panic("rpc: failed to read random bytes: " + err.Error())
+	}
+	return hex.EncodeToString(b[:])
+}
+
+// RandomIDGenerator generates random 128-bit ids encoded as hex.
+// It is the default IDGenerator of a Server.
+var RandomIDGenerator IDGenerator = randomIDGenerator{}
+
+// NewSequentialIDGenerator returns an IDGenerator producing prefix1,
+// prefix2, ... Useful for tests and replay tooling that need reproducible ids.
+func NewSequentialIDGenerator(prefix string) IDGenerator {
+	return &sequentialIDGenerator{prefix: prefix}
+}
+
+type sequentialIDGenerator struct {
+	prefix string
+	next   uint64
+}
+
+func (g *sequentialIDGenerator) NewID() string {
+	return fmt.Sprintf("%s%d", g.prefix, atomic.AddUint64(&g.next, 1))
+}
+
+// NewUUIDv7Generator returns an IDGenerator producing time-ordered UUIDv7
+// strings (RFC 9562) using the given clock for the timestamp part.
+func NewUUIDv7Generator(clock Clock) IDGenerator {
+	return &uuidv7Generator{clock: clock}
+}
+
+type uuidv7Generator struct {
+	clock  Clock
+	mutex  sync.Mutex
+	lastMs int64
+	seq    uint16
+}
+
+func (g *uuidv7Generator) NewID() string {
+	var b [16]byte
+	if _, err := rand.Read(b[6:]); err != nil {
+		panic("rpc: failed to read random bytes: " + err.Error())
+	}
+	ms := g.clock.Now().UnixNano() / 1e6
+	g.mutex.Lock()
+	if ms <= g.lastMs {
+		// Keep ids monotonic within the same millisecond, moving on to the
+		// next one once the 12-bit counter is exhausted.
+		g.seq++
+		if g.seq > 0x0fff {
+			g.lastMs++
+			g.seq = 0
+		}
+		ms = g.lastMs
+	} else {
+		g.lastMs = ms
+		g.seq = binary.BigEndian.Uint16(b[6:8]) & 0x07ff
+	}
+	seq := g.seq
+	g.mutex.Unlock()
+
+	b[0] = byte(ms >> 40)
+	b[1] = byte(ms >> 32)
+	b[2] = byte(ms >> 24)
+	b[3] = byte(ms >> 16)
+	b[4] = byte(ms >> 8)
+	b[5] = byte(ms)
+	b[6] = 0x70 | byte(seq>>8)&0x0f
+	b[7] = byte(seq)
+	b[8] = 0x80 | b[8]&0x3f
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16])
+}
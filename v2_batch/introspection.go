@@ -0,0 +1,116 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Introspection service
+// ----------------------------------------------------------------------------
+
+// introspectionServiceName is the name of the introspection service.
+const introspectionServiceName = "system"
+
+// EnableIntrospection registers the built-in "system" service describing
+// the registered methods over RPC itself, for clients exploring an API.
+// The admin methods are left out once they have their own handler.
+//
+// The methods are, in lowerCamel as in "system.listMethods":
+//
+//	listMethods      returns the sorted names of the methods
+//	methodSignature  returns the MethodSignature of a method
+//	methodHelp       returns the description of a method
+func (s *Server) EnableIntrospection() error {
+	return s.RegisterService(&IntrospectionService{server: s}, introspectionServiceName,
+		ReadOnlyMethods("ListMethods", "MethodSignature", "MethodHelp"))
+}
+
+// IntrospectionService implements the introspection service. See
+// EnableIntrospection.
+type IntrospectionService struct {
+	server *Server
+}
+
+// IntrospectionArgs are the args of system.methodSignature and
+// system.methodHelp.
+type IntrospectionArgs struct {
+	Method string `json:"method"`
+}
+
+// IntrospectionEmpty is the args of system.listMethods.
+type IntrospectionEmpty struct{}
+
+// MethodSignature is the shape of a method, as reported by
+// system.methodSignature: the JSON Schemas of its params and result, as
+// returned by Schema, along with its documentation.
+type MethodSignature struct {
+	Method      string          `json:"method"`
+	Params      json.RawMessage `json:"params"`
+	Result      json.RawMessage `json:"result"`
+	Description string          `json:"description,omitempty"`
+	Tags        []string        `json:"tags,omitempty"`
+}
+
+// listed returns true if method is listed by the introspection service.
+func (i *IntrospectionService) listed(method string) bool {
+	return !i.server.adminSeparate || !strings.HasPrefix(method, adminServiceName+".")
+}
+
+// lookup returns the name of method as listed, which may be called in
+// lowerCamel.
+func (i *IntrospectionService) lookup(method string) (string, error) {
+	if name := i.server.services.canonical(method); i.server.HasMethod(name) && i.listed(name) {
+		return name, nil
+	}
+	return "", &Error{Code: CodeInvalidParams, Message: fmt.Sprintf("rpc: can't find method %q", method)}
+}
+
+// ListMethods returns the sorted names of the methods.
+func (i *IntrospectionService) ListMethods(r *http.Request, args *IntrospectionEmpty, reply *[]string) error {
+	*reply = []string{}
+	for _, method := range i.server.Methods() {
+		if i.listed(method) {
+			*reply = append(*reply, method)
+		}
+	}
+	return nil
+}
+
+// MethodSignature returns the shape of a method.
+func (i *IntrospectionService) MethodSignature(r *http.Request, args *IntrospectionArgs, reply *MethodSignature) error {
+	method, err := i.lookup(args.Method)
+	if err != nil {
+		return err
+	}
+	schema, err := i.server.Schema(method)
+	if err != nil {
+		return err
+	}
+	doc, _ := i.server.MethodDoc(method)
+	*reply = MethodSignature{
+		Method:      method,
+		Params:      schema.Params,
+		Result:      schema.Result,
+		Description: doc.Description,
+		Tags:        doc.Tags,
+	}
+	return nil
+}
+
+// MethodHelp returns the description of a method.
+func (i *IntrospectionService) MethodHelp(r *http.Request, args *IntrospectionArgs, reply *string) error {
+	method, err := i.lookup(args.Method)
+	if err != nil {
+		return err
+	}
+	doc, _ := i.server.MethodDoc(method)
+	*reply = doc.Description
+	return nil
+}
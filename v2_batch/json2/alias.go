@@ -0,0 +1,85 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"encoding/json"
+)
+
+// FieldAliases renames top-level object keys on the wire for a method, so
+// that fields can be renamed in Go structs while old clients keep working.
+type FieldAliases struct {
+	// Params maps old param keys, still sent by old clients, to the current
+	// keys. An old key is ignored if the current key is also present.
+	Params map[string]string
+	// Reply maps old reply keys, still expected by old clients, to the
+	// current keys. The current key is written under the old key.
+	Reply map[string]string
+}
+
+// SetFieldAliases sets the field aliases of a method, in dotted notation as
+// in "Service.Method". Aliases apply to object params and results only.
+func (c *Codec) SetFieldAliases(method string, aliases FieldAliases) {
+	if c.aliases == nil {
+		c.aliases = make(map[string]FieldAliases)
+	}
+	c.aliases[method] = aliases
+}
+
+// aliasParams rewrites the old param keys of method to the current ones.
+func (c *Codec) aliasParams(method string, params json.RawMessage) json.RawMessage {
+	aliases, ok := c.aliases[method]
+	if !ok || len(aliases.Params) == 0 {
+		return params
+	}
+	return renameKeys(params, aliases.Params)
+}
+
+// aliasResult rewrites the current reply keys of method to the old ones. It
+// returns the result unchanged if the method has no reply aliases.
+func (c *Codec) aliasResult(method string, reply interface{}) (interface{}, error) {
+	aliases, ok := c.aliases[method]
+	if !ok || len(aliases.Reply) == 0 {
+		return reply, nil
+	}
+	b, err := json.Marshal(reply)
+	if err != nil {
+		return nil, &Error{Code: E_INTERNAL, Message: err.Error()}
+	}
+	reverse := make(map[string]string, len(aliases.Reply))
+	for old, current := range aliases.Reply {
+		reverse[current] = old
+	}
+	return renameKeys(b, reverse), nil
+}
+
+// renameKeys renames the top-level keys of a JSON object from the keys of
+// names to their values. Anything other than an object is returned as is.
+func renameKeys(b json.RawMessage, names map[string]string) json.RawMessage {
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(b, &obj); err != nil || obj == nil {
+		return b
+	}
+	renamed := false
+	for from, to := range names {
+		v, ok := obj[from]
+		if !ok {
+			continue
+		}
+		delete(obj, from)
+		if _, ok := obj[to]; !ok {
+			obj[to] = v
+		}
+		renamed = true
+	}
+	if !renamed {
+		return b
+	}
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return b
+	}
+	return out
+}
@@ -0,0 +1,60 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+)
+
+// maxPooledBuffer is the capacity above which buffers are not pooled, so
+// that a single huge response doesn't pin its memory.
+const maxPooledBuffer = 64 << 10
+
+var bufferPool = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
+}
+
+func getBuffer() *bytes.Buffer {
+	return bufferPool.Get().(*bytes.Buffer)
+}
+
+func putBuffer(buf *bytes.Buffer) {
+	if buf.Cap() > maxPooledBuffer {
+		return
+	}
+	buf.Reset()
+	bufferPool.Put(buf)
+}
+
+// SetWriteBufferSize sets the size in bytes up to which an uncompressed
+// batch response is buffered before being written progressively. Replies
+// are always encoded before being written, so that a reply that can't be
+// encoded is answered with an E_INTERNAL error instead of corrupting the
+// response.
+//
+// Zero, the default, buffers whole responses.
+func (c *Codec) SetWriteBufferSize(n int) {
+	c.writeBufferSize = n
+}
+
+// appendReply encodes a reply into buf. A reply that can't be encoded is
+// replaced by an E_INTERNAL error for the same request.
+func appendReply(buf *bytes.Buffer, reply interface{}) {
+	b, err := json.Marshal(reply)
+	if err != nil {
+		id := &null
+		if res, ok := reply.(*serverResponse); ok && res.Id != nil {
+			id = res.Id
+		}
+		b, _ = json.Marshal(&serverResponse{
+			Version: Version,
+			Error:   &Error{Code: E_INTERNAL, Message: "rpc: can't encode reply: " + err.Error()},
+			Id:      id,
+		})
+	}
+	buf.Write(b)
+}
@@ -0,0 +1,75 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"fmt"
+	"mime"
+	"strings"
+	"unicode/utf8"
+)
+
+var utf8BOM = []byte{0xEF, 0xBB, 0xBF}
+
+// windows1252 maps the bytes 0x80-0x9F of Windows-1252 to runes; the other
+// bytes are identical to ISO-8859-1. Undefined positions map to U+FFFD.
+var windows1252 = [32]rune{
+	'€', '�', '‚', 'ƒ', '„', '…', '†', '‡',
+	'ˆ', '‰', 'Š', '‹', 'Œ', '�', 'Ž', '�',
+	'�', '‘', '’', '“', '”', '•', '–', '—',
+	'˜', '™', 'š', '›', 'œ', '�', 'ž', 'Ÿ',
+}
+
+// toUTF8 returns body as UTF-8 according to the charset declared in the
+// Content-Type header.
+//
+// UTF-8 bodies (the default when no charset is declared) are validated,
+// US-ASCII, ISO-8859-1 and Windows-1252 bodies are transcoded and any other
+// charset is rejected.
+func toUTF8(contentType string, body []byte) ([]byte, error) {
+	charset := ""
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		charset = strings.ToLower(params["charset"])
+	}
+	switch charset {
+	case "", "utf-8", "utf8":
+		body = bytes.TrimPrefix(body, utf8BOM)
+		if !utf8.Valid(body) {
+			return nil, fmt.Errorf("rpc: request body is not valid UTF-8")
+		}
+		return body, nil
+	case "us-ascii", "ascii":
+		for i, b := range body {
+			if b >= utf8.RuneSelf {
+				return nil, fmt.Errorf("rpc: request body is not valid US-ASCII: byte 0x%02x at offset %d", b, i)
+			}
+		}
+		return body, nil
+	case "iso-8859-1", "latin1", "l1":
+		return transcode(body, func(b byte) rune { return rune(b) }), nil
+	case "windows-1252", "cp1252":
+		return transcode(body, func(b byte) rune {
+			if b >= 0x80 && b < 0xA0 {
+				return windows1252[b-0x80]
+			}
+			return rune(b)
+		}), nil
+	}
+	return nil, fmt.Errorf("rpc: unsupported charset %q", charset)
+}
+
+// transcode converts a single-byte encoded body to UTF-8.
+func transcode(body []byte, decode func(byte) rune) []byte {
+	out := make([]byte, 0, len(body))
+	for _, b := range body {
+		if b < utf8.RuneSelf {
+			out = append(out, b)
+			continue
+		}
+		out = utf8.AppendRune(out, decode(b))
+	}
+	return out
+}
@@ -67,5 +67,9 @@ func DecodeClientResponse(r io.Reader, reply interface{}) error {
 		}
 		return jsonErr
 	}
+	if c.Result == nil {
+		// A null result leaves the pointer nil.
+		return json.Unmarshal(null, reply)
+	}
 	return json.Unmarshal(*c.Result, reply)
 }
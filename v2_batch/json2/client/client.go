@@ -0,0 +1,308 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package client calls JSON-RPC 2.0 servers over HTTP, as served by the
+// json2 codec.
+//
+//	c := client.New("http://localhost:8080/rpc")
+//	var reply HelloReply
+//	err := c.Call(ctx, "HelloService.Say", &HelloArgs{Who: "world"}, &reply)
+//
+// Calls can be batched in a single request:
+//
+//	b := c.Batch()
+//	hello := b.Call("HelloService.Say", &HelloArgs{Who: "world"}, &reply)
+//	b.Notify("HelloService.Log", &LogArgs{Line: "said hello"})
+//	if err := b.Send(ctx); err != nil {
+//		return err
+//	}
+//	if hello.Error != nil {
+//		...
+//	}
+//
+// Errors replied by the server are *json2.Error values. Calls can be retried
+// with backoff, see SetRetryPolicy:
+//
+//	c.SetRetryPolicy(client.RetryPolicy{MaxAttempts: 3, Jitter: 0.2})
+//	c.SetIdempotent("HelloService.Say")
+//
+// Requests can be spread over several servers, failing over from those
+// found unreachable, see SetEndpoints.
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+	"github.com/agronomhidden/rpc/v2_batch/json2"
+)
+
+// ----------------------------------------------------------------------------
+// Client
+// ----------------------------------------------------------------------------
+
+// Client calls the methods of a JSON-RPC 2.0 server at a URL, or of several
+// servers, see SetEndpoints. It is safe for concurrent use.
+type Client struct {
+	endpoints  endpointSet
+	httpClient *http.Client
+	ids        uint64
+
+	headerMutex sync.RWMutex
+	header      http.Header
+
+	retryPolicy     RetryPolicy
+	idempotentMutex sync.RWMutex
+	idempotent      map[string]bool
+
+	fallback *rpc.Server
+	breaker  circuitBreaker
+}
+
+// New returns a client of the server at url.
+func New(url string) *Client {
+	c := &Client{httpClient: http.DefaultClient, header: make(http.Header)}
+	c.endpoints.set(RoundRobin, []string{url})
+	return c
+}
+
+// SetHTTPClient sets the HTTP client sending the requests, instead of
+// http.DefaultClient.
+func (c *Client) SetHTTPClient(httpClient *http.Client) {
+	c.httpClient = httpClient
+}
+
+// SetHeader sets a header sent with every request, e.g. Authorization.
+func (c *Client) SetHeader(key, value string) {
+	c.headerMutex.Lock()
+	defer c.headerMutex.Unlock()
+	c.header.Set(key, value)
+}
+
+// request is a request sent by the client. Notifications have no id.
+type request struct {
+	Version string      `json:"jsonrpc"`
+	Method  string      `json:"method"`
+	Params  interface{} `json:"params,omitempty"`
+	ID      *uint64     `json:"id,omitempty"`
+}
+
+// response is a response received by the client.
+type response struct {
+	Result json.RawMessage `json:"result"`
+	Error  *json2.Error    `json:"error"`
+	ID     *uint64         `json:"id"`
+}
+
+var null = json.RawMessage("null")
+
+// newRequest returns the request calling method, with an id unless it is a
+// notification.
+func (c *Client) newRequest(method string, args interface{}, notification bool) *request {
+	req := &request{Version: "2.0", Method: method, Params: args}
+	if !notification {
+		id := atomic.AddUint64(&c.ids, 1)
+		req.ID = &id
+	}
+	return req
+}
+
+// Call calls method with args and decodes its result into reply, a pointer.
+// The method uses a dotted notation as in "Service.Method". Failed calls
+// are retried as set by SetRetryPolicy, then made to the fallback, if any,
+// when the remote server is unreachable.
+func (c *Client) Call(ctx context.Context, method string, args, reply interface{}) error {
+	err := c.retry(ctx, method, func() error {
+		b := c.Batch()
+		call := b.Call(method, args, reply)
+		if err := b.Send(ctx); err != nil {
+			return err
+		}
+		return call.Error
+	})
+	return c.fallbackCall(ctx, method, args, reply, err)
+}
+
+// Notify calls method with args without waiting for a result: the server
+// replies nothing, not even errors. Notifications failing to be sent are
+// retried as calls are.
+func (c *Client) Notify(ctx context.Context, method string, args interface{}) error {
+	return c.retry(ctx, method, func() error {
+		b := c.Batch()
+		b.Notify(method, args)
+		return b.Send(ctx)
+	})
+}
+
+// post sends body, unless the circuit is open, and returns the body of the
+// response, empty if there is nothing to reply.
+func (c *Client) post(ctx context.Context, body []byte) ([]byte, error) {
+	if !c.breaker.allow() {
+		return nil, ErrCircuitOpen
+	}
+	b, err := c.sendAny(ctx, body)
+	c.breaker.record(err)
+	return b, err
+}
+
+// send posts body to the server at url.
+func (c *Client) send(ctx context.Context, url string, body []byte) ([]byte, error) {
+	r, err := http.NewRequestWithContext(ctx, "POST", url, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.headerMutex.RLock()
+	for k, v := range c.header {
+		r.Header[k] = v
+	}
+	c.headerMutex.RUnlock()
+	r.Header.Set("Content-Type", "application/json")
+	res, err := c.httpClient.Do(r)
+	if err != nil {
+		return nil, &transportError{err: err}
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, &transportError{err: err, sent: true}
+	}
+	// Errors may come with another status than 200, see
+	// rpc.Server.SetErrorStatuses, but with a JSON-RPC body.
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusNoContent && !json.Valid(b) {
+		return nil, &HTTPError{StatusCode: res.StatusCode, Body: string(bytes.TrimSpace(b))}
+	}
+	return b, nil
+}
+
+// ----------------------------------------------------------------------------
+// Batch
+// ----------------------------------------------------------------------------
+
+// Batch builds a batch of calls sent in a single request. It is not safe
+// for concurrent use.
+type Batch struct {
+	client   *Client
+	requests []*request
+	calls    map[uint64]*BatchCall
+}
+
+// BatchCall is a call of a batch. Its Error is set once the batch is sent.
+type BatchCall struct {
+	Method string
+	Reply  interface{}
+	Error  error
+}
+
+// Batch returns an empty batch of calls of the client.
+func (c *Client) Batch() *Batch {
+	return &Batch{client: c, calls: make(map[uint64]*BatchCall)}
+}
+
+// Call adds a call of method with args, whose result is decoded into reply,
+// a pointer, once the batch is sent.
+func (b *Batch) Call(method string, args, reply interface{}) *BatchCall {
+	req := b.client.newRequest(method, args, false)
+	call := &BatchCall{Method: method, Reply: reply}
+	b.requests = append(b.requests, req)
+	b.calls[*req.ID] = call
+	return call
+}
+
+// Notify adds a notification of method with args.
+func (b *Batch) Notify(method string, args interface{}) {
+	b.requests = append(b.requests, b.client.newRequest(method, args, true))
+}
+
+// Len returns the number of calls and notifications of the batch.
+func (b *Batch) Len() int {
+	return len(b.requests)
+}
+
+// Send sends the batch and sets the Error of each call: nil once its result
+// is decoded into its reply, or the error replied by the server. It returns
+// an error if the batch couldn't be sent or was rejected as a whole, as
+// when it holds too many calls, which is set to every call too.
+//
+// A batch of a single call is sent as a plain request, as the server
+// replies to it with a plain response.
+func (b *Batch) Send(ctx context.Context) error {
+	if len(b.requests) == 0 {
+		return nil
+	}
+	var body []byte
+	var err error
+	if len(b.requests) == 1 {
+		body, err = json.Marshal(b.requests[0])
+	} else {
+		body, err = json.Marshal(b.requests)
+	}
+	if err != nil {
+		return b.fail(err)
+	}
+	out, err := b.client.post(ctx, body)
+	if err != nil {
+		return b.fail(err)
+	}
+	out = bytes.TrimSpace(out)
+	if len(out) == 0 {
+		if len(b.calls) > 0 {
+			return b.fail(fmt.Errorf("rpc: empty response"))
+		}
+		return nil
+	}
+
+	var responses []response
+	if out[0] == '[' {
+		err = json.Unmarshal(out, &responses)
+	} else {
+		responses = make([]response, 1)
+		err = json.Unmarshal(out, &responses[0])
+	}
+	if err != nil {
+		return b.fail(fmt.Errorf("rpc: invalid response: %v", err))
+	}
+	for _, res := range responses {
+		if res.ID == nil {
+			if res.Error != nil {
+				// Rejected as a whole.
+				return b.fail(res.Error)
+			}
+			continue
+		}
+		call := b.calls[*res.ID]
+		if call == nil {
+			continue
+		}
+		delete(b.calls, *res.ID)
+		if res.Error != nil {
+			call.Error = res.Error
+			continue
+		}
+		result := res.Result
+		if result == nil {
+			// A null result leaves the pointer nil.
+			result = null
+		}
+		call.Error = json.Unmarshal(result, call.Reply)
+	}
+	for _, call := range b.calls {
+		call.Error = fmt.Errorf("rpc: no response to the call of %q", call.Method)
+	}
+	return nil
+}
+
+// fail sets err to every call waiting for a response and returns it.
+func (b *Batch) fail(err error) error {
+	for _, call := range b.calls {
+		call.Error = err
+	}
+	return err
+}
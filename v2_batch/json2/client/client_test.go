@@ -0,0 +1,380 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+	"github.com/agronomhidden/rpc/v2_batch/json2"
+)
+
+type Args struct {
+	A, B int
+}
+
+type Reply struct {
+	Result int
+}
+
+type Arith struct {
+	logged int32
+}
+
+func (a *Arith) Multiply(r *http.Request, args *Args, reply *Reply) error {
+	reply.Result = args.A * args.B
+	return nil
+}
+
+func (a *Arith) Divide(r *http.Request, args *Args, reply *Reply) error {
+	if args.B == 0 {
+		return errors.New("division by zero")
+	}
+	reply.Result = args.A / args.B
+	return nil
+}
+
+func (a *Arith) Log(r *http.Request, args *Args, reply *Reply) error {
+	atomic.AddInt32(&a.logged, 1)
+	return nil
+}
+
+func newTestServer(t *testing.T) (*Arith, *Client) {
+	s := rpc.NewServer()
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+	arith := new(Arith)
+	if err := s.RegisterService(arith, ""); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(s)
+	t.Cleanup(ts.Close)
+	return arith, New(ts.URL)
+}
+
+func TestCall(t *testing.T) {
+	arith, c := newTestServer(t)
+	ctx := context.Background()
+
+	var reply Reply
+	if err := c.Call(ctx, "Arith.Multiply", &Args{A: 6, B: 7}, &reply); err != nil || reply.Result != 42 {
+		t.Errorf("Expected 42, got %d %v", reply.Result, err)
+	}
+	err := c.Call(ctx, "Arith.Divide", &Args{A: 1}, &reply)
+	if jsonErr, ok := err.(*json2.Error); !ok || jsonErr.Message != "division by zero" {
+		t.Errorf("Expected the error of the server, got %#v", err)
+	}
+	err = c.Call(ctx, "Arith.Missing", &Args{}, &reply)
+	if jsonErr, ok := err.(*json2.Error); !ok || jsonErr.Code != json2.E_NO_METHOD {
+		t.Errorf("Expected E_NO_METHOD, got %#v", err)
+	}
+	if err := c.Notify(ctx, "Arith.Log", &Args{}); err != nil {
+		t.Errorf("Expected the notification sent, got %v", err)
+	}
+	if logged := atomic.LoadInt32(&arith.logged); logged != 1 {
+		t.Errorf("Expected 1 notification served, got %d", logged)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	arith, c := newTestServer(t)
+
+	var product, quotient, failed Reply
+	b := c.Batch()
+	multiply := b.Call("Arith.Multiply", &Args{A: 6, B: 7}, &product)
+	b.Notify("Arith.Log", &Args{})
+	divide := b.Call("Arith.Divide", &Args{A: 8, B: 2}, &quotient)
+	fail := b.Call("Arith.Divide", &Args{A: 8}, &failed)
+	if b.Len() != 4 {
+		t.Errorf("Expected 4 requests, got %d", b.Len())
+	}
+	if err := b.Send(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if multiply.Error != nil || product.Result != 42 {
+		t.Errorf("Expected 42, got %d %v", product.Result, multiply.Error)
+	}
+	if divide.Error != nil || quotient.Result != 4 {
+		t.Errorf("Expected 4, got %d %v", quotient.Result, divide.Error)
+	}
+	if _, ok := fail.Error.(*json2.Error); !ok {
+		t.Errorf("Expected the error of the server, got %#v", fail.Error)
+	}
+	if logged := atomic.LoadInt32(&arith.logged); logged != 1 {
+		t.Errorf("Expected 1 notification served, got %d", logged)
+	}
+
+	// Notifications only: the server replies nothing.
+	b = c.Batch()
+	b.Notify("Arith.Log", &Args{})
+	b.Notify("Arith.Log", &Args{})
+	if err := b.Send(context.Background()); err != nil {
+		t.Errorf("Expected the notifications sent, got %v", err)
+	}
+}
+
+func TestBatchRejected(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+	s.RegisterService(new(Arith), "")
+	s.SetMaxBatchSize(1)
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	var r1, r2 Reply
+	b := New(ts.URL).Batch()
+	c1 := b.Call("Arith.Multiply", &Args{A: 1, B: 2}, &r1)
+	c2 := b.Call("Arith.Multiply", &Args{A: 3, B: 4}, &r2)
+	err := b.Send(context.Background())
+	if _, ok := err.(*json2.Error); !ok {
+		t.Fatalf("Expected the batch rejected, got %#v", err)
+	}
+	if c1.Error != err || c2.Error != err {
+		t.Errorf("Expected the error set to every call, got %v %v", c1.Error, c2.Error)
+	}
+}
+
+type Flaky struct {
+	calls    int32
+	failures int32
+}
+
+func (f *Flaky) Get(r *http.Request, args *Args, reply *Reply) error {
+	if atomic.AddInt32(&f.calls, 1) <= f.failures {
+		return errors.New("try again")
+	}
+	reply.Result = args.A
+	return nil
+}
+
+func (f *Flaky) Put(r *http.Request, args *Args, reply *Reply) error {
+	atomic.AddInt32(&f.calls, 1)
+	return errors.New("try again")
+}
+
+func TestRetry(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+	flaky := &Flaky{failures: 2}
+	s.RegisterService(flaky, "")
+	ts := httptest.NewServer(s)
+	defer ts.Close()
+
+	var attempts []Attempt
+	c := New(ts.URL)
+	c.SetRetryPolicy(RetryPolicy{
+		MaxAttempts:    3,
+		InitialBackoff: time.Millisecond,
+		Jitter:         0.5,
+		OnAttempt:      func(a Attempt) { attempts = append(attempts, a) },
+	})
+	c.SetIdempotent("Flaky.Get")
+
+	var reply Reply
+	if err := c.Call(context.Background(), "Flaky.Get", &Args{A: 7}, &reply); err != nil || reply.Result != 7 {
+		t.Fatalf("Expected the call to succeed on its third attempt, got %d %v", reply.Result, err)
+	}
+	if len(attempts) != 3 || attempts[0].Err == nil || attempts[0].Backoff == 0 || attempts[2].Err != nil || attempts[2].Backoff != 0 {
+		t.Errorf("Unexpected attempts %+v", attempts)
+	}
+
+	attempts = nil
+	if err := c.Call(context.Background(), "Flaky.Put", &Args{}, &reply); err == nil {
+		t.Error("Expected the call to fail")
+	}
+	if len(attempts) != 1 {
+		t.Errorf("Expected calls to methods not idempotent made once, got %d attempts", len(attempts))
+	}
+}
+
+func TestIsRetryable(t *testing.T) {
+	for _, test := range []struct {
+		err       error
+		retryable bool
+	}{
+		{&HTTPError{StatusCode: http.StatusServiceUnavailable}, true},
+		{&HTTPError{StatusCode: http.StatusTooManyRequests}, true},
+		{&HTTPError{StatusCode: http.StatusBadRequest}, false},
+		{&json2.Error{Code: json2.E_SERVER}, true},
+		{&json2.Error{Code: rpc.CodeRateLimited}, true},
+		{&json2.Error{Code: json2.E_BAD_PARAMS}, false},
+		{&transportError{err: errors.New("connection reset")}, true},
+		{&transportError{err: context.Canceled}, false},
+		{errors.New("invalid response"), false},
+	} {
+		if retryable := IsRetryable(test.err); retryable != test.retryable {
+			t.Errorf("%v: expected retryable %v, got %v", test.err, test.retryable, retryable)
+		}
+	}
+}
+
+func TestRetryInfo(t *testing.T) {
+	p := RetryPolicy{InitialBackoff: time.Millisecond}
+	err := &json2.Error{Code: rpc.CodeRateLimited, Data: map[string]interface{}{
+		"details": []interface{}{map[string]interface{}{
+			"@type":      "type.googleapis.com/google.rpc.RetryInfo",
+			"retryDelay": "2s",
+		}},
+	}}
+	if backoff := p.backoff(1, err); backoff != 2*time.Second {
+		t.Errorf("Expected the delay of the server, got %v", backoff)
+	}
+	if backoff := p.backoff(3, errors.New("failed")); backoff != 4*time.Millisecond {
+		t.Errorf("Expected 4ms, got %v", backoff)
+	}
+}
+
+type FallbackArith struct{}
+
+func (FallbackArith) Multiply(r *http.Request, args *Args, reply *Reply) error {
+	reply.Result = -1
+	return nil
+}
+
+func TestFallback(t *testing.T) {
+	fallback := rpc.NewServer()
+	fallback.RegisterService(FallbackArith{}, "Arith")
+
+	ts := httptest.NewServer(http.NotFoundHandler())
+	ts.Close()
+	c := New(ts.URL)
+	var reply Reply
+	if err := c.Call(context.Background(), "Arith.Multiply", &Args{A: 2, B: 3}, &reply); err == nil {
+		t.Fatal("Expected an unreachable server to fail the call")
+	}
+	c.SetFallback(fallback)
+	if err := c.Call(context.Background(), "Arith.Multiply", &Args{A: 2, B: 3}, &reply); err != nil || reply.Result != -1 {
+		t.Errorf("Expected the reply of the fallback, got %d %v", reply.Result, err)
+	}
+
+	// Errors replied by the remote server aren't served by the fallback.
+	_, c = newTestServer(t)
+	c.SetFallback(fallback)
+	if err := c.Call(context.Background(), "Arith.Divide", &Args{A: 1}, &reply); err == nil {
+		t.Error("Expected the error of the remote server")
+	}
+
+	// Calls whose response is cut short may have run remotely, so only
+	// idempotent ones are made to the fallback.
+	cut := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "100")
+		w.Write([]byte(`{"jsonrpc":"2.0"`))
+	}))
+	defer cut.Close()
+	c = New(cut.URL)
+	c.SetFallback(fallback)
+	c.SetCircuitBreaker(1, time.Hour)
+	reply.Result = 0
+	if err := c.Call(context.Background(), "Arith.Multiply", &Args{A: 2, B: 3}, &reply); err == nil || reply.Result != 0 {
+		t.Errorf("Expected the call not made to the fallback, got %d %v", reply.Result, err)
+	}
+	if err := c.Call(context.Background(), "Arith.Multiply", &Args{A: 2, B: 3}, &reply); err == ErrCircuitOpen {
+		t.Error("Expected a response cut short not to open the circuit")
+	}
+	c.SetIdempotent("Arith.Multiply")
+	if err := c.Call(context.Background(), "Arith.Multiply", &Args{A: 2, B: 3}, &reply); err != nil || reply.Result != -1 {
+		t.Errorf("Expected the reply of the fallback, got %d %v", reply.Result, err)
+	}
+}
+
+func TestCircuitBreaker(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "overloaded", http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	c := New(ts.URL)
+	c.SetCircuitBreaker(2, time.Hour)
+	var reply Reply
+	for i := 0; i < 2; i++ {
+		err := c.Call(context.Background(), "Arith.Multiply", &Args{}, &reply)
+		if httpErr, ok := err.(*HTTPError); !ok || httpErr.StatusCode != http.StatusServiceUnavailable {
+			t.Errorf("Expected a 503 error, got %v", err)
+		}
+	}
+	if err := c.Call(context.Background(), "Arith.Multiply", &Args{}, &reply); err != ErrCircuitOpen {
+		t.Errorf("Expected ErrCircuitOpen, got %v", err)
+	}
+	fallback := rpc.NewServer()
+	fallback.RegisterService(FallbackArith{}, "Arith")
+	c.SetFallback(fallback)
+	if err := c.Call(context.Background(), "Arith.Multiply", &Args{}, &reply); err != nil || reply.Result != -1 {
+		t.Errorf("Expected the reply of the fallback, got %d %v", reply.Result, err)
+	}
+	if n := atomic.LoadInt32(&requests); n != 2 {
+		t.Errorf("Expected 2 requests sent before the circuit opened, got %d", n)
+	}
+
+	c.SetCircuitBreaker(2, 0)
+	c.Call(context.Background(), "Arith.Multiply", &Args{}, &reply)
+	if n := atomic.LoadInt32(&requests); n != 3 {
+		t.Errorf("Expected requests sent once the breaker is reset, got %d", n)
+	}
+}
+
+func TestEndpoints(t *testing.T) {
+	var hits [2]int32
+	servers := make([]*httptest.Server, 2)
+	for i := range servers {
+		s := rpc.NewServer()
+		s.RegisterCodec(json2.NewCodec(), "application/json")
+		s.RegisterService(new(Arith), "")
+		i := i
+		servers[i] = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&hits[i], 1)
+			s.ServeHTTP(w, r)
+		}))
+		defer servers[i].Close()
+	}
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	c := New(servers[0].URL)
+	c.SetEndpoints(RoundRobin, servers[0].URL, down.URL, servers[1].URL)
+	var reply Reply
+	for i := 0; i < 6; i++ {
+		if err := c.Call(context.Background(), "Arith.Multiply", &Args{A: 2, B: 3}, &reply); err != nil || reply.Result != 6 {
+			t.Fatalf("Expected 6, got %d %v", reply.Result, err)
+		}
+	}
+	if h0, h1 := atomic.LoadInt32(&hits[0]), atomic.LoadInt32(&hits[1]); h0+h1 != 6 || h0 < 2 || h1 < 2 {
+		t.Errorf("Expected the calls spread over the endpoints alive, got %d and %d", h0, h1)
+	}
+	statuses := c.Endpoints()
+	if len(statuses) != 3 || !statuses[0].Alive || statuses[1].Alive || !statuses[2].Alive {
+		t.Errorf("Expected the second endpoint dead, got %+v", statuses)
+	}
+
+	// Failover: the first endpoint alive serves every call.
+	hits = [2]int32{}
+	c.SetEndpoints(Failover, down.URL, servers[1].URL, servers[0].URL)
+	c.SetProbeInterval(time.Hour)
+	for i := 0; i < 3; i++ {
+		if err := c.Call(context.Background(), "Arith.Multiply", &Args{A: 2, B: 3}, &reply); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if h0, h1 := atomic.LoadInt32(&hits[0]), atomic.LoadInt32(&hits[1]); h0 != 0 || h1 != 3 {
+		t.Errorf("Expected the calls served by the second endpoint, got %d and %d", h0, h1)
+	}
+
+	// Dead endpoints are probed again once the interval has passed.
+	c.SetEndpoints(Failover, servers[0].URL, servers[1].URL)
+	c.SetProbeInterval(time.Millisecond)
+	c.endpoints.record(c.endpoints.list[0], &HTTPError{StatusCode: http.StatusServiceUnavailable})
+	time.Sleep(2 * time.Millisecond)
+	hits = [2]int32{}
+	c.Call(context.Background(), "Arith.Multiply", &Args{A: 2, B: 3}, &reply)
+	if h0 := atomic.LoadInt32(&hits[0]); h0 != 1 || !c.Endpoints()[0].Alive {
+		t.Errorf("Expected the first endpoint probed and alive again, got %d hits %+v", h0, c.Endpoints())
+	}
+}
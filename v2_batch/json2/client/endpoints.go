@@ -0,0 +1,152 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Endpoints
+// ----------------------------------------------------------------------------
+
+// Balancing is the way requests are spread over the endpoints of a client.
+type Balancing int
+
+const (
+	// RoundRobin sends each request to the next endpoint in turn.
+	RoundRobin Balancing = iota
+	// Failover sends the requests to the first endpoint alive, in the order
+	// given, e.g. a primary then its standbys.
+	Failover
+)
+
+// DefaultProbeInterval is the time a dead endpoint is skipped for, unless
+// set with SetProbeInterval.
+const DefaultProbeInterval = 10 * time.Second
+
+// EndpointStatus is the state of an endpoint of a client.
+type EndpointStatus struct {
+	URL   string
+	Alive bool
+	// DeadUntil is the time the endpoint is probed again, if it is dead.
+	DeadUntil time.Time
+}
+
+// SetEndpoints sets the URLs of the servers the requests are sent to,
+// spread as set by balancing, in place of the URL given to New.
+//
+// An endpoint found unreachable, as with a network error or a 502, 503 or
+// 504 status, is marked dead and the request is sent to the next endpoint
+// right away. Dead endpoints are skipped until the probe interval has
+// passed, then probed by the next request sent to them, and alive again
+// once they answer. When all the endpoints are dead, they are tried anyway.
+// A request whose response was cut short isn't sent again.
+func (c *Client) SetEndpoints(balancing Balancing, urls ...string) {
+	c.endpoints.set(balancing, urls)
+}
+
+// SetProbeInterval sets the time dead endpoints are skipped for.
+func (c *Client) SetProbeInterval(d time.Duration) {
+	c.endpoints.mutex.Lock()
+	defer c.endpoints.mutex.Unlock()
+	c.endpoints.probeInterval = d
+}
+
+// Endpoints returns the state of the endpoints of the client.
+func (c *Client) Endpoints() []EndpointStatus {
+	now := time.Now()
+	c.endpoints.mutex.Lock()
+	defer c.endpoints.mutex.Unlock()
+	statuses := make([]EndpointStatus, len(c.endpoints.list))
+	for i, ep := range c.endpoints.list {
+		statuses[i] = EndpointStatus{URL: ep.url, Alive: !now.Before(ep.deadUntil), DeadUntil: ep.deadUntil}
+	}
+	return statuses
+}
+
+// endpoint is a server URL of a client.
+type endpoint struct {
+	url       string
+	deadUntil time.Time
+}
+
+// endpointSet holds the endpoints of a client.
+type endpointSet struct {
+	mutex         sync.Mutex
+	list          []*endpoint
+	balancing     Balancing
+	probeInterval time.Duration
+	next          int // of the round robin
+}
+
+func (s *endpointSet) set(balancing Balancing, urls []string) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.list = make([]*endpoint, len(urls))
+	for i, url := range urls {
+		s.list[i] = &endpoint{url: url}
+	}
+	s.balancing = balancing
+	s.next = 0
+}
+
+// order returns the endpoints in the order a request tries them: those
+// alive, in turn or in priority order, then the dead ones, soonest probed
+// first.
+func (s *endpointSet) order() []*endpoint {
+	now := time.Now()
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	n := len(s.list)
+	start := 0
+	if s.balancing == RoundRobin && n > 0 {
+		start = s.next % n
+		s.next++
+	}
+	var alive, dead []*endpoint
+	for i := 0; i < n; i++ {
+		ep := s.list[(start+i)%n]
+		if now.Before(ep.deadUntil) {
+			dead = append(dead, ep)
+		} else {
+			alive = append(alive, ep)
+		}
+	}
+	sort.SliceStable(dead, func(i, j int) bool { return dead[i].deadUntil.Before(dead[j].deadUntil) })
+	return append(alive, dead...)
+}
+
+// record marks ep dead if err shows it unreachable, alive otherwise.
+func (s *endpointSet) record(ep *endpoint, err error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if !unreachable(err) {
+		ep.deadUntil = time.Time{}
+		return
+	}
+	interval := s.probeInterval
+	if interval <= 0 {
+		interval = DefaultProbeInterval
+	}
+	ep.deadUntil = time.Now().Add(interval)
+}
+
+// sendAny posts body to the endpoints in turn until one is reachable.
+func (c *Client) sendAny(ctx context.Context, body []byte) ([]byte, error) {
+	var err error
+	for _, ep := range c.endpoints.order() {
+		var b []byte
+		b, err = c.send(ctx, ep.url, body)
+		c.endpoints.record(ep, err)
+		if !unreachable(err) || ctx.Err() != nil {
+			return b, err
+		}
+	}
+	return nil, err
+}
@@ -0,0 +1,115 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+)
+
+// ----------------------------------------------------------------------------
+// Fallback and circuit breaker
+// ----------------------------------------------------------------------------
+
+// ErrCircuitOpen is returned for the requests not sent while the circuit is
+// open, see SetCircuitBreaker.
+var ErrCircuitOpen = errors.New("rpc: circuit open")
+
+// SetFallback sets the in-process server the calls are made to when the
+// remote server is unreachable or the circuit is open, e.g. serving cached
+// or degraded replies. Its methods are called with rpc.Server.Call, so
+// their args and reply types must be those passed to Call. Notifications
+// and batches aren't made to the fallback, nor the calls whose response
+// couldn't be read, as the remote server may have run them, unless marked
+// idempotent with SetIdempotent.
+func (c *Client) SetFallback(s *rpc.Server) {
+	c.fallback = s
+}
+
+// SetCircuitBreaker opens the circuit once failures requests in a row find
+// the remote server unreachable, as with a network error or a 502, 503 or
+// 504 status. The requests aren't sent while it is open, for cooldown,
+// failing with ErrCircuitOpen, or made to the fallback for calls. Then
+// requests are sent again, the first failure opening the circuit anew and
+// the first success closing it. A zero failures disables the breaker.
+func (c *Client) SetCircuitBreaker(failures int, cooldown time.Duration) {
+	c.breaker.mutex.Lock()
+	defer c.breaker.mutex.Unlock()
+	c.breaker.threshold = failures
+	c.breaker.cooldown = cooldown
+	c.breaker.failures = 0
+	c.breaker.openUntil = time.Time{}
+}
+
+// circuitBreaker stops sending requests to an unreachable server.
+type circuitBreaker struct {
+	mutex     sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	openUntil time.Time
+}
+
+// allow returns true if a request may be sent.
+func (b *circuitBreaker) allow() bool {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	return b.threshold == 0 || !time.Now().Before(b.openUntil)
+}
+
+// record records the outcome of a request.
+func (b *circuitBreaker) record(err error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.threshold == 0 {
+		return
+	}
+	if !unreachable(err) {
+		b.failures = 0
+		return
+	}
+	b.failures++
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+// unreachable returns true for the errors of requests which didn't reach
+// the remote server. A request sent whose response couldn't be read did.
+func unreachable(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var httpErr *HTTPError
+	if errors.As(err, &httpErr) {
+		switch httpErr.StatusCode {
+		case http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+			return true
+		}
+		return false
+	}
+	var transportErr *transportError
+	return errors.As(err, &transportErr) && !transportErr.sent
+}
+
+// fallbackCall makes a call to the fallback if the remote call failed with
+// err without reaching the remote server, or, for idempotent methods,
+// without a response read.
+func (c *Client) fallbackCall(ctx context.Context, method string, args, reply interface{}, err error) error {
+	if c.fallback == nil {
+		return err
+	}
+	var transportErr *transportError
+	lost := errors.As(err, &transportErr) && transportErr.sent && c.idempotentMethod(method)
+	if !(err == ErrCircuitOpen || unreachable(err) || lost) {
+		return err
+	}
+	return c.fallback.Call(ctx, method, args, reply)
+}
@@ -0,0 +1,201 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+	"github.com/agronomhidden/rpc/v2_batch/json2"
+)
+
+// ----------------------------------------------------------------------------
+// Retries
+// ----------------------------------------------------------------------------
+
+// RetryPolicy configures the retries of the calls and notifications of a
+// client, see SetRetryPolicy. Batches aren't retried.
+type RetryPolicy struct {
+	// MaxAttempts is the number of attempts of a call, including the
+	// first. There are no retries below 2.
+	MaxAttempts int
+	// InitialBackoff is the wait before the first retry, 100ms if zero.
+	// It is multiplied by Multiplier, 2 if zero, before each next retry,
+	// up to MaxBackoff, 10s if zero.
+	InitialBackoff time.Duration
+	Multiplier     float64
+	MaxBackoff     time.Duration
+	// Jitter is the fraction of each wait drawn at random, from 0 to 1, to
+	// spread the retries of clients failing together.
+	Jitter float64
+	// RetryAll retries the calls to every method. Otherwise only the calls
+	// to the methods marked idempotent with SetIdempotent are.
+	RetryAll bool
+	// Retryable returns true if a call failing with err may be retried,
+	// IsRetryable if nil.
+	Retryable func(err error) bool
+	// OnAttempt is called after each attempt, e.g. for logs or metrics.
+	OnAttempt func(Attempt)
+}
+
+// Attempt describes an attempt of a call.
+type Attempt struct {
+	Method string
+	// Number is the number of the attempt, from 1.
+	Number int
+	// Err is the error of the attempt, nil if it succeeded.
+	Err error
+	// Backoff is the wait before the next attempt, zero if there is none.
+	Backoff time.Duration
+}
+
+// HTTPError is the error of a request answered with an HTTP status other
+// than 200 and without a JSON-RPC response.
+type HTTPError struct {
+	StatusCode int
+	Body       string
+}
+
+func (e *HTTPError) Error() string {
+	return fmt.Sprintf("rpc: HTTP status %d: %s", e.StatusCode, e.Body)
+}
+
+// SetRetryPolicy sets the retries of the calls and notifications.
+func (c *Client) SetRetryPolicy(p RetryPolicy) {
+	c.retryPolicy = p
+}
+
+// SetIdempotent marks methods as idempotent: they may be retried, as calling
+// them twice has the same effect as calling them once.
+func (c *Client) SetIdempotent(methods ...string) {
+	c.idempotentMutex.Lock()
+	defer c.idempotentMutex.Unlock()
+	if c.idempotent == nil {
+		c.idempotent = make(map[string]bool)
+	}
+	for _, method := range methods {
+		c.idempotent[method] = true
+	}
+}
+
+// retryable returns true if the calls to method may be retried.
+func (c *Client) retryable(method string) bool {
+	if c.retryPolicy.MaxAttempts < 2 {
+		return false
+	}
+	return c.retryPolicy.RetryAll || c.idempotentMethod(method)
+}
+
+// idempotentMethod returns true if method is marked idempotent.
+func (c *Client) idempotentMethod(method string) bool {
+	c.idempotentMutex.RLock()
+	defer c.idempotentMutex.RUnlock()
+	return c.idempotent[method]
+}
+
+// IsRetryable returns true for the errors of calls which may succeed if
+// retried: network errors, 429 and 503 statuses, and the E_SERVER,
+// rpc.CodeUnavailable, rpc.CodeRateLimited and rpc.CodeServiceUnhealthy
+// errors replied by the server.
+func IsRetryable(err error) bool {
+	var httpErr *HTTPError
+	var jsonErr *json2.Error
+	switch {
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return false
+	case errors.As(err, &httpErr):
+		return httpErr.StatusCode == http.StatusTooManyRequests || httpErr.StatusCode == http.StatusServiceUnavailable
+	case errors.As(err, &jsonErr):
+		switch int(jsonErr.Code) {
+		case int(json2.E_SERVER), rpc.CodeUnavailable, rpc.CodeRateLimited, rpc.CodeServiceUnhealthy:
+			return true
+		}
+		return false
+	}
+	// Errors sending the request or reading the response.
+	var transportErr *transportError
+	return errors.As(err, &transportErr)
+}
+
+// transportError is an error sending a request or reading its response.
+type transportError struct {
+	err  error
+	sent bool // the request was sent, but its response couldn't be read
+}
+
+func (e *transportError) Error() string { return e.err.Error() }
+
+func (e *transportError) Unwrap() error { return e.err }
+
+// retry runs attempt, retrying it as the policy allows for method.
+func (c *Client) retry(ctx context.Context, method string, attempt func() error) error {
+	p := c.retryPolicy
+	retryable := p.Retryable
+	if retryable == nil {
+		retryable = IsRetryable
+	}
+	maxAttempts := 1
+	if c.retryable(method) {
+		maxAttempts = p.MaxAttempts
+	}
+	for n := 1; ; n++ {
+		err := attempt()
+		var backoff time.Duration
+		if err != nil && n < maxAttempts && retryable(err) && ctx.Err() == nil {
+			backoff = p.backoff(n, err)
+		}
+		if p.OnAttempt != nil {
+			p.OnAttempt(Attempt{Method: method, Number: n, Err: err, Backoff: backoff})
+		}
+		if backoff == 0 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+	}
+}
+
+// backoff returns the wait before retrying the n-th attempt, which failed
+// with err. The delays asked for by the server with a RetryInfo detail are
+// waited at least.
+func (p *RetryPolicy) backoff(n int, err error) time.Duration {
+	initial, multiplier, maxBackoff := p.InitialBackoff, p.Multiplier, p.MaxBackoff
+	if initial <= 0 {
+		initial = 100 * time.Millisecond
+	}
+	if multiplier <= 0 {
+		multiplier = 2
+	}
+	if maxBackoff <= 0 {
+		maxBackoff = 10 * time.Second
+	}
+	d := math.Min(float64(initial)*math.Pow(multiplier, float64(n-1)), float64(maxBackoff))
+	if jitter := math.Min(math.Max(p.Jitter, 0), 1); jitter > 0 {
+		d -= d * jitter * rand.Float64()
+	}
+	backoff := time.Duration(d)
+	var jsonErr *json2.Error
+	if errors.As(err, &jsonErr) {
+		details, _ := jsonErr.Details()
+		for _, detail := range details {
+			if info, ok := detail.(*rpc.RetryInfo); ok && info.RetryDelay > backoff {
+				backoff = info.RetryDelay
+			}
+		}
+	}
+	if backoff <= 0 {
+		backoff = time.Nanosecond
+	}
+	return backoff
+}
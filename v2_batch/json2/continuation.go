@@ -0,0 +1,136 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+)
+
+// ----------------------------------------------------------------------------
+// Continuation
+// ----------------------------------------------------------------------------
+
+// Continuation is the result of a reply truncated by the codec. Chunk holds
+// the next part of the JSON-encoded result; while Token is not empty, the
+// rest is fetched by calling "system.continue" with ContinueArgs.
+//
+// Concatenating the chunks yields the JSON encoding of the full result.
+type Continuation struct {
+	Truncated bool   `json:"truncated"`
+	Chunk     string `json:"chunk"`
+	Token     string `json:"continuation,omitempty"`
+}
+
+// ContinueArgs are the params of "system.continue".
+type ContinueArgs struct {
+	Token string `json:"token"`
+}
+
+// EnableContinuation makes the codec truncate results larger than chunkSize
+// bytes, returning a Continuation instead. It registers the
+// "system.continue" method on s to fetch the remainder, which is kept for
+// ttl, as measured by the server clock. chunkSize must be positive.
+func (c *Codec) EnableContinuation(s *rpc.Server, chunkSize int, ttl time.Duration) error {
+	if chunkSize <= 0 {
+		return fmt.Errorf("rpc: invalid continuation chunk size %d", chunkSize)
+	}
+	store := &continuationStore{
+		server:    s,
+		chunkSize: chunkSize,
+		ttl:       ttl,
+		entries:   make(map[string]*continuationEntry),
+	}
+	if err := s.RegisterFunc("system.continue", store.serve); err != nil {
+		return err
+	}
+	c.continuations = store
+	return nil
+}
+
+type continuationEntry struct {
+	rest    []byte
+	expires time.Time
+}
+
+// continuationStore keeps the remainders of truncated results.
+type continuationStore struct {
+	server    *rpc.Server
+	chunkSize int
+	ttl       time.Duration
+
+	mutex   sync.Mutex
+	entries map[string]*continuationEntry
+}
+
+// split returns the continuation for an encoded result, or nil if it fits in
+// a single chunk.
+func (s *continuationStore) split(b []byte) *Continuation {
+	if len(b) <= s.chunkSize {
+		return nil
+	}
+	return s.next(b)
+}
+
+// next returns the first chunk of b, storing the rest under a new token.
+func (s *continuationStore) next(b []byte) *Continuation {
+	n := len(b)
+	if n > s.chunkSize {
+		// Don't cut a UTF-8 sequence in half.
+		n = s.chunkSize
+		for n > 0 && !utf8.RuneStart(b[n]) {
+			n--
+		}
+	}
+	cont := &Continuation{Truncated: true, Chunk: string(b[:n])}
+	if n == len(b) {
+		return cont
+	}
+	cont.Token = s.server.NewID()
+	now := s.server.Clock().Now()
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for token, entry := range s.entries {
+		if now.After(entry.expires) {
+			delete(s.entries, token)
+		}
+	}
+	s.entries[cont.Token] = &continuationEntry{rest: b[n:], expires: now.Add(s.ttl)}
+	return cont
+}
+
+// take removes and returns the remainder stored under token.
+func (s *continuationStore) take(token string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	entry, ok := s.entries[token]
+	if !ok {
+		return nil, false
+	}
+	delete(s.entries, token)
+	if s.server.Clock().Now().After(entry.expires) {
+		return nil, false
+	}
+	return entry.rest, true
+}
+
+// serve implements "system.continue".
+func (s *continuationStore) serve(r *http.Request, args *ContinueArgs, reply *Continuation) error {
+	rest, ok := s.take(args.Token)
+	if !ok {
+		return &Error{
+			Code:    E_BAD_PARAMS,
+			Message: "rpc: unknown or expired continuation token",
+		}
+	}
+	*reply = *s.next(rest)
+	return nil
+}
@@ -0,0 +1,110 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+)
+
+// ----------------------------------------------------------------------------
+// Contract tests
+// ----------------------------------------------------------------------------
+
+// ContractTest checks one documented method example against a server.
+type ContractTest struct {
+	// Name identifies the test, e.g. "Service1.Multiply/Example".
+	Name string
+	// Method is the method called by the test.
+	Method string
+	// Example is the documented example.
+	Example rpc.MethodExample
+
+	server      *rpc.Server
+	contentType string
+}
+
+// ContractTests returns a test for every example documented on the server's
+// methods. contentType must be the one this codec is registered with.
+//
+// They are meant to be run from a regular test so that docs and behavior are
+// kept in sync:
+//
+//	for _, ct := range json2.ContractTests(s, "application/json") {
+//		t.Run(ct.Name, func(t *testing.T) {
+//			if err := ct.Run(); err != nil {
+//				t.Error(err)
+//			}
+//		})
+//	}
+func ContractTests(s *rpc.Server, contentType string) []ContractTest {
+	var tests []ContractTest
+	for _, method := range s.Methods() {
+		doc, _ := s.MethodDoc(method)
+		for i, example := range doc.Examples {
+			name := example.Name
+			if name == "" {
+				name = fmt.Sprintf("Example%d", i+1)
+			}
+			tests = append(tests, ContractTest{
+				Name:        method + "/" + name,
+				Method:      method,
+				Example:     example,
+				server:      s,
+				contentType: contentType,
+			})
+		}
+	}
+	return tests
+}
+
+// Run posts the example params to the server and compares the reply with
+// the example result.
+func (ct ContractTest) Run() error {
+	buf, err := EncodeClientRequest(ct.Method, ct.Example.Params)
+	if err != nil {
+		return err
+	}
+	r, err := http.NewRequest("POST", "http://localhost/", bytes.NewReader(buf))
+	if err != nil {
+		return err
+	}
+	r.Header.Set("Content-Type", ct.contentType)
+	w := httptest.NewRecorder()
+	ct.server.ServeHTTP(w, r)
+
+	var got interface{}
+	if err := DecodeClientResponse(w.Body, &got); err != nil {
+		return fmt.Errorf("%s: %v", ct.Name, err)
+	}
+	want, err := normalizeJSON(ct.Example.Result)
+	if err != nil {
+		return fmt.Errorf("%s: can't encode example result: %v", ct.Name, err)
+	}
+	if !reflect.DeepEqual(got, want) {
+		gotJSON, _ := json.Marshal(got)
+		wantJSON, _ := json.Marshal(want)
+		return fmt.Errorf("%s: got result %s, want %s", ct.Name, gotJSON, wantJSON)
+	}
+	return nil
+}
+
+// normalizeJSON round-trips v through JSON so it compares equal to a
+// decoded reply.
+func normalizeJSON(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	var n interface{}
+	err = json.Unmarshal(b, &n)
+	return n, err
+}
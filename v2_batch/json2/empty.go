@@ -0,0 +1,62 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"reflect"
+)
+
+// EmptyResultPolicy tells how nil results, and results of a struct type
+// without fields, are encoded.
+type EmptyResultPolicy int
+
+const (
+	// EmptyResultAsIs encodes nil results as null and empty structs as {}.
+	// This is the default.
+	EmptyResultAsIs EmptyResultPolicy = iota
+	// EmptyResultNull encodes nil results and empty structs as null.
+	EmptyResultNull
+	// EmptyResultObject encodes nil results and empty structs as {}.
+	EmptyResultObject
+)
+
+// SetEmptyResultPolicy sets how nil and empty results are encoded. Methods
+// replying EmptyResponse or NullResponse get {} or null whatever the policy.
+func (c *Codec) SetEmptyResultPolicy(policy EmptyResultPolicy) {
+	c.emptyPolicy = policy
+}
+
+// NullResponse is a reply always encoded as null, for methods whose clients
+// expect a null result.
+type NullResponse struct{}
+
+// MarshalJSON encodes the response as null.
+func (NullResponse) MarshalJSON() ([]byte, error) {
+	return null, nil
+}
+
+// emptyResult applies the empty result policy of the codec to a result.
+func (c *Codec) emptyResult(reply interface{}) interface{} {
+	switch reply.(type) {
+	case *EmptyResponse, EmptyResponse, *NullResponse, NullResponse:
+		return reply
+	}
+	v := reflect.ValueOf(reply)
+	if !v.IsValid() || v.Kind() == reflect.Ptr && v.IsNil() {
+		if c.emptyPolicy == EmptyResultObject {
+			return EmptyResponse{}
+		}
+		return null
+	}
+	if v = reflect.Indirect(v); v.Kind() == reflect.Struct && v.NumField() == 0 {
+		switch c.emptyPolicy {
+		case EmptyResultNull:
+			return null
+		case EmptyResultObject:
+			return EmptyResponse{}
+		}
+	}
+	return reply
+}
@@ -0,0 +1,57 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+)
+
+// ----------------------------------------------------------------------------
+// JSON engines
+// ----------------------------------------------------------------------------
+
+// JSONEngine encodes and decodes JSON as encoding/json does. The
+// configurations of jsoniter and sonic compatible with the standard library
+// implement it:
+//
+//	codec := json2.NewCodecWithJSON(jsoniter.ConfigCompatibleWithStandardLibrary)
+//	codec := json2.NewCodecWithJSON(sonic.ConfigStd)
+type JSONEngine interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+// NewCodecWithJSON returns a new JSON Codec decoding params and encoding
+// results with j. The envelope of the messages is still handled by
+// encoding/json, as are the error data.
+func NewCodecWithJSON(j JSONEngine) *Codec {
+	c := NewCustomCodec(rpc.DefaultEncoderSelector)
+	c.json = j
+	return c
+}
+
+// marshal encodes v with the engine of the codec.
+func (c *Codec) marshal(v interface{}) ([]byte, error) {
+	if c.json != nil {
+		return c.json.Marshal(v)
+	}
+	return json.Marshal(v)
+}
+
+// unmarshal decodes data into v with the engine of the codec.
+func (c *Codec) unmarshal(data []byte, v interface{}) error {
+	if c.json != nil {
+		return c.json.Unmarshal(data, v)
+	}
+	if c.strictParams {
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.DisallowUnknownFields()
+		return dec.Decode(v)
+	}
+	return json.Unmarshal(data, v)
+}
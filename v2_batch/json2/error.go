@@ -5,6 +5,10 @@
 
 package json2
 
+import (
+	"github.com/agronomhidden/rpc/v2_batch"
+)
+
 type ErrorCode int
 
 const (
@@ -31,3 +35,33 @@ type Error struct {
 func (e *Error) Error() string {
 	return e.Message
 }
+
+// ErrorCode returns the error code, for server metrics.
+func (e *Error) ErrorCode() int {
+	return int(e.Code)
+}
+
+// newError converts err to an *Error. Errors carrying a code, such as
+// *rpc.Error, keep their code and data; others are reported as E_SERVER.
+func newError(err error) *Error {
+	if jsonErr, ok := err.(*Error); ok {
+		return jsonErr
+	}
+	jsonErr := &Error{
+		Code:    E_SERVER,
+		Message: err.Error(),
+	}
+	if code, ok := rpc.ErrorCode(err); ok {
+		jsonErr.Code = ErrorCode(code)
+	}
+	if d, ok := err.(interface{ ErrorData() interface{} }); ok {
+		jsonErr.Data = d.ErrorData()
+	}
+	return jsonErr
+}
+
+// Details decodes the typed error details carried by the error data, as
+// built on the server with rpc.NewErrorWithDetails.
+func (e *Error) Details() ([]rpc.ErrorDetail, error) {
+	return rpc.ParseErrorDetails(e.Data)
+}
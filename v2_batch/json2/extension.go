@@ -0,0 +1,79 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"encoding/json"
+	"sort"
+)
+
+// envelopeMembers are the members of the request and response envelopes
+// defined by the protocol, or by this package for "meta".
+var envelopeMembers = map[string]bool{
+	"jsonrpc": true,
+	"method":  true,
+	"params":  true,
+	"id":      true,
+	"result":  true,
+	"error":   true,
+	"meta":    true,
+}
+
+// Extensions returns the members of the request envelope unknown to the
+// protocol, e.g. "traceparent". It implements rpc.ExtensionReader.
+func (c *CodecRequest) Extensions() map[string]json.RawMessage {
+	return c.request.extensions
+}
+
+// WithExtensions adds members to the response envelope, except those of the
+// protocol. It implements rpc.ExtensionReplier.
+func (c *CodecRequest) WithExtensions(reply interface{}, extensions map[string]interface{}) interface{} {
+	if res, ok := reply.(*serverResponse); ok {
+		for name, value := range extensions {
+			if envelopeMembers[name] {
+				continue
+			}
+			if res.extensions == nil {
+				res.extensions = make(map[string]interface{})
+			}
+			res.extensions[name] = value
+		}
+	}
+	return reply
+}
+
+// MarshalJSON encodes the response, followed by its extension members
+// sorted by name.
+func (r *serverResponse) MarshalJSON() ([]byte, error) {
+	if r.version1 {
+		return marshalVersion1(r)
+	}
+	type plain serverResponse
+	b, err := json.Marshal((*plain)(r))
+	if err != nil || len(r.extensions) == 0 {
+		return b, err
+	}
+	names := make([]string, 0, len(r.extensions))
+	for name := range r.extensions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var buf bytes.Buffer
+	buf.Write(b[:len(b)-1])
+	for _, name := range names {
+		value, err := json.Marshal(r.extensions[name])
+		if err != nil {
+			return nil, err
+		}
+		key, _ := json.Marshal(name)
+		buf.WriteByte(',')
+		buf.Write(key)
+		buf.WriteByte(':')
+		buf.Write(value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
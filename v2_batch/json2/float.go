@@ -0,0 +1,150 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strings"
+)
+
+// NonFinitePolicy tells how non-finite floats (NaN and infinities), which
+// JSON can't represent, are encoded in results.
+type NonFinitePolicy int
+
+const (
+	// NonFiniteError replies an E_INTERNAL error. This is the default.
+	NonFiniteError NonFinitePolicy = iota
+	// NonFiniteNull encodes non-finite floats as null.
+	NonFiniteNull
+	// NonFiniteString encodes non-finite floats as the strings "NaN",
+	// "Infinity" and "-Infinity".
+	NonFiniteString
+)
+
+// SetNonFinitePolicy sets how non-finite floats are encoded in results.
+//
+// Results holding non-finite floats are re-encoded generically under the
+// other policies, with the members of objects sorted by name.
+func (c *Codec) SetNonFinitePolicy(policy NonFinitePolicy) {
+	c.nonFinite = policy
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// replaceNonFinite returns a generic copy of v, following the rules of
+// encoding/json, where non-finite floats are replaced according to policy.
+func replaceNonFinite(v reflect.Value, policy NonFinitePolicy) interface{} {
+	if !v.IsValid() {
+		return nil
+	}
+	if v.Type().Implements(jsonMarshalerType) || v.Type().Implements(textMarshalerType) {
+		if v.Kind() == reflect.Ptr && v.IsNil() {
+			return nil
+		}
+		return v.Interface()
+	}
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		f := v.Float()
+		if !math.IsNaN(f) && !math.IsInf(f, 0) {
+			return v.Interface()
+		}
+		if policy == NonFiniteNull {
+			return nil
+		}
+		switch {
+		case math.IsNaN(f):
+			return "NaN"
+		case f > 0:
+			return "Infinity"
+		}
+		return "-Infinity"
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return nil
+		}
+		return replaceNonFinite(v.Elem(), policy)
+	case reflect.Struct:
+		obj := make(map[string]interface{})
+		replaceFields(v, policy, obj)
+		return obj
+	case reflect.Slice:
+		if v.IsNil() {
+			return nil
+		}
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Interface()
+		}
+		fallthrough
+	case reflect.Array:
+		arr := make([]interface{}, v.Len())
+		for i := range arr {
+			arr[i] = replaceNonFinite(v.Index(i), policy)
+		}
+		return arr
+	case reflect.Map:
+		if v.IsNil() {
+			return nil
+		}
+		obj := make(map[string]interface{}, v.Len())
+		iter := v.MapRange()
+		for iter.Next() {
+			key := iter.Key()
+			name := fmt.Sprint(key.Interface())
+			if m, ok := key.Interface().(encoding.TextMarshaler); ok {
+				if text, err := m.MarshalText(); err == nil {
+					name = string(text)
+				}
+			}
+			obj[name] = replaceNonFinite(iter.Value(), policy)
+		}
+		return obj
+	}
+	return v.Interface()
+}
+
+// replaceFields adds the fields of struct v to obj, as named by their json
+// tags, flattening untagged embedded structs.
+func replaceFields(v reflect.Value, policy NonFinitePolicy, obj map[string]interface{}) {
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		fv := v.Field(i)
+		if f.Anonymous && name == "" {
+			if fv.Kind() == reflect.Ptr {
+				if fv.IsNil() {
+					continue
+				}
+				fv = fv.Elem()
+			}
+			if fv.Kind() == reflect.Struct {
+				replaceFields(fv, policy, obj)
+				continue
+			}
+		}
+		if f.PkgPath != "" {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		if strings.Contains(","+opts+",", ",omitempty,") && fv.IsZero() && fv.Kind() != reflect.Struct {
+			continue
+		}
+		obj[name] = replaceNonFinite(fv, policy)
+	}
+}
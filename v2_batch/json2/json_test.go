@@ -6,13 +6,32 @@
 package json2
 
 import (
+	"bufio"
 	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/agronomhidden/rpc/v2_batch"
+	"github.com/agronomhidden/rpc/v2_batch/codectest"
 )
 
 // ResponseRecorder is an implementation of http.ResponseWriter that
@@ -143,3 +162,2458 @@ func TestService(t *testing.T) {
 		t.Errorf("Expected error but error in nil")
 	}
 }
+
+func TestContractTests(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.DescribeMethod("Service1.Multiply", rpc.MethodDoc{
+		Examples: []rpc.MethodExample{
+			{Name: "Good", Params: Service1Request{4, 2}, Result: Service1Response{8}},
+			{Name: "Bad", Params: Service1Request{4, 2}, Result: Service1Response{9}},
+		},
+	})
+	tests := ContractTests(s, "application/json")
+	if len(tests) != 2 {
+		t.Fatalf("Expected 2 contract tests, got %d", len(tests))
+	}
+	if err := tests[0].Run(); err != nil {
+		t.Errorf("Expected %s to pass, got %v", tests[0].Name, err)
+	}
+	if err := tests[1].Run(); err == nil {
+		t.Errorf("Expected %s to fail", tests[1].Name)
+	}
+}
+
+func TestParamsLimits(t *testing.T) {
+	codec := NewCodec()
+	codec.SetParamsLimits(ParamsLimits{MaxSize: 40, MaxDepth: 2, MaxArrayLen: 3, MaxStringLen: 5})
+
+	tests := []struct {
+		params string
+		ok     bool
+	}{
+		{`{"A":4,"B":2}`, true},
+		{`{"A":4,"B":2,"C":[1,2,3]}`, true},
+		{`{"A":4,"B":2,"C":[1,2,3,4]}`, false},
+		{`{"A":4,"B":2,"C":[[1]]}`, false},
+		{`{"A":4,"B":2,"C":"abcdef"}`, false},
+		{`{"A":4,"B":2,"C":1,"D":1,"E":1,"F":1,"G":1}`, false},
+	}
+	for _, test := range tests {
+		body := `{"jsonrpc":"2.0","method":"Service1.Multiply","id":1,"params":` + test.params + `}`
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+		reqs, err := codec.NewRequest(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = reqs[0].ReadRequest(new(Service1Request))
+		if test.ok && err != nil {
+			t.Errorf("%s: expected no error, got %v", test.params, err)
+		}
+		if !test.ok {
+			if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != E_BAD_PARAMS {
+				t.Errorf("%s: expected E_BAD_PARAMS, got %v", test.params, err)
+			}
+		}
+	}
+}
+
+func TestCharset(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	tests := []struct {
+		contentType string
+		body        string
+		ok          bool
+	}{
+		{"application/json", "{\"jsonrpc\":\"2.0\",\"method\":\"Service1.Multiply\",\"id\":1,\"params\":{\"A\":4,\"B\":2,\"C\":\"\xe9\"}}", false},
+		{"application/json; charset=iso-8859-1", "{\"jsonrpc\":\"2.0\",\"method\":\"Service1.Multiply\",\"id\":1,\"params\":{\"A\":4,\"B\":2,\"C\":\"\xe9\"}}", true},
+		{"application/json; charset=utf-16", `{"jsonrpc":"2.0","method":"Service1.Multiply","id":1,"params":{"A":4,"B":2}}`, false},
+	}
+	for _, test := range tests {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(test.body))
+		r.Header.Set("Content-Type", test.contentType)
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var res Service1Response
+		err := DecodeClientResponse(w.Body, &res)
+		if test.ok && (err != nil || res.Result != 8) {
+			t.Errorf("%s: expected result 8, got %v (%v)", test.contentType, res.Result, err)
+		}
+		if !test.ok {
+			if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != E_PARSE {
+				t.Errorf("%s: expected E_PARSE, got %v", test.contentType, err)
+			}
+		}
+	}
+}
+
+func TestBatchChunking(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetBatchChunking(0, 2)
+
+	body := `[
+		{"jsonrpc":"2.0","method":"Service1.Multiply","id":1,"params":{"A":1,"B":2}},
+		{"jsonrpc":"2.0","method":"Service1.Multiply","id":2,"params":{"A":2,"B":2}},
+		{"jsonrpc":"1.0","method":"Service1.Multiply","id":3,"params":{"A":3,"B":2}}
+	]`
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBufferString(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var replies []struct {
+		Result *Service1Response
+		Error  *Error
+		Id     int
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &replies); err != nil {
+		t.Fatalf("Invalid batch reply %q: %v", w.Body.String(), err)
+	}
+	if len(replies) != 3 {
+		t.Fatalf("Expected 3 replies, got %d", len(replies))
+	}
+	for i, reply := range replies[:2] {
+		if reply.Id != i+1 || reply.Result == nil || reply.Result.Result != (i+1)*2 {
+			t.Errorf("Wrong reply %d: %+v", i, reply)
+		}
+	}
+	if replies[2].Error == nil || replies[2].Error.Code != E_INVALID_REQ {
+		t.Errorf("Expected E_INVALID_REQ for the last entry, got %+v", replies[2])
+	}
+	if status := w.Header().Get(rpc.StatusTrailer); status != "200" {
+		t.Errorf("Expected a 200 status trailer, got %q", status)
+	}
+}
+
+func TestMaxReplySize(t *testing.T) {
+	codec := NewCodec()
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	codec.SetMaxReplySize(100)
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected result 8, got %v (%v)", res.Result, err)
+	}
+	codec.SetMaxReplySize(5)
+	err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != E_INTERNAL {
+		t.Errorf("Expected E_INTERNAL, got %v", err)
+	}
+}
+
+type Service2 struct {
+}
+
+type Service2Response struct {
+	Text string
+}
+
+func (t *Service2) Repeat(r *http.Request, req *Service1Request, res *Service2Response) error {
+	res.Text = strings.Repeat("é", req.A)
+	return nil
+}
+
+func TestContinuation(t *testing.T) {
+	codec := NewCodec()
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service2), "")
+	if err := codec.EnableContinuation(s, 0, time.Minute); err == nil {
+		t.Error("Expected an error for an empty chunk size")
+	}
+	if err := codec.EnableContinuation(s, 16, time.Minute); err != nil {
+		t.Fatal(err)
+	}
+
+	var cont Continuation
+	if err := execute(t, s, "Service2.Repeat", &Service1Request{A: 20}, &cont); err != nil {
+		t.Fatal(err)
+	}
+	encoded := cont.Chunk
+	for cont.Token != "" {
+		if len(cont.Chunk) > 16 {
+			t.Errorf("Chunk larger than 16 bytes: %q", cont.Chunk)
+		}
+		token := cont.Token
+		cont = Continuation{}
+		if err := execute(t, s, "system.continue", &ContinueArgs{token}, &cont); err != nil {
+			t.Fatal(err)
+		}
+		encoded += cont.Chunk
+	}
+	var res Service2Response
+	if err := json.Unmarshal([]byte(encoded), &res); err != nil {
+		t.Fatalf("Invalid reassembled result %q: %v", encoded, err)
+	}
+	if res.Text != strings.Repeat("é", 20) {
+		t.Errorf("Wrong reassembled result: %q", res.Text)
+	}
+}
+
+func TestExpvarMetrics(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetMetrics(rpc.NewExpvarMetrics("json2_test"))
+	// The counters survive the servers built before in the process, as
+	// with go test -count.
+	vars := expvar.Get("json2_test").(*expvar.Map)
+	requests := vars.Get("requests").(*expvar.Int).Value()
+	var uncoded int64
+	if v, ok := vars.Get("errors").(*expvar.Map).Get("uncoded").(*expvar.Int); ok {
+		uncoded = v.Value()
+	}
+
+	var res Service1Response
+	execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res)
+	// A rebuilt server reuses the counters.
+	s.SetMetrics(rpc.NewExpvarMetrics("json2_test"))
+	execute(t, s, "Service1.ResponseError", &Service1Request{4, 2}, &res)
+
+	if got := vars.Get("requests").(*expvar.Int).Value() - requests; got != 2 {
+		t.Errorf("Expected 2 requests, got %d", got)
+	}
+	if got := vars.Get("errors").(*expvar.Map).Get("uncoded").(*expvar.Int).Value() - uncoded; got != 1 {
+		t.Errorf("Expected 1 uncoded error, got %d", got)
+	}
+	if got := vars.Get("inflight").String(); got != "0" {
+		t.Errorf("Expected no batch in flight, got %s", got)
+	}
+
+	// Methods not served are reported as unknown.
+	var buf bytes.Buffer
+	statsd := rpc.NewStatsDMetrics(&buf, "")
+	statsd.DogStatsD = true
+	s.SetMetrics(statsd)
+	executeRaw(t, s, &clientRequest{Version: "2.0", Method: "Service1.Nope|x", Params: &Service1Request{4, 2}, Id: 1}, &res)
+	if !strings.Contains(buf.String(), "calls:1|c|#method:unknown,") {
+		t.Errorf("Expected an unknown method, got %q", buf.String())
+	}
+}
+
+func TestChaos(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	chaos := rpc.NewChaos(1)
+	chaos.SetFault("Service1.Multiply", rpc.Fault{ErrorProbability: 1, ErrorCode: -32050, ErrorMessage: "injected"})
+	s.SetChaos(chaos)
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Errorf("Expected no fault while chaos is disabled, got %v", err)
+	}
+	chaos.Enable(true)
+	err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != -32050 || jsonErr.Message != "injected" {
+		t.Errorf("Expected injected error, got %v", err)
+	}
+}
+
+func TestRecordReplay(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	var records bytes.Buffer
+	s.SetRecorder(rpc.NewRecordWriter(&records))
+
+	var res Service1Response
+	execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res)
+	execute(t, s, "Service1.Multiply", &Service1Request{3, 3}, &res)
+	recorded := records.String()
+
+	report, err := rpc.Replay(context.Background(), s, strings.NewReader(recorded), rpc.ReplayOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if report.Total != 2 || report.Matched != 2 {
+		t.Errorf("Expected 2 matching records, got %+v", report)
+	}
+
+	// A refactored service answering differently is reported.
+	s2 := rpc.NewServer()
+	s2.RegisterCodec(NewCodec(), "application/json")
+	s2.RegisterService(new(Service1), "")
+	chaos := rpc.NewChaos(1)
+	chaos.SetFault("*", rpc.Fault{ErrorProbability: 1, ErrorCode: -32050})
+	chaos.Enable(true)
+	s2.SetChaos(chaos)
+	report, err = rpc.Replay(context.Background(), s2, strings.NewReader(recorded), rpc.ReplayOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.Mismatches) != 2 {
+		t.Errorf("Expected 2 mismatches, got %+v", report)
+	}
+}
+
+func TestRetireMethod(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	clock := rpc.NewManualClock(time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC))
+	s.SetClock(clock)
+	s.RetireMethod("Service1.Multiply", rpc.Retirement{
+		Replacement: "Service1.Times",
+		Until:       clock.Now().Add(time.Hour),
+	})
+
+	var res Service1Response
+	err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res)
+	jsonErr, ok := err.(*Error)
+	if !ok || jsonErr.Code != rpc.CodeMethodRetired {
+		t.Fatalf("Expected CodeMethodRetired, got %v", err)
+	}
+	if data, _ := jsonErr.Data.(map[string]interface{}); data["replacement"] != "Service1.Times" {
+		t.Errorf("Expected replacement in data, got %v", jsonErr.Data)
+	}
+	// The lowerCamel name is the same method.
+	err = execute(t, s, "Service1.multiply", &Service1Request{4, 2}, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != rpc.CodeMethodRetired {
+		t.Errorf("Expected CodeMethodRetired for the lowerCamel name, got %v", err)
+	}
+
+	clock.Advance(2 * time.Hour)
+	err = execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != E_NO_METHOD {
+		t.Errorf("Expected method not found after the grace period, got %v", err)
+	}
+}
+
+func TestUsageReport(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetCallerFunc(func(r *http.Request) string { return r.Header.Get("X-Api-Key") })
+	s.EnableUsageTracking()
+
+	call := func(method, key string) {
+		buf, _ := EncodeClientRequest(method, &Service1Request{4, 2})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Api-Key", key)
+		s.ServeHTTP(NewRecorder(), r)
+	}
+	call("Service1.Multiply", "a")
+	call("Service1.Multiply", "b")
+	call("Service1.multiply", "a")
+	report := s.UsageReport("Service1.Multiply")
+	if len(report) != 2 || report[0].Caller != "a" || report[0].Calls != 2 || report[1].Calls != 1 {
+		t.Errorf("Unexpected usage report: %+v", report)
+	}
+
+	// Unknown methods share a single entry.
+	call("Service1.Nope", "a")
+	call("Nope.Multiply", "a")
+	report = s.UsageReport("")
+	if len(report) != 3 || report[2].Method != "unknown" || report[2].Calls != 2 {
+		t.Errorf("Expected unknown methods tracked together, got %+v", report)
+	}
+}
+
+func TestFieldAliases(t *testing.T) {
+	codec := NewCodec()
+	codec.SetFieldAliases("Service1.Multiply", FieldAliases{
+		Params: map[string]string{"X": "A", "Y": "B"},
+	})
+	codec.SetFieldAliases("Service2.Repeat", FieldAliases{
+		Reply: map[string]string{"body": "Text"},
+	})
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(new(Service2), "")
+
+	var res Service1Response
+	err := execute(t, s, "Service1.Multiply", map[string]int{"X": 4, "Y": 2}, &res)
+	if err != nil || res.Result != 8 {
+		t.Errorf("Expected 8 from aliased params, got %d, %v", res.Result, err)
+	}
+	err = execute(t, s, "Service1.Multiply", map[string]int{"X": 1, "A": 4, "B": 2}, &res)
+	if err != nil || res.Result != 8 {
+		t.Errorf("Expected current keys to win, got %d, %v", res.Result, err)
+	}
+
+	var reply map[string]string
+	err = execute(t, s, "Service2.Repeat", &Service1Request{A: 2}, &reply)
+	if err != nil || reply["body"] != "éé" || reply["Text"] != "" {
+		t.Errorf("Expected aliased reply key, got %v, %v", reply, err)
+	}
+}
+
+func (t *Service2) Panic(r *http.Request, req *Service1Request, res *Service2Response) error {
+	panic("boom")
+}
+
+func (t *Service2) Empty(r *http.Request, req *Service1Request, res *EmptyResponse) error {
+	return nil
+}
+
+func (t *Service2) Null(r *http.Request, req *Service1Request, res *NullResponse) error {
+	return nil
+}
+
+func (t *Service2) Nothing(r *http.Request, req *Service1Request, res *struct{}) error {
+	return nil
+}
+
+func (t *Service2) Save(ctx context.Context, req *Service1Request, res *Service2Response) error {
+	if err := rpc.CheckVersion(ctx, "7"); err != nil {
+		return err
+	}
+	rpc.SetVersion(ctx, "8")
+	return nil
+}
+
+func (t *Service2) Traced(ctx context.Context, req *Service1Request, res *Service2Response) error {
+	res.Text = string(rpc.RequestExtensions(ctx)["traceparent"])
+	rpc.SetResponseExtension(ctx, "traceparent", "00-reply")
+	rpc.SetResponseExtension(ctx, "id", 42)
+	return nil
+}
+
+func (t *Service2) Ticks(ctx context.Context, req *Service1Request) (*rpc.Subscription, error) {
+	sub, err := rpc.NewSubscription(ctx)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for i := 0; i < req.A; i++ {
+			sub.Notify(i)
+		}
+	}()
+	return &sub, nil
+}
+
+func (t *Service2) Quota(r *http.Request, req *Service1Request, res *Service2Response) error {
+	return rpc.NewErrorWithDetails(429, "quota exceeded",
+		&rpc.QuotaFailure{Violations: []rpc.QuotaViolation{{Subject: "project:1", Description: "daily limit"}}},
+		&rpc.RetryInfo{RetryDelay: 1500 * time.Millisecond},
+	)
+}
+
+func TestErrorDetails(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service2), "")
+
+	var res Service2Response
+	err := execute(t, s, "Service2.Quota", &Service1Request{}, &res)
+	jsonErr, ok := err.(*Error)
+	if !ok || jsonErr.Code != 429 {
+		t.Fatalf("Expected a 429 error, got %v", err)
+	}
+	details, err := jsonErr.Details()
+	if err != nil || len(details) != 2 {
+		t.Fatalf("Expected 2 details, got %v, %v", details, err)
+	}
+	quota, ok := details[0].(*rpc.QuotaFailure)
+	if !ok || len(quota.Violations) != 1 || quota.Violations[0].Subject != "project:1" {
+		t.Errorf("Unexpected quota failure: %#v", details[0])
+	}
+	retry, ok := details[1].(*rpc.RetryInfo)
+	if !ok || retry.RetryDelay != 1500*time.Millisecond {
+		t.Errorf("Unexpected retry info: %#v", details[1])
+	}
+}
+
+func (t *Service2) Cached(r *http.Request, req *Service1Request, res *Service2Response) error {
+	rpc.SetResponseHeader(r.Context(), "Cache-Control", "max-age=60")
+	res.Text = "cached"
+	return nil
+}
+
+func TestSetResponseHeader(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service2), "")
+
+	buf, _ := EncodeClientRequest("Service2.Cached", &Service1Request{})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+	if got := w.Header().Get("Cache-Control"); got != "max-age=60" {
+		t.Errorf("Expected Cache-Control header, got %q", got)
+	}
+
+	batch := `[{"jsonrpc":"2.0","method":"Service2.Cached","params":{},"id":1},` +
+		`{"jsonrpc":"2.0","method":"Service2.Repeat","params":{"A":1},"id":2}]`
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(batch))
+	r.Header.Set("Content-Type", "application/json")
+	w = NewRecorder()
+	s.ServeHTTP(w, r)
+	var replies []struct {
+		Meta struct {
+			Headers http.Header `json:"headers"`
+		} `json:"meta"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &replies); err != nil || len(replies) != 2 {
+		t.Fatalf("Unexpected batch response %s: %v", w.Body, err)
+	}
+	if got := replies[0].Meta.Headers.Get("Cache-Control"); got != "max-age=60" {
+		t.Errorf("Expected Cache-Control in reply meta, got %q", got)
+	}
+	if replies[1].Meta.Headers != nil || w.Header().Get("Cache-Control") != "" {
+		t.Errorf("Unexpected headers on other replies: %s", w.Body)
+	}
+}
+
+// barrier is awaited by Service2.Barrier.
+var barrier sync.WaitGroup
+
+func (t *Service2) Barrier(r *http.Request, req *Service1Request, res *Service2Response) error {
+	barrier.Done()
+	done := make(chan struct{})
+	go func() {
+		barrier.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		res.Text = strconv.Itoa(req.A)
+		return nil
+	case <-time.After(5 * time.Second):
+		return errors.New("calls not run concurrently")
+	}
+}
+
+func TestBatchConcurrency(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service2), "")
+	s.SetBatchConcurrency(3)
+
+	barrier.Add(3)
+	batch := `[{"jsonrpc":"2.0","method":"Service2.Barrier","params":{"A":1},"id":1},` +
+		`{"jsonrpc":"2.0","method":"Service2.Barrier","params":{"A":2},"id":2},` +
+		`{"jsonrpc":"2.0","method":"Service2.Barrier","params":{"A":3},"id":3}]`
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(batch))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var replies []struct {
+		Result Service2Response `json:"result"`
+		Id     int              `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &replies); err != nil || len(replies) != 3 {
+		t.Fatalf("Unexpected batch response %s: %v", w.Body, err)
+	}
+	for i, reply := range replies {
+		if reply.Id != i+1 || reply.Result.Text != strconv.Itoa(i+1) {
+			t.Errorf("Unexpected reply %d: %+v", i, reply)
+		}
+	}
+
+	// A panic in middleware on a worker only fails its request.
+	s.Use(func(next rpc.Handler) rpc.Handler {
+		return func(call *rpc.MethodCall) (interface{}, error) {
+			if call.Method == "Service1.Multiply" {
+				panic("boom")
+			}
+			return next(call)
+		}
+	})
+	s.RegisterService(new(Service1), "")
+	batch = `[{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":1,"B":2},"id":1},` +
+		`{"jsonrpc":"2.0","method":"Service2.Repeat","params":{"A":2},"id":2}]`
+	r, _ = http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(batch))
+	r.Header.Set("Content-Type", "application/json")
+	w = NewRecorder()
+	s.ServeHTTP(w, r)
+	var results []struct {
+		Error *Error `json:"error"`
+		Id    int    `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &results); err != nil || len(results) != 2 {
+		t.Fatalf("Unexpected batch response %s: %v", w.Body, err)
+	}
+	if results[0].Error == nil || results[0].Error.Code != E_INTERNAL || results[1].Error != nil {
+		t.Errorf("Expected only the panicking request to fail, got %s", w.Body)
+	}
+}
+
+// cachedCalls counts the calls of Service2.Cacheable.
+var cachedCalls int
+
+func (t *Service2) Cacheable(r *http.Request, req *Service1Request, res *Service2Response) error {
+	cachedCalls++
+	rpc.SetCacheTTL(r.Context(), time.Minute)
+	res.Text = strconv.Itoa(req.A)
+	return nil
+}
+
+func TestReplyCache(t *testing.T) {
+	clock := rpc.NewManualClock(time.Unix(0, 0))
+	s := rpc.NewServer()
+	s.SetClock(clock)
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service2), "")
+	s.SetReplyCache(10)
+	s.SetCallerFunc(func(r *http.Request) string { return r.Header.Get("X-Api-Key") })
+
+	caller := "a"
+	call := func(a int) (string, string) {
+		buf, _ := EncodeClientRequest("Service2.Cacheable", &Service1Request{A: a})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Api-Key", caller)
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		var res Service2Response
+		if err := DecodeClientResponse(w.Body, &res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Text, w.Header().Get("Cache-Control")
+	}
+
+	cachedCalls = 0
+	if text, cc := call(1); text != "1" || cc != "private, max-age=60" {
+		t.Errorf("Unexpected reply %q with Cache-Control %q", text, cc)
+	}
+	clock.Advance(20 * time.Second)
+	if text, cc := call(1); text != "1" || cc != "private, max-age=40" || cachedCalls != 1 {
+		t.Errorf("Expected cached reply, got %q with Cache-Control %q after %d calls", text, cc, cachedCalls)
+	}
+	if call(2); cachedCalls != 2 {
+		t.Errorf("Expected other params to miss the cache, got %d calls", cachedCalls)
+	}
+	caller = "b"
+	if call(1); cachedCalls != 3 {
+		t.Errorf("Expected another caller to miss the cache, got %d calls", cachedCalls)
+	}
+	caller = "a"
+	clock.Advance(time.Minute)
+	if call(1); cachedCalls != 4 {
+		t.Errorf("Expected expired entry to miss the cache, got %d calls", cachedCalls)
+	}
+}
+
+func TestBatchItemErrors(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	batch := `[{"jsonrpc":"2.0","method":"Service1.Unknown","params":{},"id":1},` +
+		`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":"x"},"id":2},` +
+		`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":3}]`
+	serve := func() *ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(batch))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	var replies []struct {
+		Result *Service1Response `json:"result"`
+		Error  *Error            `json:"error"`
+		Id     int               `json:"id"`
+	}
+	w := serve()
+	if err := json.Unmarshal(w.Body.Bytes(), &replies); err != nil || len(replies) != 3 {
+		t.Fatalf("Unexpected batch response %s: %v", w.Body, err)
+	}
+	if replies[0].Error == nil || replies[0].Error.Code != E_NO_METHOD {
+		t.Errorf("Expected method not found, got %+v", replies[0])
+	}
+	if replies[1].Error == nil || replies[1].Error.Code != E_INVALID_REQ {
+		t.Errorf("Expected invalid params, got %+v", replies[1])
+	}
+	if replies[2].Result == nil || replies[2].Result.Result != 8 {
+		t.Errorf("Expected 8, got %+v", replies[2])
+	}
+
+	s.SetAbortBatchOnError(true)
+	if w := serve(); w.Body.Len() != 0 {
+		t.Errorf("Expected no reply with the batch aborted, got %s", w.Body)
+	}
+}
+
+func TestNotifications(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	serve := func(body string) *ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(`[{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2}},` +
+		`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":3},"id":null}]`)
+	var replies []struct {
+		Result Service1Response `json:"result"`
+		Id     *json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &replies); err != nil || len(replies) != 1 || replies[0].Result.Result != 12 {
+		t.Errorf("Expected only the reply to the null id request, got %s: %v", w.Body, err)
+	}
+
+	w = serve(`[{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2}},` +
+		`{"jsonrpc":"2.0","method":"Service1.Unknown","params":{}}]`)
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("Expected 204 for a batch of notifications, got %d %s", w.Code, w.Body)
+	}
+	w = serve(`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2}}`)
+	if w.Code != http.StatusNoContent || w.Body.Len() != 0 {
+		t.Errorf("Expected 204 for a notification, got %d %s", w.Code, w.Body)
+	}
+}
+
+type Service2Float struct {
+	Value float64
+}
+
+func (t *Service2) NaN(r *http.Request, req *Service1Request, res *Service2Float) error {
+	res.Value = math.NaN()
+	return nil
+}
+
+func TestEncodingFailure(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCustomCodec(&rpc.CompressionSelector{}), "application/json")
+	s.RegisterService(new(Service2), "")
+
+	buf, _ := EncodeClientRequest("Service2.NaN", &Service1Request{})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Accept-Encoding", "gzip")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+	zr, err := gzip.NewReader(w.Body)
+	if err != nil {
+		t.Fatalf("Expected a gzipped response, got %q: %v", w.Body, err)
+	}
+	var res Service2Float
+	err = DecodeClientResponse(zr, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != E_INTERNAL || !strings.Contains(jsonErr.Message, "NaN") {
+		t.Errorf("Expected E_INTERNAL naming NaN, got %v", err)
+	}
+}
+
+func TestWriteBufferSize(t *testing.T) {
+	codec := NewCodec()
+	codec.SetWriteBufferSize(1)
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service2), "")
+
+	batch := `[{"jsonrpc":"2.0","method":"Service2.Repeat","params":{"A":1},"id":1},` +
+		`{"jsonrpc":"2.0","method":"Service2.NaN","params":{},"id":2},` +
+		`{"jsonrpc":"2.0","method":"Service2.Repeat","params":{"A":2},"id":3}]`
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(batch))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var replies []struct {
+		Result *Service2Response `json:"result"`
+		Error  *Error            `json:"error"`
+		Id     int               `json:"id"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &replies); err != nil || len(replies) != 3 {
+		t.Fatalf("Unexpected batch response %s: %v", w.Body, err)
+	}
+	if replies[1].Id != 2 || replies[1].Error == nil || replies[1].Error.Code != E_INTERNAL {
+		t.Errorf("Expected E_INTERNAL for the NaN reply, got %+v", replies[1])
+	}
+	if replies[2].Result == nil || replies[2].Result.Text != "éé" {
+		t.Errorf("Expected the last reply after the failed one, got %+v", replies[2])
+	}
+}
+
+func TestEmptyBatch(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	for _, chunked := range []bool{false, true} {
+		if chunked {
+			s.SetBatchChunking(0, 2)
+		}
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(" [ ] "))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+
+		var reply struct {
+			Error *Error           `json:"error"`
+			Id    *json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &reply); err != nil {
+			t.Fatalf("Expected a single error object, got %s: %v", w.Body, err)
+		}
+		if reply.Error == nil || reply.Error.Code != E_INVALID_REQ || reply.Id != nil {
+			t.Errorf("Expected E_INVALID_REQ with null id, got %s", w.Body)
+		}
+	}
+}
+
+func TestMaxBatchSize(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service2), "")
+	s.SetMaxBatchSize(2)
+
+	call := `{"jsonrpc":"2.0","method":"Service2.Cacheable","params":{"A":1},"id":1}`
+	for _, chunked := range []bool{false, true} {
+		if chunked {
+			s.SetBatchChunking(0, 1)
+		}
+		cachedCalls = 0
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader("["+call+","+call+","+call+"]"))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		body := strings.Trim(strings.TrimSpace(w.Body.String()), "[]")
+		var reply struct {
+			Error *Error           `json:"error"`
+			Id    *json.RawMessage `json:"id"`
+		}
+		if err := json.Unmarshal([]byte(body), &reply); err != nil || reply.Error == nil || reply.Error.Code != E_INVALID_REQ {
+			t.Errorf("Expected E_INVALID_REQ, got %s: %v", w.Body, err)
+		}
+		if cachedCalls != 0 {
+			t.Errorf("Expected no request dispatched, got %d", cachedCalls)
+		}
+
+		cachedCalls = 0
+		r, _ = http.NewRequest("POST", "http://localhost:8080/", strings.NewReader("["+call+","+call+"]"))
+		r.Header.Set("Content-Type", "application/json")
+		s.ServeHTTP(NewRecorder(), r)
+		if cachedCalls != 2 {
+			t.Errorf("Expected a batch within the limit to be dispatched, got %d calls", cachedCalls)
+		}
+	}
+}
+
+func TestNonFinitePolicy(t *testing.T) {
+	for policy, want := range map[NonFinitePolicy]string{
+		NonFiniteNull:   `{"Value":null}`,
+		NonFiniteString: `{"Value":"NaN"}`,
+	} {
+		codec := NewCodec()
+		codec.SetNonFinitePolicy(policy)
+		s := rpc.NewServer()
+		s.RegisterCodec(codec, "application/json")
+		s.RegisterService(new(Service2), "")
+
+		var res json.RawMessage
+		if err := execute(t, s, "Service2.NaN", &Service1Request{}, &res); err != nil {
+			t.Fatalf("Policy %d: %v", policy, err)
+		}
+		if string(res) != want {
+			t.Errorf("Policy %d: expected %s, got %s", policy, want, res)
+		}
+	}
+}
+
+type ctxKey struct{}
+
+func (t *Service2) FromContext(ctx context.Context, req *Service1Request, res *Service2Response) error {
+	res.Text, _ = ctx.Value(ctxKey{}).(string)
+	return ctx.Err()
+}
+
+func (t *Service2) FromContextAndRequest(ctx context.Context, r *http.Request, req *Service1Request, res *Service2Response) error {
+	res.Text, _ = ctx.Value(ctxKey{}).(string)
+	res.Text += " " + r.Header.Get("X-Text")
+	return nil
+}
+
+func TestContextMethods(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service2), "")
+
+	serve := func(ctx context.Context, method string) (string, error) {
+		buf, _ := EncodeClientRequest(method, &Service1Request{})
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r = r.WithContext(ctx)
+		r.Header.Set("Content-Type", "application/json")
+		r.Header.Set("X-Text", "request")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		var res Service2Response
+		err := DecodeClientResponse(w.Body, &res)
+		return res.Text, err
+	}
+
+	ctx := context.WithValue(context.Background(), ctxKey{}, "context")
+	if text, err := serve(ctx, "Service2.FromContext"); err != nil || text != "context" {
+		t.Errorf("Expected the request context, got %q, %v", text, err)
+	}
+	if text, err := serve(ctx, "Service2.FromContextAndRequest"); err != nil || text != "context request" {
+		t.Errorf("Expected the request context and request, got %q, %v", text, err)
+	}
+	canceled, cancel := context.WithCancel(ctx)
+	cancel()
+	if _, err := serve(canceled, "Service2.FromContext"); err != io.EOF {
+		t.Errorf("Expected no reply once the client went away, got %v", err)
+	}
+}
+
+func (t *Service2) Returning(ctx context.Context, req *Service1Request) (*Service2Response, error) {
+	if req.A < 0 {
+		return nil, errors.New("negative")
+	}
+	return &Service2Response{Text: strings.Repeat("a", req.A)}, nil
+}
+
+func TestReturningMethods(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service2), "")
+
+	var res Service2Response
+	if err := execute(t, s, "Service2.Returning", &Service1Request{A: 3}, &res); err != nil || res.Text != "aaa" {
+		t.Errorf("Expected the returned reply, got %q, %v", res.Text, err)
+	}
+	if err := execute(t, s, "Service2.Returning", &Service1Request{A: -1}, &res); err == nil || err.Error() != "negative" {
+		t.Errorf("Expected the returned error, got %v", err)
+	}
+	var reply Service2Response
+	if err := s.Call(context.Background(), "Service2.Returning", Service1Request{A: 2}, &reply); err != nil || reply.Text != "aa" {
+		t.Errorf("Expected the returned reply in-process, got %q, %v", reply.Text, err)
+	}
+}
+
+func TestAdmin(t *testing.T) {
+	clock := rpc.NewManualClock(time.Unix(0, 0))
+	s := rpc.NewServer()
+	s.SetClock(clock)
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.EnableAdmin(func(r *http.Request) bool { return r.Header.Get("X-Admin") == "secret" })
+
+	call := func(method string, args interface{}, admin bool) error {
+		buf, _ := EncodeClientRequest(method, args)
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		if admin {
+			r.Header.Set("X-Admin", "secret")
+		}
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		var res json.RawMessage
+		return DecodeClientResponse(w.Body, &res)
+	}
+	code := func(err error) ErrorCode {
+		if jsonErr, ok := err.(*Error); ok {
+			return jsonErr.Code
+		}
+		return 0
+	}
+	multiply := &Service1Request{4, 2}
+
+	if err := call("admin.setLogLevel", &rpc.AdminLogLevelArgs{Level: "warn"}, false); code(err) != rpc.CodeUnauthorized {
+		t.Errorf("Expected CodeUnauthorized, got %v", err)
+	}
+	if err := call("admin.setLogLevel", &rpc.AdminLogLevelArgs{Level: "warn"}, true); err != nil || s.LogLevel() != rpc.LevelWarn {
+		t.Errorf("Expected the log level to be set, got %v, %v", s.LogLevel(), err)
+	}
+
+	call("admin.setMaintenance", &rpc.AdminMaintenanceArgs{Enabled: true}, true)
+	if err := call("Service1.Multiply", multiply, false); code(err) != rpc.CodeUnavailable {
+		t.Errorf("Expected CodeUnavailable in maintenance, got %v", err)
+	}
+	call("admin.setMaintenance", &rpc.AdminMaintenanceArgs{Enabled: false}, true)
+
+	call("admin.setRateLimit", &rpc.AdminRateLimitArgs{Method: "Service1.Multiply", Rate: 1, Burst: 1}, true)
+	if err := call("Service1.Multiply", multiply, false); err != nil {
+		t.Errorf("Expected the first call to be admitted, got %v", err)
+	}
+	err := call("Service1.Multiply", multiply, false)
+	if code(err) != rpc.CodeRateLimited {
+		t.Fatalf("Expected CodeRateLimited, got %v", err)
+	}
+	if details, _ := err.(*Error).Details(); len(details) != 1 || details[0].(*rpc.RetryInfo).RetryDelay != time.Second {
+		t.Errorf("Expected a retry delay of 1s, got %v", details)
+	}
+	clock.Advance(time.Second)
+	if err := call("Service1.Multiply", multiply, false); err != nil {
+		t.Errorf("Expected a call to be admitted after a second, got %v", err)
+	}
+
+	if err := call("admin.setProfileSampling", &rpc.AdminProfileSamplingArgs{Method: "Service1.Multiply", Rate: 2}, true); code(err) != rpc.CodeInvalidParams {
+		t.Errorf("Expected CodeInvalidParams for a rate over 1, got %v", err)
+	}
+	call("admin.setProfileSampling", &rpc.AdminProfileSamplingArgs{Method: "Service1.Multiply", Rate: 0.5}, true)
+
+	call("admin.drain", &rpc.AdminDrainArgs{Timeout: "1s"}, true)
+	if err := call("Service1.Multiply", multiply, false); code(err) != rpc.CodeUnavailable {
+		t.Errorf("Expected CodeUnavailable while draining, got %v", err)
+	}
+	var status rpc.AdminStatus
+	buf, _ := EncodeClientRequest("admin.status", &rpc.AdminEmpty{})
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("X-Admin", "secret")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+	if err := DecodeClientResponse(w.Body, &status); err != nil || !status.Draining || status.RateLimits["Service1.Multiply"].Rate != 1 ||
+		status.ProfileSampling["Service1.Multiply"] != 0.5 {
+		t.Errorf("Unexpected status %+v: %v", status, err)
+	}
+	call("admin.resume", &rpc.AdminEmpty{}, true)
+	if err := call("Service1.Multiply", multiply, false); code(err) == rpc.CodeUnavailable {
+		t.Errorf("Expected calls to be admitted after resume, got %v", err)
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.EnableAdmin(func(r *http.Request) bool { return true })
+	admin := s.AdminHandler()
+
+	call := func(h http.Handler, method string, args interface{}) error {
+		buf, _ := EncodeClientRequest(method, args)
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		h.ServeHTTP(w, r)
+		var res json.RawMessage
+		return DecodeClientResponse(w.Body, &res)
+	}
+	notFound := func(err error) bool {
+		jsonErr, ok := err.(*Error)
+		return ok && jsonErr.Code == E_NO_METHOD
+	}
+	multiply := &Service1Request{4, 2}
+
+	if err := call(s, "admin.status", &rpc.AdminEmpty{}); !notFound(err) {
+		t.Errorf("Expected admin.status not to be found on the public API, got %v", err)
+	}
+	if err := call(admin, "admin.status", &rpc.AdminEmpty{}); err != nil {
+		t.Errorf("Expected admin.status on the admin handler, got %v", err)
+	}
+	if err := call(admin, "Service1.Multiply", multiply); !notFound(err) {
+		t.Errorf("Expected Service1.Multiply not to be found on the admin handler, got %v", err)
+	}
+	if err := call(s, "Service1.Multiply", multiply); err != nil {
+		t.Errorf("Expected Service1.Multiply on the public API, got %v", err)
+	}
+
+	r, _ := http.NewRequest("GET", "http://localhost:8080/usage", nil)
+	w := NewRecorder()
+	admin.ServeHTTP(w, r)
+	if w.Code != 200 || w.Header().Get("Content-Type") != "application/json; charset=utf-8" {
+		t.Errorf("Expected the usage report, got %d %q", w.Code, w.Header().Get("Content-Type"))
+	}
+}
+
+func TestMiddleware(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	var order []string
+	var body string
+	s.Use(func(next rpc.Handler) rpc.Handler {
+		return func(call *rpc.MethodCall) (interface{}, error) {
+			order = append(order, "auth "+call.Method)
+			if call.Args.(*Service1Request).A < 0 {
+				return nil, &rpc.Error{Code: rpc.CodeUnauthorized, Message: "denied"}
+			}
+			return next(call)
+		}
+	}, rpc.RestoreBody, func(next rpc.Handler) rpc.Handler {
+		return func(call *rpc.MethodCall) (interface{}, error) {
+			raw, _ := io.ReadAll(call.Request.Body)
+			body = string(raw)
+			reply, err := next(call)
+			order = append(order, "log")
+			return reply, err
+		}
+	})
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8, got %d, %v", res.Result, err)
+	}
+	if !strings.Contains(body, `"Service1.Multiply"`) {
+		t.Errorf("Expected the restored body, got %q", body)
+	}
+	err := execute(t, s, "Service1.Multiply", &Service1Request{-4, 2}, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != rpc.CodeUnauthorized {
+		t.Errorf("Expected CodeUnauthorized, got %v", err)
+	}
+	if got := strings.Join(order, ","); got != "auth Service1.Multiply,log,auth Service1.Multiply" {
+		t.Errorf("Unexpected middleware order: %s", got)
+	}
+}
+
+func TestPanicRecovery(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(new(Service2), "")
+	var panicked []string
+	s.SetPanicHandler(func(r *http.Request, method string, value interface{}, stack []byte) {
+		panicked = append(panicked, fmt.Sprintf("%s %v %t", method, value, len(stack) > 0))
+	})
+
+	batch := `[{"jsonrpc":"2.0","method":"Service2.Panic","params":{},"id":1},` +
+		`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":2}]`
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(batch))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	var replies []struct {
+		Result *Service1Response `json:"result"`
+		Error  *Error            `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &replies); err != nil || len(replies) != 2 {
+		t.Fatalf("Unexpected batch response %s: %v", w.Body, err)
+	}
+	if replies[0].Error == nil || replies[0].Error.Code != E_SERVER {
+		t.Errorf("Expected E_SERVER, got %+v", replies[0])
+	} else if strings.Contains(replies[0].Error.Message, "boom") {
+		t.Errorf("Expected the panic value to be withheld, got %q", replies[0].Error.Message)
+	}
+	if replies[1].Result == nil || replies[1].Result.Result != 8 {
+		t.Errorf("Expected 8, got %+v", replies[1])
+	}
+	if len(panicked) != 1 || panicked[0] != "Service2.Panic boom true" {
+		t.Errorf("Expected the panic handler to be called once, got %v", panicked)
+	}
+}
+
+func TestClientDisconnect(t *testing.T) {
+	for _, concurrency := range []int{1, 2} {
+		s := rpc.NewServer()
+		s.RegisterCodec(NewCodec(), "application/json")
+		s.RegisterService(new(Service1), "")
+		s.SetBatchConcurrency(concurrency)
+		ctx, cancel := context.WithCancel(context.Background())
+		var calls int32
+		s.Use(func(next rpc.Handler) rpc.Handler {
+			return func(call *rpc.MethodCall) (interface{}, error) {
+				// The client goes away during the first call.
+				if atomic.AddInt32(&calls, 1) == 1 {
+					cancel()
+				}
+				return next(call)
+			}
+		})
+
+		var batch []string
+		for i := 0; i < 10; i++ {
+			batch = append(batch, fmt.Sprintf(`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":%d,"B":2},"id":%d}`, i, i))
+		}
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader("["+strings.Join(batch, ",")+"]"))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r.WithContext(ctx))
+		if n := atomic.LoadInt32(&calls); n > int32(concurrency) {
+			t.Errorf("Expected the batch to stop after the client went away, got %d calls with concurrency %d", n, concurrency)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("Expected no reply, got %s", w.Body)
+		}
+	}
+}
+
+func TestEmptyResultPolicy(t *testing.T) {
+	for policy, want := range map[EmptyResultPolicy]map[string]string{
+		EmptyResultAsIs:   {"Service2.Empty": `{}`, "Service2.Null": `null`, "Service2.Nothing": `{}`, "Service1.Multiply": `null`},
+		EmptyResultNull:   {"Service2.Empty": `{}`, "Service2.Null": `null`, "Service2.Nothing": `null`, "Service1.Multiply": `null`},
+		EmptyResultObject: {"Service2.Empty": `{}`, "Service2.Null": `null`, "Service2.Nothing": `{}`, "Service1.Multiply": `{}`},
+	} {
+		codec := NewCodec()
+		codec.SetEmptyResultPolicy(policy)
+		s := rpc.NewServer()
+		s.RegisterCodec(codec, "application/json")
+		s.RegisterService(new(Service1), "")
+		s.RegisterService(new(Service2), "")
+		// Service1.Multiply replies nil through the middleware.
+		s.Use(func(next rpc.Handler) rpc.Handler {
+			return func(call *rpc.MethodCall) (interface{}, error) {
+				reply, err := next(call)
+				if call.Method == "Service1.Multiply" {
+					return nil, err
+				}
+				return reply, err
+			}
+		})
+
+		for method, result := range want {
+			var res json.RawMessage
+			if err := execute(t, s, method, &Service1Request{}, &res); err != nil {
+				t.Fatalf("Policy %d, %s: %v", policy, method, err)
+			}
+			if string(res) != result {
+				t.Errorf("Policy %d, %s: expected %s, got %s", policy, method, result, res)
+			}
+		}
+	}
+}
+
+func TestPreconditions(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service2), "")
+	save := func(ifMatch, extension string) *ResponseRecorder {
+		body := `{"jsonrpc":"2.0","method":"Service2.Save","params":{},"id":1` + extension + `}`
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if ifMatch != "" {
+			r.Header.Set(rpc.IfMatchHeader, ifMatch)
+		}
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	for _, ifMatch := range []string{"", `"7"`, `W/"7"`, "*"} {
+		w := save(ifMatch, "")
+		if strings.Contains(w.Body.String(), "error") || w.Header().Get("ETag") != `"8"` {
+			t.Errorf("Expected success for If-Match %q, got %s", ifMatch, w.Body.String())
+		}
+	}
+	// The extension takes precedence over the header.
+	for _, w := range []*ResponseRecorder{save(`"6"`, ""), save(`"7"`, `,"ifMatch":"6"`)} {
+		var res struct {
+			Error struct {
+				Code int
+				Data *rpc.ErrorDetails
+			}
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		if res.Error.Code != rpc.CodePreconditionFailed || res.Error.Data == nil {
+			t.Fatalf("Expected a precondition failure, got %s", w.Body.String())
+		}
+		failure, ok := res.Error.Data.Details[0].(*rpc.PreconditionFailure)
+		if !ok || failure.Violations[0].Subject != "6" {
+			t.Errorf("Expected the failed version in the details, got %s", w.Body.String())
+		}
+	}
+	// Numbers are versions too, and other values are rejected.
+	if w := save(`"6"`, `,"ifMatch":7`); strings.Contains(w.Body.String(), "error") {
+		t.Errorf("Expected success for a number, got %s", w.Body.String())
+	}
+	for _, extension := range []string{`,"ifMatch":true`, `,"ifMatch":""`, `,"ifMatch":null`} {
+		if w := save("", extension); !strings.Contains(w.Body.String(), strconv.Itoa(rpc.CodeInvalidParams)) {
+			t.Errorf("Expected CodeInvalidParams for %s, got %s", extension, w.Body.String())
+		}
+	}
+}
+
+type PatchedDoc struct {
+	Title string   `json:"title"`
+	Tags  []string `json:"tags"`
+	Count int      `json:"count"`
+}
+
+func TestPatchParams(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterFunc("Docs.Patch", func(ctx context.Context, patch *rpc.JSONPatch) (*PatchedDoc, error) {
+		doc := &PatchedDoc{Title: "draft", Tags: []string{"a"}, Count: 1}
+		if err := patch.ApplyTo(doc); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	})
+	s.RegisterFunc("Docs.Merge", func(ctx context.Context, patch *rpc.MergePatch) (*PatchedDoc, error) {
+		doc := &PatchedDoc{Title: "draft", Tags: []string{"a"}, Count: 1}
+		if err := patch.ApplyTo(doc); err != nil {
+			return nil, err
+		}
+		return doc, nil
+	})
+	call := func(method, params string) (PatchedDoc, int) {
+		body := `{"jsonrpc":"2.0","method":"` + method + `","params":` + params + `,"id":1}`
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		var res struct {
+			Result PatchedDoc
+			Error  struct{ Code int }
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil {
+			t.Fatal(err)
+		}
+		return res.Result, res.Error.Code
+	}
+
+	doc, code := call("Docs.Patch", `[{"op":"test","path":"/count","value":1},{"op":"replace","path":"/title","value":"final"},{"op":"add","path":"/tags/-","value":"b"}]`)
+	if code != 0 || doc.Title != "final" || !reflect.DeepEqual(doc.Tags, []string{"a", "b"}) {
+		t.Errorf("Expected the patched doc, got %+v, %d", doc, code)
+	}
+	for params, want := range map[string]int{
+		`[{"op":"test","path":"/count","value":2}]`:     rpc.CodePreconditionFailed,
+		`[{"op":"add","path":"/title"}]`:                rpc.CodeInvalidRequest,
+		`[{"op":"add","path":"/unknown","value":true}]`: rpc.CodeInvalidParams,
+		`{"title":"not a patch"}`:                       rpc.CodeInvalidRequest,
+	} {
+		if _, code := call("Docs.Patch", params); code != want {
+			t.Errorf("%s: expected code %d, got %d", params, want, code)
+		}
+	}
+
+	doc, code = call("Docs.Merge", `{"title":"final","tags":null}`)
+	if code != 0 || doc.Title != "final" || doc.Tags != nil || doc.Count != 1 {
+		t.Errorf("Expected the merged doc, got %+v, %d", doc, code)
+	}
+	if _, code := call("Docs.Merge", `["not a patch"]`); code != rpc.CodeInvalidRequest {
+		t.Errorf("Expected an invalid request, got %d", code)
+	}
+
+	if schema, ok := s.ParamsSchema("Docs.Patch"); !ok || !json.Valid(schema) {
+		t.Errorf("Expected the schema of JSON Patch, got %s", schema)
+	}
+	var md bytes.Buffer
+	s.WriteMarkdown(&md)
+	if !strings.Contains(md.String(), "JSON Merge Patch (RFC 7386)") {
+		t.Errorf("Expected the params schema in the documentation, got\n%s", md.String())
+	}
+}
+
+func TestEnvelopeExtensions(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service2), "")
+	var seen map[string]json.RawMessage
+	s.Use(func(next rpc.Handler) rpc.Handler {
+		return func(call *rpc.MethodCall) (interface{}, error) {
+			seen = call.Extensions
+			return next(call)
+		}
+	})
+
+	body := `{"jsonrpc":"2.0","method":"Service2.Traced","params":{},"id":1,"traceparent":"00-abc","x-vendor":{"a":1}}`
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+
+	want := `{"jsonrpc":"2.0","result":{"Text":"\"00-abc\""},"id":1,"traceparent":"00-reply"}`
+	if got := strings.TrimSpace(w.Body.String()); got != want {
+		t.Errorf("Expected %s, got %s", want, got)
+	}
+	if len(seen) != 2 || string(seen["x-vendor"]) != `{"a":1}` {
+		t.Errorf("Expected the extensions in the middleware, got %v", seen)
+	}
+}
+
+// memMQTT is an MQTTClient delivering the requests published by the test.
+type memMQTT struct {
+	mutex     sync.Mutex
+	handler   func(topic string, payload []byte)
+	published chan [2]string
+}
+
+func (c *memMQTT) Subscribe(filter string, handler func(topic string, payload []byte)) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.handler = handler
+	return nil
+}
+
+func (c *memMQTT) Unsubscribe(filter string) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.handler = nil
+	return nil
+}
+
+func (c *memMQTT) Publish(topic string, payload []byte) error {
+	c.published <- [2]string{topic, string(payload)}
+	return nil
+}
+
+func (c *memMQTT) deliver(topic, payload string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.handler == nil {
+		return false
+	}
+	c.handler(topic, []byte(payload))
+	return true
+}
+
+func TestMQTTListener(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	client := &memMQTT{published: make(chan [2]string, 1)}
+	l := &rpc.MQTTListener{Client: client, RequestTopic: "rpc/+/request"}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- rpc.Serve(ctx, s, l)
+	}()
+
+	for !client.deliver("rpc/device-1/request", `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`) {
+		time.Sleep(time.Millisecond)
+	}
+	published := <-client.published
+	if published[0] != "rpc/device-1/response" {
+		t.Errorf("Expected the response topic of the client, got %q", published[0])
+	}
+	var res Service1Response
+	if err := DecodeClientResponse(strings.NewReader(published[1]), &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8, got %d, %v", res.Result, err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+	if client.deliver("rpc/device-1/request", "{}") {
+		t.Error("Expected to be unsubscribed")
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service2), "")
+	if err := s.EnableSubscriptions(); err != nil {
+		t.Fatal(err)
+	}
+	mux := http.NewServeMux()
+	mux.Handle("/", s)
+	mux.Handle("/subscriptions", s.SubscriptionHandler())
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	events, err := http.Get(ts.URL + "/subscriptions")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer events.Body.Close()
+	lines := bufio.NewScanner(events.Body)
+	next := func() string {
+		for lines.Scan() {
+			if line := lines.Text(); strings.HasPrefix(line, "data: ") {
+				return strings.TrimPrefix(line, "data: ")
+			}
+		}
+		return ""
+	}
+	conn := next()
+
+	call := func(method string, args, reply interface{}, withConn bool) error {
+		buf, _ := EncodeClientRequest(method, args)
+		r, _ := http.NewRequest("POST", ts.URL+"/", bytes.NewBuffer(buf))
+		r.Header.Set("Content-Type", "application/json")
+		if withConn {
+			r.Header.Set(rpc.ConnectionHeader, conn)
+		}
+		res, err := http.DefaultClient.Do(r)
+		if err != nil {
+			return err
+		}
+		defer res.Body.Close()
+		return DecodeClientResponse(res.Body, reply)
+	}
+
+	var id string
+	if err := call("Service2.Ticks", &Service1Request{A: 2}, &id, false); err == nil {
+		t.Error("Expected an error subscribing without a connection")
+	}
+	if err := call("Service2.Ticks", &Service1Request{A: 2}, &id, true); err != nil || id == "" {
+		t.Fatalf("Expected a subscription id, got %q, %v", id, err)
+	}
+	for i := 0; i < 2; i++ {
+		want := fmt.Sprintf(`{"jsonrpc":"2.0","method":"Service2.subscription","params":{"result":%d,"subscription":%q}}`, i, id)
+		if got := next(); got != want {
+			t.Errorf("Expected %s, got %s", want, got)
+		}
+	}
+	var ok bool
+	if err := call("subscription.unsubscribe", id, &ok, true); err != nil || !ok {
+		t.Errorf("Expected the subscription to be cancelled, got %t, %v", ok, err)
+	}
+	if err := call("subscription.unsubscribe", id, &ok, true); err != nil || ok {
+		t.Errorf("Expected no subscription left, got %t, %v", ok, err)
+	}
+
+	// The zero Subscription is cancelled.
+	var zero rpc.Subscription
+	zero.Unsubscribe()
+	select {
+	case <-zero.Done():
+	default:
+		t.Error("Expected the zero subscription to be done")
+	}
+	if err := zero.Notify(1); err == nil {
+		t.Error("Expected an error notifying the zero subscription")
+	}
+}
+
+// memQueue is a Queue holding the messages of the test.
+type memQueue struct {
+	messages chan *rpc.QueueMessage
+	acked    chan string
+}
+
+func (q *memQueue) Receive(ctx context.Context, max int) ([]*rpc.QueueMessage, error) {
+	select {
+	case msg := <-q.messages:
+		return []*rpc.QueueMessage{msg}, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (q *memQueue) Ack(ctx context.Context, msg *rpc.QueueMessage) error {
+	q.acked <- msg.ID
+	return nil
+}
+
+func TestQueueWorker(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	queue := &memQueue{messages: make(chan *rpc.QueueMessage, 2), acked: make(chan string, 2)}
+	responses := make(chan string, 2)
+	worker := &rpc.QueueWorker{
+		Queue:       queue,
+		Concurrency: 2,
+		OnResponse: func(msg *rpc.QueueMessage, response []byte) {
+			responses <- string(response)
+		},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- rpc.Serve(ctx, s, worker)
+	}()
+
+	// The first message is past its deadline, less the margin.
+	queue.messages <- &rpc.QueueMessage{
+		ID:       "late",
+		Body:     []byte(`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":1,"B":2},"id":1}`),
+		Deadline: time.Now().Add(time.Millisecond),
+	}
+	queue.messages <- &rpc.QueueMessage{
+		ID:       "on-time",
+		Body:     []byte(`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":2}`),
+		Deadline: time.Now().Add(time.Minute),
+	}
+	if id := <-queue.acked; id != "on-time" {
+		t.Errorf("Expected the message on time to be acknowledged, got %q", id)
+	}
+	var res Service1Response
+	if err := DecodeClientResponse(strings.NewReader(<-responses), &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8, got %d, %v", res.Result, err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+	select {
+	case id := <-queue.acked:
+		t.Errorf("Expected the late message not to be acknowledged, got %q", id)
+	default:
+	}
+}
+
+func TestConnListener(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- rpc.Serve(ctx, s, &rpc.ConnListener{Listener: ln})
+	}()
+
+	conn, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	// A notification gets no response.
+	fmt.Fprint(conn, `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":1,"B":2}}`+"\n")
+	for _, a := range []int{4, 5} {
+		fmt.Fprintf(conn, `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":%d,"B":2},"id":%d}`+"\n", a, a)
+	}
+	lines := bufio.NewScanner(conn)
+	for _, want := range []int{8, 10} {
+		if !lines.Scan() {
+			t.Fatalf("Expected a response, got %v", lines.Err())
+		}
+		var res Service1Response
+		if err := DecodeClientResponse(strings.NewReader(lines.Text()), &res); err != nil || res.Result != want {
+			t.Errorf("Expected %d, got %d, %v", want, res.Result, err)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+	if lines.Scan() {
+		t.Errorf("Expected the connection to be closed, got %q", lines.Text())
+	}
+}
+
+// memAMQP is an AMQPChannel delivering the messages of the test.
+type memAMQP struct {
+	deliveries chan *rpc.AMQPDelivery
+	acked      chan uint64
+	published  chan rpc.AMQPPublishing
+}
+
+func (c *memAMQP) Consume(ctx context.Context, queue string) (<-chan *rpc.AMQPDelivery, error) {
+	out := make(chan *rpc.AMQPDelivery)
+	go func() {
+		defer close(out)
+		for {
+			select {
+			case d := <-c.deliveries:
+				out <- d
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return out, nil
+}
+
+func (c *memAMQP) Ack(tag uint64) error {
+	c.acked <- tag
+	return nil
+}
+
+func (c *memAMQP) Nack(tag uint64, requeue bool) error {
+	return nil
+}
+
+func (c *memAMQP) Publish(ctx context.Context, exchange, key string, msg rpc.AMQPPublishing) error {
+	if exchange != "" || key != "replies" {
+		return fmt.Errorf("unexpected destination %q %q", exchange, key)
+	}
+	c.published <- msg
+	return nil
+}
+
+func TestAMQPListener(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	channel := &memAMQP{
+		deliveries: make(chan *rpc.AMQPDelivery),
+		acked:      make(chan uint64, 2),
+		published:  make(chan rpc.AMQPPublishing, 2),
+	}
+	var errs []error
+	l := &rpc.AMQPListener{
+		Channel: channel,
+		Queue:   "rpc",
+		OnError: func(d *rpc.AMQPDelivery, err error) { errs = append(errs, err) },
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- rpc.Serve(ctx, s, l)
+	}()
+
+	// A notification is acknowledged without a response.
+	channel.deliveries <- &rpc.AMQPDelivery{
+		DeliveryTag: 1,
+		Body:        []byte(`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":1,"B":2}}`),
+	}
+	if tag := <-channel.acked; tag != 1 {
+		t.Errorf("Expected delivery 1 to be acknowledged, got %d", tag)
+	}
+	channel.deliveries <- &rpc.AMQPDelivery{
+		DeliveryTag:   2,
+		Body:          []byte(`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`),
+		ReplyTo:       "replies",
+		CorrelationID: "c-42",
+	}
+	if tag := <-channel.acked; tag != 2 {
+		t.Errorf("Expected delivery 2 to be acknowledged, got %d", tag)
+	}
+	msg := <-channel.published
+	if msg.CorrelationID != "c-42" || msg.ContentType != "application/json" {
+		t.Errorf("Expected the correlation id and content type, got %q, %q", msg.CorrelationID, msg.ContentType)
+	}
+	var res Service1Response
+	if err := DecodeClientResponse(bytes.NewReader(msg.Body), &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected 8, got %d, %v", res.Result, err)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+	if len(errs) > 0 {
+		t.Errorf("Expected no errors, got %v", errs)
+	}
+}
+
+// memKafka is a KafkaConsumer and KafkaProducer of the messages of the
+// test.
+type memKafka struct {
+	messages  chan *rpc.KafkaMessage
+	committed chan int64
+	produced  chan [2]string
+}
+
+func (k *memKafka) Fetch(ctx context.Context) (*rpc.KafkaMessage, error) {
+	select {
+	case msg := <-k.messages:
+		return msg, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (k *memKafka) Commit(ctx context.Context, msg *rpc.KafkaMessage) error {
+	k.committed <- msg.Offset
+	return nil
+}
+
+func (k *memKafka) Produce(ctx context.Context, topic string, key, value []byte) error {
+	if topic != "rpc-responses" {
+		return fmt.Errorf("unexpected topic %q", topic)
+	}
+	k.produced <- [2]string{string(key), string(value)}
+	return nil
+}
+
+func TestKafkaBridge(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	kafka := &memKafka{
+		messages:  make(chan *rpc.KafkaMessage),
+		committed: make(chan int64, 1),
+		produced:  make(chan [2]string, 2),
+	}
+	bridge := &rpc.KafkaBridge{Consumer: kafka, Producer: kafka, ResponseTopic: "rpc-responses"}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- rpc.Serve(ctx, s, bridge)
+	}()
+
+	kafka.messages <- &rpc.KafkaMessage{Topic: "rpc-requests", Offset: 7, Value: []byte(`[
+		{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":1,"B":2},"id":"a"},
+		{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":2,"B":2}},
+		{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":3,"B":2},"id":2}
+	]`)}
+	if offset := <-kafka.committed; offset != 7 {
+		t.Errorf("Expected offset 7 to be committed, got %d", offset)
+	}
+	for _, want := range []struct {
+		key    string
+		result int
+	}{{"a", 2}, {"2", 6}} {
+		produced := <-kafka.produced
+		var res struct{ Result Service1Response }
+		if err := json.Unmarshal([]byte(produced[1]), &res); err != nil || produced[0] != want.key || res.Result.Result != want.result {
+			t.Errorf("Expected %d keyed %q, got %q keyed %q, %v", want.result, want.key, produced[1], produced[0], err)
+		}
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+}
+
+func TestServeStream(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	var in, out bytes.Buffer
+	for _, msg := range []string{
+		`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":1,"B":2}}`,
+		`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":3,"B":2},"id":1}`,
+	} {
+		fmt.Fprintf(&in, "Content-Length: %d\r\n\r\n%s", len(msg), msg)
+	}
+	if err := s.ServeStream(context.Background(), &in, &out); err != nil {
+		t.Fatal(err)
+	}
+	header, body, _ := strings.Cut(out.String(), "\r\n\r\n")
+	if header != fmt.Sprintf("Content-Length: %d", len(body)) {
+		t.Errorf("Expected one response of %d bytes, got %q", len(body), out.String())
+	}
+	var res Service1Response
+	if err := DecodeClientResponse(strings.NewReader(body), &res); err != nil || res.Result != 6 {
+		t.Errorf("Expected 6, got %d, %v", res.Result, err)
+	}
+}
+
+func TestHandleServerless(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	event := new(rpc.ServerlessEvent)
+	body := `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`
+	json.Unmarshal([]byte(`{
+		"version": "2.0",
+		"headers": {"content-type": "application/json"},
+		"requestContext": {"http": {"method": "POST", "path": "/rpc", "sourceIp": "10.0.0.1"}},
+		"isBase64Encoded": true,
+		"body": "`+base64.StdEncoding.EncodeToString([]byte(body))+`"
+	}`), event)
+	res, err := s.HandleServerless(context.Background(), event)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 || res.IsBase64Encoded || res.Headers["Content-Type"] != "application/json; charset=utf-8" {
+		t.Errorf("Unexpected response %+v", res)
+	}
+	var reply Service1Response
+	if err := DecodeClientResponse(strings.NewReader(res.Body), &reply); err != nil || reply.Result != 8 {
+		t.Errorf("Expected 8, got %d, %v", reply.Result, err)
+	}
+
+	event = &rpc.ServerlessEvent{HTTPMethod: "GET", Path: "/"}
+	if res, err := s.HandleServerless(context.Background(), event); err != nil || res.StatusCode != 405 {
+		t.Errorf("Expected status 405, got %+v, %v", res, err)
+	}
+}
+
+func TestLambdaHandler(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	handler := rpc.LambdaHandler(s)
+
+	// A direct invocation.
+	out, err := handler(context.Background(), json.RawMessage(`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2},"id":1}`))
+	var reply Service1Response
+	if err != nil || DecodeClientResponse(bytes.NewReader(out), &reply) != nil || reply.Result != 8 {
+		t.Errorf("Expected 8, got %s, %v", out, err)
+	}
+	out, err = handler(context.Background(), json.RawMessage(`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":2}}`))
+	if err != nil || string(out) != "null" {
+		t.Errorf("Expected null for a notification, got %s, %v", out, err)
+	}
+
+	// A version 1.0 API Gateway event.
+	out, err = handler(context.Background(), json.RawMessage(`{
+		"httpMethod": "POST",
+		"path": "/",
+		"multiValueHeaders": {"content-type": ["application/json"]},
+		"body": "{\"jsonrpc\":\"2.0\",\"method\":\"Service1.Multiply\",\"params\":{\"A\":3,\"B\":2},\"id\":1}"
+	}`))
+	var res rpc.ServerlessResponse
+	if err != nil || json.Unmarshal(out, &res) != nil || res.StatusCode != 200 {
+		t.Fatalf("Expected a response, got %s, %v", out, err)
+	}
+	if err := DecodeClientResponse(strings.NewReader(res.Body), &reply); err != nil || reply.Result != 6 {
+		t.Errorf("Expected 6, got %d, %v", reply.Result, err)
+	}
+}
+
+func TestAdaptiveBatchLimits(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetAdaptiveBatchLimits(rpc.AdaptiveBatchLimits{
+		MinBatchSize:   2,
+		MaxBatchSize:   4,
+		MaxConcurrency: 3,
+		Step:           0.5,
+	})
+
+	batch := func(addr, method string, n int) *ResponseRecorder {
+		calls := make([]string, n)
+		for i := range calls {
+			calls[i] = fmt.Sprintf(`{"jsonrpc":"2.0","method":%q,"params":{"A":1,"B":2},"id":%d}`, method, i)
+		}
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader("["+strings.Join(calls, ",")+"]"))
+		r.Header.Set("Content-Type", "application/json")
+		r.RemoteAddr = addr + ":1234"
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	limits := func(caller string, size, concurrency int) {
+		t.Helper()
+		if gotSize, gotConcurrency := s.BatchLimits(caller); gotSize != size || gotConcurrency != concurrency {
+			t.Errorf("Expected limits %d and %d for %s, got %d and %d", size, concurrency, caller, gotSize, gotConcurrency)
+		}
+	}
+
+	limits("192.0.2.1", 2, 1)
+	if w := batch("192.0.2.1", "Service1.Multiply", 3); !strings.Contains(w.Body.String(), "batch larger than 2") {
+		t.Errorf("Expected a batch over the minimum to be rejected, got %s", w.Body)
+	}
+	limits("192.0.2.1", 2, 1)
+
+	batch("192.0.2.2", "Service1.Multiply", 2)
+	limits("192.0.2.2", 3, 2)
+	batch("192.0.2.2", "Service1.Multiply", 2)
+	limits("192.0.2.2", 4, 3)
+	if w := batch("192.0.2.2", "Service1.Multiply", 4); strings.Contains(w.Body.String(), "error") {
+		t.Errorf("Expected a batch within the adapted limit to be served, got %s", w.Body)
+	}
+
+	batch("192.0.2.2", "Service1.ResponseError", 2)
+	limits("192.0.2.2", 3, 2)
+	limits("192.0.2.1", 2, 1)
+
+	// Batches processed in chunks are limited and recorded too.
+	s.SetBatchChunking(0, 2)
+	if w := batch("192.0.2.3", "Service1.Multiply", 3); !strings.Contains(w.Body.String(), "batch larger than 2") {
+		t.Errorf("Expected a chunked batch over the minimum to be rejected, got %s", w.Body)
+	}
+	batch("192.0.2.4", "Service1.Multiply", 2)
+	limits("192.0.2.4", 3, 2)
+}
+
+func TestVersion1Compat(t *testing.T) {
+	codec := NewCodec()
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+	post := func(body string) *ResponseRecorder {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+
+	call := `{"method":"Service1.Multiply","params":[{"A":4,"B":2}],"id":1}`
+	if w := post(call); !strings.Contains(w.Body.String(), `"code":-32600`) {
+		t.Errorf("Expected a 1.0 request to be rejected by default, got %s", w.Body)
+	}
+
+	codec.SetVersion1Compat(true)
+	for _, test := range []struct {
+		body, reply string
+	}{
+		{call, `{"result":{"Result":8},"error":null,"id":1}`},
+		{`{"method":"Service1.Divide","params":[{}],"id":"x"}`, `{"result":null,"error":{"code":-32601,"message":"rpc: can't find method \"Service1.Divide\"","data":null},"id":"x"}`},
+		{`{"method":"Service1.Multiply","params":[{"A":4,"B":2}],"id":null}`, ``},
+		{`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":4,"B":3},"id":2}`, `{"jsonrpc":"2.0","result":{"Result":12},"id":2}`},
+	} {
+		if w := post(test.body); strings.TrimSpace(w.Body.String()) != test.reply {
+			t.Errorf("%s: expected %s, got %d %s", test.body, test.reply, w.Code, w.Body)
+		}
+	}
+
+	// Batches processed in chunks accept 1.0 requests too.
+	s.SetBatchChunking(0, 1)
+	if w := post("[" + call + "]"); strings.Contains(w.Body.String(), "-32600") || !strings.Contains(w.Body.String(), `"Result":8`) {
+		t.Errorf("Expected a chunked 1.0 request to be served, got %s", w.Body)
+	}
+}
+
+// countingEngine is a JSONEngine counting its calls.
+type countingEngine struct {
+	marshaled, unmarshaled int
+}
+
+func (e *countingEngine) Marshal(v interface{}) ([]byte, error) {
+	e.marshaled++
+	return json.Marshal(v)
+}
+
+func (e *countingEngine) Unmarshal(data []byte, v interface{}) error {
+	e.unmarshaled++
+	return json.Unmarshal(data, v)
+}
+
+func TestJSONEngine(t *testing.T) {
+	engine := new(countingEngine)
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodecWithJSON(engine), "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil || res.Result != 8 {
+		t.Fatalf("Expected 8, got %d: %v", res.Result, err)
+	}
+	if engine.marshaled != 1 || engine.unmarshaled != 1 {
+		t.Errorf("Expected the params and result handled by the engine, got %d and %d calls", engine.unmarshaled, engine.marshaled)
+	}
+}
+
+var codeRegistered = rpc.RegisterErrorCode("json2test", 7001, "Registered", "")
+
+func TestStrictErrorCodes(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterFunc("codes.fail", func(ctx context.Context, code *int) (*int, error) {
+		return nil, &rpc.Error{Code: *code, Message: "failed"}
+	})
+	s.SetStrictErrorCodes(true)
+
+	for code, want := range map[int]ErrorCode{
+		codeRegistered: ErrorCode(codeRegistered),
+		7002:           E_INTERNAL,
+	} {
+		var res int
+		err := execute(t, s, "codes.fail", code, &res)
+		if e, ok := err.(*Error); !ok || e.Code != want {
+			t.Errorf("%d: expected code %d, got %v", code, want, err)
+		}
+	}
+}
+
+func TestPositionalParams(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.RegisterFunc("list.count", func(ctx context.Context, args *[]interface{}) (*int, error) {
+		n := len(*args)
+		return &n, nil
+	})
+
+	for _, test := range []struct {
+		method, params, reply string
+	}{
+		{"Service1.Multiply", `[4, 2]`, `"result":{"Result":8}`},
+		{"Service1.Multiply", `[4]`, `"result":{"Result":0}`},
+		{"Service1.Multiply", `{"A":4,"B":3}`, `"result":{"Result":12}`},
+		{"Service1.Multiply", `[4, 2, 1]`, `"code":-32602`},
+		{"list.count", `[1, "two", null]`, `"result":3`},
+	} {
+		body := fmt.Sprintf(`{"jsonrpc":"2.0","method":%q,"params":%s,"id":1}`, test.method, test.params)
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		if !strings.Contains(w.Body.String(), test.reply) {
+			t.Errorf("%s %s: expected %s, got %s", test.method, test.params, test.reply, w.Body)
+		}
+	}
+}
+
+func TestErrorStatuses(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	statuses := rpc.DefaultErrorStatuses()
+	statuses[codeRegistered] = http.StatusPaymentRequired
+	s.SetErrorStatuses(statuses)
+	s.RegisterFunc("billing.charge", func(ctx context.Context, args *Service1Request) (*Service1Response, error) {
+		return nil, &rpc.Error{Code: codeRegistered, Message: "no funds"}
+	})
+
+	for _, test := range []struct {
+		body string
+		code int
+	}{
+		{`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":2,"B":3},"id":1}`, http.StatusOK},
+		{`{"jsonrpc":"2.0","method":"Service1.Missing","id":1}`, http.StatusNotFound},
+		{`{"jsonrpc":"2.0","method":"billing.charge","params":{},"id":1}`, http.StatusPaymentRequired},
+		// Uncoded errors aren't mapped.
+		{`{"jsonrpc":"2.0","method":"Service1.ResponseError","params":{},"id":1}`, http.StatusOK},
+		// Nor are batches and notifications.
+		{`[{"jsonrpc":"2.0","method":"Service1.Missing","id":1},{"jsonrpc":"2.0","method":"Service1.Missing","id":2}]`, http.StatusOK},
+		{`{"jsonrpc":"2.0","method":"Service1.Missing"}`, http.StatusNoContent},
+	} {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: expected status %d, got %d: %s", test.body, test.code, w.Code, w.Body)
+		}
+	}
+}
+
+func TestStrictParams(t *testing.T) {
+	codec := NewCodec()
+	codec.SetStrictParams(true)
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+
+	var res Service1Response
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil || res.Result != 8 {
+		t.Errorf("Expected Result 8, got %d: %v", res.Result, err)
+	}
+	err := execute(t, s, "Service1.Multiply", map[string]int{"A": 4, "Bee": 2}, &res)
+	if jsonErr, ok := err.(*Error); !ok || jsonErr.Code != E_INVALID_REQ || !strings.Contains(jsonErr.Message, `"Bee"`) {
+		t.Errorf("Expected an invalid request error naming the member, got %v", err)
+	}
+	// Positional params only name known members.
+	if err := executeRaw(t, s, map[string]interface{}{"jsonrpc": "2.0", "method": "Service1.Multiply", "params": []int{4, 3}, "id": 1}, &res); err != nil || res.Result != 12 {
+		t.Errorf("Expected Result 12, got %d: %v", res.Result, err)
+	}
+}
+
+func TestOptionalParams(t *testing.T) {
+	codec := NewCodec()
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, "application/json")
+	s.RegisterService(new(Service1), "")
+	s.RegisterFunc("System.Ping", func(ctx context.Context, args *struct{}) (*string, error) {
+		pong := "pong"
+		return &pong, nil
+	})
+
+	ping := map[string]interface{}{"jsonrpc": "2.0", "method": "System.Ping", "id": 1}
+	var pong string
+	if err := executeRaw(t, s, ping, &pong); err == nil || err.(*Error).Code != E_INVALID_REQ {
+		t.Errorf("Expected an invalid request error without optional params, got %v", err)
+	}
+	codec.SetOptionalParams("System.Ping", true)
+	if err := executeRaw(t, s, ping, &pong); err != nil || pong != "pong" {
+		t.Errorf("Expected pong, got %q: %v", pong, err)
+	}
+	var res Service1Response
+	multiply := map[string]interface{}{"jsonrpc": "2.0", "method": "Service1.Multiply", "id": 1}
+	if err := executeRaw(t, s, multiply, &res); err == nil {
+		t.Error("Expected an error for a method without optional params")
+	}
+	codec.SetOptionalParams("*", true)
+	codec.SetOptionalParams("System.Ping", false)
+	if err := executeRaw(t, s, multiply, &res); err != nil || res.Result != 0 {
+		t.Errorf("Expected Result 0, got %d: %v", res.Result, err)
+	}
+	if err := executeRaw(t, s, ping, &pong); err == nil {
+		t.Error("Expected the method setting to override the default")
+	}
+}
+
+type TransferArgs struct {
+	Amount int
+	To     string
+}
+
+func (a *TransferArgs) Validate(r *http.Request) error {
+	if a.To == "" {
+		return errors.New("missing recipient")
+	}
+	if a.Amount <= 0 {
+		return &rpc.BadRequest{FieldViolations: []rpc.FieldViolation{{Field: "Amount", Description: "must be positive"}}}
+	}
+	return nil
+}
+
+func TestArgsValidator(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterFunc("bank.transfer", func(ctx context.Context, args *TransferArgs) (*int, error) {
+		return &args.Amount, nil
+	})
+
+	var n int
+	if err := execute(t, s, "bank.transfer", &TransferArgs{Amount: 5, To: "bob"}, &n); err != nil || n != 5 {
+		t.Errorf("Expected 5, got %d: %v", n, err)
+	}
+	for _, test := range []struct {
+		args  *TransferArgs
+		field string
+	}{
+		{&TransferArgs{Amount: 5}, `"field":""`},
+		{&TransferArgs{Amount: -1, To: "bob"}, `"field":"Amount"`},
+	} {
+		buf, _ := EncodeClientRequest("bank.transfer", test.args)
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		body := w.Body.String()
+		if !strings.Contains(body, `"code":-32600`) || !strings.Contains(body, `"@type":"type.googleapis.com/google.rpc.BadRequest"`) || !strings.Contains(body, test.field) {
+			t.Errorf("Expected an invalid request error with a BadRequest detail, got %s", body)
+		}
+	}
+}
+
+func TestReplyProcessors(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.AddReplyProcessor(func(method string, reply interface{}) interface{} {
+		if res, ok := reply.(*Service1Response); ok {
+			return &Service1Response{Result: res.Result * 10}
+		}
+		return reply
+	})
+	s.AddReplyProcessor(func(method string, reply interface{}) interface{} {
+		return map[string]interface{}{"method": method, "data": reply}
+	})
+
+	var res struct {
+		Method string
+		Data   Service1Response
+	}
+	if err := execute(t, s, "Service1.Multiply", &Service1Request{4, 2}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Method != "Service1.Multiply" || res.Data.Result != 80 {
+		t.Errorf("Expected the processed reply, got %+v", res)
+	}
+	if err := execute(t, s, "Service1.ResponseError", &Service1Request{4, 2}, &res); err == nil {
+		t.Error("Expected errors not to be processed")
+	}
+}
+
+type OrderItem struct {
+	SKU      string `json:"sku" rpc:"required,pattern=^[A-Z]{3}-[0-9]+$"`
+	Quantity int    `json:"quantity" rpc:"min=1,max=10"`
+}
+
+type OrderArgs struct {
+	Customer string      `json:"customer" rpc:"required"`
+	Note     *string     `json:"note" rpc:"max=5"`
+	Items    []OrderItem `json:"items" rpc:"min=1"`
+}
+
+func TestTagValidation(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterFunc("shop.order", func(ctx context.Context, args *OrderArgs) (*int, error) {
+		n := len(args.Items)
+		return &n, nil
+	})
+
+	var n int
+	args := &OrderArgs{Customer: "ann", Items: []OrderItem{{"ABC-1", 2}}}
+	if err := execute(t, s, "shop.order", args, &n); err != nil || n != 1 {
+		t.Errorf("Expected 1, got %d: %v", n, err)
+	}
+	long := "too long"
+	args = &OrderArgs{Note: &long, Items: []OrderItem{{"ABC-1", 2}, {"abc", 11}}}
+	buf, _ := EncodeClientRequest("shop.order", args)
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", bytes.NewReader(buf))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+	var res struct {
+		Error struct {
+			Code int
+			Data rpc.ErrorDetails
+		}
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Error.Code != rpc.CodeInvalidRequest || len(res.Error.Data.Details) != 1 {
+		t.Fatalf("Expected an invalid request error with details, got %s", w.Body)
+	}
+	var fields []string
+	for _, v := range res.Error.Data.Details[0].(*rpc.BadRequest).FieldViolations {
+		fields = append(fields, v.Field+" "+v.Description)
+	}
+	expected := `customer is required,note must have at most 5 characters,items[1].sku must match "^[A-Z]{3}-[0-9]+$",items[1].quantity must be at most 10`
+	if got := strings.Join(fields, ","); got != expected {
+		t.Errorf("Expected violations %s, got %s", expected, got)
+	}
+
+	err := s.RegisterFunc("shop.bad", func(ctx context.Context, args *struct {
+		N int `rpc:"pattern=^a"`
+	}) (*int, error) {
+		return nil, nil
+	})
+	if err == nil || !strings.Contains(err.Error(), "invalid rpc tag") {
+		t.Errorf("Expected an invalid tag to be rejected, got %v", err)
+	}
+}
+
+func TestRequestRewriters(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.AddRequestRewriter(func(r *http.Request, body []byte) ([]byte, error) {
+		return bytes.TrimPrefix(body, []byte(")]}'\n")), nil
+	})
+	s.AddRequestRewriter(func(r *http.Request, body []byte) ([]byte, error) {
+		var legacy struct {
+			Call json.RawMessage `json:"call"`
+		}
+		if !bytes.HasPrefix(body, []byte(`{"call"`)) {
+			return body, nil
+		}
+		if err := json.Unmarshal(body, &legacy); err != nil {
+			return nil, err
+		}
+		return legacy.Call, nil
+	})
+
+	for _, test := range []struct {
+		body string
+		code int
+		out  string
+	}{
+		{`{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":2,"B":3},"id":1}`, 200, `"Result":6`},
+		{")]}'\n" + `{"call":{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":2,"B":4},"id":1}}`, 200, `"Result":8`},
+		{`{"call":[}`, 400, "rpc: can't rewrite the request"},
+	} {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(test.body))
+		r.Header.Set("Content-Type", "application/json")
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != test.code || !strings.Contains(w.Body.String(), test.out) {
+			t.Errorf("%q: expected %d %s, got %d %s", test.body, test.code, test.out, w.Code, w.Body)
+		}
+	}
+}
+
+func TestOpenRPC(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	if err := s.EnableDiscovery(rpc.OpenRPCInfo{Title: "test", Version: "1.0.0"}); err != nil {
+		t.Fatal(err)
+	}
+
+	var doc struct {
+		OpenRPC string `json:"openrpc"`
+		Info    rpc.OpenRPCInfo
+		Methods []struct {
+			Name           string
+			ParamStructure string
+			Params         []struct {
+				Name   string
+				Schema map[string]interface{}
+			}
+		}
+	}
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(`{"jsonrpc":"2.0","method":"rpc.discover","id":1}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+	var res struct {
+		Result json.RawMessage
+		Error  *Error
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &res); err != nil || res.Error != nil {
+		t.Fatalf("rpc.discover: %v %v", err, w.Body)
+	}
+	if err := json.Unmarshal(res.Result, &doc); err != nil {
+		t.Fatal(err)
+	}
+	if doc.OpenRPC != "1.3.2" || doc.Info.Title != "test" {
+		t.Errorf("unexpected document header %q %+v", doc.OpenRPC, doc.Info)
+	}
+	var found bool
+	for _, m := range doc.Methods {
+		if m.Name != "Service1.Multiply" {
+			continue
+		}
+		found = true
+		if m.ParamStructure != "either" || len(m.Params) != 2 || m.Params[0].Name != "A" || m.Params[0].Schema["type"] != "integer" {
+			t.Errorf("unexpected method %+v", m)
+		}
+	}
+	if !found {
+		t.Errorf("Service1.Multiply not described: %s", res.Result)
+	}
+
+	r, _ = http.NewRequest("GET", "http://localhost:8080/openrpc.json", nil)
+	w = NewRecorder()
+	s.OpenRPCHandler().ServeHTTP(w, r)
+	if w.Code != 200 || !strings.Contains(w.Body.String(), `"name":"rpc.discover"`) {
+		t.Errorf("expected the document, got %d %s", w.Code, w.Body)
+	}
+}
+
+func TestVerifyDigest(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.SetBodyReader(rpc.VerifyDigest)
+	s.SetResponseDigest(true)
+
+	body := `{"jsonrpc":"2.0","method":"Service1.Multiply","params":{"A":2,"B":3},"id":1}`
+	md5Sum := md5.Sum([]byte(body))
+	sha256Sum := sha256.Sum256([]byte(body))
+	for _, test := range []struct {
+		header string
+		value  string
+		code   int
+	}{
+		{"", "", 200},
+		{"Content-MD5", base64.StdEncoding.EncodeToString(md5Sum[:]), 200},
+		{"Digest", "unknown=abc, SHA-256=" + base64.StdEncoding.EncodeToString(sha256Sum[:]), 200},
+		{"Content-MD5", base64.StdEncoding.EncodeToString(sha256Sum[:]), 400},
+		{"Digest", "sha-256=" + base64.StdEncoding.EncodeToString(md5Sum[:]), 400},
+		{"Digest", "md5=%%%", 400},
+	} {
+		r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(body))
+		r.Header.Set("Content-Type", "application/json")
+		if test.header != "" {
+			r.Header.Set(test.header, test.value)
+		}
+		w := NewRecorder()
+		s.ServeHTTP(w, r)
+		if w.Code != test.code {
+			t.Errorf("%s: %s: expected %d, got %d %s", test.header, test.value, test.code, w.Code, w.Body)
+			continue
+		}
+		if w.Code != 200 {
+			continue
+		}
+		sum := sha256.Sum256(w.Body.Bytes())
+		if digest := "sha-256=" + base64.StdEncoding.EncodeToString(sum[:]); w.HeaderMap.Get("Digest") != digest {
+			t.Errorf("expected Digest %s, got %q", digest, w.HeaderMap.Get("Digest"))
+		}
+	}
+}
+
+func TestIntrospection(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	s.DescribeMethod("Service1.Multiply", rpc.MethodDoc{Description: "Multiplies A by B."})
+	if err := s.EnableIntrospection(); err != nil {
+		t.Fatal(err)
+	}
+
+	var methods []string
+	r, _ := http.NewRequest("POST", "http://localhost:8080/", strings.NewReader(`{"jsonrpc":"2.0","method":"system.listMethods","id":1}`))
+	r.Header.Set("Content-Type", "application/json")
+	w := NewRecorder()
+	s.ServeHTTP(w, r)
+	if err := DecodeClientResponse(w.Body, &methods); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(methods[:2], []string{"Service1.Multiply", "Service1.ResponseError"}) || len(methods) != 5 {
+		t.Errorf("unexpected methods %v", methods)
+	}
+
+	var signature rpc.MethodSignature
+	if err := execute(t, s, "system.methodSignature", &rpc.IntrospectionArgs{Method: "Service1.multiply"}, &signature); err != nil {
+		t.Fatal(err)
+	}
+	if signature.Method != "Service1.Multiply" || signature.Description != "Multiplies A by B." ||
+		!strings.Contains(string(signature.Params), `"A":{"type":"integer"}`) ||
+		!strings.Contains(string(signature.Result), `"Result":{"type":"integer"}`) {
+		t.Errorf("unexpected signature %+v", signature)
+	}
+
+	var help string
+	err := execute(t, s, "system.methodHelp", &rpc.IntrospectionArgs{Method: "Service1.Divide"}, &help)
+	if e, ok := err.(*Error); !ok || e.Code != E_BAD_PARAMS {
+		t.Errorf("expected E_BAD_PARAMS, got %v", err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	codectest.Run(t, codectest.Suite{
+		Codec:       NewCodec(),
+		ContentType: "application/json",
+		Wire:        codectest.JSONWire{},
+	})
+}
@@ -0,0 +1,78 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// ParamsLimits bounds the shape of the params accepted by the codec.
+// A zero field means no limit.
+type ParamsLimits struct {
+	// MaxSize is the maximum encoded size in bytes of the params of each
+	// request, batch entries included.
+	MaxSize int
+	// MaxDepth is the maximum nesting depth of objects and arrays.
+	MaxDepth int
+	// MaxArrayLen is the maximum number of elements of any array.
+	MaxArrayLen int
+	// MaxStringLen is the maximum length in bytes of any string, including
+	// object keys.
+	MaxStringLen int
+}
+
+func (l ParamsLimits) isZero() bool {
+	return l == ParamsLimits{}
+}
+
+// check scans raw params and reports the first limit exceeded.
+func (l ParamsLimits) check(params []byte) error {
+	if l.MaxSize > 0 && len(params) > l.MaxSize {
+		return fmt.Errorf("params larger than %d bytes", l.MaxSize)
+	}
+	dec := json.NewDecoder(bytes.NewReader(params))
+	// counts holds the element count of each open array, or -1 for objects.
+	var counts []int
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if n := len(counts); n > 0 && counts[n-1] >= 0 {
+			if d, ok := tok.(json.Delim); !ok || d != ']' {
+				counts[n-1]++
+				if l.MaxArrayLen > 0 && counts[n-1] > l.MaxArrayLen {
+					return fmt.Errorf("array longer than %d elements", l.MaxArrayLen)
+				}
+			}
+		}
+		switch t := tok.(type) {
+		case json.Delim:
+			switch t {
+			case '{', '[':
+				if l.MaxDepth > 0 && len(counts) >= l.MaxDepth {
+					return fmt.Errorf("nesting deeper than %d levels", l.MaxDepth)
+				}
+				if t == '{' {
+					counts = append(counts, -1)
+				} else {
+					counts = append(counts, 0)
+				}
+			default:
+				counts = counts[:len(counts)-1]
+			}
+		case string:
+			if l.MaxStringLen > 0 && len(t) > l.MaxStringLen {
+				return fmt.Errorf("string longer than %d bytes", l.MaxStringLen)
+			}
+		}
+	}
+}
@@ -0,0 +1,82 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Positional params
+// ----------------------------------------------------------------------------
+
+// positionalParams maps params given as an array onto the fields of args,
+// when args is a struct: the elements become the fields in order, named as
+// encoding/json does, and missing trailing elements leave their fields
+// untouched. Other params, and args decoding arrays themselves, such as
+// slices, are returned unchanged.
+func positionalParams(params json.RawMessage, args interface{}) (json.RawMessage, error) {
+	if trimmed := bytes.TrimSpace(params); len(trimmed) == 0 || trimmed[0] != '[' {
+		return params, nil
+	}
+	t := reflect.TypeOf(args)
+	for t.Kind() == reflect.Ptr {
+		if t.Implements(jsonUnmarshalerType) || t.Implements(textUnmarshalerType) {
+			return params, nil
+		}
+		t = t.Elem()
+	}
+	if t.Kind() != reflect.Struct {
+		return params, nil
+	}
+	var elems []json.RawMessage
+	if err := json.Unmarshal(params, &elems); err != nil {
+		return params, nil
+	}
+	names := positionalNames(t)
+	if len(elems) > len(names) {
+		return nil, fmt.Errorf("rpc: %d positional params for %d fields of %s", len(elems), len(names), t)
+	}
+	fields := make(map[string]json.RawMessage, len(elems))
+	for i, elem := range elems {
+		fields[names[i]] = elem
+	}
+	return json.Marshal(fields)
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// positionalNames returns the JSON names of the fields of struct type t, in
+// order, those of embedded structs included.
+func positionalNames(t reflect.Type) []string {
+	var names []string
+	for _, f := range reflect.VisibleFields(t) {
+		if f.Anonymous || !f.IsExported() {
+			continue
+		}
+		name := f.Name
+		if tag := f.Tag.Get("json"); tag != "" {
+			if tag == "-" {
+				continue
+			}
+			if i := strings.Index(tag, ","); i >= 0 {
+				tag = tag[:i]
+			}
+			if tag != "" {
+				name = tag
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
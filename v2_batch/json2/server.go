@@ -7,8 +7,10 @@ package json2
 
 import (
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
+	"reflect"
 
 	"bytes"
 
@@ -37,6 +39,40 @@ type serverRequest struct {
 	// Our implementation will not do type checking for id.
 	// It will be copied as it is.
 	Id *json.RawMessage `json:"id"`
+
+	// A request without id member is a notification, which gets no reply.
+	notification bool
+
+	// A JSON-RPC 1.0 request, see SetVersion1Compat.
+	version1 bool
+
+	// The members unknown to the protocol.
+	extensions map[string]json.RawMessage
+}
+
+// UnmarshalJSON decodes the request, telling notifications apart from
+// requests with a null id.
+func (r *serverRequest) UnmarshalJSON(b []byte) error {
+	type plain serverRequest
+	if err := json.Unmarshal(b, (*plain)(r)); err != nil {
+		return err
+	}
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(b, &members); err != nil {
+		return err
+	}
+	_, hasId := members["id"]
+	r.notification = !hasId
+	for name, value := range members {
+		if envelopeMembers[name] {
+			continue
+		}
+		if r.extensions == nil {
+			r.extensions = make(map[string]json.RawMessage)
+		}
+		r.extensions[name] = value
+	}
+	return nil
 }
 
 // serverResponse represents a JSON-RPC response returned by the server.
@@ -56,6 +92,19 @@ type serverResponse struct {
 
 	// This must be the same id as the request it is responding to.
 	Id *json.RawMessage `json:"id"`
+
+	// Extension member carrying metadata about the reply, such as the
+	// headers set by the handler of a request in a batch.
+	Meta map[string]interface{} `json:"meta,omitempty"`
+
+	// Replies to notifications are omitted from the response.
+	notification bool
+
+	// Replies to JSON-RPC 1.0 requests are encoded as such.
+	version1 bool
+
+	// The extension members, see WithExtensions.
+	extensions map[string]interface{}
 }
 
 // ----------------------------------------------------------------------------
@@ -74,38 +123,155 @@ func NewCodec() *Codec {
 
 // Codec creates a CodecRequest to process each request.
 type Codec struct {
-	encSel rpc.EncoderSelector
+	encSel          rpc.EncoderSelector
+	limits          ParamsLimits
+	maxReplySize    int
+	aliases         map[string]FieldAliases
+	writeBufferSize int
+	nonFinite       NonFinitePolicy
+	emptyPolicy     EmptyResultPolicy
+	version1        bool
+	json            JSONEngine
+	strictParams    bool
+	optionalParams  map[string]bool
+
+	continuations *continuationStore
+}
+
+// SetParamsLimits bounds the nesting depth, array lengths and string lengths
+// of the params accepted by the codec. Requests exceeding them are answered
+// with an E_BAD_PARAMS error before the params are decoded.
+func (c *Codec) SetParamsLimits(limits ParamsLimits) {
+	c.limits = limits
+}
+
+// SetStrictParams enables rejecting params with members unknown to the
+// args, e.g. misspelled ones, with an E_INVALID_REQ error naming the member
+// instead of ignoring them. With a JSON engine, see NewCodecWithJSON, it is
+// up to the configuration of the engine.
+func (c *Codec) SetStrictParams(strict bool) {
+	c.strictParams = strict
+}
+
+// SetOptionalParams sets whether requests for method may omit params, in
+// dotted notation as in "Service.Method", or for every method without its
+// own setting with "*". Omitted params are then decoded as {}, leaving the
+// args of parameterless methods, such as struct{}, zero:
+//
+//	codec.SetOptionalParams("System.Ping", true)
+//
+// Params are optional for rpc.discover and system.listMethods unless set
+// otherwise.
+func (c *Codec) SetOptionalParams(method string, optional bool) {
+	if c.optionalParams == nil {
+		c.optionalParams = make(map[string]bool)
+	}
+	c.optionalParams[method] = optional
+}
+
+// parameterless are the built-in methods whose params are optional by
+// default.
+var parameterless = map[string]bool{
+	rpc.DiscoverMethod:   true,
+	"system.ListMethods": true,
+}
+
+// emptyParams are the params of the requests omitting them, see
+// SetOptionalParams.
+var emptyParams = json.RawMessage("{}")
+
+// paramsOptional returns true if requests for method may omit params.
+func (c *Codec) paramsOptional(method string) bool {
+	if optional, ok := c.optionalParams[method]; ok {
+		return optional
+	}
+	if _, ok := c.optionalParams["*"]; !ok && parameterless[method] {
+		return true
+	}
+	return c.optionalParams["*"]
+}
+
+// SetMaxReplySize bounds the encoded size in bytes of the result of each
+// reply, batch entries included. A result exceeding it is replaced by an
+// E_INTERNAL error. Zero means no limit.
+func (c *Codec) SetMaxReplySize(n int) {
+	c.maxReplySize = n
 }
 
 // NewRequest returns a CodecRequest.
 func (c *Codec) NewRequest(r *http.Request) ([]rpc.CodecRequest, error) {
-	return newCodecRequest(r, c.encSel.Select(r))
+	return newCodecRequest(r, c, c.encSel.Select(r))
 }
 
 func (c *Codec) WriteBatchedReply(r *http.Request, w http.ResponseWriter, replyArray []interface{}) {
 	w.Header().Set("Content-Type", "application/json; charset=utf-8")
-	encoder_ := c.encSel.Select(r)
-	encoder := json.NewEncoder(encoder_.Encode(w))
-
-	var temp interface{}
-	if len(replyArray) == 1 {
-		temp = replyArray[0]
+	single := len(replyArray) == 1
+	replyArray, omitted := omitNotifications(replyArray)
+	if len(replyArray) == 0 && omitted > 0 {
+		// Only notifications: there is nothing to reply.
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	encoder := c.encSel.Select(r)
+	// Compressed responses must be written in one piece.
+	progressive := c.writeBufferSize > 0 && encoder == rpc.Encoder(rpc.DefaultEncoder)
+	out := encoder.Encode(w)
+
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if single {
+		appendReply(buf, replyArray[0])
 	} else {
-		temp = replyArray
+		buf.WriteByte('[')
+		for i, reply := range replyArray {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			appendReply(buf, reply)
+			if progressive && buf.Len() > c.writeBufferSize {
+				if _, err := out.Write(buf.Bytes()); err != nil {
+					return
+				}
+				buf.Reset()
+				if f, ok := w.(http.Flusher); ok {
+					f.Flush()
+				}
+			}
+		}
+		buf.WriteByte(']')
 	}
+	buf.WriteByte('\n')
+	out.Write(buf.Bytes())
+}
 
-	err := encoder.Encode(temp)
-	if err != nil {
-		rpc.WriteError(w, 400, err.Error())
+// ErrorReply implements rpc.ErrorReplier, answering a whole request with an
+// error of null id.
+func (c *Codec) ErrorReply(err error) interface{} {
+	return &serverResponse{
+		Version: Version,
+		Error:   newError(err),
 	}
 }
 
+// omitNotifications removes the replies to notifications, returning how
+// many were removed.
+func omitNotifications(replies []interface{}) ([]interface{}, int) {
+	kept := replies[:0]
+	for _, reply := range replies {
+		if res, ok := reply.(*serverResponse); ok && res.notification {
+			continue
+		}
+		kept = append(kept, reply)
+	}
+	return kept, len(replies) - len(kept)
+}
+
 // ----------------------------------------------------------------------------
 // CodecRequest
 // ----------------------------------------------------------------------------
 
 // newCodecRequest returns a new CodecRequest.
-func newCodecRequest(r *http.Request, encoder rpc.Encoder) ([]rpc.CodecRequest, error) {
+func newCodecRequest(r *http.Request, codec *Codec, encoder rpc.Encoder) ([]rpc.CodecRequest, error) {
 
 	//jason:
 	body_, err := ioutil.ReadAll(r.Body)
@@ -113,6 +279,15 @@ func newCodecRequest(r *http.Request, encoder rpc.Encoder) ([]rpc.CodecRequest,
 	if err != nil || body_ == nil || len(body_) < 2 { // think of "[]" or "{}"
 		return []rpc.CodecRequest{}, nil
 	}
+	body_, err = toUTF8(r.Header.Get("Content-Type"), body_)
+	if err != nil {
+		// Answered with a single error reply, as for a request without id.
+		err = &Error{
+			Code:    E_PARSE,
+			Message: err.Error(),
+		}
+		return []rpc.CodecRequest{&CodecRequest{request: new(serverRequest), err: err, codec: codec, encoder: encoder}}, nil
+	}
 
 	// Decode the request body and check if RPC method is valid.
 	var reqArray []serverRequest
@@ -142,31 +317,58 @@ func newCodecRequest(r *http.Request, encoder rpc.Encoder) ([]rpc.CodecRequest,
 		return nil, err
 	}
 
+	if isMultiQuery && len(reqArray) == 0 {
+		return []rpc.CodecRequest{emptyBatchRequest(codec, encoder)}, nil
+	}
+
 	codecRequestArray := make([]rpc.CodecRequest, len(reqArray))
 
-	for i, req := range reqArray {
-		if req.Version != Version {
-			err := &Error{
-				Code:    E_INVALID_REQ,
-				Message: "jsonrpc must be " + Version,
-				Data:    req,
-			}
-			codecRequestArray[i] = &CodecRequest{request: &reqArray[i], err: err, encoder: encoder, body: body_}
+	for i := range reqArray {
+		err := codec.checkVersion(&reqArray[i])
+		codecRequestArray[i] = &CodecRequest{request: &reqArray[i], err: err, codec: codec, encoder: encoder, body: body_}
+	}
 
-		} else {
-			codecRequestArray[i] = &CodecRequest{request: &reqArray[i], err: nil, encoder: encoder, body: body_}
+	return codecRequestArray, nil
 
+}
+
+// checkVersion returns an error if req is neither a 2.0 request nor, in
+// 1.0 compatibility mode, a 1.0 one.
+func (c *Codec) checkVersion(req *serverRequest) error {
+	if c.version1 && req.Version == "" {
+		req.version1 = true
+		// A 1.0 notification has a null id.
+		req.notification = req.Id == nil
+		return nil
+	}
+	if req.Version != Version {
+		// An invalid request is answered even without id.
+		req.notification = false
+		return &Error{
+			Code:    E_INVALID_REQ,
+			Message: "jsonrpc must be " + Version,
+			Data:    *req,
 		}
 	}
+	return nil
+}
 
-	return codecRequestArray, nil
-
+// emptyBatchRequest returns the request answering an empty batch, which is
+// an invalid request, with a single error.
+func emptyBatchRequest(codec *Codec, encoder rpc.Encoder) *CodecRequest {
+	return &CodecRequest{
+		request: new(serverRequest),
+		err:     &Error{Code: E_INVALID_REQ, Message: "rpc: empty batch"},
+		codec:   codec,
+		encoder: encoder,
+	}
 }
 
 // CodecRequest decodes and encodes a single request.
 type CodecRequest struct {
 	request *serverRequest
 	err     error
+	codec   *Codec
 	encoder rpc.Encoder
 	//Jason
 	body []byte
@@ -182,11 +384,30 @@ func (c *CodecRequest) Method() (string, error) {
 	return "", c.err
 }
 
+// RenameMethod sets the registered name of the method, called in
+// lowerCamel, so that the settings of the method apply.
+func (c *CodecRequest) RenameMethod(method string) {
+	c.request.Method = method
+}
+
 //Jason
 func (c *CodecRequest) Body() []byte {
 	return c.body
 }
 
+// CacheKey identifies the request by its method and params, for the server
+// reply cache.
+func (c *CodecRequest) CacheKey() (string, bool) {
+	if c.err != nil || c.request.Params == nil {
+		return "", false
+	}
+	var params bytes.Buffer
+	if err := json.Compact(&params, *c.request.Params); err != nil {
+		return "", false
+	}
+	return c.request.Method + "\x00" + params.String(), true
+}
+
 func (c *CodecRequest) Error() error {
 	return c.err
 }
@@ -194,9 +415,36 @@ func (c *CodecRequest) Error() error {
 // ReadRequest fills the request object for the RPC method.
 func (c *CodecRequest) ReadRequest(args interface{}) error {
 	if c.err == nil {
-		if c.request.Params != nil {
+		raw := c.request.Params
+		if raw == nil && c.codec.paramsOptional(c.request.Method) {
+			raw = &emptyParams
+		}
+		if raw != nil {
+			if !c.codec.limits.isZero() {
+				if err := c.codec.limits.check(*raw); err != nil {
+					c.err = &Error{
+						Code:    E_BAD_PARAMS,
+						Message: "rpc: params rejected: " + err.Error(),
+					}
+					return c.err
+				}
+			}
+			params := *raw
+			if c.request.version1 {
+				params = version1Params(params)
+			}
+			params, err := positionalParams(params, args)
+			if err != nil {
+				c.err = &Error{
+					Code:    E_BAD_PARAMS,
+					Message: err.Error(),
+					Data:    c.request.Params,
+				}
+				return c.err
+			}
+			params = c.codec.aliasParams(c.request.Method, params)
 			// JSON params structured object. Unmarshal to the args object.
-			err := json.Unmarshal(*c.request.Params, args)
+			err = c.codec.unmarshal(params, args)
 			if err != nil {
 				c.err = &Error{
 					Code:    E_INVALID_REQ,
@@ -225,13 +473,7 @@ func (c *CodecRequest) WriteResponse(w http.ResponseWriter, reply interface{}) {
 }
 
 func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error) {
-	jsonErr, ok := err.(*Error)
-	if !ok {
-		jsonErr = &Error{
-			Code:    E_SERVER,
-			Message: err.Error(),
-		}
-	}
+	jsonErr := newError(err)
 	res := &serverResponse{
 		Version: Version,
 		Error:   jsonErr,
@@ -241,43 +483,89 @@ func (c *CodecRequest) WriteError(w http.ResponseWriter, status int, err error)
 }
 
 func (c *CodecRequest) ResponseReply(reply interface{}) interface{} {
+	reply, err := c.codec.aliasResult(c.request.Method, reply)
+	if err == nil {
+		reply, err = c.codec.encodeResult(c.codec.emptyResult(reply))
+	}
+	if err != nil {
+		return c.ErrorReply(err)
+	}
 	res := &serverResponse{
-		Version: Version,
-		Result:  reply,
-		Id:      c.request.Id,
+		Version:      Version,
+		Result:       reply,
+		Id:           c.request.Id,
+		notification: c.request.notification,
+		version1:     c.request.version1,
 	}
 	return res
 }
 
-func (c *CodecRequest) ErrorReply(err error) interface{} {
-	jsonErr, ok := err.(*Error)
-	if !ok {
-		jsonErr = &Error{
-			Code:    E_SERVER,
-			Message: err.Error(),
+// encodeResult applies the size limits and the non-finite float policy of
+// the codec to a result, returning it pre-encoded or truncated if needed.
+// With a JSONEngine, results are always pre-encoded by it.
+func (c *Codec) encodeResult(reply interface{}) (interface{}, error) {
+	if c.maxReplySize <= 0 && c.continuations == nil && c.nonFinite == NonFiniteError && c.json == nil {
+		return reply, nil
+	}
+	if _, ok := reply.(*Continuation); ok {
+		return reply, nil
+	}
+	b, err := c.marshal(reply)
+	if err != nil && c.nonFinite != NonFiniteError {
+		// Other engines than encoding/json fail with errors of their own.
+		if _, ok := err.(*json.UnsupportedValueError); ok || c.json != nil {
+			b, err = c.marshal(replaceNonFinite(reflect.ValueOf(reply), c.nonFinite))
+		}
+	}
+	if err != nil {
+		return nil, &Error{Code: E_INTERNAL, Message: err.Error()}
+	}
+	if c.maxReplySize > 0 && len(b) > c.maxReplySize {
+		return nil, &Error{
+			Code:    E_INTERNAL,
+			Message: fmt.Sprintf("rpc: reply larger than %d bytes", c.maxReplySize),
+		}
+	}
+	if c.continuations != nil {
+		if cont := c.continuations.split(b); cont != nil {
+			return cont, nil
 		}
 	}
+	return json.RawMessage(b), nil
+}
+
+func (c *CodecRequest) ErrorReply(err error) interface{} {
+	jsonErr := newError(err)
 	res := &serverResponse{
-		Version: Version,
-		Error:   jsonErr,
-		Id:      c.request.Id,
+		Version:      Version,
+		Error:        jsonErr,
+		Id:           c.request.Id,
+		notification: c.request.notification,
+		version1:     c.request.version1,
 	}
 	return res
 }
 
+// WithMeta attaches meta to a reply, in the "meta" member of the response.
+func (c *CodecRequest) WithMeta(reply interface{}, meta map[string]interface{}) interface{} {
+	if res, ok := reply.(*serverResponse); ok {
+		res.Meta = meta
+	}
+	return reply
+}
+
 func (c *CodecRequest) writeServerResponse(w http.ResponseWriter, res *serverResponse) {
 	// Id is null for notifications and they don't have a response.
 	if c.request.Id != nil {
 		w.Header().Set("Content-Type", "application/json; charset=utf-8")
-		encoder := json.NewEncoder(c.encoder.Encode(w))
-		err := encoder.Encode(res)
-
-		// Not sure in which case will this happen. But seems harmless.
-		if err != nil {
-			rpc.WriteError(w, 400, err.Error())
-		}
+		buf := getBuffer()
+		defer putBuffer(buf)
+		appendReply(buf, res)
+		buf.WriteByte('\n')
+		c.encoder.Encode(w).Write(buf.Bytes())
 	}
 }
 
+// EmptyResponse is a reply without members, always encoded as {}.
 type EmptyResponse struct {
 }
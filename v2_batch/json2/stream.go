@@ -0,0 +1,165 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+)
+
+// NewStream implements rpc.StreamCodec. Batches are decoded entry by entry
+// and their replies written as they are produced.
+//
+// Only UTF-8 bodies are streamed, and the response is never compressed, since
+// compressed responses are written in one piece by the encoders.
+func (c *Codec) NewStream(r *http.Request, w http.ResponseWriter) (rpc.BatchStream, error) {
+	if _, params, err := mime.ParseMediaType(r.Header.Get("Content-Type")); err == nil {
+		if charset := strings.ToLower(params["charset"]); charset != "" && charset != "utf-8" && charset != "utf8" {
+			return nil, nil
+		}
+	}
+	br := bufio.NewReader(r.Body)
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{br, r.Body}
+	for {
+		b, err := br.Peek(1)
+		if err != nil {
+			return nil, nil
+		}
+		switch b[0] {
+		case ' ', '\t', '\r', '\n':
+			br.ReadByte()
+			continue
+		case '[':
+		default:
+			return nil, nil
+		}
+		break
+	}
+	dec := json.NewDecoder(br)
+	if _, err := dec.Token(); err != nil {
+		return nil, err
+	}
+	return &batchStream{codec: c, dec: dec, w: w}, nil
+}
+
+// batchStream implements rpc.BatchStream.
+type batchStream struct {
+	codec   *Codec
+	dec     *json.Decoder
+	w       http.ResponseWriter
+	done    bool
+	written bool
+	omitted int
+	// total counts the decoded requests; single is set when the reply is
+	// a single object rather than an array.
+	total  int
+	single bool
+}
+
+// Next implements rpc.BatchStream.
+func (s *batchStream) Next(n int) ([]rpc.CodecRequest, error) {
+	var reqs []rpc.CodecRequest
+	for len(reqs) < n {
+		if s.done || !s.dec.More() {
+			if !s.done && s.total == 0 {
+				// An empty batch is answered with a single error.
+				s.single = true
+				reqs = append(reqs, emptyBatchRequest(s.codec, rpc.DefaultEncoder))
+			}
+			s.done = true
+			return reqs, io.EOF
+		}
+		s.total++
+		var raw json.RawMessage
+		if err := s.dec.Decode(&raw); err != nil {
+			// The rest of the body can't be decoded.
+			s.done = true
+			reqs = append(reqs, s.errorRequest(E_PARSE, err.Error(), nil))
+			return reqs, io.EOF
+		}
+		if !utf8.Valid(raw) {
+			reqs = append(reqs, s.errorRequest(E_PARSE, "rpc: request body is not valid UTF-8", nil))
+			continue
+		}
+		req := new(serverRequest)
+		if err := json.Unmarshal(raw, req); err != nil {
+			reqs = append(reqs, s.errorRequest(E_INVALID_REQ, err.Error(), raw))
+			continue
+		}
+		err := s.codec.checkVersion(req)
+		reqs = append(reqs, &CodecRequest{request: req, err: err, codec: s.codec, encoder: rpc.DefaultEncoder, body: raw})
+	}
+	return reqs, nil
+}
+
+func (s *batchStream) errorRequest(code ErrorCode, message string, data interface{}) *CodecRequest {
+	return &CodecRequest{
+		request: new(serverRequest),
+		err:     &Error{Code: code, Message: message, Data: data},
+		codec:   s.codec,
+		encoder: rpc.DefaultEncoder,
+	}
+}
+
+// WriteReplies implements rpc.BatchStream.
+func (s *batchStream) WriteReplies(replies []interface{}) error {
+	replies, omitted := omitNotifications(replies)
+	s.omitted += omitted
+	buf := getBuffer()
+	defer putBuffer(buf)
+	for _, reply := range replies {
+		buf.Reset()
+		appendReply(buf, reply)
+		sep := ","
+		if !s.written {
+			s.w.Header().Set("Content-Type", "application/json; charset=utf-8")
+			sep = "["
+			if s.single {
+				sep = ""
+			}
+			s.written = true
+		}
+		if _, err := io.WriteString(s.w, sep); err != nil {
+			return err
+		}
+		if _, err := s.w.Write(buf.Bytes()); err != nil {
+			return err
+		}
+	}
+	if f, ok := s.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return nil
+}
+
+// Close implements rpc.BatchStream.
+func (s *batchStream) Close() error {
+	if !s.written && s.omitted > 0 {
+		// Only notifications: there is nothing to reply.
+		s.w.WriteHeader(http.StatusNoContent)
+		return nil
+	}
+	if !s.written {
+		s.w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		_, err := io.WriteString(s.w, "[]\n")
+		return err
+	}
+	end := "]\n"
+	if s.single {
+		end = "\n"
+	}
+	_, err := io.WriteString(s.w, end)
+	return err
+}
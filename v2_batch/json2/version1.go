@@ -0,0 +1,58 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package json2
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// ----------------------------------------------------------------------------
+// JSON-RPC 1.0 compatibility
+// ----------------------------------------------------------------------------
+
+// SetVersion1Compat makes the codec accept JSON-RPC 1.0 requests, without
+// the "jsonrpc" member, rather than rejecting them with E_INVALID_REQ, for
+// old clients. They are answered with 1.0 responses, carrying both the
+// "result" and "error" members, one of them null, and no extension
+// members.
+//
+// As in 1.0, a request with a null id is a notification. Its params are an
+// array, whose only element, if there is one, is decoded into the args.
+func (c *Codec) SetVersion1Compat(enabled bool) {
+	c.version1 = enabled
+}
+
+// version1Response is a JSON-RPC 1.0 response.
+type version1Response struct {
+	Result interface{}      `json:"result"`
+	Error  *Error           `json:"error"`
+	Id     *json.RawMessage `json:"id"`
+}
+
+// marshalVersion1 encodes res as a JSON-RPC 1.0 response.
+func marshalVersion1(res *serverResponse) ([]byte, error) {
+	v1 := &version1Response{Result: res.Result, Error: res.Error, Id: res.Id}
+	if v1.Error != nil {
+		v1.Result = nil
+	}
+	if v1.Id == nil {
+		v1.Id = &null
+	}
+	return json.Marshal(v1)
+}
+
+// version1Params returns the only element of the params array of a 1.0
+// request, or the params unchanged if they hold more or less.
+func version1Params(params json.RawMessage) json.RawMessage {
+	if trimmed := bytes.TrimSpace(params); len(trimmed) == 0 || trimmed[0] != '[' {
+		return params
+	}
+	var elems []json.RawMessage
+	if err := json.Unmarshal(params, &elems); err != nil || len(elems) != 1 {
+		return params
+	}
+	return elems[0]
+}
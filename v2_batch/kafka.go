@@ -0,0 +1,225 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Kafka
+// ----------------------------------------------------------------------------
+
+// KafkaMessage is a message fetched from a topic.
+type KafkaMessage struct {
+	Topic     string
+	Partition int32
+	Offset    int64
+	Key       []byte
+	Value     []byte
+	// ContentType selects the codec, if set, e.g. from a header.
+	ContentType string
+}
+
+// KafkaConsumer is the part of a consumer group member used by KafkaBridge,
+// e.g. an adapter of a Kafka client. Implementations must be safe for
+// concurrent use.
+type KafkaConsumer interface {
+	// Fetch waits for the next message, returning early if ctx is done.
+	Fetch(ctx context.Context) (*KafkaMessage, error)
+	// Commit commits the offset of a processed message.
+	Commit(ctx context.Context, msg *KafkaMessage) error
+}
+
+// KafkaProducer is the part of a producer used by KafkaBridge.
+// Implementations must be safe for concurrent use.
+type KafkaProducer interface {
+	// Produce writes a message to topic and waits for its acknowledgement.
+	Produce(ctx context.Context, topic string, key, value []byte) error
+}
+
+// KafkaBridge is a Listener serving the JSON-RPC requests consumed from a
+// Kafka topic. The responses are produced to ResponseTopic, one message per
+// response keyed by the request id, so that a batch payload yields one
+// message per call that isn't a notification. A message's offset is
+// committed once its responses are produced.
+//
+// Messages are processed one at a time, in order; run several bridges in
+// the same consumer group to process partitions in parallel.
+type KafkaBridge struct {
+	// Consumer fetches the requests.
+	Consumer KafkaConsumer
+	// Producer writes the responses.
+	Producer KafkaProducer
+	// ResponseTopic is the topic of the responses. Responses are dropped
+	// without it.
+	ResponseTopic string
+	// ContentType selects the codec of messages without one. Defaults to
+	// "application/json".
+	ContentType string
+	// RetryDelay is waited after a failure to fetch a message or produce
+	// a response. Defaults to one second.
+	RetryDelay time.Duration
+	// OnError is called when a message can't be fetched or committed, or
+	// a response can't be produced. Producing is retried after RetryDelay
+	// until it succeeds, or the bridge is shut down before committing the
+	// message.
+	OnError func(msg *KafkaMessage, err error)
+
+	mutex  sync.Mutex
+	closed bool
+	cancel context.CancelFunc
+	calls  context.CancelFunc
+	done   chan struct{}
+}
+
+// Serve implements Listener.
+func (b *KafkaBridge) Serve(s *Server) error {
+	b.mutex.Lock()
+	if b.closed {
+		b.mutex.Unlock()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	calls, cancelCalls := context.WithCancel(context.Background())
+	b.cancel, b.calls = cancel, cancelCalls
+	b.done = make(chan struct{})
+	defer close(b.done)
+	b.mutex.Unlock()
+	defer cancel()
+	defer cancelCalls()
+
+	for {
+		msg, err := b.Consumer.Fetch(ctx)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			b.report(nil, err)
+			select {
+			case <-s.clock.After(b.retryDelay()):
+			case <-ctx.Done():
+			}
+			continue
+		}
+		responses, err := b.serve(calls, s, msg)
+		if err != nil {
+			b.report(msg, err)
+			continue
+		}
+		for len(responses) > 0 {
+			response := responses[0]
+			if err := b.Producer.Produce(calls, b.ResponseTopic, responseKey(response), response); err != nil {
+				b.report(msg, err)
+				select {
+				case <-s.clock.After(b.retryDelay()):
+					continue
+				case <-ctx.Done():
+					return nil
+				}
+			}
+			responses = responses[1:]
+		}
+		if err := b.Consumer.Commit(calls, msg); err != nil {
+			b.report(msg, err)
+		}
+	}
+}
+
+// serve dispatches the requests of a message, returning their responses.
+func (b *KafkaBridge) serve(ctx context.Context, s *Server, msg *KafkaMessage) ([]json.RawMessage, error) {
+	r, err := http.NewRequest("POST", "kafka://"+msg.Topic, bytes.NewReader(msg.Value))
+	if err != nil {
+		return nil, err
+	}
+	contentType := msg.ContentType
+	if contentType == "" {
+		contentType = b.ContentType
+	}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	r.Header.Set("Content-Type", contentType)
+	r.RemoteAddr = msg.Topic + "/" + strconv.Itoa(int(msg.Partition))
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r.WithContext(ctx))
+	if b.ResponseTopic == "" {
+		return nil, nil
+	}
+	return splitResponses(w.Body.Bytes()), nil
+}
+
+// splitResponses returns the responses of a JSON-RPC payload, one per
+// element of a batch.
+func splitResponses(body []byte) []json.RawMessage {
+	body = bytes.TrimSpace(body)
+	if len(body) == 0 {
+		return nil
+	}
+	if body[0] == '[' {
+		var responses []json.RawMessage
+		if err := json.Unmarshal(body, &responses); err == nil {
+			return responses
+		}
+	}
+	return []json.RawMessage{body}
+}
+
+// responseKey returns the id of a JSON-RPC response, unquoted if a string,
+// or nil if it has none.
+func responseKey(response []byte) []byte {
+	var envelope struct {
+		ID json.RawMessage `json:"id"`
+	}
+	if err := json.Unmarshal(response, &envelope); err != nil || len(envelope.ID) == 0 || string(envelope.ID) == "null" {
+		return nil
+	}
+	var id string
+	if err := json.Unmarshal(envelope.ID, &id); err == nil {
+		return []byte(id)
+	}
+	return envelope.ID
+}
+
+func (b *KafkaBridge) retryDelay() time.Duration {
+	if b.RetryDelay > 0 {
+		return b.RetryDelay
+	}
+	return time.Second
+}
+
+func (b *KafkaBridge) report(msg *KafkaMessage, err error) {
+	if b.OnError != nil {
+		b.OnError(msg, err)
+	}
+}
+
+// Shutdown implements Listener. It stops fetching messages and waits for
+// the message in flight, cancelling its requests once ctx is done.
+func (b *KafkaBridge) Shutdown(ctx context.Context) error {
+	b.mutex.Lock()
+	b.closed = true
+	cancel, calls, done := b.cancel, b.calls, b.done
+	b.mutex.Unlock()
+	if cancel == nil {
+		return nil
+	}
+	cancel()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		calls()
+		<-done
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,215 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// Service lifecycle
+// ----------------------------------------------------------------------------
+
+// Initializer can be implemented by a service receiver needing setup before
+// serving calls, e.g. opening connection pools.
+type Initializer interface {
+	Init(ctx context.Context) error
+}
+
+// Warmer can be implemented by a service receiver to be primed before
+// serving calls, e.g. filling caches. Warmup is called after Init.
+type Warmer interface {
+	Warmup(ctx context.Context) error
+}
+
+// serviceInit is the initialization state of a service implementing
+// Initializer or Warmer.
+type serviceInit struct {
+	lazy bool // initialized by the first call rather than by Start
+
+	mutex   sync.Mutex
+	done    bool
+	running chan struct{} // closed when the running initialization ends
+	err     error         // of the last initialization
+}
+
+// lifecycle is the readiness of the server.
+type lifecycle struct {
+	mutex sync.Mutex
+	ready bool
+}
+
+// LazyInit makes the server initialize the service on its first call
+// rather than in Start, and report ready without it.
+func LazyInit() ServiceOption {
+	return func(o *serviceOptions) {
+		o.lazy = true
+	}
+}
+
+// newServiceInit returns the initialization state of rcvr, or nil if it
+// needs none.
+func newServiceInit(rcvr interface{}, lazy bool) *serviceInit {
+	_, initializer := rcvr.(Initializer)
+	_, warmer := rcvr.(Warmer)
+	if !initializer && !warmer {
+		return nil
+	}
+	return &serviceInit{lazy: lazy}
+}
+
+// Start initializes the services implementing Initializer or Warmer, other
+// than those registered with LazyInit, concurrently, then reports the
+// server ready, see Ready. Serve calls it along with the listeners; the
+// calls to a service received meanwhile wait for its initialization.
+//
+// A service failing to initialize is retried by its next call, which is
+// answered with a CodeUnavailable error if it fails again. Services
+// registered after Start are initialized by their first call.
+func (s *Server) Start(ctx context.Context) error {
+	s.services.mutex.Lock()
+	var services []*service
+	for _, service := range s.services.services {
+		if service.init != nil && !service.init.lazy {
+			services = append(services, service)
+		}
+	}
+	s.services.mutex.Unlock()
+	sort.Slice(services, func(i, j int) bool { return services[i].name < services[j].name })
+
+	errs := make([]error, len(services))
+	var wg sync.WaitGroup
+	for i := range services {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			errs[i] = services[i].initialize(ctx, false)
+		}(i)
+	}
+	wg.Wait()
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("rpc: can't initialize %q: %v", services[i].name, err)
+		}
+	}
+	s.lifecycle.mutex.Lock()
+	s.lifecycle.ready = true
+	s.lifecycle.mutex.Unlock()
+	return nil
+}
+
+// Ready returns true once Start has initialized the services.
+func (s *Server) Ready() bool {
+	s.lifecycle.mutex.Lock()
+	defer s.lifecycle.mutex.Unlock()
+	return s.lifecycle.ready
+}
+
+// ReadyHandler returns a handler for readiness probes, answering 200 once
+// the server is ready and 503 before.
+func (s *Server) ReadyHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.Ready() {
+			WriteError(w, http.StatusServiceUnavailable, "rpc: not ready")
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.Write([]byte("ready"))
+	})
+}
+
+// initialized returns an error if the service called by r can't be
+// initialized.
+func (s *Server) initialized(r *http.Request, service *service) error {
+	if service.init == nil {
+		return nil
+	}
+	// The initialization is shared by the calls waiting for it, so it
+	// isn't cancelled with the call starting it.
+	if err := service.initialize(r.Context(), true); err != nil {
+		if p, ok := err.(*initPanic); ok {
+			// The panic value is logged rather than disclosed to the client.
+			s.log(LevelError, "rpc: initialization panicked", Field{"rpc.service", service.name},
+				Field{"rpc.panic", p.value})
+			err = errors.New("initialization panicked")
+		}
+		return &Error{
+			Code:    CodeUnavailable,
+			Message: fmt.Sprintf("rpc: service %q not initialized: %v", service.name, err),
+		}
+	}
+	return nil
+}
+
+// initialize initializes the service with ctx, or without its cancellation
+// if detach is set, unless it is already. If an initialization is running,
+// it waits for it to end or ctx to be done. A panic in Init or Warmup fails
+// the initialization.
+func (s *service) initialize(ctx context.Context, detach bool) (err error) {
+	i := s.init
+	i.mutex.Lock()
+	if i.done {
+		i.mutex.Unlock()
+		return nil
+	}
+	if running := i.running; running != nil {
+		i.mutex.Unlock()
+		select {
+		case <-running:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		i.mutex.Lock()
+		defer i.mutex.Unlock()
+		return i.err
+	}
+	running := make(chan struct{})
+	i.running = running
+	i.mutex.Unlock()
+
+	defer func() {
+		if value := recover(); value != nil {
+			err = &initPanic{value}
+		}
+		i.mutex.Lock()
+		i.done = err == nil
+		i.err = err
+		i.running = nil
+		i.mutex.Unlock()
+		close(running)
+	}()
+	if detach {
+		ctx = context.WithoutCancel(ctx)
+	}
+	return s.runInit(ctx)
+}
+
+// initPanic is the error of an initialization that panicked.
+type initPanic struct {
+	value interface{}
+}
+
+func (e *initPanic) Error() string {
+	return fmt.Sprintf("rpc: initialization panicked: %v", e.value)
+}
+
+// runInit calls the Init then Warmup methods of the receiver.
+func (s *service) runInit(ctx context.Context) error {
+	rcvr := s.rcvr.Interface()
+	if initializer, ok := rcvr.(Initializer); ok {
+		if err := initializer.Init(ctx); err != nil {
+			return err
+		}
+	}
+	if warmer, ok := rcvr.(Warmer); ok {
+		return warmer.Warmup(ctx)
+	}
+	return nil
+}
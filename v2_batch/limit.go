@@ -0,0 +1,51 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+)
+
+// ErrorReplier is implemented by codecs able to build an error reply that
+// answers a whole HTTP request rather than one of its calls, e.g. when a
+// batch is rejected.
+type ErrorReplier interface {
+	ErrorReply(err error) interface{}
+}
+
+// SetMaxBatchSize limits the number of requests in a batch. Larger batches
+// are rejected as a whole with a CodeInvalidRequest error before any of
+// their requests is dispatched. Zero means no limit, which is the default.
+//
+// Chunked batches (see SetBatchChunking) are read up to the limit before
+// being processed.
+func (s *Server) SetMaxBatchSize(n int) {
+	atomic.StoreInt64(&s.maxBatchSize, int64(n))
+}
+
+// batchSizeLimit returns the limit set with SetMaxBatchSize.
+func (s *Server) batchSizeLimit() int {
+	return int(atomic.LoadInt64(&s.maxBatchSize))
+}
+
+// batchTooLarge returns the error rejecting a batch over a size limit.
+func batchTooLarge(n int) error {
+	return &Error{
+		Code:    CodeInvalidRequest,
+		Message: fmt.Sprintf("rpc: batch larger than %d requests", n),
+	}
+}
+
+// rejectBatch answers a batch with a single error, or with an HTTP status
+// if the codec can't write errors on their own.
+func (s *Server) rejectBatch(w http.ResponseWriter, r *http.Request, codec Codec, status int, err error) {
+	if replier, ok := codec.(ErrorReplier); ok {
+		codec.WriteBatchedReply(r, w, []interface{}{replier.ErrorReply(err)})
+		return
+	}
+	WriteError(w, status, err.Error())
+}
@@ -0,0 +1,148 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"log/slog"
+	"sync/atomic"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Logging
+// ----------------------------------------------------------------------------
+
+// LogLevel is the severity of a log entry. The values match log/slog.
+type LogLevel int
+
+const (
+	LevelDebug LogLevel = -4
+	LevelInfo  LogLevel = 0
+	LevelWarn  LogLevel = 4
+	LevelError LogLevel = 8
+)
+
+// String returns the name of the level.
+func (l LogLevel) String() string {
+	return slog.Level(l).String()
+}
+
+// Field is a key/value pair attached to a log entry.
+//
+// Fields logged by the server use the "rpc." key prefix:
+//
+//	rpc.method    the called method, in dotted notation
+//	rpc.duration  the call duration, a time.Duration
+//	rpc.error     the error replied, if any
+//	rpc.code      the code of the error replied, if it has one
+//	rpc.panic     the value of a panic in a method
+//	rpc.stack     the stack trace of the panic
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+// Logger receives the structured log entries of the server.
+type Logger interface {
+	Log(level LogLevel, msg string, fields ...Field)
+}
+
+// SetLogger sets the logger of the server and the minimum level of the
+// entries passed to it.
+func (s *Server) SetLogger(logger Logger, level LogLevel) {
+	s.logger = logger
+	s.SetLogLevel(level)
+}
+
+// SetLogLevel changes the minimum level of the logged entries.
+func (s *Server) SetLogLevel(level LogLevel) {
+	atomic.StoreInt64(&s.logLevel, int64(level))
+}
+
+// LogLevel returns the minimum level of the logged entries.
+func (s *Server) LogLevel() LogLevel {
+	return LogLevel(atomic.LoadInt64(&s.logLevel))
+}
+
+// log sends an entry to the logger, if its level is enabled.
+func (s *Server) log(level LogLevel, msg string, fields ...Field) {
+	if s.logger != nil && level >= s.LogLevel() {
+		s.logger.Log(level, msg, fields...)
+	}
+}
+
+// logCall logs the completion of a call at debug level, along with the ID
+// of its profile if it was sampled.
+func (s *Server) logCall(method string, err error, elapsed time.Duration, profileID string) {
+	if s.logger == nil || LevelDebug < s.LogLevel() {
+		return
+	}
+	fields := []Field{{"rpc.method", method}, {"rpc.duration", elapsed}}
+	if profileID != "" {
+		fields = append(fields, Field{"rpc.profile_id", profileID})
+	}
+	if err != nil {
+		fields = append(fields, Field{"rpc.error", err.Error()})
+		if code, ok := ErrorCode(err); ok {
+			fields = append(fields, Field{"rpc.code", code})
+		}
+	}
+	s.log(LevelDebug, "rpc: call done", fields...)
+}
+
+// NewSlogLogger returns a Logger writing to a log/slog logger.
+func NewSlogLogger(logger *slog.Logger) Logger {
+	return slogLogger{logger}
+}
+
+type slogLogger struct {
+	logger *slog.Logger
+}
+
+func (l slogLogger) Log(level LogLevel, msg string, fields ...Field) {
+	attrs := make([]slog.Attr, len(fields))
+	for i, f := range fields {
+		attrs[i] = slog.Any(f.Key, f.Value)
+	}
+	l.logger.LogAttrs(context.Background(), slog.Level(level), msg, attrs...)
+}
+
+// ZapSugaredLogger is the subset of *zap.SugaredLogger used by
+// NewZapLogger; it is declared here so that this package doesn't depend on
+// zap.
+type ZapSugaredLogger interface {
+	Debugw(msg string, keysAndValues ...interface{})
+	Infow(msg string, keysAndValues ...interface{})
+	Warnw(msg string, keysAndValues ...interface{})
+	Errorw(msg string, keysAndValues ...interface{})
+}
+
+// NewZapLogger returns a Logger writing to a zap sugared logger, e.g.
+// NewZapLogger(zapLogger.Sugar()).
+func NewZapLogger(logger ZapSugaredLogger) Logger {
+	return zapLogger{logger}
+}
+
+type zapLogger struct {
+	logger ZapSugaredLogger
+}
+
+func (l zapLogger) Log(level LogLevel, msg string, fields ...Field) {
+	kv := make([]interface{}, 0, 2*len(fields))
+	for _, f := range fields {
+		kv = append(kv, f.Key, f.Value)
+	}
+	switch {
+	case level >= LevelError:
+		l.logger.Errorw(msg, kv...)
+	case level >= LevelWarn:
+		l.logger.Warnw(msg, kv...)
+	case level >= LevelInfo:
+		l.logger.Infow(msg, kv...)
+	default:
+		l.logger.Debugw(msg, kv...)
+	}
+}
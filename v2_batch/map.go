@@ -6,9 +6,11 @@
 package rpc
 
 import (
+	"context"
 	"fmt"
 	"net/http"
 	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"unicode"
@@ -16,9 +18,10 @@ import (
 )
 
 var (
-	// Precompute the reflect.Type of error and http.Request
+	// Precompute the reflect.Type of error, http.Request and context.Context
 	typeOfError   = reflect.TypeOf((*error)(nil)).Elem()
 	typeOfRequest = reflect.TypeOf((*http.Request)(nil)).Elem()
+	typeOfContext = reflect.TypeOf((*context.Context)(nil)).Elem()
 )
 
 // ----------------------------------------------------------------------------
@@ -30,12 +33,95 @@ type service struct {
 	rcvr     reflect.Value             // receiver of methods for the service
 	rcvrType reflect.Type              // type of the receiver
 	methods  map[string]*serviceMethod // registered methods
+	init     *serviceInit              // initialization, if the receiver needs one
+	health   *serviceHealth            // last health check, if the receiver reports its health
 }
 
 type serviceMethod struct {
-	method    reflect.Method // receiver method
-	argsType  reflect.Type   // type of the request argument
-	replyType reflect.Type   // type of the response argument
+	method    reflect.Method                                           // receiver method
+	fn        reflect.Value                                            // function, for methods registered with RegisterFunc
+	call      func(ctx context.Context, args, reply interface{}) error // closure, for methods registered with Register
+	argsType  reflect.Type                                             // type of the request argument
+	replyType reflect.Type                                             // type of the response argument
+	doc       MethodDoc                                                // documentation metadata
+	readOnly  bool                                                     // doesn't mutate state, see ReadOnlyMethods
+	ctx       bool                                                     // takes a context.Context first
+	req       bool                                                     // takes the *http.Request
+	returns   bool                                                     // returns the reply instead of filling it
+}
+
+// newServiceMethod returns the serviceMethod of a receiver method, or nil
+// if the method doesn't have a suitable signature:
+//
+//	Method(r *http.Request, args *A, reply *R) error
+//	Method(ctx context.Context, r *http.Request, args *A, reply *R) error
+//	Method(ctx context.Context, args *A, reply *R) error
+//
+// or any of these shapes returning the reply instead, as in:
+//
+//	Method(ctx context.Context, args *A) (*R, error)
+func newServiceMethod(method reflect.Method) *serviceMethod {
+	// Method must be exported.
+	if method.PkgPath != "" {
+		return nil
+	}
+	m := parseSignature(method.Type, 1)
+	if m != nil {
+		m.method = method
+	}
+	return m
+}
+
+// parseSignature checks the signature of a method or function whose ins
+// start at first, returning its serviceMethod without the function to call.
+func parseSignature(mtype reflect.Type, first int) *serviceMethod {
+	m := new(serviceMethod)
+	// Ins: [ctx], [*http.Request], *args, [*reply].
+	in := first
+	if in < mtype.NumIn() && mtype.In(in) == typeOfContext {
+		m.ctx = true
+		in++
+	}
+	// The request must be a pointer to http.Request.
+	if in < mtype.NumIn() {
+		if reqType := mtype.In(in); reqType.Kind() == reflect.Ptr && reqType.Elem() == typeOfRequest {
+			m.req = true
+			in++
+		}
+	}
+	if !m.ctx && !m.req {
+		return nil
+	}
+	// Args must be a pointer and must be exported.
+	if mtype.NumIn() <= in {
+		return nil
+	}
+	args := mtype.In(in)
+	if args.Kind() != reflect.Ptr || !isExportedOrBuiltin(args) {
+		return nil
+	}
+	var reply reflect.Type
+	switch {
+	case mtype.NumIn() == in+2 && mtype.NumOut() == 1:
+		// Reply must be a pointer and must be exported.
+		reply = mtype.In(in + 1)
+	case mtype.NumIn() == in+1 && mtype.NumOut() == 2:
+		// Or be returned, as a pointer, before the error.
+		reply = mtype.Out(0)
+		m.returns = true
+	default:
+		return nil
+	}
+	if reply.Kind() != reflect.Ptr || !isExportedOrBuiltin(reply) {
+		return nil
+	}
+	// Method must return an error last.
+	if returnType := mtype.Out(mtype.NumOut() - 1); returnType != typeOfError {
+		return nil
+	}
+	m.argsType = args.Elem()
+	m.replyType = reply.Elem()
+	return m
 }
 
 // ----------------------------------------------------------------------------
@@ -44,18 +130,21 @@ type serviceMethod struct {
 
 // serviceMap is a registry for services.
 type serviceMap struct {
-	mutex    sync.Mutex
-	services map[string]*service
+	mutex      sync.Mutex
+	services   map[string]*service
+	onConflict func(Conflict) error
 }
 
 // register adds a new service using reflection to extract its methods.
-func (m *serviceMap) register(rcvr interface{}, name string) error {
+func (m *serviceMap) register(rcvr interface{}, name string, opts serviceOptions) error {
 	// Setup service.
 	s := &service{
 		name:     name,
 		rcvr:     reflect.ValueOf(rcvr),
 		rcvrType: reflect.TypeOf(rcvr),
 		methods:  make(map[string]*serviceMethod),
+		init:     newServiceInit(rcvr, opts.lazy),
+		health:   newServiceHealth(rcvr),
 	}
 	if name == "" {
 		s.name = reflect.Indirect(s.rcvr).Type().Name()
@@ -68,49 +157,61 @@ func (m *serviceMap) register(rcvr interface{}, name string) error {
 			s.rcvrType.String())
 	}
 	// Setup methods.
-	for i := 0; i < s.rcvrType.NumMethod(); i++ {
+	for i := 0; i < s.rcvrType.NumMethod() && opts.include == nil; i++ {
 		method := s.rcvrType.Method(i)
-		mtype := method.Type
-		// Method must be exported.
-		if method.PkgPath != "" {
-			continue
-		}
-		// Method needs four ins: receiver, *http.Request, *args, *reply.
-		if mtype.NumIn() != 4 {
-			continue
-		}
-		// First argument must be a pointer and must be http.Request.
-		reqType := mtype.In(1)
-		if reqType.Kind() != reflect.Ptr || reqType.Elem() != typeOfRequest {
-			continue
+		if m := newServiceMethod(method); m != nil {
+			s.methods[method.Name] = m
 		}
-		// Second argument must be a pointer and must be exported.
-		args := mtype.In(2)
-		if args.Kind() != reflect.Ptr || !isExportedOrBuiltin(args) {
-			continue
-		}
-		// Third argument must be a pointer and must be exported.
-		reply := mtype.In(3)
-		if reply.Kind() != reflect.Ptr || !isExportedOrBuiltin(reply) {
-			continue
+	}
+	for _, name := range opts.include {
+		method, ok := s.rcvrType.MethodByName(name)
+		if !ok {
+			return fmt.Errorf("rpc: %q has no method %q", s.name, name)
 		}
-		// Method needs one out: error.
-		if mtype.NumOut() != 1 {
-			continue
+		m := newServiceMethod(method)
+		if m == nil {
+			return fmt.Errorf("rpc: method %q of %q doesn't have a suitable type", name, s.name)
 		}
-		if returnType := mtype.Out(0); returnType != typeOfError {
-			continue
+		s.methods[name] = m
+	}
+	exclude := opts.exclude
+	if excluder, ok := rcvr.(MethodExcluder); ok {
+		exclude = append(exclude, excluder.ExcludedMethods()...)
+	}
+	for _, name := range exclude {
+		if _, ok := s.rcvrType.MethodByName(name); !ok {
+			return fmt.Errorf("rpc: %q has no method %q", s.name, name)
 		}
-		s.methods[method.Name] = &serviceMethod{
-			method:    method,
-			argsType:  args.Elem(),
-			replyType: reply.Elem(),
+		delete(s.methods, name)
+	}
+	for _, name := range opts.readOnly {
+		method := s.methods[name]
+		if method == nil {
+			return fmt.Errorf("rpc: %q has no method %q", s.name, name)
 		}
+		method.readOnly = true
 	}
 	if len(s.methods) == 0 {
 		return fmt.Errorf("rpc: %q has no exported methods of suitable type",
 			s.name)
 	}
+	if err := checkMethods(s.name, s.methods); err != nil {
+		return err
+	}
+	for name, m := range s.methods {
+		for _, check := range opts.checks {
+			if err := check(name, m.argsType, m.replyType); err != nil {
+				return fmt.Errorf("rpc: method %q of %q: %v", name, s.name, err)
+			}
+		}
+	}
+	if documenter, ok := rcvr.(MethodDocumenter); ok {
+		for name, doc := range documenter.MethodDocs() {
+			if method := s.methods[name]; method != nil {
+				method.doc = doc
+			}
+		}
+	}
 	// Add to the map.
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
@@ -119,10 +220,62 @@ func (m *serviceMap) register(rcvr interface{}, name string) error {
 	} else if _, ok := m.services[s.name]; ok {
 		return fmt.Errorf("rpc: service already defined: %q", s.name)
 	}
+	added := make([]string, 0, len(s.methods))
+	for name := range s.methods {
+		added = append(added, s.name+"."+name)
+	}
+	if err := m.checkConflicts(added); err != nil {
+		return err
+	}
 	m.services[s.name] = s
 	return nil
 }
 
+// registerFunc adds a function as a method, in dotted notation as in
+// "Service.Method", creating its service if needed.
+func (m *serviceMap) registerFunc(method string, fn interface{}) error {
+	fnValue := reflect.ValueOf(fn)
+	if fnValue.Kind() != reflect.Func || fnValue.IsNil() {
+		return fmt.Errorf("rpc: %T is not a function", fn)
+	}
+	spec := parseSignature(fnValue.Type(), 0)
+	if spec == nil {
+		return fmt.Errorf("rpc: function %q doesn't have a suitable type", method)
+	}
+	spec.fn = fnValue
+	return m.add(method, spec)
+}
+
+// add adds a method without a receiver, in dotted notation as in
+// "Service.Method", creating its service if needed.
+func (m *serviceMap) add(method string, spec *serviceMethod) error {
+	parts := strings.Split(method, ".")
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return fmt.Errorf("rpc: service/method name ill-formed: %q", method)
+	}
+	if err := checkMethods(parts[0], map[string]*serviceMethod{parts[1]: spec}); err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if m.services == nil {
+		m.services = make(map[string]*service)
+	}
+	s := m.services[parts[0]]
+	if s != nil && s.methods[parts[1]] != nil {
+		return fmt.Errorf("rpc: method already defined: %q", method)
+	}
+	if err := m.checkConflicts([]string{method}); err != nil {
+		return err
+	}
+	if s == nil {
+		s = &service{name: parts[0], methods: make(map[string]*serviceMethod)}
+		m.services[parts[0]] = s
+	}
+	s.methods[parts[1]] = spec
+	return nil
+}
+
 // get returns a registered service given a method name.
 //
 // The method name uses a dotted notation as in "Service.Method".
@@ -132,14 +285,18 @@ func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
 		err := fmt.Errorf("rpc: service/method request ill-formed: %q", method)
 		return nil, nil, err
 	}
+	// The methods of a service may be added while serving, see add.
 	m.mutex.Lock()
 	service := m.services[parts[0]]
+	var serviceMethod *serviceMethod
+	if service != nil {
+		serviceMethod = service.methods[parts[1]]
+	}
 	m.mutex.Unlock()
 	if service == nil {
 		err := fmt.Errorf("rpc: can't find service %q", method)
 		return nil, nil, err
 	}
-	serviceMethod := service.methods[parts[1]]
 	if serviceMethod == nil {
 		err := fmt.Errorf("rpc: can't find method %q", method)
 		return nil, nil, err
@@ -147,6 +304,90 @@ func (m *serviceMap) get(method string) (*service, *serviceMethod, error) {
 	return service, serviceMethod, nil
 }
 
+// canonical returns the registered name of method, which may be called with
+// its method name in lowerCamel as used by JSON-RPC conventions, e.g.
+// "system.listMethods" for the ListMethods method. Unknown methods are
+// returned unchanged.
+func (m *serviceMap) canonical(method string) string {
+	serviceName, methodName, ok := strings.Cut(method, ".")
+	if !ok || methodName == "" {
+		return method
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	service := m.services[serviceName]
+	if service == nil || service.methods[methodName] != nil {
+		return method
+	}
+	if upper := upperFirst(methodName); service.methods[upper] != nil {
+		return serviceName + "." + upper
+	}
+	return method
+}
+
+// describe sets the documentation of a registered method.
+func (m *serviceMap) describe(method string, doc MethodDoc) error {
+	_, serviceMethod, err := m.get(method)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	serviceMethod.doc = doc
+	return nil
+}
+
+// doc returns the documentation of a registered method.
+func (m *serviceMap) doc(method string) (MethodDoc, bool) {
+	_, serviceMethod, err := m.get(method)
+	if err != nil {
+		return MethodDoc{}, false
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return serviceMethod.doc, true
+}
+
+// markReadOnly marks a registered method as not mutating state.
+func (m *serviceMap) markReadOnly(method string) error {
+	_, serviceMethod, err := m.get(method)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	serviceMethod.readOnly = true
+	return nil
+}
+
+// readOnly returns true if a method is marked as not mutating state.
+func (m *serviceMap) readOnly(serviceMethod *serviceMethod) bool {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return serviceMethod.readOnly
+}
+
+// names returns the sorted names of all registered methods, in dotted
+// notation.
+func (m *serviceMap) names() []string {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var names []string
+	for serviceName, service := range m.services {
+		for methodName := range service.methods {
+			names = append(names, serviceName+"."+methodName)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// upperFirst returns name with its first rune in upper case.
+func upperFirst(name string) string {
+	r, size := utf8.DecodeRuneInString(name)
+	return string(unicode.ToUpper(r)) + name[size:]
+}
+
 // isExported returns true of a string is an exported (upper case) name.
 func isExported(name string) bool {
 	rune, _ := utf8.DecodeRuneInString(name)
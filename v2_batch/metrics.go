@@ -0,0 +1,144 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"expvar"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Metrics
+// ----------------------------------------------------------------------------
+
+// Metrics receives measurements from the server. Implementations must be
+// safe for concurrent use.
+type Metrics interface {
+	// BatchStarted is called when a batch of n requests starts being
+	// processed. A single request is a batch of one.
+	BatchStarted(n int)
+	// BatchDone is called when the batch has been answered.
+	BatchDone(n int)
+	// CallDone is called for each request of a batch once it has been
+	// processed. method is empty if it could not be decoded or names a
+	// method neither registered nor retired, and err is the error replied,
+	// if any.
+	CallDone(method string, err error, elapsed time.Duration)
+}
+
+// SetMetrics sets the receiver of the server measurements.
+func (s *Server) SetMetrics(m Metrics) {
+	s.metrics = m
+}
+
+// coder is implemented by errors carrying a protocol error code.
+type coder interface {
+	ErrorCode() int
+}
+
+// ErrorCode returns the protocol error code carried by err, if any.
+func ErrorCode(err error) (int, bool) {
+	if c, ok := err.(coder); ok {
+		return c.ErrorCode(), true
+	}
+	return 0, false
+}
+
+// errorLabel returns the label used to count err in metrics.
+func errorLabel(err error) string {
+	if code, ok := ErrorCode(err); ok {
+		return strconv.Itoa(code)
+	}
+	return "uncoded"
+}
+
+// batchSizeBuckets are the upper bounds of the batch size histogram.
+var batchSizeBuckets = []int{1, 2, 5, 10, 20, 50, 100, 200, 500, 1000}
+
+// batchSizeBucket returns the histogram bucket label for a batch size.
+func batchSizeBucket(n int) string {
+	for _, bound := range batchSizeBuckets {
+		if n <= bound {
+			return "le_" + strconv.Itoa(bound)
+		}
+	}
+	return "le_inf"
+}
+
+// ExpvarMetrics publishes the server counters with the expvar package.
+type ExpvarMetrics struct {
+	requests   *expvar.Int
+	batches    *expvar.Int
+	inflight   *expvar.Int
+	errors     *expvar.Map
+	batchSizes *expvar.Map
+}
+
+// expvarMutex serializes the lookups and publications of NewExpvarMetrics.
+var expvarMutex sync.Mutex
+
+// NewExpvarMetrics returns Metrics published as an expvar map under the
+// given name, which appears in /debug/vars. If the name is already used by
+// an expvar map, e.g. by the Metrics of a server built before, its counters
+// are reused and keep counting. Like expvar.Publish, it panics if the name
+// is used by another kind of variable.
+func NewExpvarMetrics(name string) *ExpvarMetrics {
+	expvarMutex.Lock()
+	defer expvarMutex.Unlock()
+	vars, ok := expvar.Get(name).(*expvar.Map)
+	if !ok {
+		vars = new(expvar.Map).Init()
+		expvar.Publish(name, vars)
+	}
+	return &ExpvarMetrics{
+		requests:   expvarInt(vars, "requests"),
+		batches:    expvarInt(vars, "batches"),
+		inflight:   expvarInt(vars, "inflight"),
+		errors:     expvarMap(vars, "errors"),
+		batchSizes: expvarMap(vars, "batch_sizes"),
+	}
+}
+
+// expvarInt returns the integer of vars under key, adding it if missing.
+func expvarInt(vars *expvar.Map, key string) *expvar.Int {
+	if v, ok := vars.Get(key).(*expvar.Int); ok {
+		return v
+	}
+	v := new(expvar.Int)
+	vars.Set(key, v)
+	return v
+}
+
+// expvarMap returns the map of vars under key, adding it if missing.
+func expvarMap(vars *expvar.Map, key string) *expvar.Map {
+	if v, ok := vars.Get(key).(*expvar.Map); ok {
+		return v
+	}
+	v := new(expvar.Map).Init()
+	vars.Set(key, v)
+	return v
+}
+
+// BatchStarted implements Metrics.
+func (m *ExpvarMetrics) BatchStarted(n int) {
+	m.batches.Add(1)
+	m.inflight.Add(1)
+	m.batchSizes.Add(batchSizeBucket(n), 1)
+}
+
+// BatchDone implements Metrics.
+func (m *ExpvarMetrics) BatchDone(n int) {
+	m.inflight.Add(-1)
+}
+
+// CallDone implements Metrics.
+func (m *ExpvarMetrics) CallDone(method string, err error, elapsed time.Duration) {
+	m.requests.Add(1)
+	if err != nil {
+		m.errors.Add(errorLabel(err), 1)
+	}
+}
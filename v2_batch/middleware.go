@@ -0,0 +1,135 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+)
+
+// ----------------------------------------------------------------------------
+// Middleware
+// ----------------------------------------------------------------------------
+
+// MethodCall is a call of a batch passed through the middleware chain.
+type MethodCall struct {
+	// Method is the method name, in dotted notation as in "Service.Method".
+	Method string
+	// Args is the pointer to the decoded args.
+	Args interface{}
+	// Request is the HTTP request. Middleware may replace it, e.g. to add
+	// values to its context.
+	Request *http.Request
+	// Body is the raw body of the call, as returned by CodecRequest.Body.
+	Body []byte
+	// Extensions are the members of the request envelope unknown to the
+	// protocol, as returned by RequestExtensions.
+	Extensions map[string]json.RawMessage
+}
+
+// Handler serves a call, returning its reply.
+type Handler func(call *MethodCall) (interface{}, error)
+
+// Middleware wraps a Handler, e.g. for auth, logging or validation.
+type Middleware func(next Handler) Handler
+
+// Use appends middleware to the chain serving each call of a batch, once
+// its args are decoded. The first middleware is the outermost. Replies
+// served from the reply cache go through the chain too, but in-process
+// calls made with Server.Call don't.
+func (s *Server) Use(middleware ...Middleware) {
+	s.middleware = append(s.middleware, middleware...)
+}
+
+// chain wraps h with the middleware.
+func (s *Server) chain(h Handler) Handler {
+	for i := len(s.middleware) - 1; i >= 0; i-- {
+		h = s.middleware[i](h)
+	}
+	return h
+}
+
+// RestoreBody is a Middleware setting the body of the request to the raw
+// body of the call, for methods reading it, e.g. to check a signature.
+func RestoreBody(next Handler) Handler {
+	return func(call *MethodCall) (interface{}, error) {
+		r := *call.Request
+		r.Body = nopCloser{bytes.NewReader(call.Body)}
+		call.Request = &r
+		return next(call)
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Reply processors
+// ----------------------------------------------------------------------------
+
+// ReplyProcessor returns the reply of method to encode in place of reply,
+// e.g. with the server time injected, fields masked or wrapped in an
+// envelope.
+type ReplyProcessor func(method string, reply interface{}) interface{}
+
+// AddReplyProcessor appends p to the processors applied in order to each
+// successful reply, after the middleware chain and before the reply is
+// encoded. Replies served from the reply cache are processed too, as the
+// cache holds them unprocessed: processors must return a new reply rather
+// than modify the one they are given.
+func (s *Server) AddReplyProcessor(p ReplyProcessor) {
+	s.replyProcessors = append(s.replyProcessors, p)
+}
+
+// processReply applies the reply processors to the reply of method.
+func (s *Server) processReply(method string, reply interface{}) interface{} {
+	for _, p := range s.replyProcessors {
+		reply = p(method, reply)
+	}
+	return reply
+}
+
+// ----------------------------------------------------------------------------
+// Request rewriters
+// ----------------------------------------------------------------------------
+
+// RequestRewriter returns the body of a request to parse in place of body,
+// e.g. with a legacy outer envelope unwrapped or a prefix stripped. It may
+// also set the Content-Type header of r to choose another codec. An error
+// rejects the request with a 400 status.
+type RequestRewriter func(r *http.Request, body []byte) ([]byte, error)
+
+// AddRequestRewriter appends rw to the rewriters applied in order to the
+// body of each request before a codec is chosen and parses it, so that
+// gateways can migrate old traffic without a separate proxy. Recorded
+// requests are recorded as received.
+func (s *Server) AddRequestRewriter(rw RequestRewriter) {
+	s.requestRewriters = append(s.requestRewriters, rw)
+}
+
+// rewriteRequest returns r with its body read by the body reader and
+// rewritten by the request rewriters.
+func (s *Server) rewriteRequest(r *http.Request) (*http.Request, error) {
+	var body []byte
+	var err error
+	if s.bodyReader != nil {
+		body, err = s.bodyReader(r)
+	} else {
+		body, err = ioutil.ReadAll(r.Body)
+	}
+	r.Body.Close()
+	if err != nil {
+		return r, fmt.Errorf("rpc: failed to read the request body: %v", err)
+	}
+	for _, rw := range s.requestRewriters {
+		if body, err = rw(r, body); err != nil {
+			return r, fmt.Errorf("rpc: can't rewrite the request: %v", err)
+		}
+	}
+	r = r.Clone(r.Context())
+	r.Body = nopCloser{bytes.NewReader(body)}
+	r.ContentLength = int64(len(body))
+	return r, nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// MQTT
+// ----------------------------------------------------------------------------
+
+// MQTTClient is the part of an MQTT client used by MQTTListener, e.g. an
+// adapter of the Eclipse Paho client. Implementations must be safe for
+// concurrent use.
+type MQTTClient interface {
+	// Subscribe calls handler with the messages published to the topics
+	// matching filter.
+	Subscribe(filter string, handler func(topic string, payload []byte)) error
+	Unsubscribe(filter string) error
+	Publish(topic string, payload []byte) error
+}
+
+// MQTTListener serves a Server over MQTT: requests published to the topics
+// matching RequestTopic are dispatched through the server, each in its own
+// goroutine, and the responses published to a response topic per client.
+type MQTTListener struct {
+	// Client is connected to the broker.
+	Client MQTTClient
+	// RequestTopic is the topic filter of the requests, e.g.
+	// "rpc/+/request" with a topic level per client.
+	RequestTopic string
+	// ResponseTopic returns the topic of the response to a request
+	// published to topic. By default a last "request" level is replaced by
+	// "response", as in "rpc/client-42/response"; otherwise "/response" is
+	// appended to the topic.
+	ResponseTopic func(topic string) string
+	// ContentType selects the codec. Defaults to "application/json".
+	ContentType string
+	// OnError is called when a response can't be published.
+	OnError func(topic string, err error)
+
+	mutex    sync.Mutex
+	closed   bool
+	done     chan struct{}
+	cancel   context.CancelFunc
+	inflight sync.WaitGroup
+}
+
+// Serve implements Listener.
+func (l *MQTTListener) Serve(s *Server) error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	l.cancel = cancel
+	l.done = make(chan struct{})
+	done := l.done
+	l.mutex.Unlock()
+
+	err := l.Client.Subscribe(l.RequestTopic, func(topic string, payload []byte) {
+		l.mutex.Lock()
+		defer l.mutex.Unlock()
+		if l.closed {
+			return
+		}
+		l.inflight.Add(1)
+		go l.serve(ctx, s, topic, payload)
+	})
+	if err != nil {
+		cancel()
+		return err
+	}
+	<-done
+	return nil
+}
+
+// serve dispatches a request and publishes its response, if any.
+func (l *MQTTListener) serve(ctx context.Context, s *Server, topic string, payload []byte) {
+	defer l.inflight.Done()
+	r, err := http.NewRequest("POST", "mqtt://"+topic, bytes.NewReader(payload))
+	if err != nil {
+		return
+	}
+	contentType := l.ContentType
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	r.Header.Set("Content-Type", contentType)
+	r.RemoteAddr = topic
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r.WithContext(ctx))
+	if w.Body.Len() == 0 {
+		// Notifications get no response.
+		return
+	}
+	responseTopic := l.responseTopic(topic)
+	if err := l.Client.Publish(responseTopic, w.Body.Bytes()); err != nil && l.OnError != nil {
+		l.OnError(responseTopic, err)
+	}
+}
+
+// responseTopic returns the topic of the response to a request published
+// to topic.
+func (l *MQTTListener) responseTopic(topic string) string {
+	if l.ResponseTopic != nil {
+		return l.ResponseTopic(topic)
+	}
+	if strings.HasSuffix(topic, "/request") || topic == "request" {
+		return strings.TrimSuffix(topic, "request") + "response"
+	}
+	return topic + "/response"
+}
+
+// Shutdown implements Listener. It unsubscribes from the requests and waits
+// for the requests in flight, cancelling them once ctx is done.
+func (l *MQTTListener) Shutdown(ctx context.Context) error {
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.closed = true
+	done, cancel := l.done, l.cancel
+	l.mutex.Unlock()
+	if done == nil {
+		return nil
+	}
+	err := l.Client.Unsubscribe(l.RequestTopic)
+	idle := make(chan struct{})
+	go func() {
+		l.inflight.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+	case <-ctx.Done():
+		cancel()
+		<-idle
+		if err == nil {
+			err = ctx.Err()
+		}
+	}
+	cancel()
+	close(done)
+	return err
+}
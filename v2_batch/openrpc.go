@@ -0,0 +1,205 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// OpenRPC discovery
+// ----------------------------------------------------------------------------
+
+// DiscoverMethod is the method returning the OpenRPC document of the server,
+// see EnableDiscovery.
+const DiscoverMethod = "rpc.discover"
+
+// openRPCVersion is the version of the OpenRPC specification of the
+// documents.
+const openRPCVersion = "1.3.2"
+
+// OpenRPCInfo is the info object of the OpenRPC document.
+type OpenRPCInfo struct {
+	Title       string `json:"title"`
+	Version     string `json:"version"`
+	Description string `json:"description,omitempty"`
+}
+
+// EnableDiscovery registers the DiscoverMethod, taking no params and
+// returning the OpenRPC document describing the methods of the server, with
+// info as its info object. Serve it over GET with OpenRPCHandler as well,
+// for tools which don't make calls.
+func (s *Server) EnableDiscovery(info OpenRPCInfo) error {
+	s.openRPCInfo = info
+	err := s.RegisterFunc(DiscoverMethod, func(ctx context.Context, args *struct{}) (*json.RawMessage, error) {
+		doc, err := s.OpenRPC()
+		if err != nil {
+			return nil, &Error{Code: CodeInternalError, Message: err.Error()}
+		}
+		return &doc, nil
+	})
+	if err != nil {
+		return err
+	}
+	return s.MarkReadOnly(DiscoverMethod)
+}
+
+// OpenRPCHandler returns a handler serving the OpenRPC document.
+func (s *Server) OpenRPCHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		doc, err := s.OpenRPC()
+		if err != nil {
+			WriteError(w, http.StatusInternalServerError, err.Error())
+			return
+		}
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Write(doc)
+	})
+}
+
+// openRPCDocument is the OpenRPC document of a server.
+type openRPCDocument struct {
+	OpenRPC    string             `json:"openrpc"`
+	Info       OpenRPCInfo        `json:"info"`
+	Methods    []openRPCMethod    `json:"methods"`
+	Components *openRPCComponents `json:"components,omitempty"`
+}
+
+type openRPCComponents struct {
+	Schemas map[string]interface{} `json:"schemas"`
+}
+
+type openRPCMethod struct {
+	Name           string           `json:"name"`
+	Description    string           `json:"description,omitempty"`
+	Tags           []openRPCTag     `json:"tags,omitempty"`
+	ParamStructure string           `json:"paramStructure,omitempty"`
+	Params         []openRPCContent `json:"params"`
+	Result         openRPCContent   `json:"result"`
+	Deprecated     bool             `json:"deprecated,omitempty"`
+	Examples       []openRPCExample `json:"examples,omitempty"`
+}
+
+type openRPCTag struct {
+	Name string `json:"name"`
+}
+
+// openRPCContent is a content descriptor.
+type openRPCContent struct {
+	Name     string                 `json:"name"`
+	Schema   map[string]interface{} `json:"schema"`
+	Required bool                   `json:"required,omitempty"`
+}
+
+// openRPCExample is an example pairing.
+type openRPCExample struct {
+	Name   string                `json:"name"`
+	Params []openRPCExampleValue `json:"params"`
+	Result openRPCExampleValue   `json:"result"`
+}
+
+type openRPCExampleValue struct {
+	Name  string          `json:"name"`
+	Value json.RawMessage `json:"value"`
+}
+
+// OpenRPC returns the OpenRPC document describing the methods of the server,
+// from their args and reply types, as in Schema, and their documentation.
+// The fields of struct args are the params, by name or by position; other
+// args are a single "params" param. The methods retired are deprecated, and
+// the admin methods left out once they have their own handler.
+func (s *Server) OpenRPC() (json.RawMessage, error) {
+	g := newSchemaGenerator("#/components/schemas/")
+	doc := openRPCDocument{OpenRPC: openRPCVersion, Info: s.openRPCInfo, Methods: []openRPCMethod{}}
+	for _, name := range s.Methods() {
+		if s.adminSeparate && strings.HasPrefix(name, adminServiceName+".") {
+			continue
+		}
+		_, methodSpec, err := s.services.get(name)
+		if err != nil {
+			continue
+		}
+		methodDoc, _ := s.MethodDoc(name)
+		method := openRPCMethod{
+			Name:        name,
+			Description: methodDoc.Description,
+			Params:      openRPCParams(g, methodSpec.argsType),
+			Result:      openRPCContent{Name: "result", Schema: g.schema(methodSpec.replyType)},
+		}
+		if methodSpec.argsType.Kind() == reflect.Struct {
+			method.ParamStructure = "either"
+		}
+		for _, tag := range methodDoc.Tags {
+			method.Tags = append(method.Tags, openRPCTag{Name: tag})
+		}
+		for _, example := range methodDoc.Examples {
+			pairing, err := openRPCExamplePairing(example, method.Params)
+			if err != nil {
+				return nil, err
+			}
+			method.Examples = append(method.Examples, pairing)
+		}
+		s.retiredMutex.Lock()
+		if retirement, ok := s.retired[name]; ok {
+			method.Deprecated = true
+			if method.Description == "" {
+				method.Description = retirement.Message
+			}
+		}
+		s.retiredMutex.Unlock()
+		doc.Methods = append(doc.Methods, method)
+	}
+	if len(g.defs) > 0 {
+		doc.Components = &openRPCComponents{Schemas: g.defs}
+	}
+	return json.Marshal(doc)
+}
+
+// openRPCParams returns the content descriptors of the params of args type
+// t.
+func openRPCParams(g *schemaGenerator, t reflect.Type) []openRPCContent {
+	if t.Kind() != reflect.Struct {
+		return []openRPCContent{{Name: "params", Schema: g.schema(t), Required: true}}
+	}
+	properties := g.properties(t)
+	params := make([]openRPCContent, len(properties))
+	for i, p := range properties {
+		params[i] = openRPCContent{Name: p.name, Schema: p.schema, Required: p.required}
+	}
+	return params
+}
+
+// openRPCExamplePairing returns the pairing of an example with the params
+// of its method.
+func openRPCExamplePairing(example MethodExample, params []openRPCContent) (openRPCExample, error) {
+	pairing := openRPCExample{Name: example.Name, Params: []openRPCExampleValue{}}
+	if pairing.Name == "" {
+		pairing.Name = "Example"
+	}
+	b, err := json.Marshal(example.Params)
+	if err != nil {
+		return pairing, err
+	}
+	var members map[string]json.RawMessage
+	if len(params) == 1 && params[0].Name == "params" || json.Unmarshal(b, &members) != nil {
+		pairing.Params = append(pairing.Params, openRPCExampleValue{Name: "params", Value: b})
+	} else {
+		for _, param := range params {
+			if value, ok := members[param.Name]; ok {
+				pairing.Params = append(pairing.Params, openRPCExampleValue{Name: param.Name, Value: value})
+			}
+		}
+	}
+	result, err := json.Marshal(example.Result)
+	if err != nil {
+		return pairing, err
+	}
+	pairing.Result = openRPCExampleValue{Name: "result", Value: result}
+	return pairing, nil
+}
@@ -0,0 +1,67 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"reflect"
+)
+
+// ----------------------------------------------------------------------------
+// Registration options
+// ----------------------------------------------------------------------------
+
+// ServiceOption configures the registration of a service.
+type ServiceOption func(*serviceOptions)
+
+// serviceOptions are the options of a service registration.
+type serviceOptions struct {
+	include []string // if not nil, the only methods added
+	exclude []string // methods not added
+	checks  []func(method string, args, reply reflect.Type) error
+	lazy    bool // initialized by the first call, see LazyInit
+	// methods not mutating state, see ReadOnlyMethods
+	readOnly []string
+}
+
+// IncludeMethods only adds the named methods of the receiver, each of which
+// must have a suitable signature.
+func IncludeMethods(names ...string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.include = append(o.include, names...)
+	}
+}
+
+// ExcludeMethods doesn't add the named methods of the receiver, e.g. helpers
+// that are exported for use in Go but must not be callable.
+func ExcludeMethods(names ...string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.exclude = append(o.exclude, names...)
+	}
+}
+
+// ReadOnlyMethods marks the named methods of the receiver as not mutating
+// state, so that they are served by read-only replicas, see SetReplicaOf.
+func ReadOnlyMethods(names ...string) ServiceOption {
+	return func(o *serviceOptions) {
+		o.readOnly = append(o.readOnly, names...)
+	}
+}
+
+// CheckTypes rejects the registration of the service if check returns an
+// error for the args or reply type of one of its methods, e.g. for codecs
+// only able to encode some types. The types aren't pointers, and method is
+// the method name, without the service prefix.
+func CheckTypes(check func(method string, args, reply reflect.Type) error) ServiceOption {
+	return func(o *serviceOptions) {
+		o.checks = append(o.checks, check)
+	}
+}
+
+// MethodExcluder can be implemented by a service receiver to keep some of
+// its exported methods from being added, as with ExcludeMethods. The names
+// are method names, without the service prefix.
+type MethodExcluder interface {
+	ExcludedMethods() []string
+}
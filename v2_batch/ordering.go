@@ -0,0 +1,94 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"net/http"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// Per-caller ordering
+// ----------------------------------------------------------------------------
+
+// callerOrdering serializes the requests of each caller.
+type callerOrdering struct {
+	mutex  sync.Mutex
+	depth  int
+	queues map[string]*callerQueue
+}
+
+// callerQueue chains the requests of a caller: each one waits for the
+// previous one to be done.
+type callerQueue struct {
+	pending int           // requests served or waiting
+	tail    chan struct{} // closed once the last request is done
+}
+
+// SetCallerOrdering serves the requests of each caller, as identified by
+// Caller, one at a time and in arrival order, even across HTTP requests,
+// for clients whose calls don't commute. The calls of a batch are still
+// served as set with SetBatchConcurrency.
+//
+// Up to depth requests of a caller wait behind the one being served; more
+// are answered with a CodeRateLimited error. A depth of 0 turns ordering
+// off.
+func (s *Server) SetCallerOrdering(depth int) {
+	s.ordering.mutex.Lock()
+	defer s.ordering.mutex.Unlock()
+	s.ordering.depth = depth
+}
+
+// awaitTurn waits for the earlier requests of the caller of r to be done.
+// The returned function must be called once r is done.
+func (s *Server) awaitTurn(r *http.Request) (func(), error) {
+	o := &s.ordering
+	o.mutex.Lock()
+	if o.depth <= 0 {
+		o.mutex.Unlock()
+		return func() {}, nil
+	}
+	caller := s.Caller(r)
+	q := o.queues[caller]
+	if q == nil {
+		if o.queues == nil {
+			o.queues = make(map[string]*callerQueue)
+		}
+		q = new(callerQueue)
+		o.queues[caller] = q
+	}
+	if q.pending > o.depth {
+		o.mutex.Unlock()
+		return nil, &Error{Code: CodeRateLimited, Message: "rpc: too many requests queued for the caller"}
+	}
+	q.pending++
+	prev, own := q.tail, make(chan struct{})
+	q.tail = own
+	o.mutex.Unlock()
+
+	done := func() {
+		close(own)
+		o.mutex.Lock()
+		defer o.mutex.Unlock()
+		q.pending--
+		if q.pending == 0 {
+			delete(o.queues, caller)
+		}
+	}
+	if prev == nil {
+		return done, nil
+	}
+	select {
+	case <-prev:
+		return done, nil
+	case <-r.Context().Done():
+		// Keep the place in the chain for the requests behind.
+		go func() {
+			<-prev
+			done()
+		}()
+		return nil, r.Context().Err()
+	}
+}
@@ -0,0 +1,46 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"net/http"
+	"runtime/debug"
+)
+
+// ----------------------------------------------------------------------------
+// Panic recovery
+// ----------------------------------------------------------------------------
+
+// PanicHandler is called with the value and stack trace of a panic in a
+// service method.
+type PanicHandler func(r *http.Request, method string, value interface{}, stack []byte)
+
+// SetPanicHandler sets the function called when a service method panics,
+// e.g. to report the stack trace. The panic is recovered either way, and
+// only the call that panicked is answered with an error, which doesn't
+// disclose the panic value.
+//
+// By default the panic is logged at error level.
+func (s *Server) SetPanicHandler(h PanicHandler) {
+	s.panicHandler = h
+}
+
+// recoverPanic recovers a panic in the call to method, setting err. It must
+// be deferred.
+func (s *Server) recoverPanic(r *http.Request, method string, err *error) {
+	value := recover()
+	if value == nil {
+		return
+	}
+	stack := debug.Stack()
+	if s.panicHandler != nil {
+		s.panicHandler(r, method, value, stack)
+	} else {
+		s.log(LevelError, "rpc: method panicked", Field{"rpc.method", method},
+			Field{"rpc.panic", value}, Field{"rpc.stack", string(stack)})
+	}
+	*err = fmt.Errorf("rpc: method %q panicked", method)
+}
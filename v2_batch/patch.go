@@ -0,0 +1,452 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Patch params
+// ----------------------------------------------------------------------------
+
+// PatchOperation is an operation of a JSON Patch.
+type PatchOperation struct {
+	Op    string          `json:"op"`
+	Path  string          `json:"path"`
+	From  string          `json:"from,omitempty"`
+	Value json.RawMessage `json:"value,omitempty"`
+}
+
+// JSONPatch is an RFC 6902 JSON Patch document, to be used as the params of
+// update methods:
+//
+//	func (s *Docs) Update(ctx context.Context, patch *rpc.JSONPatch, reply *Doc) error {
+//		doc := s.load(ctx)
+//		if err := patch.ApplyTo(doc); err != nil {
+//			return err
+//		}
+//		...
+//	}
+//
+// Malformed patches are rejected when the params are decoded.
+type JSONPatch []PatchOperation
+
+// UnmarshalJSON decodes and validates a patch.
+func (p *JSONPatch) UnmarshalJSON(b []byte) error {
+	var ops []PatchOperation
+	if err := json.Unmarshal(b, &ops); err != nil {
+		return err
+	}
+	if err := JSONPatch(ops).Validate(); err != nil {
+		return err
+	}
+	*p = ops
+	return nil
+}
+
+// Validate checks that the operations of the patch are well-formed.
+func (p JSONPatch) Validate() error {
+	for i, op := range p {
+		if _, err := parsePointer(op.Path); err != nil {
+			return fmt.Errorf("rpc: patch operation %d: %v", i, err)
+		}
+		switch op.Op {
+		case "add", "replace", "test":
+			if op.Value == nil {
+				return fmt.Errorf("rpc: patch operation %d: %q without a value", i, op.Op)
+			}
+		case "remove":
+		case "move", "copy":
+			if _, err := parsePointer(op.From); err != nil {
+				return fmt.Errorf("rpc: patch operation %d: %v", i, err)
+			}
+			if op.Op == "move" && strings.HasPrefix(op.Path, op.From+"/") {
+				return fmt.Errorf("rpc: patch operation %d: can't move %q into itself", i, op.From)
+			}
+		default:
+			return fmt.Errorf("rpc: patch operation %d: unknown op %q", i, op.Op)
+		}
+	}
+	return nil
+}
+
+// Apply applies the patch to a JSON document, atomically: it returns an
+// error without any change if an operation fails. A failed "test" is a
+// CodePreconditionFailed error, other failures are CodeInvalidParams.
+func (p JSONPatch) Apply(doc []byte) ([]byte, error) {
+	root, err := decodeDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	for i, op := range p {
+		if root, err = op.apply(root); err != nil {
+			if e, ok := err.(*Error); ok {
+				e.Message = fmt.Sprintf("rpc: patch operation %d: %s", i, e.Message)
+				return nil, e
+			}
+			return nil, &Error{Code: CodeInvalidParams, Message: fmt.Sprintf("rpc: patch operation %d: %v", i, err)}
+		}
+	}
+	return json.Marshal(root)
+}
+
+// ApplyTo applies the patch to v, a pointer to a struct or other value,
+// through its JSON encoding. It fails without any change if the patched
+// document doesn't decode into v, e.g. with a path unknown to it.
+func (p JSONPatch) ApplyTo(v interface{}) error {
+	return applyTo(v, p.Apply)
+}
+
+// JSONSchema implements SchemaProvider.
+func (JSONPatch) JSONSchema() json.RawMessage {
+	return json.RawMessage(jsonPatchSchema)
+}
+
+const jsonPatchSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "JSON Patch (RFC 6902)",
+  "type": "array",
+  "items": {
+    "type": "object",
+    "required": ["op", "path"],
+    "properties": {
+      "op": {"enum": ["add", "remove", "replace", "move", "copy", "test"]},
+      "path": {"type": "string", "description": "JSON Pointer (RFC 6901)"},
+      "from": {"type": "string", "description": "JSON Pointer of move and copy"},
+      "value": {"description": "value of add, replace and test"}
+    }
+  }
+}`
+
+// apply applies an operation to a decoded document.
+func (op *PatchOperation) apply(root interface{}) (interface{}, error) {
+	path, _ := parsePointer(op.Path)
+	switch op.Op {
+	case "add", "replace":
+		value, err := decodeDocument(op.Value)
+		if err != nil {
+			return nil, err
+		}
+		return setAt(root, path, value, op.Op == "add")
+	case "remove":
+		root, _, err := removeAt(root, path)
+		return root, err
+	case "move", "copy":
+		from, _ := parsePointer(op.From)
+		value, err := getAt(root, from)
+		if err != nil {
+			return nil, err
+		}
+		if op.Op == "move" {
+			if root, _, err = removeAt(root, from); err != nil {
+				return nil, err
+			}
+		} else if value, err = copyDocument(value); err != nil {
+			return nil, err
+		}
+		return setAt(root, path, value, true)
+	case "test":
+		value, err := getAt(root, path)
+		if err != nil {
+			return nil, err
+		}
+		if !equalDocuments(value, op.Value) {
+			return nil, &Error{Code: CodePreconditionFailed, Message: fmt.Sprintf("test of %q failed", op.Path)}
+		}
+		return root, nil
+	}
+	return nil, fmt.Errorf("unknown op %q", op.Op)
+}
+
+// MergePatch is an RFC 7386 JSON merge patch document, to be used as the
+// params of update methods: the members of the patch replace those of the
+// document, recursively, and null members remove them. Patches that aren't
+// objects are rejected when the params are decoded.
+type MergePatch json.RawMessage
+
+// UnmarshalJSON decodes and validates a patch.
+func (p *MergePatch) UnmarshalJSON(b []byte) error {
+	b = bytes.TrimSpace(b)
+	if len(b) == 0 || b[0] != '{' {
+		return fmt.Errorf("rpc: merge patch must be an object")
+	}
+	if !json.Valid(b) {
+		return fmt.Errorf("rpc: invalid merge patch")
+	}
+	*p = append((*p)[:0], b...)
+	return nil
+}
+
+// MarshalJSON returns the patch.
+func (p MergePatch) MarshalJSON() ([]byte, error) {
+	if p == nil {
+		return []byte("null"), nil
+	}
+	return p, nil
+}
+
+// Apply applies the patch to a JSON document.
+func (p MergePatch) Apply(doc []byte) ([]byte, error) {
+	root, err := decodeDocument(doc)
+	if err != nil {
+		return nil, err
+	}
+	patch, err := decodeDocument(p)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(mergeDocuments(root, patch))
+}
+
+// ApplyTo applies the patch to v, a pointer to a struct or other value,
+// through its JSON encoding. It fails without any change if the patched
+// document doesn't decode into v, e.g. with a member unknown to it.
+func (p MergePatch) ApplyTo(v interface{}) error {
+	return applyTo(v, p.Apply)
+}
+
+// JSONSchema implements SchemaProvider.
+func (MergePatch) JSONSchema() json.RawMessage {
+	return json.RawMessage(mergePatchSchema)
+}
+
+const mergePatchSchema = `{
+  "$schema": "https://json-schema.org/draft/2020-12/schema",
+  "title": "JSON Merge Patch (RFC 7386)",
+  "type": "object",
+  "description": "members replace those of the document, null members remove them"
+}`
+
+// mergeDocuments merges patch into target, as in RFC 7386.
+func mergeDocuments(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergeDocuments(t[k], v)
+		}
+	}
+	return t
+}
+
+// applyTo applies a patch to v through its JSON encoding.
+func applyTo(v interface{}, apply func([]byte) ([]byte, error)) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.IsNil() {
+		return fmt.Errorf("rpc: can't patch %T, need a non-nil pointer", v)
+	}
+	doc, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	if doc, err = apply(doc); err != nil {
+		return err
+	}
+	patched := reflect.New(rv.Elem().Type())
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(patched.Interface()); err != nil {
+		return &Error{Code: CodeInvalidParams, Message: fmt.Sprintf("rpc: patch doesn't apply to %s: %v", rv.Elem().Type(), err)}
+	}
+	rv.Elem().Set(patched.Elem())
+	return nil
+}
+
+// ----------------------------------------------------------------------------
+// JSON Pointers
+// ----------------------------------------------------------------------------
+
+// parsePointer returns the reference tokens of an RFC 6901 JSON Pointer.
+func parsePointer(pointer string) ([]string, error) {
+	if pointer == "" {
+		return nil, nil
+	}
+	if pointer[0] != '/' {
+		return nil, fmt.Errorf("invalid JSON pointer %q", pointer)
+	}
+	tokens := strings.Split(pointer[1:], "/")
+	for i, token := range tokens {
+		tokens[i] = pointerUnescaper.Replace(token)
+	}
+	return tokens, nil
+}
+
+// pointerUnescaper unescapes the reference tokens of JSON Pointers.
+var pointerUnescaper = strings.NewReplacer("~1", "/", "~0", "~")
+
+// getAt returns the value at path.
+func getAt(node interface{}, path []string) (interface{}, error) {
+	for _, token := range path {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			child, ok := n[token]
+			if !ok {
+				return nil, fmt.Errorf("no member %q", token)
+			}
+			node = child
+		case []interface{}:
+			i, err := arrayIndex(token, len(n)-1)
+			if err != nil {
+				return nil, err
+			}
+			node = n[i]
+		default:
+			return nil, fmt.Errorf("no member %q in a scalar", token)
+		}
+	}
+	return node, nil
+}
+
+// setAt sets the value at path, adding it to its object or inserting it in
+// its array if add is true, or replacing an existing one otherwise. It
+// returns the new root.
+func setAt(root interface{}, path []string, value interface{}, add bool) (interface{}, error) {
+	if len(path) == 0 {
+		return value, nil
+	}
+	return updateParent(root, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			if _, ok := p[token]; !ok && !add {
+				return nil, fmt.Errorf("no member %q to replace", token)
+			}
+			p[token] = value
+			return p, nil
+		case []interface{}:
+			if !add {
+				i, err := arrayIndex(token, len(p)-1)
+				if err != nil {
+					return nil, err
+				}
+				p[i] = value
+				return p, nil
+			}
+			i := len(p)
+			if token != "-" {
+				var err error
+				if i, err = arrayIndex(token, len(p)); err != nil {
+					return nil, err
+				}
+			}
+			p = append(p, nil)
+			copy(p[i+1:], p[i:])
+			p[i] = value
+			return p, nil
+		}
+		return nil, fmt.Errorf("no member %q in a scalar", token)
+	})
+}
+
+// removeAt removes the value at path, returning the new root and the value.
+func removeAt(root interface{}, path []string) (interface{}, interface{}, error) {
+	if len(path) == 0 {
+		return nil, nil, fmt.Errorf("can't remove the whole document")
+	}
+	var removed interface{}
+	root, err := updateParent(root, path, func(parent interface{}, token string) (interface{}, error) {
+		switch p := parent.(type) {
+		case map[string]interface{}:
+			value, ok := p[token]
+			if !ok {
+				return nil, fmt.Errorf("no member %q to remove", token)
+			}
+			removed = value
+			delete(p, token)
+			return p, nil
+		case []interface{}:
+			i, err := arrayIndex(token, len(p)-1)
+			if err != nil {
+				return nil, err
+			}
+			removed = p[i]
+			return append(p[:i], p[i+1:]...), nil
+		}
+		return nil, fmt.Errorf("no member %q in a scalar", token)
+	})
+	return root, removed, err
+}
+
+// updateParent replaces the parent of the value at path with the result of
+// update, returning the new root.
+func updateParent(node interface{}, path []string, update func(parent interface{}, token string) (interface{}, error)) (interface{}, error) {
+	if len(path) == 1 {
+		return update(node, path[0])
+	}
+	child, err := getAt(node, path[:1])
+	if err != nil {
+		return nil, err
+	}
+	if child, err = updateParent(child, path[1:], update); err != nil {
+		return nil, err
+	}
+	switch n := node.(type) {
+	case map[string]interface{}:
+		n[path[0]] = child
+	case []interface{}:
+		i, _ := arrayIndex(path[0], len(n)-1)
+		n[i] = child
+	}
+	return node, nil
+}
+
+// arrayIndex parses an array index of at most max.
+func arrayIndex(token string, max int) (int, error) {
+	i, err := strconv.Atoi(token)
+	if err != nil || i < 0 || (len(token) > 1 && token[0] == '0') {
+		return 0, fmt.Errorf("invalid array index %q", token)
+	}
+	if i > max {
+		return 0, fmt.Errorf("array index %d out of bounds", i)
+	}
+	return i, nil
+}
+
+// decodeDocument decodes a JSON document, keeping numbers exact.
+func decodeDocument(doc []byte) (interface{}, error) {
+	var v interface{}
+	dec := json.NewDecoder(bytes.NewReader(doc))
+	dec.UseNumber()
+	if err := dec.Decode(&v); err != nil {
+		return nil, &Error{Code: CodeInvalidParams, Message: "rpc: invalid JSON document: " + err.Error()}
+	}
+	return v, nil
+}
+
+// copyDocument returns a deep copy of a decoded document.
+func copyDocument(v interface{}) (interface{}, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return decodeDocument(b)
+}
+
+// equalDocuments returns true if a decoded document equals a JSON one, with
+// numbers compared by value.
+func equalDocuments(v interface{}, doc json.RawMessage) bool {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return false
+	}
+	var x, y interface{}
+	if json.Unmarshal(b, &x) != nil || json.Unmarshal(doc, &y) != nil {
+		return false
+	}
+	return reflect.DeepEqual(x, y)
+}
@@ -0,0 +1,158 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// Resource policies
+// ----------------------------------------------------------------------------
+
+// ResourcePolicy bounds the resources a method may use. The server
+// enforces the element limits; the other knobs are for handlers, which
+// query the policy of their call with CurrentPolicy, and middleware, with
+// Server.ResourcePolicy. Zero values mean no limit.
+type ResourcePolicy struct {
+	// MaxArgsElements bounds the number of elements of the slices, arrays
+	// and maps of the args, counted through nested values.
+	MaxArgsElements int `json:"max_args_elements,omitempty"`
+	// MaxReplyElements bounds the number of elements of the reply, as
+	// MaxArgsElements.
+	MaxReplyElements int `json:"max_reply_elements,omitempty"`
+	// MaxExpansion bounds the ratio of the items a handler may read, e.g.
+	// rows joined, to the items it is asked for.
+	MaxExpansion float64 `json:"max_expansion,omitempty"`
+	// Limits holds application-defined limits by name.
+	Limits map[string]int64 `json:"limits,omitempty"`
+}
+
+// Limit returns the application-defined limit of name, 0 if unset.
+func (p ResourcePolicy) Limit(name string) int64 {
+	return p.Limits[name]
+}
+
+// CheckExpansion returns a CodeResourceExhausted error if reading read
+// items for requested ones exceeds MaxExpansion.
+func (p ResourcePolicy) CheckExpansion(requested, read int) error {
+	if p.MaxExpansion <= 0 || float64(read) <= p.MaxExpansion*float64(requested) {
+		return nil
+	}
+	return &Error{
+		Code:    CodeResourceExhausted,
+		Message: fmt.Sprintf("rpc: expansion of %d items to %d exceeds %g", requested, read, p.MaxExpansion),
+	}
+}
+
+// resourcePolicies holds the policies of the methods.
+type resourcePolicies struct {
+	mutex    sync.RWMutex
+	byMethod map[string]ResourcePolicy
+}
+
+// policyKey is the context key of the policy of a call.
+type policyKey struct{}
+
+// SetResourcePolicy sets the resource policy of method, or of every method
+// without its own policy with "*". Calls with args over the limits are
+// answered with a CodeResourceExhausted error without being served, as are
+// calls whose reply is over the limits.
+func (s *Server) SetResourcePolicy(method string, policy ResourcePolicy) {
+	s.policies.mutex.Lock()
+	defer s.policies.mutex.Unlock()
+	if s.policies.byMethod == nil {
+		s.policies.byMethod = make(map[string]ResourcePolicy)
+	}
+	s.policies.byMethod[method] = policy
+}
+
+// ResourcePolicy returns the resource policy of method.
+func (s *Server) ResourcePolicy(method string) ResourcePolicy {
+	s.policies.mutex.RLock()
+	defer s.policies.mutex.RUnlock()
+	if policy, ok := s.policies.byMethod[method]; ok {
+		return policy
+	}
+	return s.policies.byMethod["*"]
+}
+
+// CurrentPolicy returns the resource policy of the call whose handler runs
+// with ctx.
+func CurrentPolicy(ctx context.Context) ResourcePolicy {
+	policy, _ := ctx.Value(policyKey{}).(ResourcePolicy)
+	return policy
+}
+
+// withPolicy returns r carrying the policy of method, which its args must
+// comply with.
+func (s *Server) withPolicy(r *http.Request, method string, args reflect.Value) (*http.Request, ResourcePolicy, error) {
+	policy := s.ResourcePolicy(method)
+	if err := checkElements(args, "args", policy.MaxArgsElements); err != nil {
+		return r, policy, err
+	}
+	return r.WithContext(context.WithValue(r.Context(), policyKey{}, policy)), policy, nil
+}
+
+// checkElements returns a CodeResourceExhausted error if v holds more than
+// max elements.
+func checkElements(v reflect.Value, what string, max int) error {
+	if max <= 0 {
+		return nil
+	}
+	if n := countElements(v, max, make(map[uintptr]bool)); n > max {
+		return &Error{
+			Code:    CodeResourceExhausted,
+			Message: fmt.Sprintf("rpc: %s with more than %d elements", what, max),
+		}
+	}
+	return nil
+}
+
+// countElements counts the elements of the slices, arrays and maps of v,
+// stopping past max.
+func countElements(v reflect.Value, max int, seen map[uintptr]bool) int {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return 0
+		}
+		if v.Kind() == reflect.Ptr {
+			if seen[v.Pointer()] {
+				return 0
+			}
+			seen[v.Pointer()] = true
+		}
+		return countElements(v.Elem(), max, seen)
+	case reflect.Struct:
+		n := 0
+		for i := 0; i < v.NumField() && n <= max; i++ {
+			n += countElements(v.Field(i), max-n, seen)
+		}
+		return n
+	case reflect.Slice, reflect.Array:
+		n := v.Len()
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			// Byte strings are single values.
+			return 0
+		}
+		for i := 0; i < v.Len() && n <= max; i++ {
+			n += countElements(v.Index(i), max-n, seen)
+		}
+		return n
+	case reflect.Map:
+		n := v.Len()
+		iter := v.MapRange()
+		for iter.Next() && n <= max {
+			n += countElements(iter.Value(), max-n, seen)
+		}
+		return n
+	}
+	return 0
+}
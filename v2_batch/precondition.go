@@ -0,0 +1,114 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Preconditions
+// ----------------------------------------------------------------------------
+
+const (
+	// IfMatchHeader is the HTTP header carrying the entity version expected
+	// by the calls of a request, as in HTTP conditional requests.
+	IfMatchHeader = "If-Match"
+	// IfMatchExtension is the envelope member carrying the entity version
+	// expected by a single call, which takes precedence over the header:
+	//
+	//	{"jsonrpc": "2.0", "method": "Doc.Save", "ifMatch": "7", ...}
+	IfMatchExtension = "ifMatch"
+)
+
+// ifMatchKey is the context key of the entity version expected by a call.
+type ifMatchKey struct{}
+
+// IfMatch returns the entity version expected by a call, with ctx the
+// context of the request passed to its handler, and whether there is one.
+// The version is unquoted; "*" matches any existing entity.
+func IfMatch(ctx context.Context) (string, bool) {
+	version, ok := ctx.Value(ifMatchKey{}).(string)
+	return version, ok
+}
+
+// CheckVersion compares the version of an entity, or "" if it doesn't
+// exist, with the one expected by a call. It returns nil if the call has
+// no precondition or it holds, and a CodePreconditionFailed error carrying
+// the current version otherwise:
+//
+//	if err := rpc.CheckVersion(ctx, doc.Version); err != nil {
+//		return err
+//	}
+func CheckVersion(ctx context.Context, current string) error {
+	expected, ok := IfMatch(ctx)
+	if !ok || expected == current || (expected == "*" && current != "") {
+		return nil
+	}
+	description := "entity doesn't exist"
+	if current != "" {
+		description = "current version is " + strconv.Quote(current)
+	}
+	return NewErrorWithDetails(CodePreconditionFailed, "rpc: precondition failed",
+		&PreconditionFailure{Violations: []PreconditionViolation{{
+			Type:        "VERSION",
+			Subject:     expected,
+			Description: description,
+		}}})
+}
+
+// SetVersion reports the version of the entity of a call in the ETag
+// response header, with ctx the context of the request passed to its
+// handler, for the client's next precondition.
+func SetVersion(ctx context.Context, version string) {
+	SetResponseHeader(ctx, "ETag", strconv.Quote(version))
+}
+
+// withIfMatch returns r carrying the entity version expected by its call,
+// from extensions or else the If-Match header. The extension must be a
+// non-empty string or a number, otherwise the call is rejected rather than
+// run without its precondition.
+func withIfMatch(r *http.Request, extensions map[string]json.RawMessage) (*http.Request, error) {
+	version := unquoteETag(r.Header.Get(IfMatchHeader))
+	if raw, ok := extensions[IfMatchExtension]; ok {
+		var value interface{}
+		decoder := json.NewDecoder(bytes.NewReader(raw))
+		decoder.UseNumber()
+		decoder.Decode(&value)
+		switch value := value.(type) {
+		case string:
+			version = value
+		case json.Number:
+			version = value.String()
+		default:
+			version = ""
+		}
+		if version == "" {
+			return r, &Error{
+				Code:    CodeInvalidParams,
+				Message: "rpc: " + IfMatchExtension + " must be a non-empty string or a number",
+			}
+		}
+	}
+	if version == "" {
+		return r, nil
+	}
+	return r.WithContext(context.WithValue(r.Context(), ifMatchKey{}, version)), nil
+}
+
+// unquoteETag returns the opaque version of an entity tag, as in "7" for
+// W/"7".
+func unquoteETag(tag string) string {
+	tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+	if unquoted, err := strconv.Unquote(tag); err == nil {
+		return unquoted
+	}
+	return tag
+}
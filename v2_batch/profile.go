@@ -0,0 +1,133 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"math/rand"
+	"runtime/pprof"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Profile sampling
+// ----------------------------------------------------------------------------
+
+// Profile holds the profiles captured during a sampled call.
+type Profile struct {
+	// ID identifies the profile, e.g. in logs.
+	ID string
+	// Method is the called method, in dotted notation.
+	Method string
+	// Start is the time the call started and Duration how long it took.
+	Start    time.Time
+	Duration time.Duration
+	// CPU is the CPU profile of the call, in pprof format. It is empty if
+	// another CPU profile was already running.
+	CPU []byte
+	// Heap is a heap profile taken after the call, in pprof format.
+	Heap []byte
+}
+
+// SetProfileSampling enables profiling of a fraction of the calls to a
+// method; rate is between 0 (disabled) and 1 (every call). Captured profiles
+// are passed to the sink set with SetProfileSink.
+//
+// The CPU profiler is process-wide, so a sampled call running concurrently
+// with another profile only gets a heap profile. The ID of the profile is
+// logged along with the call, see SetLogger. Sampling can be set at runtime
+// with admin.setProfileSampling, see EnableAdmin.
+func (s *Server) SetProfileSampling(method string, rate float64) {
+	s.profileMutex.Lock()
+	defer s.profileMutex.Unlock()
+	if s.profileRates == nil {
+		s.profileRates = make(map[string]float64)
+	}
+	if rate <= 0 {
+		delete(s.profileRates, method)
+		return
+	}
+	s.profileRates[method] = rate
+}
+
+// SetProfileSink sets the function receiving sampled profiles.
+func (s *Server) SetProfileSink(sink func(*Profile)) {
+	s.profileMutex.Lock()
+	defer s.profileMutex.Unlock()
+	s.profileSink = sink
+}
+
+// ProfileSampling returns the sampling rates set with SetProfileSampling,
+// by method.
+func (s *Server) ProfileSampling() map[string]float64 {
+	s.profileMutex.Lock()
+	defer s.profileMutex.Unlock()
+	rates := make(map[string]float64, len(s.profileRates))
+	for method, rate := range s.profileRates {
+		rates[method] = rate
+	}
+	return rates
+}
+
+// profile returns the ID of the profile of the call, if sampled.
+func (h *replyDirectives) profile() string {
+	if h == nil {
+		return ""
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.profileID
+}
+
+// sampleProfile reports whether a call to method must be profiled, and
+// returns the sink to use.
+func (s *Server) sampleProfile(method string) (func(*Profile), bool) {
+	s.profileMutex.Lock()
+	defer s.profileMutex.Unlock()
+	rate, ok := s.profileRates[method]
+	if !ok || s.profileSink == nil || rand.Float64() >= rate {
+		return nil, false
+	}
+	return s.profileSink, true
+}
+
+// profileCall runs call while capturing its profiles, with ctx the context
+// of the call. The profile ID is logged along with the call.
+func (s *Server) profileCall(ctx context.Context, method string, sink func(*Profile), call func() error) error {
+	p := &Profile{
+		ID:     s.NewID(),
+		Method: method,
+		Start:  s.clock.Now(),
+	}
+	if h, ok := ctx.Value(directivesKey{}).(*replyDirectives); ok {
+		h.mutex.Lock()
+		h.profileID = p.ID
+		h.mutex.Unlock()
+	}
+	var cpu bytes.Buffer
+	cpuStarted := pprof.StartCPUProfile(&cpu) == nil
+	if cpuStarted {
+		// The profiler is process-wide: stop it even if call panics.
+		defer func() {
+			if cpuStarted {
+				pprof.StopCPUProfile()
+			}
+		}()
+	}
+	err := call()
+	if cpuStarted {
+		pprof.StopCPUProfile()
+		cpuStarted = false
+		p.CPU = cpu.Bytes()
+	}
+	p.Duration = s.clock.Now().Sub(p.Start)
+	var heap bytes.Buffer
+	if pprof.Lookup("heap").WriteTo(&heap, 0) == nil {
+		p.Heap = heap.Bytes()
+	}
+	sink(p)
+	return err
+}
@@ -0,0 +1,232 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+/*
+Package protobuf provides a codec whose params and results are binary
+protobuf messages, routed as JSON-RPC calls by method name.
+
+The request body is the params message, and the method is named in the
+Rpc-Method header, or else by the last element of the URL path, as in
+"/rpc/Greeter.Hello". The response body is the result message, or, for an
+error, its message as text, with its code in the Rpc-Error-Code header.
+
+The codec doesn't depend on a protobuf runtime: it is given the functions
+marshaling and unmarshaling messages, e.g. with google.golang.org/protobuf:
+
+	codec := protobuf.NewCodec(
+		func(m interface{}) ([]byte, error) { return proto.Marshal(m.(proto.Message)) },
+		func(b []byte, m interface{}) error { return proto.Unmarshal(b, m.(proto.Message)) },
+	)
+	s := rpc.NewServer()
+	s.RegisterCodec(codec, protobuf.ContentType)
+	s.RegisterService(new(Greeter), "", protobuf.Messages())
+
+Services registered with the Messages option have their args and reply
+types checked to be messages.
+*/
+package protobuf
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+)
+
+const (
+	// ContentType is the content type of the codec.
+	ContentType = "application/x-protobuf"
+	// MethodHeader is the request header naming the method.
+	MethodHeader = "Rpc-Method"
+	// ErrorCodeHeader is the response header carrying the code of an
+	// error.
+	ErrorCodeHeader = "Rpc-Error-Code"
+)
+
+// ----------------------------------------------------------------------------
+// Messages
+// ----------------------------------------------------------------------------
+
+// Messages returns a registration option rejecting the services whose args
+// or reply types aren't protobuf messages.
+func Messages() rpc.ServiceOption {
+	return rpc.CheckTypes(func(method string, args, reply reflect.Type) error {
+		for _, t := range []reflect.Type{args, reply} {
+			if !isMessageType(reflect.PtrTo(t)) {
+				return fmt.Errorf("*%s is not a protobuf message", t)
+			}
+		}
+		return nil
+	})
+}
+
+// IsMessage returns true if v is a protobuf message, as generated by
+// protoc-gen-go: it has a ProtoReflect method.
+func IsMessage(v interface{}) bool {
+	return v != nil && isMessageType(reflect.TypeOf(v))
+}
+
+func isMessageType(t reflect.Type) bool {
+	m, ok := t.MethodByName("ProtoReflect")
+	return ok && m.Type.NumIn() == 1 && m.Type.NumOut() == 1
+}
+
+// ----------------------------------------------------------------------------
+// Codec
+// ----------------------------------------------------------------------------
+
+// NewCodec returns a new protobuf Codec using marshal and unmarshal to
+// encode and decode messages.
+func NewCodec(marshal func(m interface{}) ([]byte, error), unmarshal func(b []byte, m interface{}) error) *Codec {
+	return &Codec{marshal: marshal, unmarshal: unmarshal}
+}
+
+// Codec creates a CodecRequest to process each request.
+type Codec struct {
+	marshal   func(m interface{}) ([]byte, error)
+	unmarshal func(b []byte, m interface{}) error
+}
+
+// NewRequest returns the CodecRequest of r. Requests aren't batched.
+func (c *Codec) NewRequest(r *http.Request) ([]rpc.CodecRequest, error) {
+	req := &CodecRequest{codec: c, method: r.Header.Get(MethodHeader)}
+	if req.method == "" {
+		req.method = r.URL.Path[strings.LastIndex(r.URL.Path, "/")+1:]
+	}
+	if req.method == "" {
+		req.err = &rpc.Error{Code: rpc.CodeInvalidRequest, Message: "rpc: no method"}
+	}
+	body, err := io.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	req.body = body
+	return []rpc.CodecRequest{req}, nil
+}
+
+// WriteBatchedReply writes the reply of the request.
+func (c *Codec) WriteBatchedReply(r *http.Request, w http.ResponseWriter, replyArray []interface{}) {
+	if len(replyArray) != 1 {
+		rpc.WriteError(w, http.StatusInternalServerError, "rpc: protobuf requests aren't batched")
+		return
+	}
+	res, ok := replyArray[0].(*response)
+	if !ok {
+		rpc.WriteError(w, http.StatusInternalServerError, "rpc: unknown reply")
+		return
+	}
+	if res.err == nil {
+		b, err := c.marshal(res.message)
+		if err == nil {
+			w.Header().Set("Content-Type", ContentType)
+			w.Write(b)
+			return
+		}
+		res.err = &rpc.Error{Code: rpc.CodeInternalError, Message: "rpc: can't encode the result: " + err.Error()}
+	}
+	code := rpc.CodeInternalError
+	if e, ok := res.err.(interface{ ErrorCode() int }); ok {
+		code = e.ErrorCode()
+	}
+	w.Header().Set(ErrorCodeHeader, strconv.Itoa(code))
+	rpc.WriteError(w, httpStatus(code), res.err.Error())
+}
+
+// ErrorReply implements rpc.ErrorReplier.
+func (c *Codec) ErrorReply(err error) interface{} {
+	return &response{err: err}
+}
+
+// httpStatus returns the HTTP status of an error code.
+func httpStatus(code int) int {
+	switch code {
+	case rpc.CodeInvalidRequest, rpc.CodeInvalidParams:
+		return http.StatusBadRequest
+	case rpc.CodeMethodNotFound:
+		return http.StatusNotFound
+	case rpc.CodeUnauthorized:
+		return http.StatusUnauthorized
+	case rpc.CodePreconditionFailed:
+		return http.StatusPreconditionFailed
+	case rpc.CodeRateLimited:
+		return http.StatusTooManyRequests
+	case rpc.CodeMethodRetired:
+		return http.StatusGone
+	case rpc.CodeUnavailable, rpc.CodeServiceUnhealthy:
+		return http.StatusServiceUnavailable
+	case rpc.CodeDeadlineExceeded:
+		return http.StatusGatewayTimeout
+	case rpc.CodeResourceExhausted:
+		return http.StatusRequestEntityTooLarge
+	case rpc.CodeReadOnlyReplica:
+		return http.StatusMisdirectedRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// ----------------------------------------------------------------------------
+// CodecRequest
+// ----------------------------------------------------------------------------
+
+// response is the reply to a request: a message or an error.
+type response struct {
+	message interface{}
+	err     error
+}
+
+// CodecRequest decodes and encodes a single request.
+type CodecRequest struct {
+	codec  *Codec
+	method string
+	body   []byte
+	err    error
+}
+
+// Method returns the RPC method for the current request.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (c *CodecRequest) Method() (string, error) {
+	return c.method, c.err
+}
+
+// ReadRequest fills the request object for the RPC method.
+func (c *CodecRequest) ReadRequest(args interface{}) error {
+	if c.err != nil {
+		return c.err
+	}
+	if !IsMessage(args) {
+		c.err = &rpc.Error{Code: rpc.CodeInternalError, Message: fmt.Sprintf("rpc: %T is not a protobuf message", args)}
+	} else if err := c.codec.unmarshal(c.body, args); err != nil {
+		c.err = &rpc.Error{Code: rpc.CodeInvalidParams, Message: "rpc: invalid params: " + err.Error()}
+	}
+	return c.err
+}
+
+// ResponseReply returns the reply of a result message.
+func (c *CodecRequest) ResponseReply(reply interface{}) interface{} {
+	if !IsMessage(reply) {
+		return c.ErrorReply(&rpc.Error{Code: rpc.CodeInternalError, Message: fmt.Sprintf("rpc: %T is not a protobuf message", reply)})
+	}
+	return &response{message: reply}
+}
+
+// ErrorReply returns the reply of an error.
+func (c *CodecRequest) ErrorReply(err error) interface{} {
+	return &response{err: err}
+}
+
+// Body returns the request body.
+func (c *CodecRequest) Body() []byte {
+	return c.body
+}
+
+// Error returns the error decoding the request, if any.
+func (c *CodecRequest) Error() error {
+	return c.err
+}
@@ -0,0 +1,114 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package protobuf
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+)
+
+// HelloRequest and HelloReply stand for generated messages, encoded as
+// their only field.
+type HelloRequest struct {
+	Name string
+}
+
+func (m *HelloRequest) ProtoReflect() interface{} { return m }
+
+type HelloReply struct {
+	Message string
+}
+
+func (m *HelloReply) ProtoReflect() interface{} { return m }
+
+func marshal(m interface{}) ([]byte, error) {
+	switch m := m.(type) {
+	case *HelloRequest:
+		return []byte(m.Name), nil
+	case *HelloReply:
+		return []byte(m.Message), nil
+	}
+	return nil, fmt.Errorf("can't marshal %T", m)
+}
+
+func unmarshal(b []byte, m interface{}) error {
+	switch m := m.(type) {
+	case *HelloRequest:
+		m.Name = string(b)
+	case *HelloReply:
+		m.Message = string(b)
+	default:
+		return fmt.Errorf("can't unmarshal %T", m)
+	}
+	return nil
+}
+
+type Greeter struct{}
+
+func (g *Greeter) Hello(ctx context.Context, req *HelloRequest) (*HelloReply, error) {
+	if req.Name == "" {
+		return nil, &rpc.Error{Code: rpc.CodePreconditionFailed, Message: "rpc: no name"}
+	}
+	return &HelloReply{Message: "Hello, " + req.Name}, nil
+}
+
+type JSONArgs struct{ Name string }
+
+type JSONService struct{}
+
+func (s *JSONService) Hello(ctx context.Context, req *JSONArgs) (*HelloReply, error) {
+	return nil, nil
+}
+
+func TestCodec(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(NewCodec(marshal, unmarshal), ContentType)
+	if err := s.RegisterService(new(Greeter), "", Messages()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(new(JSONService), "", Messages()); err == nil {
+		t.Error("Expected an error registering args that aren't messages")
+	}
+
+	call := func(path, method, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", path, bytes.NewBufferString(body))
+		r.Header.Set("Content-Type", ContentType)
+		if method != "" {
+			r.Header.Set(MethodHeader, method)
+		}
+		w := httptest.NewRecorder()
+		s.ServeHTTP(w, r)
+		return w
+	}
+	for _, w := range []*httptest.ResponseRecorder{
+		call("/rpc/Greeter.Hello", "", "gopher"),
+		call("/rpc", "Greeter.Hello", "gopher"),
+	} {
+		if w.Code != 200 || w.Header().Get("Content-Type") != ContentType || w.Body.String() != "Hello, gopher" {
+			t.Errorf("Expected the reply message, got %d %q", w.Code, w.Body.String())
+		}
+	}
+
+	for _, test := range []struct {
+		method string
+		status int
+		code   int
+	}{
+		{"Greeter.Hello", http.StatusPreconditionFailed, rpc.CodePreconditionFailed},
+		{"Greeter.Bye", http.StatusNotFound, rpc.CodeMethodNotFound},
+	} {
+		w := call("/rpc", test.method, "")
+		if w.Code != test.status || w.Header().Get(ErrorCodeHeader) != strconv.Itoa(test.code) {
+			t.Errorf("%s: expected status %d and code %d, got %d and %s", test.method, test.status, test.code, w.Code, w.Header().Get(ErrorCodeHeader))
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Queue workers
+// ----------------------------------------------------------------------------
+
+// QueueMessage is a message received from a Queue.
+type QueueMessage struct {
+	// ID identifies the message to the queue, e.g. an SQS receipt handle
+	// or a Pub/Sub ack id.
+	ID string
+	// Body holds the request.
+	Body []byte
+	// ContentType selects the codec, if set.
+	ContentType string
+	// Deadline is the end of the visibility timeout or ack deadline, after
+	// which the message is delivered again if not acknowledged.
+	Deadline time.Time
+}
+
+// Queue is a message queue with SQS or Pub/Sub semantics: received messages
+// are hidden until their deadline, and deleted once acknowledged.
+// Implementations must be safe for concurrent use.
+type Queue interface {
+	// Receive waits for up to max messages, returning early if ctx is done.
+	Receive(ctx context.Context, max int) ([]*QueueMessage, error)
+	// Ack deletes a processed message.
+	Ack(ctx context.Context, msg *QueueMessage) error
+}
+
+// QueueWorker is a Listener processing the requests queued in a Queue with
+// the services of a Server. A message is acknowledged once its request is
+// served, unless its deadline passed first, in which case it is left to be
+// delivered again. Calls are cancelled at the deadline, less Margin.
+type QueueWorker struct {
+	// Queue holds the requests.
+	Queue Queue
+	// Concurrency is the number of messages processed at once. Defaults
+	// to 1.
+	Concurrency int
+	// ContentType selects the codec of messages without one. Defaults to
+	// "application/json".
+	ContentType string
+	// Margin is kept before the deadline of a message to acknowledge it.
+	// Defaults to one second.
+	Margin time.Duration
+	// RetryDelay is waited after a failure to receive. Defaults to one
+	// second.
+	RetryDelay time.Duration
+	// OnResponse is called with the response to each request, if any, e.g.
+	// to publish it to a reply queue.
+	OnResponse func(msg *QueueMessage, response []byte)
+	// OnError is called when messages can't be received or acknowledged.
+	OnError func(msg *QueueMessage, err error)
+
+	mutex    sync.Mutex
+	closed   bool
+	cancel   context.CancelFunc
+	inflight sync.WaitGroup
+}
+
+// Serve implements Listener.
+func (q *QueueWorker) Serve(s *Server) error {
+	q.mutex.Lock()
+	if q.closed {
+		q.mutex.Unlock()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	q.cancel = cancel
+	q.mutex.Unlock()
+	defer cancel()
+
+	concurrency := q.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	slots := make(chan struct{}, concurrency)
+	for {
+		// Wait for a free slot, then receive as many messages as there
+		// are free slots.
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil
+		}
+		free := 1
+		for free < concurrency && len(slots) < cap(slots) {
+			slots <- struct{}{}
+			free++
+		}
+		msgs, err := q.Queue.Receive(ctx, free)
+		if ctx.Err() != nil {
+			return nil
+		}
+		if err != nil {
+			q.report(nil, err)
+			select {
+			case <-s.clock.After(q.retryDelay()):
+			case <-ctx.Done():
+			}
+		}
+		for i, msg := range msgs {
+			if i >= free {
+				break
+			}
+			q.inflight.Add(1)
+			go func(msg *QueueMessage) {
+				defer func() { <-slots }()
+				q.serve(s, msg)
+			}(msg)
+		}
+		for i := len(msgs); i < free; i++ {
+			<-slots
+		}
+	}
+}
+
+// serve dispatches the request of a message and acknowledges it.
+func (q *QueueWorker) serve(s *Server, msg *QueueMessage) {
+	defer q.inflight.Done()
+	margin := q.Margin
+	if margin <= 0 {
+		margin = time.Second
+	}
+	ctx := context.Background()
+	if !msg.Deadline.IsZero() {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, msg.Deadline.Add(-margin))
+		defer cancel()
+	}
+	r, err := http.NewRequest("POST", "queue://", bytes.NewReader(msg.Body))
+	if err != nil {
+		return
+	}
+	contentType := msg.ContentType
+	if contentType == "" {
+		contentType = q.ContentType
+	}
+	if contentType == "" {
+		contentType = "application/json"
+	}
+	r.Header.Set("Content-Type", contentType)
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r.WithContext(ctx))
+	if ctx.Err() != nil {
+		// Too late: the message is delivered again.
+		return
+	}
+	if q.OnResponse != nil && w.Body.Len() > 0 {
+		q.OnResponse(msg, w.Body.Bytes())
+	}
+	if err := q.Queue.Ack(ctx, msg); err != nil {
+		q.report(msg, err)
+	}
+}
+
+func (q *QueueWorker) retryDelay() time.Duration {
+	if q.RetryDelay > 0 {
+		return q.RetryDelay
+	}
+	return time.Second
+}
+
+func (q *QueueWorker) report(msg *QueueMessage, err error) {
+	if q.OnError != nil {
+		q.OnError(msg, err)
+	}
+}
+
+// Shutdown implements Listener. It stops receiving messages and waits for
+// those in flight, or for ctx to be done.
+func (q *QueueWorker) Shutdown(ctx context.Context) error {
+	q.mutex.Lock()
+	q.closed = true
+	cancel := q.cancel
+	q.mutex.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	idle := make(chan struct{})
+	go func() {
+		q.inflight.Wait()
+		close(idle)
+	}()
+	select {
+	case <-idle:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Recording
+// ----------------------------------------------------------------------------
+
+// Record is a captured HTTP exchange: a request body, single or batch, and
+// the response written for it.
+type Record struct {
+	Time        time.Time     `json:"time"`
+	Duration    time.Duration `json:"duration"`
+	ContentType string        `json:"content_type"`
+	Request     []byte        `json:"request"`
+	Status      int           `json:"status"`
+	Response    []byte        `json:"response"`
+}
+
+// Recorder receives the records captured by the server. Implementations
+// must be safe for concurrent use.
+type Recorder interface {
+	Record(*Record)
+}
+
+// SetRecorder makes the server capture every request and response and pass
+// them to rec. A nil Recorder stops recording.
+func (s *Server) SetRecorder(rec Recorder) {
+	s.recorder = rec
+}
+
+// NewRecordWriter returns a Recorder writing records to w as
+// newline-delimited JSON, the format read by Replay.
+func NewRecordWriter(w io.Writer) Recorder {
+	return &recordWriter{enc: json.NewEncoder(w)}
+}
+
+type recordWriter struct {
+	mutex sync.Mutex
+	enc   *json.Encoder
+}
+
+func (w *recordWriter) Record(rec *Record) {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	w.enc.Encode(rec)
+}
+
+// record serves r, capturing the exchange.
+func (s *Server) record(w http.ResponseWriter, r *http.Request, serve func(http.ResponseWriter, *http.Request)) {
+	body, err := ioutil.ReadAll(r.Body)
+	r.Body.Close()
+	if err != nil {
+		WriteError(w, 400, "rpc: failed to read the request body")
+		return
+	}
+	r.Body = nopCloser{bytes.NewReader(body)}
+	rw := &recordingWriter{ResponseWriter: w}
+	rec := &Record{
+		Time:        s.clock.Now(),
+		ContentType: r.Header.Get("Content-Type"),
+		Request:     body,
+	}
+	serve(rw, r)
+	rec.Duration = s.clock.Now().Sub(rec.Time)
+	rec.Status = rw.status
+	if rec.Status == 0 {
+		rec.Status = http.StatusOK
+	}
+	rec.Response = rw.body.Bytes()
+	s.recorder.Record(rec)
+}
+
+// recordingWriter copies the response it writes.
+type recordingWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *recordingWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *recordingWriter) Write(p []byte) (int, error) {
+	w.body.Write(p)
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *recordingWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// ----------------------------------------------------------------------------
+// Replay
+// ----------------------------------------------------------------------------
+
+// ReplayOptions configures Replay.
+type ReplayOptions struct {
+	// Speed scales the original pacing between records: 1 replays at the
+	// recorded pace, 2 twice as fast. Zero replays as fast as possible.
+	Speed float64
+	// Clock is used to wait between records. Defaults to SystemClock.
+	Clock Clock
+	// Equal compares a recorded response with the replayed one. By
+	// default JSON responses are compared structurally and others byte by
+	// byte.
+	Equal func(recorded, replayed []byte) bool
+}
+
+// ReplayResult is the outcome of replaying one record.
+type ReplayResult struct {
+	Record   *Record
+	Status   int
+	Response []byte
+}
+
+// ReplayReport summarizes a replay.
+type ReplayReport struct {
+	Total   int
+	Matched int
+	// Mismatches holds the records whose replayed status or response
+	// differ from the recorded ones.
+	Mismatches []ReplayResult
+}
+
+// Replay feeds the records read from r, as written by NewRecordWriter, to h
+// in order and compares the responses with the recorded ones.
+//
+// It stops early, returning the partial report, if ctx is done.
+func Replay(ctx context.Context, h http.Handler, r io.Reader, opts ReplayOptions) (*ReplayReport, error) {
+	clock := opts.Clock
+	if clock == nil {
+		clock = SystemClock
+	}
+	equal := opts.Equal
+	if equal == nil {
+		equal = equalResponses
+	}
+	report := new(ReplayReport)
+	dec := json.NewDecoder(bufio.NewReader(r))
+	var last time.Time
+	for {
+		rec := new(Record)
+		if err := dec.Decode(rec); err == io.EOF {
+			return report, nil
+		} else if err != nil {
+			return report, err
+		}
+		if opts.Speed > 0 && !last.IsZero() {
+			if wait := time.Duration(float64(rec.Time.Sub(last)) / opts.Speed); wait > 0 {
+				select {
+				case <-clock.After(wait):
+				case <-ctx.Done():
+					return report, ctx.Err()
+				}
+			}
+		}
+		last = rec.Time
+		if err := ctx.Err(); err != nil {
+			return report, err
+		}
+
+		req, err := http.NewRequest("POST", "http://localhost/", bytes.NewReader(rec.Request))
+		if err != nil {
+			return report, err
+		}
+		req = req.WithContext(ctx)
+		req.Header.Set("Content-Type", rec.ContentType)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+
+		report.Total++
+		if w.Code == rec.Status && equal(rec.Response, w.Body.Bytes()) {
+			report.Matched++
+			continue
+		}
+		report.Mismatches = append(report.Mismatches, ReplayResult{
+			Record:   rec,
+			Status:   w.Code,
+			Response: w.Body.Bytes(),
+		})
+	}
+}
+
+// equalResponses compares two responses structurally if both are JSON.
+func equalResponses(a, b []byte) bool {
+	var va, vb interface{}
+	if json.Unmarshal(a, &va) == nil && json.Unmarshal(b, &vb) == nil {
+		return reflect.DeepEqual(va, vb)
+	}
+	return bytes.Equal(a, b)
+}
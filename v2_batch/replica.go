@@ -0,0 +1,51 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+)
+
+// ----------------------------------------------------------------------------
+// Read-only replicas
+// ----------------------------------------------------------------------------
+
+// ReplicaRedirect is the data of the CodeReadOnlyReplica errors, pointing
+// the client at the primary.
+type ReplicaRedirect struct {
+	Primary string `json:"primary"`
+}
+
+// SetReplicaOf turns the server into a read-only replica of primary, the
+// endpoint of the server serving every method, as in
+// "https://primary.example.com/rpc". Only the methods marked read-only,
+// with ReadOnlyMethods or MarkReadOnly, are served; the calls to the others
+// are answered with a CodeReadOnlyReplica error whose data is a
+// ReplicaRedirect, for the client to call the primary instead. The admin
+// methods, controlling the replica itself, are served too. An empty
+// primary serves every method again.
+func (s *Server) SetReplicaOf(primary string) {
+	s.replicaOf = primary
+}
+
+// MarkReadOnly marks a registered method as not mutating state, as
+// ReadOnlyMethods does, e.g. for methods registered with RegisterFunc.
+//
+// The method uses a dotted notation as in "Service.Method".
+func (s *Server) MarkReadOnly(method string) error {
+	return s.services.markReadOnly(method)
+}
+
+// replicaError returns an error if the method isn't served by the replica.
+func (s *Server) replicaError(service *service, method *serviceMethod) error {
+	if s.replicaOf == "" || service.name == adminServiceName || s.services.readOnly(method) {
+		return nil
+	}
+	return &Error{
+		Code:    CodeReadOnlyReplica,
+		Message: fmt.Sprintf("rpc: read-only replica, call the primary at %s", s.replicaOf),
+		Data:    &ReplicaRedirect{Primary: s.replicaOf},
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"net/http"
+)
+
+// StatusTrailer is the trailer carrying the final status of a streamed
+// batch response, whose HTTP status is sent before the batch is processed:
+// "200" if the whole batch was answered, "500" otherwise.
+const StatusTrailer = "Rpc-Status"
+
+// responseBuilder defers writing a response until it is complete, so that
+// a failure while encoding it, e.g. by the codec, can still replace it with
+// a clean error response instead of a 200 followed by a mangled body.
+//
+// A codec writing a large response can Flush it to send what it wrote so
+// far; further writes then go straight to the client.
+type responseBuilder struct {
+	w         http.ResponseWriter
+	status    int
+	body      bytes.Buffer
+	committed bool
+	// digest is set to send the Digest header of the body on commit.
+	digest bool
+}
+
+func (b *responseBuilder) Header() http.Header {
+	return b.w.Header()
+}
+
+// WriteHeader records the status. Unlike with a plain ResponseWriter, it can
+// still be changed after the body is written, until the response is
+// committed.
+func (b *responseBuilder) WriteHeader(status int) {
+	if b.committed {
+		b.w.WriteHeader(status)
+		return
+	}
+	b.status = status
+}
+
+func (b *responseBuilder) Write(p []byte) (int, error) {
+	if b.committed {
+		return b.w.Write(p)
+	}
+	return b.body.Write(p)
+}
+
+// Flush commits the response written so far.
+func (b *responseBuilder) Flush() {
+	// The digest of a partial body would be wrong.
+	b.digest = false
+	b.commit()
+	if f, ok := b.w.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// reset discards the response written so far, if it is not committed yet.
+func (b *responseBuilder) reset() bool {
+	if b.committed {
+		return false
+	}
+	b.status = 0
+	b.body.Reset()
+	b.w.Header().Del("Content-Encoding")
+	return true
+}
+
+// commit writes the response.
+func (b *responseBuilder) commit() error {
+	if b.committed {
+		return nil
+	}
+	b.committed = true
+	if b.digest {
+		b.w.Header().Set("Digest", bodyDigest(b.body.Bytes()))
+	}
+	if b.status != 0 {
+		b.w.WriteHeader(b.status)
+	}
+	_, err := b.w.Write(b.body.Bytes())
+	b.body.Reset()
+	return err
+}
+
+// DefaultErrorStatuses returns the HTTP statuses of the error codes of the
+// protocol and this package, as a starting point for SetErrorStatuses.
+func DefaultErrorStatuses() map[int]int {
+	return map[int]int{
+		CodeInvalidRequest:     http.StatusBadRequest,
+		CodeMethodNotFound:     http.StatusNotFound,
+		CodeInvalidParams:      http.StatusBadRequest,
+		CodeInternalError:      http.StatusInternalServerError,
+		CodeMethodRetired:      http.StatusGone,
+		CodeUnavailable:        http.StatusServiceUnavailable,
+		CodeRateLimited:        http.StatusTooManyRequests,
+		CodeUnauthorized:       http.StatusUnauthorized,
+		CodePreconditionFailed: http.StatusPreconditionFailed,
+		CodeDeadlineExceeded:   http.StatusGatewayTimeout,
+		CodeResourceExhausted:  http.StatusRequestEntityTooLarge,
+		CodeServiceUnhealthy:   http.StatusServiceUnavailable,
+		CodeReadOnlyReplica:    http.StatusMisdirectedRequest,
+		CodePartialFailure:     http.StatusInternalServerError,
+	}
+}
+
+// SetErrorStatuses sets the HTTP statuses of the responses to single
+// requests replied with an error, by error code, for proxies and monitors
+// which only look at statuses:
+//
+//	statuses := rpc.DefaultErrorStatuses()
+//	statuses[CodeNoFunds] = http.StatusPaymentRequired
+//	s.SetErrorStatuses(statuses)
+//
+// Errors whose code isn't mapped, batches and notifications keep the status
+// written by the codec, as do codecs writing a status other than 200.
+func (s *Server) SetErrorStatuses(statuses map[int]int) {
+	s.errorStatuses = make(map[int]int, len(statuses))
+	for code, status := range statuses {
+		s.errorStatuses[code] = status
+	}
+}
+
+// applyErrorStatus sets the status of the response built by b to the one
+// mapped to the code of err, if any.
+func (s *Server) applyErrorStatus(b *responseBuilder, err error) {
+	code, ok := ErrorCode(err)
+	if !ok {
+		return
+	}
+	status, ok := s.errorStatuses[code]
+	if !ok || b.committed || (b.status != 0 && b.status != http.StatusOK) {
+		return
+	}
+	b.status = status
+}
@@ -0,0 +1,74 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"time"
+)
+
+// Retirement describes the retirement of a method.
+type Retirement struct {
+	// Replacement is the method to call instead, if any.
+	Replacement string `json:"replacement,omitempty"`
+	// DocsURL points to migration documentation.
+	DocsURL string `json:"docs,omitempty"`
+	// Message explains the retirement to callers.
+	Message string `json:"message,omitempty"`
+	// Until is the end of the grace period. Afterwards the method is
+	// reported as not found.
+	Until time.Time `json:"until"`
+}
+
+// RetireMethod retires a method: calls are no longer dispatched to it but
+// answered with a CodeMethodRetired error whose data is the Retirement,
+// guiding callers to its replacement. Once the grace period ends, calls get
+// the same error as for an unknown method.
+//
+// The method doesn't need to be registered, so guidance can be kept for a
+// method already removed from the code.
+func (s *Server) RetireMethod(method string, retirement Retirement) {
+	s.retiredMutex.Lock()
+	if s.retired == nil {
+		s.retired = make(map[string]Retirement)
+	}
+	s.retired[method] = retirement
+	s.retiredMutex.Unlock()
+	s.catalogChanged(false)
+}
+
+// knownMethod returns true if method is the canonical name of a method
+// registered or retired.
+func (s *Server) knownMethod(method string) bool {
+	if _, _, err := s.services.get(method); err == nil {
+		return true
+	}
+	s.retiredMutex.Lock()
+	defer s.retiredMutex.Unlock()
+	_, retired := s.retired[method]
+	return retired
+}
+
+// retiredError returns the error replied for a retired method, or nil if
+// the method is not retired.
+func (s *Server) retiredError(method string) error {
+	s.retiredMutex.Lock()
+	retirement, ok := s.retired[method]
+	s.retiredMutex.Unlock()
+	if !ok {
+		return nil
+	}
+	if s.clock.Now().After(retirement.Until) {
+		return &Error{Code: CodeMethodNotFound, Message: fmt.Sprintf("rpc: can't find method %q", method)}
+	}
+	msg := retirement.Message
+	if msg == "" {
+		msg = fmt.Sprintf("rpc: method %q is retired", method)
+		if retirement.Replacement != "" {
+			msg += fmt.Sprintf(", use %q", retirement.Replacement)
+		}
+	}
+	return &Error{Code: CodeMethodRetired, Message: msg, Data: retirement}
+}
@@ -0,0 +1,94 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+// Package rpctest runs an rpc.Server on loopback listeners for integration
+// tests.
+//
+//	s := rpc.NewServer()
+//	s.RegisterCodec(json2.NewCodec(), "application/json")
+//	s.RegisterService(new(HelloService), "")
+//	ts := rpctest.Start(t, s, rpctest.HTTP)
+//	res, err := http.Post(ts.URL, "application/json", body)
+//
+// The server is ready when Start returns and is shut down when the test ends.
+package rpctest
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+)
+
+// ReadyTimeout bounds the wait for the listeners to accept connections.
+var ReadyTimeout = 5 * time.Second
+
+// Transport creates the rpc.Listener serving a loopback listener.
+type Transport func(l net.Listener) rpc.Listener
+
+// HTTP serves the server over HTTP.
+func HTTP(l net.Listener) rpc.Listener {
+	return &rpc.HTTPListener{Listener: l}
+}
+
+// Harness is a running server.
+type Harness struct {
+	// Server is the served rpc.Server.
+	Server *rpc.Server
+	// Addrs are the listener addresses, one per transport, in order.
+	Addrs []string
+	// URL is "http://" followed by the first address.
+	URL string
+}
+
+// Start serves s with each transport on its own loopback port and waits
+// until all of them accept connections. The server is shut down, and any
+// serving error reported, when the test and its subtests complete.
+func Start(t testing.TB, s *rpc.Server, transports ...Transport) *Harness {
+	t.Helper()
+	if len(transports) == 0 {
+		transports = []Transport{HTTP}
+	}
+	h := &Harness{Server: s}
+	listeners := make([]rpc.Listener, len(transports))
+	for i, transport := range transports {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatalf("rpctest: failed to listen: %v", err)
+		}
+		h.Addrs = append(h.Addrs, l.Addr().String())
+		listeners[i] = transport(l)
+	}
+	h.URL = "http://" + h.Addrs[0]
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- rpc.Serve(ctx, s, listeners...)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		if err := <-done; err != nil {
+			t.Errorf("rpctest: serving failed: %v", err)
+		}
+	})
+
+	deadline := time.Now().Add(ReadyTimeout)
+	for _, addr := range h.Addrs {
+		for {
+			conn, err := net.DialTimeout("tcp", addr, time.Second)
+			if err == nil {
+				conn.Close()
+				break
+			}
+			if time.Now().After(deadline) {
+				t.Fatalf("rpctest: %s not ready: %v", addr, err)
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	}
+	return h
+}
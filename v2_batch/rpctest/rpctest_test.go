@@ -0,0 +1,52 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpctest
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/agronomhidden/rpc/v2_batch"
+	"github.com/agronomhidden/rpc/v2_batch/json2"
+)
+
+type Service1Request struct {
+	A int
+	B int
+}
+
+type Service1Response struct {
+	Result int
+}
+
+type Service1 struct {
+}
+
+func (t *Service1) Multiply(r *http.Request, req *Service1Request, res *Service1Response) error {
+	res.Result = req.A * req.B
+	return nil
+}
+
+func TestStart(t *testing.T) {
+	s := rpc.NewServer()
+	s.RegisterCodec(json2.NewCodec(), "application/json")
+	s.RegisterService(new(Service1), "")
+	ts := Start(t, s, HTTP)
+
+	buf, _ := json2.EncodeClientRequest("Service1.Multiply", &Service1Request{4, 2})
+	res, err := http.Post(ts.URL, "application/json", bytes.NewReader(buf))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	var reply Service1Response
+	if err := json2.DecodeClientResponse(res.Body, &reply); err != nil {
+		t.Fatal(err)
+	}
+	if reply.Result != 8 {
+		t.Errorf("Wrong response: %v.", reply.Result)
+	}
+}
@@ -0,0 +1,158 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Sagas
+// ----------------------------------------------------------------------------
+
+// Saga runs the steps of an operation spanning several calls or resources,
+// undoing those done when one fails, e.g. in a handler:
+//
+//	var saga rpc.Saga
+//	saga.Step("reserve", reserveStock, releaseStock)
+//	saga.Step("charge", chargeCard, refundCard)
+//	saga.Step("ship", scheduleShipping, nil)
+//	if err := saga.Run(ctx); err != nil {
+//		return err
+//	}
+//
+// A Saga is meant to be run once, and is not safe for concurrent use.
+type Saga struct {
+	steps []sagaStep
+}
+
+type sagaStep struct {
+	name       string
+	do         func(ctx context.Context) error
+	compensate func(ctx context.Context) error
+}
+
+// Step appends a step named name, run by do and undone by compensate, which
+// may be nil for steps without effects to undo.
+func (s *Saga) Step(name string, do, compensate func(ctx context.Context) error) {
+	s.steps = append(s.steps, sagaStep{name: name, do: do, compensate: compensate})
+}
+
+// Run runs the steps in order. If one fails, the compensations of the steps
+// done are run in reverse order, with a context which isn't cancelled with
+// ctx, and a *SagaError is returned.
+func (s *Saga) Run(ctx context.Context) error {
+	for i, step := range s.steps {
+		if err := ctx.Err(); err != nil {
+			return s.compensate(ctx, i, step.name, err)
+		}
+		if err := step.do(ctx); err != nil {
+			return s.compensate(ctx, i, step.name, err)
+		}
+	}
+	return nil
+}
+
+// compensate undoes the steps before the n-th, which failed with err.
+func (s *Saga) compensate(ctx context.Context, n int, name string, err error) *SagaError {
+	ctx = context.WithoutCancel(ctx)
+	e := &SagaError{Step: name, Err: err}
+	for i := n - 1; i >= 0; i-- {
+		step := s.steps[i]
+		if step.compensate == nil {
+			continue
+		}
+		if err := step.compensate(ctx); err != nil {
+			if e.CompensationErrors == nil {
+				e.CompensationErrors = make(map[string]error)
+			}
+			e.CompensationErrors[step.name] = err
+			continue
+		}
+		e.Compensated = append(e.Compensated, step.name)
+	}
+	return e
+}
+
+// SagaError is the error of a saga whose step failed. It is replied with
+// the code of the error of the step, if it has one, or CodeInternalError;
+// if a compensation failed too, leaving the operation partly done, it is
+// replied with CodePartialFailure. Its data are as in:
+//
+//	{
+//		"step": "charge",
+//		"error": "card declined",
+//		"compensated": ["reserve"],
+//		"compensationErrors": {"...": "..."}
+//	}
+type SagaError struct {
+	// Step is the name of the step which failed, and Err its error.
+	Step string
+	Err  error
+	// Compensated are the names of the steps undone, in the order they
+	// were.
+	Compensated []string
+	// CompensationErrors are the errors of the compensations which failed,
+	// by step name.
+	CompensationErrors map[string]error
+}
+
+func (e *SagaError) Error() string {
+	msg := fmt.Sprintf("rpc: saga step %q failed: %v", e.Step, e.Err)
+	if len(e.CompensationErrors) == 0 {
+		return msg
+	}
+	names := make([]string, 0, len(e.CompensationErrors))
+	for name := range e.CompensationErrors {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for i, name := range names {
+		names[i] = fmt.Sprintf("%q: %v", name, e.CompensationErrors[name])
+	}
+	return msg + "; compensations failed: " + strings.Join(names, ", ")
+}
+
+// Unwrap returns the error of the step which failed.
+func (e *SagaError) Unwrap() error {
+	return e.Err
+}
+
+// ErrorCode returns the code the error is replied with.
+func (e *SagaError) ErrorCode() int {
+	if len(e.CompensationErrors) > 0 {
+		return CodePartialFailure
+	}
+	if code, ok := ErrorCode(e.Err); ok {
+		return code
+	}
+	return CodeInternalError
+}
+
+// sagaErrorData are the data of a SagaError.
+type sagaErrorData struct {
+	Step               string            `json:"step"`
+	Error              string            `json:"error"`
+	Compensated        []string          `json:"compensated"`
+	CompensationErrors map[string]string `json:"compensationErrors,omitempty"`
+}
+
+// ErrorData returns the steps failed and undone.
+func (e *SagaError) ErrorData() interface{} {
+	data := &sagaErrorData{Step: e.Step, Error: e.Err.Error(), Compensated: e.Compensated}
+	if data.Compensated == nil {
+		data.Compensated = []string{}
+	}
+	if len(e.CompensationErrors) > 0 {
+		data.CompensationErrors = make(map[string]string, len(e.CompensationErrors))
+		for name, err := range e.CompensationErrors {
+			data.CompensationErrors[name] = err.Error()
+		}
+	}
+	return data
+}
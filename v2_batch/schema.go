@@ -0,0 +1,254 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// JSON Schema generation
+// ----------------------------------------------------------------------------
+
+// schemaDialect is the JSON Schema dialect of the generated schemas.
+const schemaDialect = "https://json-schema.org/draft/2020-12/schema"
+
+// MethodSchema holds the JSON Schemas of the params and result of a method.
+type MethodSchema struct {
+	Params json.RawMessage `json:"params"`
+	Result json.RawMessage `json:"result"`
+}
+
+// Schema returns the JSON Schemas of the params and result of a registered
+// method, generated from its args and reply types as encoded by
+// encoding/json. Types implementing SchemaProvider describe themselves.
+//
+// Named structs are defined in "$defs" under their type name, so that
+// recursive types can be described. The rules of the rpc tags (see
+// Validator) are translated to their JSON Schema keywords, as in
+// "required" and "minimum".
+func (s *Server) Schema(method string) (*MethodSchema, error) {
+	_, methodSpec, err := s.services.get(method)
+	if err != nil {
+		return nil, err
+	}
+	params, err := typeSchema(methodSpec.argsType)
+	if err != nil {
+		return nil, err
+	}
+	result, err := typeSchema(methodSpec.replyType)
+	if err != nil {
+		return nil, err
+	}
+	return &MethodSchema{Params: params, Result: result}, nil
+}
+
+// typeSchema returns the JSON Schema document of t.
+func typeSchema(t reflect.Type) (json.RawMessage, error) {
+	if provider, ok := reflect.New(t).Interface().(SchemaProvider); ok {
+		return provider.JSONSchema(), nil
+	}
+	g := newSchemaGenerator("#/$defs/")
+	root := g.schema(t)
+	root["$schema"] = schemaDialect
+	if len(g.defs) > 0 {
+		root["$defs"] = g.defs
+	}
+	return json.Marshal(root)
+}
+
+// schemaGenerator generates the schema of a type and of the named structs
+// it references, defined in defs and referenced under prefix.
+type schemaGenerator struct {
+	prefix string
+	defs   map[string]interface{}
+	names  map[reflect.Type]string
+}
+
+func newSchemaGenerator(prefix string) *schemaGenerator {
+	return &schemaGenerator{
+		prefix: prefix,
+		defs:   make(map[string]interface{}),
+		names:  make(map[reflect.Type]string),
+	}
+}
+
+// propertySchema is the schema of a property of an object.
+type propertySchema struct {
+	name     string
+	schema   map[string]interface{}
+	required bool
+}
+
+var (
+	timeType       = reflect.TypeOf(time.Time{})
+	rawMessageType = reflect.TypeOf(json.RawMessage{})
+)
+
+// schema returns the schema of t.
+func (g *schemaGenerator) schema(t reflect.Type) map[string]interface{} {
+	if provider, ok := reflect.New(t).Interface().(SchemaProvider); ok {
+		var schema map[string]interface{}
+		if json.Unmarshal(provider.JSONSchema(), &schema) == nil {
+			delete(schema, "$schema")
+			return schema
+		}
+	}
+	switch {
+	case t == timeType:
+		return map[string]interface{}{"type": "string", "format": "date-time"}
+	case t == rawMessageType:
+		return map[string]interface{}{}
+	case t == bytesType:
+		return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+	case t.Implements(jsonMarshalerType) || reflect.PtrTo(t).Implements(jsonMarshalerType):
+		// Unknown encoding.
+		return map[string]interface{}{}
+	case t.Implements(textMarshalerType) || reflect.PtrTo(t).Implements(textMarshalerType):
+		return map[string]interface{}{"type": "string"}
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		return map[string]interface{}{"type": "integer", "minimum": 0}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Ptr:
+		return g.schema(t.Elem())
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 && t.Kind() == reflect.Slice {
+			return map[string]interface{}{"type": "string", "contentEncoding": "base64"}
+		}
+		schema := map[string]interface{}{"type": "array", "items": g.schema(t.Elem())}
+		if t.Kind() == reflect.Array {
+			schema["minItems"] = t.Len()
+			schema["maxItems"] = t.Len()
+		}
+		return schema
+	case reflect.Map:
+		return map[string]interface{}{"type": "object", "additionalProperties": g.schema(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		name, ok := g.names[t]
+		if !ok {
+			name = g.defName(t)
+			g.names[t] = name
+			// Defined first for recursive references.
+			g.defs[name] = nil
+			g.defs[name] = g.structSchema(t)
+		}
+		return map[string]interface{}{"$ref": g.prefix + name}
+	}
+	// Interfaces and anything else.
+	return map[string]interface{}{}
+}
+
+// defName returns the name of the definition of named struct t.
+func (g *schemaGenerator) defName(t reflect.Type) string {
+	name := t.Name()
+	if _, taken := g.defs[name]; taken {
+		name = strings.ReplaceAll(t.PkgPath(), "/", ".") + "." + name
+	}
+	return name
+}
+
+// structSchema returns the schema of the object encoding struct t.
+func (g *schemaGenerator) structSchema(t reflect.Type) map[string]interface{} {
+	properties := make(map[string]interface{})
+	var required []string
+	for _, p := range g.properties(t) {
+		properties[p.name] = p.schema
+		if p.required {
+			required = append(required, p.name)
+		}
+	}
+	schema := map[string]interface{}{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// properties returns the properties of the object encoding struct t, in the
+// order of the fields, promoting those of embedded structs.
+func (g *schemaGenerator) properties(t reflect.Type) []propertySchema {
+	var properties []propertySchema
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name := strings.Split(tag, ",")[0]
+		if name == "" {
+			if f.Anonymous && indirect(f.Type).Kind() == reflect.Struct {
+				properties = append(properties, g.properties(indirect(f.Type))...)
+				continue
+			}
+			if f.PkgPath != "" {
+				continue
+			}
+			name = f.Name
+		}
+		p := propertySchema{name: name, schema: g.schema(f.Type)}
+		if tag, ok := f.Tag.Lookup("rpc"); ok {
+			if rules, err := parseRules(tag, f.Type); err == nil {
+				p.schema = rules.schema(p.schema, indirect(f.Type).Kind())
+				p.required = rules.required
+			}
+		}
+		properties = append(properties, p)
+	}
+	return properties
+}
+
+// schema returns schema with the keywords of the rules of a field of kind.
+func (r *fieldRules) schema(schema map[string]interface{}, kind reflect.Kind) map[string]interface{} {
+	if r.min == nil && r.max == nil && r.pattern == nil {
+		return schema
+	}
+	if _, ok := schema["$ref"]; ok {
+		// Keywords applied along with a reference.
+		schema = map[string]interface{}{"allOf": []interface{}{schema}}
+	} else {
+		copied := make(map[string]interface{}, len(schema)+2)
+		for k, v := range schema {
+			copied[k] = v
+		}
+		schema = copied
+	}
+	minKey, maxKey := "minimum", "maximum"
+	switch kind {
+	case reflect.String:
+		minKey, maxKey = "minLength", "maxLength"
+	case reflect.Slice, reflect.Array:
+		minKey, maxKey = "minItems", "maxItems"
+	case reflect.Map:
+		minKey, maxKey = "minProperties", "maxProperties"
+	}
+	if r.min != nil {
+		schema[minKey] = *r.min
+	}
+	if r.max != nil {
+		schema[maxKey] = *r.max
+	}
+	if r.pattern != nil {
+		schema["pattern"] = r.pattern.String()
+	}
+	return schema
+}
@@ -0,0 +1,132 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Serving
+// ----------------------------------------------------------------------------
+
+// ShutdownTimeout bounds the graceful shutdown of the listeners run by Serve.
+var ShutdownTimeout = 30 * time.Second
+
+// Listener is a transport exposing the services of a Server.
+type Listener interface {
+	// Serve accepts connections and serves them with s. It blocks until
+	// the listener fails or Shutdown is called, in which case it returns nil.
+	Serve(s *Server) error
+	// Shutdown stops accepting connections and waits for the active ones
+	// to finish, or for ctx to be done.
+	Shutdown(ctx context.Context) error
+}
+
+// Serve runs all listeners concurrently against s until ctx is done or one
+// of them fails, then shuts all of them down gracefully. The services are
+// initialized meanwhile, see Start, whose failure also ends the serving.
+//
+// It returns the first listener or initialization error, or nil if ctx
+// ended the serving.
+func Serve(ctx context.Context, s *Server, listeners ...Listener) error {
+	errc := make(chan error, len(listeners))
+	for _, l := range listeners {
+		go func(l Listener) {
+			errc <- l.Serve(s)
+		}(l)
+	}
+	started := make(chan error, 1)
+	go func() {
+		if err := s.Start(ctx); err != nil {
+			started <- err
+		}
+	}()
+
+	var err error
+	running := len(listeners)
+	select {
+	case <-ctx.Done():
+	case err = <-errc:
+		running--
+	case err = <-started:
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), ShutdownTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, l := range listeners {
+		wg.Add(1)
+		go func(l Listener) {
+			defer wg.Done()
+			l.Shutdown(shutdownCtx)
+		}(l)
+	}
+	wg.Wait()
+	for ; running > 0; running-- {
+		if e := <-errc; err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// HTTPListener serves a Server over HTTP.
+type HTTPListener struct {
+	// Listener accepts the connections.
+	Listener net.Listener
+	// Handler serves the requests. If nil, the Server itself is used.
+	Handler http.Handler
+	// Timeouts applied to the underlying http.Server.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	IdleTimeout  time.Duration
+
+	mutex  sync.Mutex
+	server *http.Server
+	closed bool
+}
+
+// Serve implements Listener.
+func (l *HTTPListener) Serve(s *Server) error {
+	handler := l.Handler
+	if handler == nil {
+		handler = s
+	}
+	l.mutex.Lock()
+	if l.closed {
+		l.mutex.Unlock()
+		return nil
+	}
+	l.server = &http.Server{
+		Handler:      handler,
+		ReadTimeout:  l.ReadTimeout,
+		WriteTimeout: l.WriteTimeout,
+		IdleTimeout:  l.IdleTimeout,
+	}
+	srv := l.server
+	l.mutex.Unlock()
+
+	if err := srv.Serve(l.Listener); err != http.ErrServerClosed {
+		return err
+	}
+	return nil
+}
+
+// Shutdown implements Listener.
+func (l *HTTPListener) Shutdown(ctx context.Context) error {
+	l.mutex.Lock()
+	l.closed = true
+	srv := l.server
+	l.mutex.Unlock()
+	if srv == nil {
+		return l.Listener.Close()
+	}
+	return srv.Shutdown(ctx)
+}
@@ -6,12 +6,17 @@
 package rpc
 
 import (
-	"bytes"
+	"context"
 	"fmt"
 	"io"
 	"net/http"
 	"reflect"
+	"runtime/pprof"
+	"runtime/trace"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // ----------------------------------------------------------------------------
@@ -44,6 +49,13 @@ type CodecRequest interface {
 	Error() error
 }
 
+// MethodRenamer is implemented by codec requests keying settings on the
+// method name, such as field aliases, to be given the registered name of a
+// method called in lowerCamel before the request is read.
+type MethodRenamer interface {
+	RenameMethod(method string)
+}
+
 // ----------------------------------------------------------------------------
 // Server
 // ----------------------------------------------------------------------------
@@ -53,6 +65,9 @@ func NewServer() *Server {
 	return &Server{
 		codecs:   make(map[string]Codec),
 		services: new(serviceMap),
+		clock:    SystemClock,
+		ids:      RandomIDGenerator,
+		config:   new(Config),
 	}
 }
 
@@ -60,6 +75,66 @@ func NewServer() *Server {
 type Server struct {
 	codecs   map[string]Codec
 	services *serviceMap
+	clock    Clock
+	ids      IDGenerator
+
+	configMutex      sync.RWMutex
+	config           *Config
+	configValidators []func(*Config) error
+
+	profileMutex sync.Mutex
+	profileRates map[string]float64
+	profileSink  func(*Profile)
+
+	chunkThreshold    int64
+	chunkSize         int
+	batchConcurrency  int
+	maxBatchSize      int64 // accessed atomically
+	abortBatchOnError bool
+	strictReplies     bool
+	strictErrorCodes  bool
+	openRPCInfo       OpenRPCInfo
+	healthGate        bool
+	replicaOf         string
+	errorStatuses     map[int]int
+
+	metrics  Metrics
+	logger   Logger
+	logLevel int64
+	chaos    *Chaos
+	recorder Recorder
+
+	callerFunc func(*http.Request) string
+	deps       dependencyGraph
+	ordering   callerOrdering
+	catalog    catalog
+	adaptive   adaptiveLimits
+
+	retiredMutex sync.Mutex
+	retired      map[string]Retirement
+
+	usage      usageTracker
+	replyCache *replyCache
+	admission  admission
+	admin      *AdminService
+
+	adminSeparate bool // admin service only served by the AdminHandler
+
+	middleware       []Middleware
+	replyProcessors  []ReplyProcessor
+	requestRewriters []RequestRewriter
+	bodyReader       BodyReader
+	responseDigest   bool
+	panicHandler     PanicHandler
+	events           eventHub
+	subscriptions    subscriptionHub
+	streams          streamHub
+	groups           groupTracker
+	hardTimeout      time.Duration
+	stuck            stuckCalls
+	policies         resourcePolicies
+	lifecycle        lifecycle
+	shards           *shards
 }
 
 // RegisterCodec adds a new codec to the server.
@@ -71,6 +146,37 @@ func (s *Server) RegisterCodec(codec Codec, contentType string) {
 	s.codecs[strings.ToLower(contentType)] = codec
 }
 
+// SetAbortBatchOnError restores the former batch behavior: when a request
+// names an unknown method or has params that can't be decoded, no reply at
+// all is written for the batch. By default such a request gets its own
+// error reply and the rest of the batch is processed.
+func (s *Server) SetAbortBatchOnError(abort bool) {
+	s.abortBatchOnError = abort
+}
+
+// SetClock sets the clock used by the server for all time measurements.
+//
+// It is intended for tests; the default is SystemClock.
+func (s *Server) SetClock(clock Clock) {
+	s.clock = clock
+}
+
+// Clock returns the clock used by the server.
+func (s *Server) Clock() Clock {
+	return s.clock
+}
+
+// SetIDGenerator sets the generator used for every id handed out by the
+// server. The default is RandomIDGenerator.
+func (s *Server) SetIDGenerator(ids IDGenerator) {
+	s.ids = ids
+}
+
+// NewID returns a new id from the server's IDGenerator.
+func (s *Server) NewID() string {
+	return s.ids.NewID()
+}
+
 // RegisterService adds a new service to the server.
 //
 // The name parameter is optional: if empty it will be inferred from
@@ -82,20 +188,53 @@ func (s *Server) RegisterCodec(codec Codec, contentType string) {
 //      (defined in the package registering the service).
 //    - The method name is exported.
 //    - The method has three arguments: *http.Request, *args, *reply.
-//    - All three arguments are pointers.
-//    - The second and third arguments are exported or local.
-//    - The method has return type error.
+//      The request may be preceded or replaced by a context.Context,
+//      which is the context of the request.
+//    - The *http.Request, *args and *reply arguments are pointers.
+//    - The *args and *reply arguments are exported or local.
+//    - The method has return type error, or returns (*reply, error)
+//      instead of taking the reply argument.
+//
+// All other methods are ignored, as are those excluded with the options or
+// by a receiver implementing MethodExcluder.
+//
+// The args and reply types of the methods are checked for values that can't
+// be encoded or decoded, such as channels or fields encoding to the same
+// name; a *RegistrationError reports all the problems found.
+func (s *Server) RegisterService(receiver interface{}, name string, opts ...ServiceOption) error {
+	var options serviceOptions
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if err := s.services.register(receiver, name, options); err != nil {
+		return err
+	}
+	s.catalogChanged(false)
+	return nil
+}
+
+// RegisterFunc adds a function as a method, in dotted notation as in
+// "Service.Method", without a receiver. The function follows the rules of
+// RegisterService for methods, as in:
+//
+//	func(ctx context.Context, args *Args) (*Reply, error)
 //
-// All other methods are ignored.
-func (s *Server) RegisterService(receiver interface{}, name string) error {
-	return s.services.register(receiver, name)
+// The method name isn't required to be exported. The service is created if
+// needed, and may hold other functions but not a receiver.
+func (s *Server) RegisterFunc(method string, fn interface{}) error {
+	if err := s.services.registerFunc(method, fn); err != nil {
+		return err
+	}
+	s.catalogChanged(false)
+	return nil
 }
 
 // HasMethod returns true if the given method is registered.
 //
-// The method uses a dotted notation as in "Service.Method".
+// The method uses a dotted notation as in "Service.Method", with the method
+// name possibly in lowerCamel as when called.
 func (s *Server) HasMethod(method string) bool {
-	if _, _, err := s.services.get(method); err == nil {
+	if _, _, err := s.services.get(s.services.canonical(method)); err == nil {
 		return true
 	}
 	return false
@@ -110,10 +249,27 @@ func (nopCloser) Close() error { return nil }
 
 // ServeHTTP
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.recorder != nil && r.Method == "POST" {
+		s.record(w, r, s.serveHTTP)
+		return
+	}
+	s.serveHTTP(w, r)
+}
+
+// serveHTTP decodes the request, dispatches each of its calls and writes
+// the replies.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request) {
 	if r.Method != "POST" {
 		WriteError(w, 405, "rpc: POST method required, received "+r.Method)
 		return
 	}
+	if s.bodyReader != nil || len(s.requestRewriters) > 0 {
+		var err error
+		if r, err = s.rewriteRequest(r); err != nil {
+			WriteError(w, 400, err.Error())
+			return
+		}
+	}
 	contentType := r.Header.Get("Content-Type")
 	idx := strings.Index(contentType, ";")
 	if idx != -1 {
@@ -124,6 +280,38 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		WriteError(w, 415, "rpc: unrecognized Content-Type: "+contentType)
 		return
 	}
+	// Prevents Internet Explorer from MIME-sniffing a response away
+	// from the declared content-type
+	w.Header().Set("x-content-type-options", "nosniff")
+
+	done, err := s.awaitTurn(r)
+	if err != nil {
+		if r.Context().Err() == nil {
+			s.rejectBatch(w, r, codec, http.StatusTooManyRequests, err)
+		}
+		return
+	}
+	defer done()
+
+	if streamCodec, ok := codec.(StreamCodec); ok && s.streamable(r) {
+		w.Header().Set("Trailer", StatusTrailer)
+		stream, err := streamCodec.NewStream(r, w)
+		if err != nil {
+			w.Header().Del("Trailer")
+			WriteError(w, 400, "Failed to parse the body as valid JSONRPC 2.0 request")
+			return
+		}
+		if stream != nil {
+			status := "200"
+			if !s.serveStream(r, codec, stream) {
+				status = "500"
+			}
+			w.Header().Set(StatusTrailer, status)
+			return
+		}
+		w.Header().Del("Trailer")
+	}
+
 	// Create a new codec request.
 	codecReqArray, err := codec.NewRequest(r)
 
@@ -133,75 +321,330 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	}
 
 	queryCount := len(codecReqArray)
+	if limit := s.batchSizeLimit(); limit > 0 && queryCount > limit {
+		s.rejectBatch(w, r, codec, http.StatusRequestEntityTooLarge, batchTooLarge(limit))
+		return
+	}
+	caller := s.Caller(r)
+	maxSize, concurrency := s.BatchLimits(caller)
+	if maxSize > 0 && queryCount > maxSize {
+		s.recordBatch(caller, queryCount, queryCount, r.ContentLength)
+		s.rejectBatch(w, r, codec, http.StatusRequestEntityTooLarge, batchTooLarge(maxSize))
+		return
+	}
 
-	// Prevents Internet Explorer from MIME-sniffing a response away
-	// from the declared content-type
-	w.Header().Set("x-content-type-options", "nosniff")
+	if s.metrics != nil {
+		s.metrics.BatchStarted(queryCount)
+		defer s.metrics.BatchDone(queryCount)
+	}
+	b := &batch{single: queryCount == 1, concurrency: concurrency}
+	codecRepArray, ok := s.serveRequests(r, codecReqArray, b)
+	s.recordBatch(caller, queryCount, int(atomic.LoadInt32(&b.failed)), r.ContentLength)
+	if !ok {
+		return
+	}
 
-	codecRepArray := make([]interface{}, queryCount)
+	for k, v := range b.header {
+		w.Header()[k] = v
+	}
+	// The reply is built before anything is sent, so that a codec failing
+	// halfway can still answer with an error.
+	builder := &responseBuilder{w: w, digest: s.responseDigest}
+	w = builder
+	if b.truncate {
+		w = &truncatingWriter{ResponseWriter: w}
+	}
+	codec.WriteBatchedReply(r, w, compactReplies(codecRepArray))
+	if b.err != nil && s.errorStatuses != nil {
+		s.applyErrorStatus(builder, b.err)
+	}
+	builder.commit()
+}
 
-	for i, codecReq := range codecReqArray {
+// batch holds the state shared by the requests of a batch.
+type batch struct {
+	mutex sync.Mutex
+	// truncate is set when chaos requires the response to be truncated.
+	truncate bool
+	// single is set when the batch holds a single request, whose headers
+	// set by the handler go in header.
+	single bool
+	header http.Header
+	// concurrency overrides the batch concurrency of the server.
+	concurrency int
+	// failed counts the calls replied with an error.
+	failed int32
+	// err is the error of a single request.
+	err error
+}
 
-		// if queryCount > 1 && i == 0 {
-		// 	w.Write([]byte("["))
-		// }
-		errParse := codecReq.Error()
-		if errParse != nil {
-			codecRepArray[i] = codecReq.ErrorReply(errParse)
-			continue
+// compactReplies removes the replies dropped from a batch.
+func compactReplies(replies []interface{}) []interface{} {
+	compacted := replies[:0]
+	for _, reply := range replies {
+		if reply != nil {
+			compacted = append(compacted, reply)
 		}
+	}
+	return compacted
+}
 
-		// Get service method to be called.
-		method, errMethod := codecReq.Method()
-		if errMethod != nil {
-			//codecReq.WriteError(w, 400, errMethod)
-			codecRepArray[i] = codecReq.ErrorReply(errMethod)
-			return
-		}
-		serviceSpec, methodSpec, errGet := s.services.get(method)
-		if errGet != nil {
-			//codecReq.WriteError(w, 400, errGet)
-			codecRepArray[i] = codecReq.ErrorReply(errGet)
-			return
+// serveRequest processes a single request of a batch and returns its reply,
+// or nil if the reply must be dropped.
+//
+// It returns false if processing of the whole batch must be aborted, which
+// only happens with SetAbortBatchOnError.
+func (s *Server) serveRequest(r *http.Request, codecReq CodecRequest, b *batch) (interface{}, bool) {
+	var method string
+	var err error
+	var directives *replyDirectives
+	if s.metrics != nil || s.logger != nil {
+		start := s.clock.Now()
+		defer func() {
+			elapsed := s.clock.Now().Sub(start)
+			if s.metrics != nil {
+				name := method
+				if !s.knownMethod(name) {
+					name = ""
+				}
+				s.metrics.CallDone(name, err, elapsed)
+			}
+			s.logCall(method, err, elapsed, directives.profile())
+		}()
+	}
+
+	defer func() {
+		if err != nil {
+			atomic.AddInt32(&b.failed, 1)
+			if b.single {
+				b.err = err
+			}
 		}
-		// Decode the args.
-		args := reflect.New(methodSpec.argsType)
-		if errRead := codecReq.ReadRequest(args.Interface()); errRead != nil {
-			//codecReq.WriteError(w, 400, errRead)
-			codecRepArray[i] = codecReq.ErrorReply(errRead)
-			return
+	}()
+
+	err = codecReq.Error()
+	if err != nil {
+		return codecReq.ErrorReply(err), true
+	}
+
+	// Get service method to be called.
+	method, err = codecReq.Method()
+	if err != nil {
+		return codecReq.ErrorReply(err), !s.abortBatchOnError
+	}
+	if canonical := s.services.canonical(method); canonical != method {
+		method = canonical
+		if renamer, ok := codecReq.(MethodRenamer); ok {
+			renamer.RenameMethod(method)
 		}
+	}
+	s.trackUsage(r, method)
+	if err = s.retiredError(method); err != nil {
+		return codecReq.ErrorReply(err), true
+	}
+	if err = s.adminRouteError(r, method); err != nil {
+		return codecReq.ErrorReply(err), !s.abortBatchOnError
+	}
+	if err = s.authError(r, method); err != nil {
+		return codecReq.ErrorReply(err), true
+	}
+	release, err := s.admit(method)
+	if err != nil {
+		return codecReq.ErrorReply(err), true
+	}
+	defer release()
+	serviceSpec, methodSpec, err := s.services.get(method)
+	if err != nil {
+		err = &Error{Code: CodeMethodNotFound, Message: err.Error()}
+		return codecReq.ErrorReply(err), !s.abortBatchOnError
+	}
+	// Decode the args.
+	args := reflect.New(methodSpec.argsType)
+	if err = codecReq.ReadRequest(args.Interface()); err != nil {
+		return codecReq.ErrorReply(err), !s.abortBatchOnError
+	}
+	if err = validateArgs(r, args.Interface()); err != nil {
+		return codecReq.ErrorReply(err), true
+	}
 
-		//Jason: restore body for further auth check
-		r.Body = nopCloser{bytes.NewBuffer(codecReq.Body())}
+	r, directives = withDirectives(r)
+	r, extensions := withExtensions(r, codecReq)
+	if r, err = withIfMatch(r, extensions); err != nil {
+		return codecReq.ErrorReply(err), true
+	}
+	r = s.withConnection(r)
+	latency, chaosErr, drop, truncate := s.chaos.roll(method)
+	if truncate {
+		b.mutex.Lock()
+		b.truncate = true
+		b.mutex.Unlock()
+	}
+	if latency > 0 {
+		<-s.clock.After(latency)
+	}
 
-		// Call the service method.
+	// Call the service method through the middleware.
+	cacheKey, cacheable := s.cacheKey(r, codecReq)
+	cached := false
+	handler := s.chain(func(call *MethodCall) (interface{}, error) {
+		if cacheable {
+			if reply, ttl, ok := s.replyCache.get(cacheKey, s.clock.Now()); ok {
+				directives.cacheTTL = ttl
+				cached = true
+				return reply, nil
+			}
+		}
+		if chaosErr != nil {
+			return nil, chaosErr
+		}
 		reply := reflect.New(methodSpec.replyType)
-		errValue := methodSpec.method.Func.Call([]reflect.Value{
-			serviceSpec.rcvr,
-			reflect.ValueOf(r),
-			args,
-			reply,
-		})
-		// Cast the result to error if needed.
-		var errResult error
-		errInter := errValue[0].Interface()
-		if errInter != nil {
-			errResult = errInter.(error)
+		if err := s.call(call.Request, call.Method, serviceSpec, methodSpec, reflect.ValueOf(call.Args), reply); err != nil {
+			if s.strictErrorCodes {
+				err = checkErrorCode(err)
+			}
+			return nil, err
+		}
+		if s.strictReplies {
+			if err := validateReply(reply); err != nil {
+				return nil, err
+			}
 		}
+		return reply.Interface(), nil
+	})
+	reply, err := handler(&MethodCall{Method: method, Args: args.Interface(), Request: r, Body: codecReq.Body(), Extensions: extensions})
+	if drop {
+		return nil, true
+	}
+
+	// Encode the response.
+	if err == nil {
+		if cacheable && !cached && directives.cacheTTL > 0 {
+			s.replyCache.put(cacheKey, reply, s.clock.Now().Add(directives.cacheTTL))
+		}
+		reply = s.processReply(method, reply)
+		return applyDirectives(directives, codecReq, codecReq.ResponseReply(reply), b), true
+	}
+	return applyDirectives(directives, codecReq, codecReq.ErrorReply(err), b), true
+}
+
+// call invokes a service method with the decoded args, filling reply, on
+// its shard if the args have a ShardKey, and abandoning it past its
+// deadline in hard timeout mode. Calls to unhealthy services are rejected
+// with the health gate, the service is initialized first if needed, and
+// the args and reply are checked against the resource policy
+// of the method.
+//
+// The handler runs with profiler labels identifying the method, service and
+// caller, and within a runtime/trace region when tracing is enabled.
+func (s *Server) call(r *http.Request, method string, serviceSpec *service, methodSpec *serviceMethod, args, reply reflect.Value) error {
+	if err := s.replicaError(serviceSpec, methodSpec); err != nil {
+		return err
+	}
+	if err := s.healthError(serviceSpec); err != nil {
+		return err
+	}
+	if err := s.initialized(r, serviceSpec); err != nil {
+		return err
+	}
+	r, policy, err := s.withPolicy(r, method, args)
+	if err != nil {
+		return err
+	}
+	if s.hardTimeout > 0 {
+		err = s.callAbortable(r, method, args, reply, func(r *http.Request, args, reply reflect.Value) error {
+			return s.dispatch(r, method, serviceSpec, methodSpec, args, reply)
+		})
+	} else {
+		err = s.dispatch(r, method, serviceSpec, methodSpec, args, reply)
+	}
+	if err != nil {
+		return err
+	}
+	return checkElements(reply, "reply", policy.MaxReplyElements)
+}
 
-		// Encode the response.
-		if errResult == nil {
-			codecRepArray[i] = codecReq.ResponseReply(reply.Interface())
-		} else {
-			codecRepArray[i] = codecReq.ErrorReply(errResult)
+// dispatch invokes a service method on its shard, if any.
+func (s *Server) dispatch(r *http.Request, method string, serviceSpec *service, methodSpec *serviceMethod, args, reply reflect.Value) error {
+	var err error
+	if keyer, ok := args.Interface().(ShardKeyer); ok && s.shards != nil {
+		shardErr := s.shards.do(r.Context(), keyer.ShardKey(), func(ctx context.Context) {
+			err = s.callLabeled(r.WithContext(ctx), method, serviceSpec, methodSpec, args, reply)
+		})
+		if shardErr != nil {
+			return shardErr
 		}
+		return err
 	}
+	return s.callLabeled(r, method, serviceSpec, methodSpec, args, reply)
+}
+
+// callLabeled invokes a service method with profiler labels and tracing.
+func (s *Server) callLabeled(r *http.Request, method string, serviceSpec *service, methodSpec *serviceMethod, args, reply reflect.Value) error {
+	var err error
+	labels := pprof.Labels("rpc.method", method, "rpc.service", serviceSpec.name, "rpc.caller", s.Caller(r))
+	pprof.Do(r.Context(), labels, func(ctx context.Context) {
+		ctx = context.WithValue(ctx, callFrameKey{}, method)
+		ctx = context.WithValue(ctx, serverKey{}, s)
+		r = r.WithContext(ctx)
+		invoke := func() {
+			defer s.recoverPanic(r, method, &err)
+			if sink, ok := s.sampleProfile(method); ok {
+				err = s.profileCall(r.Context(), method, sink, func() error {
+					return s.invoke(r, serviceSpec, methodSpec, args, reply)
+				})
+				return
+			}
+			err = s.invoke(r, serviceSpec, methodSpec, args, reply)
+		}
+		if trace.IsEnabled() {
+			trace.WithRegion(ctx, "rpc "+method, invoke)
+			return
+		}
+		invoke()
+	})
+	return err
+}
 
-	codec.WriteBatchedReply(r, w, codecRepArray)
+// invoke calls the service method, through reflection unless it was
+// registered with Register.
+func (s *Server) invoke(r *http.Request, serviceSpec *service, methodSpec *serviceMethod, args, reply reflect.Value) error {
+	if methodSpec.call != nil {
+		return methodSpec.call(r.Context(), args.Interface(), reply.Interface())
+	}
+	fn := methodSpec.fn
+	var in []reflect.Value
+	if !fn.IsValid() {
+		fn = methodSpec.method.Func
+		in = append(in, serviceSpec.rcvr)
+	}
+	if methodSpec.ctx {
+		in = append(in, reflect.ValueOf(r.Context()))
+	}
+	if methodSpec.req {
+		in = append(in, reflect.ValueOf(r))
+	}
+	in = append(in, args)
+	if !methodSpec.returns {
+		in = append(in, reply)
+	}
+	out := fn.Call(in)
+	if methodSpec.returns && !out[0].IsNil() {
+		reply.Elem().Set(out[0].Elem())
+	}
+	// Cast the result to error if needed.
+	var errResult error
+	errInter := out[len(out)-1].Interface()
+	if errInter != nil {
+		errResult = errInter.(error)
+	}
+	return errResult
 }
 
 func WriteError(w http.ResponseWriter, status int, msg string) {
+	if b, ok := w.(*responseBuilder); ok {
+		// Replace whatever was written of the reply, unless it was sent.
+		b.reset()
+	}
 	w.WriteHeader(status)
 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
 	fmt.Fprint(w, msg)
@@ -6,8 +6,29 @@
 package rpc
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"runtime/pprof"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 type Service1Request struct {
@@ -52,3 +73,1583 @@ func TestRegisterService(t *testing.T) {
 		t.Errorf("Expected error on service2")
 	}
 }
+
+func TestManualClock(t *testing.T) {
+	start := time.Date(2012, 1, 1, 0, 0, 0, 0, time.UTC)
+	c := NewManualClock(start)
+	fired := c.After(time.Second)
+
+	c.Advance(500 * time.Millisecond)
+	select {
+	case <-fired:
+		t.Fatal("Expected timer not to fire before its deadline")
+	default:
+	}
+	c.Advance(500 * time.Millisecond)
+	select {
+	case now := <-fired:
+		if !now.Equal(start.Add(time.Second)) {
+			t.Errorf("Wrong fire time: %v", now)
+		}
+	default:
+		t.Fatal("Expected timer to fire at its deadline")
+	}
+}
+
+func TestDescribeMethod(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	doc := MethodDoc{
+		Description: "Multiplies A by B.",
+		Examples:    []MethodExample{{Params: Service1Request{4, 2}, Result: Service1Response{8}}},
+	}
+	if err := s.DescribeMethod("Service1.Multiply", doc); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DescribeMethod("Service1.Divide", doc); err == nil {
+		t.Error("Expected error describing an unknown method")
+	}
+	var buf bytes.Buffer
+	if err := s.WriteMarkdown(&buf); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(buf.String(), "## Service1.Multiply") ||
+		!strings.Contains(buf.String(), "Multiplies A by B.") {
+		t.Errorf("Unexpected markdown:\n%s", buf.String())
+	}
+}
+
+func TestServe(t *testing.T) {
+	s := NewServer()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- Serve(ctx, s, &HTTPListener{Listener: l})
+	}()
+
+	res, err := http.Get("http://" + l.Addr().String() + "/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", res.StatusCode)
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+}
+
+func TestIDGenerators(t *testing.T) {
+	for _, prefix := range []string{"", "sub-"} {
+		g := NewSequentialIDGenerator(prefix)
+		for i := 1; i <= 3; i++ {
+			if id, want := g.NewID(), fmt.Sprintf("%s%d", prefix, i); id != want {
+				t.Errorf("Expected %q, got %q", want, id)
+			}
+		}
+	}
+
+	clock := NewManualClock(time.UnixMilli(1700000000000))
+	g := NewUUIDv7Generator(clock)
+	format := regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-7[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+	last := ""
+	// More ids than the counter holds in the same millisecond, then a
+	// clock going back.
+	for i := 0; i < 5000; i++ {
+		if i == 4500 {
+			clock.Advance(-time.Second)
+		}
+		id := g.NewID()
+		if !format.MatchString(id) {
+			t.Fatalf("Expected a UUIDv7, got %q", id)
+		}
+		if id <= last {
+			t.Fatalf("Expected ids to increase, got %q after %q", id, last)
+		}
+		last = id
+	}
+	if prefix := fmt.Sprintf("%012x", 1700000000000); strings.ReplaceAll(g.NewID(), "-", "")[:12] <= prefix {
+		t.Errorf("Expected the timestamp to move on past %s", prefix)
+	}
+}
+
+func TestSetConfig(t *testing.T) {
+	s := NewServer()
+	s.AddConfigValidator(func(cfg *Config) error {
+		if cfg.Flags["broken"] {
+			return errors.New("broken flag set")
+		}
+		return nil
+	})
+	if err := s.SetConfig(&Config{Flags: map[string]bool{"beta": true}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetConfig(&Config{Flags: map[string]bool{"broken": true}}); err == nil {
+		t.Error("Expected invalid config to be rejected")
+	}
+	if !s.FeatureEnabled("beta") || s.FeatureEnabled("broken") {
+		t.Error("Expected rejected config not to replace the current one")
+	}
+
+	cfg := &Config{
+		MaxBatchSize: 2,
+		RateLimits:   map[string]RateLimit{"*": {Rate: 10, Burst: 5}},
+		AuthKeys:     []string{"secret"},
+		LogLevel:     "warn",
+	}
+	if err := s.SetConfig(cfg); err != nil {
+		t.Fatal(err)
+	}
+	rateLimit := func(method string) RateLimit {
+		s.admission.mutex.Lock()
+		defer s.admission.mutex.Unlock()
+		if bucket := s.admission.limits[method]; bucket != nil {
+			return bucket.RateLimit
+		}
+		return RateLimit{}
+	}
+	for _, bad := range []*Config{
+		{MaxBatchSize: 8, LogLevel: "loud"},
+		{MaxBatchSize: -1},
+		{MaxBatchSize: 8, RateLimits: map[string]RateLimit{"*": {Rate: -1}}},
+		{MaxBatchSize: 8, AuthKeys: []string{""}},
+	} {
+		if err := s.SetConfig(bad); err == nil {
+			t.Errorf("Expected %+v to be rejected", bad)
+		}
+	}
+	if s.batchSizeLimit() != 2 || rateLimit("*") != (RateLimit{Rate: 10, Burst: 5}) || s.LogLevel() != LevelWarn {
+		t.Errorf("Expected rejected configs to leave the limits, got %d, %+v, %v",
+			s.batchSizeLimit(), rateLimit("*"), s.LogLevel())
+	}
+	r, _ := http.NewRequest("POST", "/", nil)
+	if err := s.authError(r, "Service1.Multiply"); err == nil {
+		t.Error("Expected a call without key to be unauthorized")
+	}
+	r.Header.Set("Authorization", "Bearer secret")
+	if err := s.authError(r, "Service1.Multiply"); err != nil {
+		t.Errorf("Expected a call with a key to be authorized, got %v", err)
+	}
+
+	// The settings dropped from the config are reset, the others kept.
+	s.SetRateLimit("Service1.Multiply", 1, 1)
+	if err := s.SetConfig(&Config{}); err != nil {
+		t.Fatal(err)
+	}
+	if s.batchSizeLimit() != 0 || rateLimit("*") != (RateLimit{}) || rateLimit("Service1.Multiply").Rate != 1 {
+		t.Errorf("Unexpected limits after reload: %d, %+v", s.batchSizeLimit(), rateLimit("*"))
+	}
+	if err := s.authError(r, "Service1.Multiply"); err != nil || s.LogLevel() != LevelWarn {
+		t.Errorf("Expected no auth and the level kept, got %v, %v", err, s.LogLevel())
+	}
+}
+
+type lineWriter struct {
+	lines []string
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.lines = append(w.lines, string(p))
+	return len(p), nil
+}
+
+func TestStatsDMetrics(t *testing.T) {
+	w := new(lineWriter)
+	m := NewStatsDMetrics(w, "rpc.")
+	m.CallDone("Service1.Multiply", nil, 1500*time.Microsecond)
+	m.DogStatsD = true
+	m.Tags = []string{"env:test"}
+	m.CallDone("Service1.Multiply", errors.New("failed"), time.Millisecond)
+	m.Tags = nil
+	m.CallDone("A.b|c,d:e#f", nil, time.Millisecond)
+
+	expected := []string{
+		"rpc.calls.Service1_Multiply.ok:1|c",
+		"rpc.call_time.Service1_Multiply:1.5|ms",
+		"rpc.calls:1|c|#env:test,method:Service1.Multiply,code:uncoded",
+		"rpc.call_time:1|ms|#env:test,method:Service1.Multiply",
+		"rpc.calls:1|c|#method:A.b_c_d:e_f,code:ok",
+		"rpc.call_time:1|ms|#method:A.b_c_d:e_f",
+	}
+	if strings.Join(w.lines, "\n") != strings.Join(expected, "\n") {
+		t.Errorf("Unexpected metrics:\n%s", strings.Join(w.lines, "\n"))
+	}
+}
+
+func TestSlogLogger(t *testing.T) {
+	var buf bytes.Buffer
+	s := NewServer()
+	s.SetLogger(NewSlogLogger(slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))), LevelInfo)
+
+	s.logCall("Service1.Multiply", nil, time.Millisecond, "")
+	if buf.Len() != 0 {
+		t.Errorf("Expected debug entry to be filtered, got %q", buf.String())
+	}
+	s.SetLogLevel(LevelDebug)
+	s.logCall("Service1.Multiply", nil, time.Millisecond, "p1")
+	if !strings.Contains(buf.String(), "rpc.method=Service1.Multiply") || !strings.Contains(buf.String(), "rpc.profile_id=p1") {
+		t.Errorf("Unexpected log entry: %q", buf.String())
+	}
+}
+
+func TestProfileSampling(t *testing.T) {
+	s := NewServer()
+	s.RegisterFunc("Prof.Panic", func(ctx context.Context, args *int) (*int, error) { panic("boom") })
+	s.SetProfileSink(func(*Profile) {})
+	s.SetProfileSampling("Prof.Panic", 1)
+	if rates := s.ProfileSampling(); rates["Prof.Panic"] != 1 {
+		t.Errorf("Expected the sampling rate, got %v", rates)
+	}
+	var n int
+	if err := s.Call(context.Background(), "Prof.Panic", 1, &n); err == nil {
+		t.Error("Expected the panic to fail the call")
+	}
+	// The CPU profiler is stopped despite the panic.
+	if err := pprof.StartCPUProfile(io.Discard); err != nil {
+		t.Errorf("Expected the CPU profiler stopped, got %v", err)
+	} else {
+		pprof.StopCPUProfile()
+	}
+}
+
+type Service3 struct {
+	server *Server
+}
+
+func (t *Service3) Square(r *http.Request, req *Service1Request, res *Service1Response) error {
+	return t.server.Call(r.Context(), "Service1.Multiply", &Service1Request{req.A, req.A}, res)
+}
+
+func TestCall(t *testing.T) {
+	s := NewServer()
+	s.RegisterService(new(Service1), "")
+	s.RegisterService(&Service3{s}, "")
+
+	var res Service1Response
+	if err := s.Call(context.Background(), "Service3.Square", Service1Request{A: 3}, &res); err != nil {
+		t.Fatal(err)
+	}
+	if res.Result != 9 {
+		t.Errorf("Wrong response: %v.", res.Result)
+	}
+	if err := s.Call(context.Background(), "Service3.Square", 3, &res); err == nil {
+		t.Error("Expected error for wrong args type")
+	}
+	if err := s.Call(context.Background(), "Service3.Square", nil, &res); err == nil {
+		t.Error("Expected error for nil args")
+	}
+	if err := s.Call(context.Background(), "Service3.Square", (*Service1Request)(nil), &res); err == nil {
+		t.Error("Expected error for nil args pointer")
+	}
+	if err := s.Call(context.Background(), "Service3.Square", &Service1Request{A: 3}, nil); err == nil {
+		t.Error("Expected error for nil reply")
+	}
+	if err := s.Call(context.Background(), "Service3.Square", &Service1Request{A: 3}, res); err == nil {
+		t.Error("Expected error for non-pointer reply")
+	}
+	deps := s.Dependencies()
+	if len(deps) != 1 || deps[0] != (Dependency{"Service3.Square", "Service1.Multiply", 1}) {
+		t.Errorf("Unexpected dependencies: %+v", deps)
+	}
+}
+
+type strictReply struct {
+	Name   string
+	Values map[string][]float64
+}
+
+func TestValidateReply(t *testing.T) {
+	reply := &strictReply{Values: map[string][]float64{"a": {1, 2}}}
+	if err := validateReply(reflect.ValueOf(reply)); err != nil {
+		t.Errorf("Expected a valid reply, got %v", err)
+	}
+	reply.Values["a"][1] = math.Inf(1)
+	err := validateReply(reflect.ValueOf(reply))
+	if err == nil || !strings.Contains(err.Error(), "reply.Values[a][1]") {
+		t.Errorf("Expected an error naming reply.Values[a][1], got %v", err)
+	}
+	if code, _ := ErrorCode(err); code != CodeInternalError {
+		t.Errorf("Expected CodeInternalError, got %d", code)
+	}
+	chReply := &struct{ Ch chan int }{}
+	if err := validateReply(reflect.ValueOf(chReply)); err == nil || !strings.Contains(err.Error(), "reply.Ch") {
+		t.Errorf("Expected an error naming reply.Ch, got %v", err)
+	}
+}
+
+// memStore is an ObjectStore failing its first fail puts.
+type memStore struct {
+	mutex   sync.Mutex
+	fail    int
+	objects map[string][]byte
+}
+
+func (s *memStore) PutObject(ctx context.Context, key string, body io.Reader, size int64) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.fail > 0 {
+		s.fail--
+		return errors.New("unavailable")
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+	s.objects[key] = data
+	return nil
+}
+
+func TestArchiver(t *testing.T) {
+	store := &memStore{fail: 1, objects: make(map[string][]byte)}
+	a := NewArchiver(store, ArchiverOptions{Prefix: "rpc/", MaxRecords: 2, RetryDelay: time.Millisecond})
+	start := time.Date(2024, 1, 1, 10, 30, 0, 0, time.UTC)
+	for _, offset := range []time.Duration{0, time.Minute, 2 * time.Minute, time.Hour} {
+		a.Record(&Record{Time: start.Add(offset), Request: []byte(`{}`)})
+	}
+	if err := a.Close(); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]int{
+		"rpc/2024/01/01/10-00-00-0.ndjson.gz": 2,
+		"rpc/2024/01/01/10-00-00-1.ndjson.gz": 1,
+		"rpc/2024/01/01/11-00-00-0.ndjson.gz": 1,
+	}
+	if len(store.objects) != len(want) {
+		t.Fatalf("Expected %d objects, got %d", len(want), len(store.objects))
+	}
+	for key, n := range want {
+		zr, err := gzip.NewReader(bytes.NewReader(store.objects[key]))
+		if err != nil {
+			t.Fatalf("Object %s: %v", key, err)
+		}
+		data, _ := io.ReadAll(zr)
+		if lines := strings.Count(string(data), "\n"); lines != n {
+			t.Errorf("Expected %d records in %s, got %d", n, key, lines)
+		}
+	}
+}
+
+func TestRegisterFunc(t *testing.T) {
+	s := NewServer()
+	err := s.RegisterFunc("math.double", func(ctx context.Context, args *int) (*int, error) {
+		n := *args * 2
+		return &n, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterFunc("math.double", func(ctx context.Context, args *int) (*int, error) { return args, nil }); err == nil {
+		t.Error("Expected an error registering a method twice")
+	}
+	if err := s.RegisterFunc("math.bad", func(args *int) error { return nil }); err == nil {
+		t.Error("Expected an error registering a function of unsuitable type")
+	}
+	var n int
+	if err := s.Call(context.Background(), "math.double", 21, &n); err != nil || n != 42 {
+		t.Errorf("Expected 42, got %d, %v", n, err)
+	}
+
+	// Functions may be added to a service while it is called.
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 100; i++ {
+			var n int
+			s.Call(context.Background(), "math.double", i, &n)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		s.RegisterFunc(fmt.Sprintf("math.f%d", i), func(ctx context.Context, args *int) (*int, error) { return args, nil })
+	}
+	<-done
+}
+
+func TestRegisterGeneric(t *testing.T) {
+	type Args struct{ A, B int }
+	type Reply struct{ Sum int }
+	s := NewServer()
+	err := Register(s, "Math.Add", func(ctx context.Context, args *Args) (*Reply, error) {
+		if args.A < 0 {
+			return nil, &Error{Code: CodeInvalidParams, Message: "negative"}
+		}
+		return &Reply{Sum: args.A + args.B}, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := Register(s, "Math.Add", func(ctx context.Context, args *Args) (*Reply, error) { return nil, nil }); err == nil {
+		t.Error("Expected an error registering a method twice")
+	}
+	var reply Reply
+	if err := s.Call(context.Background(), "Math.add", Args{A: 1, B: 2}, &reply); err != nil || reply.Sum != 3 {
+		t.Errorf("Expected 3, got %d, %v", reply.Sum, err)
+	}
+	if err := s.Call(context.Background(), "Math.Add", Args{A: -1}, &reply); err == nil {
+		t.Error("Expected an error")
+	}
+}
+
+type Greeter interface {
+	Greet(ctx context.Context, name *string) (*string, error)
+}
+
+type greeterImpl struct{}
+
+func (greeterImpl) Greet(ctx context.Context, name *string) (*string, error) {
+	greeting := "Hello, " + *name
+	return &greeting, nil
+}
+
+func (greeterImpl) Reset(ctx context.Context, args *string) (*string, error) {
+	return args, nil
+}
+
+func TestRegisterInterface(t *testing.T) {
+	s := NewServer()
+	if err := RegisterInterface[Greeter](s, greeterImpl{}, ""); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasMethod("Greeter.Greet") || s.HasMethod("Greeter.Reset") {
+		t.Errorf("Expected only Greeter.Greet, got %v", s.services.names())
+	}
+	var greeting string
+	if err := s.Call(context.Background(), "Greeter.Greet", "Go", &greeting); err != nil || greeting != "Hello, Go" {
+		t.Errorf("Expected a greeting, got %q, %v", greeting, err)
+	}
+	if err := RegisterInterface[greeterImpl](s, greeterImpl{}, "Impl"); err == nil {
+		t.Error("Expected an error registering a non-interface type")
+	}
+	if err := RegisterInterface[fmt.Stringer](s, time.Second, "Stringer"); err == nil {
+		t.Error("Expected an error registering an interface without suitable methods")
+	}
+}
+
+type helperService struct{}
+
+func (helperService) Greet(ctx context.Context, name *string) (*string, error) { return name, nil }
+func (helperService) Reset(ctx context.Context, args *string) (*string, error) { return args, nil }
+func (helperService) Flush(ctx context.Context, args *string) (*string, error) { return args, nil }
+func (helperService) ExcludedMethods() []string                                { return []string{"Flush"} }
+
+func TestServiceOptions(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(helperService{}, "Excluded", ExcludeMethods("Reset")); err != nil {
+		t.Fatal(err)
+	}
+	if !s.HasMethod("Excluded.Greet") || s.HasMethod("Excluded.Reset") || s.HasMethod("Excluded.Flush") {
+		t.Errorf("Expected only Excluded.Greet, got %v", s.services.names())
+	}
+	if err := s.RegisterService(helperService{}, "Included", IncludeMethods("Reset", "Flush")); err != nil {
+		t.Fatal(err)
+	}
+	if s.HasMethod("Included.Greet") || !s.HasMethod("Included.Reset") || s.HasMethod("Included.Flush") {
+		t.Errorf("Expected only Included.Reset, got %v", s.services.names())
+	}
+	if err := s.RegisterService(helperService{}, "Typo", ExcludeMethods("Rest")); err == nil {
+		t.Error("Expected an error excluding an unknown method")
+	}
+	if err := s.RegisterService(helperService{}, "Unsuitable", IncludeMethods("ExcludedMethods")); err == nil {
+		t.Error("Expected an error including a method of unsuitable type")
+	}
+}
+
+type BadArgs struct {
+	Name    string
+	Alias   string   `json:"Name"` // wins over Name
+	Skipped chan int `json:"-"`
+	Items   []struct{ Fn func() }
+	badLeft
+	badRight
+}
+
+type badLeft struct{ Side, Top string }
+
+type badRight struct {
+	Side string
+	badDeep
+}
+
+type badDeep struct{ Top string } // shadowed by badLeft.Top
+
+type BadReply struct {
+	Values map[[2]int]complex128
+	Time   time.Time
+	Next   *BadReply
+}
+
+type badService struct{}
+
+func (badService) Bad(ctx context.Context, args *BadArgs) (*BadReply, error) { return nil, nil }
+
+func TestRegistrationCheck(t *testing.T) {
+	s := NewServer()
+	err := s.RegisterService(badService{}, "Bad")
+	regErr, ok := err.(*RegistrationError)
+	if !ok {
+		t.Fatalf("Expected a RegistrationError, got %v", err)
+	}
+	var got []string
+	for _, p := range regErr.Problems {
+		got = append(got, p.String())
+	}
+	want := []string{
+		`Bad.Bad: args: fields badLeft.Side and badRight.Side both encode as "Side" and are dropped`,
+		`Bad.Bad: args.Items[].Fn: unsupported type func()`,
+		`Bad.Bad: reply.Values: unsupported map key type [2]int`,
+		`Bad.Bad: reply.Values[]: unsupported type complex128`,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected problems\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+	if s.HasMethod("Bad.Bad") {
+		t.Error("Expected the service not to be registered")
+	}
+	if err := s.RegisterFunc("Bad.func", func(ctx context.Context, args *chan int) (*int, error) { return nil, nil }); err == nil {
+		t.Error("Expected an error registering a function with unsupported args")
+	}
+}
+
+func TestNameConflicts(t *testing.T) {
+	s := NewServer()
+	double := func(ctx context.Context, args *int) (*int, error) { return args, nil }
+	if err := s.RegisterFunc("Math.Double", double); err != nil {
+		t.Fatal(err)
+	}
+	err := s.RegisterFunc("Math.double", double)
+	if conflictErr, ok := err.(*ConflictError); !ok || len(conflictErr.Conflicts) != 1 ||
+		conflictErr.Conflicts[0].String() != "Math.double: only differs in case from Math.Double" {
+		t.Errorf("Expected a conflict, got %v", err)
+	}
+	if err := s.RegisterFunc("math.Double", double); err == nil {
+		t.Error("Expected a conflict between services differing in case")
+	}
+
+	var warnings []string
+	s.SetConflictHandler(func(c Conflict) error {
+		warnings = append(warnings, c.String())
+		return nil
+	})
+	if err := s.RegisterFunc("math.Double", double); err != nil || len(warnings) != 1 {
+		t.Errorf("Expected a warning, got %v, %v", warnings, err)
+	}
+
+	s.RetireMethod("Math.Triple", Retirement{Replacement: "Math.Quadruple"})
+	err = s.Validate()
+	want := "rpc: 2 method name conflicts:" +
+		"\n\tMath.Triple: is retired for the unregistered Math.Quadruple" +
+		"\n\tmath.Double: only differs in case from Math.Double"
+	if err == nil || err.Error() != want {
+		t.Errorf("Expected\n%s\ngot\n%v", want, err)
+	}
+}
+
+func TestEvents(t *testing.T) {
+	s := NewServer()
+	ts := httptest.NewServer(s.EventsHandler())
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/?topic=jobs.*&topic=alerts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if ct := res.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Expected an event stream, got %q", ct)
+	}
+	// The headers are flushed once subscribed.
+	s.Notify("other", "ignored", nil)
+	s.Notify("jobs.1", "progress", map[string]int{"percent": 50})
+	s.Notify("alerts", "alert", nil)
+
+	lines := bufio.NewScanner(res.Body)
+	var got []string
+	for len(got) < 8 && lines.Scan() {
+		got = append(got, lines.Text())
+	}
+	want := []string{
+		"id: 2", "event: jobs.1", `data: {"jsonrpc":"2.0","method":"progress","params":{"percent":50}}`, "",
+		"id: 3", "event: alerts", `data: {"jsonrpc":"2.0","method":"alert"}`, "",
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected events\n%s\ngot\n%s", strings.Join(want, "\n"), strings.Join(got, "\n"))
+	}
+}
+
+func TestConnFraming(t *testing.T) {
+	l := &ConnListener{Framing: FrameLength}
+	var buf bytes.Buffer
+	l.writeFrame(&buf, []byte(`{"a":1}`))
+	if got := buf.Bytes(); !bytes.Equal(got[:4], []byte{0, 0, 0, 7}) {
+		t.Errorf("Expected a length prefix of 7, got %v", got[:4])
+	}
+	if msg, err := l.readFrame(bufio.NewReader(&buf)); err != nil || string(msg) != `{"a":1}` {
+		t.Errorf("Expected the message back, got %q, %v", msg, err)
+	}
+
+	l = &ConnListener{MaxFrameSize: 8}
+	rd := bufio.NewReader(strings.NewReader("{\"a\":1}\r\n\n{\"b\":2}"))
+	for _, want := range []string{`{"a":1}`, ``, `{"b":2}`} {
+		if msg, err := l.readFrame(rd); err != nil || string(msg) != want {
+			t.Errorf("Expected %q, got %q, %v", want, msg, err)
+		}
+	}
+	if _, err := l.readFrame(bufio.NewReader(strings.NewReader(`{"a":"too long"}`))); err == nil {
+		t.Error("Expected an error reading a frame over the limit")
+	}
+
+	l = &ConnListener{Framing: FrameHeader}
+	buf.Reset()
+	l.writeFrame(&buf, []byte(`{"a":1}`))
+	if got := buf.String(); got != "Content-Length: 7\r\n\r\n{\"a\":1}" {
+		t.Errorf("Expected a Content-Length header, got %q", got)
+	}
+	rd = bufio.NewReader(strings.NewReader("content-length: 7\r\nContent-Type: application/vscode-jsonrpc\r\n\r\n{\"b\":2}Content-Length: 9\r\n\r\n{}"))
+	if msg, err := l.readFrame(rd); err != nil || string(msg) != `{"b":2}` {
+		t.Errorf("Expected the message, got %q, %v", msg, err)
+	}
+	if _, err := l.readFrame(rd); err != io.ErrUnexpectedEOF {
+		t.Errorf("Expected a truncated frame, got %v", err)
+	}
+	if _, err := l.readFrame(bufio.NewReader(strings.NewReader("X: 1\r\n\r\n{}"))); err == nil {
+		t.Error("Expected an error reading a frame without Content-Length")
+	}
+	for _, headers := range []string{
+		"X: " + strings.Repeat("x", 2*maxHeaderSize),
+		strings.Repeat("X: 1\r\n", maxHeaderSize),
+	} {
+		_, err := l.readFrame(bufio.NewReader(strings.NewReader(headers)))
+		if err == nil || !strings.Contains(err.Error(), "headers exceed") {
+			t.Errorf("Expected an error reading oversized headers, got %v", err)
+		}
+	}
+}
+
+func TestListenAndServeUnix(t *testing.T) {
+	path := t.TempDir() + "/rpc.sock"
+	// A stale socket is replaced.
+	stale, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	s := NewServer()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- ListenAndServeUnix(ctx, path, s, SocketMode(0660))
+	}()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return net.Dial("unix", path)
+		},
+	}}
+	var res *http.Response
+	for i := 0; i < 100; i++ {
+		if res, err = client.Get("http://unix/"); err == nil {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("Expected status 405, got %d", res.StatusCode)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Mode().Perm() != 0660 {
+		t.Errorf("Expected mode 0660, got %v, %v", fi.Mode(), err)
+	}
+	if _, err := ListenUnix(path); err == nil {
+		t.Error("Expected an error listening on a socket in use")
+	}
+
+	cancel()
+	if err := <-done; err != nil {
+		t.Errorf("Expected clean shutdown, got %v", err)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("Expected the socket to be removed, got %v", err)
+	}
+}
+
+type AccountArgs struct {
+	Account string
+}
+
+func (a *AccountArgs) ShardKey() string { return a.Account }
+
+func TestShards(t *testing.T) {
+	s := NewServer()
+	s.SetShards(4)
+	defer s.SetShards(0)
+	var mutex sync.Mutex
+	running := make(map[string]int)
+	err := s.RegisterFunc("Accounts.Debit", func(ctx context.Context, args *AccountArgs) (*int, error) {
+		shard, ok := CurrentShard(ctx)
+		if !ok {
+			return nil, errors.New("no shard")
+		}
+		mutex.Lock()
+		running[args.Account]++
+		overlap := running[args.Account] > 1
+		mutex.Unlock()
+		time.Sleep(time.Millisecond)
+		mutex.Lock()
+		running[args.Account]--
+		mutex.Unlock()
+		if overlap {
+			return nil, fmt.Errorf("concurrent calls for %q", args.Account)
+		}
+		return &shard, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wg sync.WaitGroup
+	shardOf := make(map[string]int)
+	for i := 0; i < 40; i++ {
+		account := fmt.Sprintf("acct-%d", i%8)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var shard int
+			if err := s.Call(context.Background(), "Accounts.Debit", &AccountArgs{Account: account}, &shard); err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			if prev, ok := shardOf[account]; ok && prev != shard {
+				t.Errorf("Expected %q on shard %d, got %d", account, prev, shard)
+			}
+			shardOf[account] = shard
+		}()
+	}
+	wg.Wait()
+
+	// Growing the ring moves only some of the keys.
+	s.SetShards(4)
+	before := s.shards
+	s.SetShards(5)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := strconv.Itoa(i)
+		if before.shard(key) != s.shards.shard(key) {
+			moved++
+		}
+	}
+	if moved == 0 || moved > 400 {
+		t.Errorf("Expected about a fifth of the keys to move, got %d of 1000", moved)
+	}
+}
+
+func TestCallerOrdering(t *testing.T) {
+	s := NewServer()
+	s.SetCallerOrdering(1)
+	request := func(addr string) *http.Request {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.RemoteAddr = addr
+		return r
+	}
+	pending := func() int {
+		s.ordering.mutex.Lock()
+		defer s.ordering.mutex.Unlock()
+		if q := s.ordering.queues["192.0.2.1"]; q != nil {
+			return q.pending
+		}
+		return 0
+	}
+	done1, err := s.awaitTurn(request("192.0.2.1:1000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	second := make(chan func())
+	go func() {
+		done, err := s.awaitTurn(request("192.0.2.1:1001"))
+		if err != nil {
+			t.Error(err)
+		}
+		second <- done
+	}()
+	for pending() < 2 {
+		time.Sleep(time.Millisecond)
+	}
+	if _, err := s.awaitTurn(request("192.0.2.1:1002")); err == nil || err.(*Error).Code != CodeRateLimited {
+		t.Errorf("Expected a CodeRateLimited error over the depth, got %v", err)
+	}
+	// Other callers aren't held up.
+	done, err := s.awaitTurn(request("192.0.2.2:1000"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	done()
+	select {
+	case <-second:
+		t.Fatal("Expected the second request to wait for the first")
+	default:
+	}
+	done1()
+	(<-second)()
+	if n := pending(); n != 0 {
+		t.Errorf("Expected the queue to be released, got %d pending", n)
+	}
+}
+
+func TestDictionaryCompression(t *testing.T) {
+	reply := func(i int) []byte {
+		return []byte(fmt.Sprintf(`{"jsonrpc":"2.0","result":{"order_id":%d,"status":"shipped","carrier":"postal-service","items":[{"sku":"SKU-%05d","quantity":%d}]},"id":%d}`, i, i*7, i%5+1, i))
+	}
+	var samples [][]byte
+	for i := 0; i < 200; i++ {
+		samples = append(samples, reply(i))
+	}
+	dict := NewDictionary(TrainDictionary(samples, 1024))
+	if n := len(dict.Bytes()); n == 0 || n > 1024 {
+		t.Fatalf("Expected a dictionary of up to 1024 bytes, got %d", n)
+	}
+
+	selector := &DictionarySelector{Dictionaries: []*Dictionary{dict}}
+	compress := func(header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("POST", "/", nil)
+		r.Header = header
+		w := httptest.NewRecorder()
+		selector.Select(r).Encode(w).Write(reply(1000))
+		return w
+	}
+	generic := compress(http.Header{"Accept-Encoding": {"gzip"}})
+	w := compress(http.Header{"Accept-Encoding": {"gzip, " + DictionaryEncoding}, DictionaryHeader: {dict.ID()}})
+	if enc := w.Header().Get("Content-Encoding"); enc != DictionaryEncoding {
+		t.Fatalf("Expected %s, got %q", DictionaryEncoding, enc)
+	}
+	if w.Body.Len() >= generic.Body.Len()/2 {
+		t.Errorf("Expected the dictionary to halve the size, got %d bytes against %d", w.Body.Len(), generic.Body.Len())
+	}
+	got, err := io.ReadAll(NewDictionaryReader(w.Body, dict))
+	if err != nil || !bytes.Equal(got, reply(1000)) {
+		t.Errorf("Expected the reply back, got %q, %v", got, err)
+	}
+	// An unknown dictionary falls back to generic compression.
+	w = compress(http.Header{"Accept-Encoding": {"gzip, " + DictionaryEncoding}, DictionaryHeader: {":AAAA:"}})
+	if enc := w.Header().Get("Content-Encoding"); enc != "gzip" {
+		t.Errorf("Expected gzip, got %q", enc)
+	}
+}
+
+func TestJSONPatch(t *testing.T) {
+	doc := []byte(`{"a":{"b":[1,2,3]},"c/d":"x","e":1.0}`)
+	tests := []struct {
+		patch string
+		want  string
+	}{
+		{`[{"op":"add","path":"/a/b/1","value":9}]`, `{"a":{"b":[1,9,2,3]},"c/d":"x","e":1.0}`},
+		{`[{"op":"add","path":"/a/b/-","value":4}]`, `{"a":{"b":[1,2,3,4]},"c/d":"x","e":1.0}`},
+		{`[{"op":"remove","path":"/a/b/0"}]`, `{"a":{"b":[2,3]},"c/d":"x","e":1.0}`},
+		{`[{"op":"replace","path":"/c~1d","value":null}]`, `{"a":{"b":[1,2,3]},"c/d":null,"e":1.0}`},
+		{`[{"op":"move","from":"/a/b","path":"/b"}]`, `{"a":{},"b":[1,2,3],"c/d":"x","e":1.0}`},
+		{`[{"op":"copy","from":"/a/b/2","path":"/f"}]`, `{"a":{"b":[1,2,3]},"c/d":"x","e":1.0,"f":3}`},
+		{`[{"op":"test","path":"/e","value":1},{"op":"replace","path":"","value":[]}]`, `[]`},
+	}
+	for _, test := range tests {
+		var patch JSONPatch
+		if err := json.Unmarshal([]byte(test.patch), &patch); err != nil {
+			t.Fatalf("%s: %v", test.patch, err)
+		}
+		got, err := patch.Apply(doc)
+		if err != nil {
+			t.Errorf("%s: %v", test.patch, err)
+			continue
+		}
+		var x, y interface{}
+		json.Unmarshal(got, &x)
+		json.Unmarshal([]byte(test.want), &y)
+		if !reflect.DeepEqual(x, y) {
+			t.Errorf("%s: expected %s, got %s", test.patch, test.want, got)
+		}
+	}
+
+	for _, bad := range []string{
+		`[{"op":"add","path":"/x"}]`,
+		`[{"op":"jump","path":"/x"}]`,
+		`[{"op":"remove","path":"x"}]`,
+		`[{"op":"move","from":"/a","path":"/a/b"}]`,
+	} {
+		var patch JSONPatch
+		if err := json.Unmarshal([]byte(bad), &patch); err == nil {
+			t.Errorf("%s: expected a validation error", bad)
+		}
+	}
+	for _, failing := range []string{
+		`[{"op":"remove","path":"/a/b/3"}]`,
+		`[{"op":"replace","path":"/nope","value":1}]`,
+		`[{"op":"add","path":"/a/b/01","value":1}]`,
+		`[{"op":"test","path":"/c~1d","value":"y"}]`,
+	} {
+		var patch JSONPatch
+		json.Unmarshal([]byte(failing), &patch)
+		if _, err := patch.Apply(doc); err == nil {
+			t.Errorf("%s: expected an error", failing)
+		}
+	}
+}
+
+func TestCatalogChanged(t *testing.T) {
+	s := NewServer()
+	double := func(ctx context.Context, args *int) (*int, error) { return args, nil }
+	s.RegisterFunc("Math.Double", double)
+	ts := httptest.NewServer(s.EventsHandler())
+	defer ts.Close()
+	res, err := http.Get(ts.URL + "/?topic=jobs.*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	events := bufio.NewScanner(res.Body)
+	next := func() CatalogChange {
+		for events.Scan() {
+			if data := strings.TrimPrefix(events.Text(), "data: "); data != events.Text() {
+				var n struct {
+					Method string
+					Params CatalogChange
+				}
+				if err := json.Unmarshal([]byte(data), &n); err != nil || n.Method != CatalogChangedMethod {
+					t.Fatalf("Expected a catalog notification, got %s, %v", data, err)
+				}
+				return n.Params
+			}
+		}
+		t.Fatal("Expected an event")
+		return CatalogChange{}
+	}
+
+	s.RegisterFunc("Math.Triple", double)
+	if change := next(); !reflect.DeepEqual(change.Methods, []string{"Math.Double", "Math.Triple"}) {
+		t.Errorf("Expected the new catalog, got %+v", change)
+	}
+	// A failed registration changes nothing, a retirement does.
+	s.RegisterFunc("Math.Triple", double)
+	s.RetireMethod("Math.Double", Retirement{Replacement: "Math.Triple"})
+	first := next()
+	if !reflect.DeepEqual(first.Methods, []string{"Math.Triple"}) {
+		t.Errorf("Expected the retired method to be left out, got %+v", first)
+	}
+	s.SetConfig(&Config{Flags: map[string]bool{"beta": true}})
+	if change := next(); change.Version != first.Version+1 {
+		t.Errorf("Expected version %d on a flag change, got %+v", first.Version+1, change)
+	}
+
+	// Raw connections are pushed the notification too.
+	client, conn := net.Pipe()
+	defer client.Close()
+	served := make(chan error, 1)
+	go func() { served <- s.ServeConn(conn) }()
+	for {
+		s.NotifyCatalogChanged()
+		client.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		line, err := bufio.NewReader(client).ReadString('\n')
+		if err == nil {
+			var n struct {
+				Method string
+				Params CatalogChange
+			}
+			if err := json.Unmarshal([]byte(line), &n); err != nil || n.Method != CatalogChangedMethod {
+				t.Fatalf("Expected a catalog notification, got %s, %v", line, err)
+			}
+			break
+		}
+	}
+	client.Close()
+	if err := <-served; err != nil && err != io.EOF {
+		t.Errorf("Expected the connection to be served, got %v", err)
+	}
+}
+
+func TestGroup(t *testing.T) {
+	s := NewServer()
+	release := make(chan struct{})
+	var finished int32
+	err := s.RegisterFunc("mail.send", func(ctx context.Context, args *int) (*int, error) {
+		g, ctx := Group(ctx)
+		g.Go(func() error {
+			select {
+			case <-release:
+				atomic.AddInt32(&finished, 1)
+			case <-ctx.Done():
+			}
+			return nil
+		})
+		if *args > 0 {
+			// Ignores cancellation.
+			g.Go(func() error {
+				<-release
+				return nil
+			})
+		}
+		return args, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	ctx, cancel := context.WithCancel(context.Background())
+	if err := s.Call(ctx, "mail.send", 0, &n); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	go close(release)
+	if err := s.Drain(context.Background()); err != nil || atomic.LoadInt32(&finished) != 1 {
+		t.Fatalf("Expected Drain to wait for the background work, got %v", err)
+	}
+	s.Resume()
+
+	release = make(chan struct{})
+	defer close(release)
+	if err := s.Call(context.Background(), "mail.send", 1, &n); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := s.Drain(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Expected the background work to be cancelled, got %v", err)
+	}
+	var leaks []GroupLeak
+	for i := 0; i < 100; i++ {
+		if leaks = s.Leaks(); len(leaks) == 1 && leaks[0].Running == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if len(leaks) != 1 || leaks[0].Method != "mail.send" || leaks[0].Running != 1 {
+		t.Errorf("Expected the goroutine ignoring cancellation to be reported, got %+v", leaks)
+	}
+	if atomic.LoadInt32(&finished) != 1 {
+		t.Error("Expected the cancelled goroutine not to finish its work")
+	}
+}
+
+func TestHardTimeout(t *testing.T) {
+	s := NewServer()
+	clock := NewManualClock(time.Unix(0, 0))
+	s.SetClock(clock)
+	s.SetHardTimeout(20 * time.Millisecond)
+	started := make(chan struct{})
+	release := make(chan struct{})
+	err := s.RegisterFunc("slow.echo", func(ctx context.Context, args *int) (*int, error) {
+		if *args > 0 {
+			started <- struct{}{}
+			// Ignores cancellation.
+			<-release
+		}
+		return args, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var n int
+	if err := s.Call(context.Background(), "slow.echo", 0, &n); err != nil {
+		t.Fatalf("Expected a quick call to succeed, got %v", err)
+	}
+	n = 0
+	done := make(chan error, 1)
+	go func() { done <- s.Call(context.Background(), "slow.echo", 1, &n) }()
+	<-started
+	clock.Advance(20 * time.Millisecond)
+	err = <-done
+	if code, _ := ErrorCode(err); code != CodeDeadlineExceeded {
+		t.Fatalf("Expected the call to be abandoned, got %v", err)
+	}
+	if stuck := s.StuckCalls(); len(stuck) != 1 || stuck[0].Method != "slow.echo" {
+		t.Errorf("Expected the stuck handler to be reported, got %+v", stuck)
+	}
+
+	// A call cancelled by its caller isn't abandoned.
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() { done <- s.Call(ctx, "slow.echo", 2, &n) }()
+	<-started
+	cancel()
+	err = <-done
+	if code, _ := ErrorCode(err); code == CodeDeadlineExceeded || !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected the call to be cancelled, got %v", err)
+	}
+	if stuck := s.StuckCalls(); len(stuck) != 1 {
+		t.Errorf("Expected the cancelled handler not to be reported, got %+v", stuck)
+	}
+
+	close(release)
+	for i := 0; i < 100 && len(s.StuckCalls()) > 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	if stuck := s.StuckCalls(); len(stuck) != 0 {
+		t.Errorf("Expected the handler no longer reported once returned, got %+v", stuck)
+	}
+	if n != 0 {
+		t.Errorf("Expected the result of the abandoned handler to be discarded, got %d", n)
+	}
+}
+
+func TestResourcePolicy(t *testing.T) {
+	s := NewServer()
+	err := s.RegisterFunc("list.repeat", func(ctx context.Context, args *[]int) (*[]int, error) {
+		policy := CurrentPolicy(ctx)
+		if err := policy.CheckExpansion(len(*args), len(*args)*int(policy.Limit("copies"))); err != nil {
+			return nil, err
+		}
+		var reply []int
+		for i := int64(0); i < policy.Limit("copies"); i++ {
+			reply = append(reply, *args...)
+		}
+		return &reply, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SetResourcePolicy("*", ResourcePolicy{MaxArgsElements: 3, MaxReplyElements: 4, MaxExpansion: 2, Limits: map[string]int64{"copies": 2}})
+
+	var reply []int
+	if err := s.Call(context.Background(), "list.repeat", []int{1, 2}, &reply); err != nil || len(reply) != 4 {
+		t.Errorf("Expected 4 elements, got %v, %v", reply, err)
+	}
+	for _, args := range [][]int{{1, 2, 3, 4}, {1, 2, 3}} {
+		err := s.Call(context.Background(), "list.repeat", args, &reply)
+		if code, _ := ErrorCode(err); code != CodeResourceExhausted {
+			t.Errorf("%v: expected CodeResourceExhausted, got %v", args, err)
+		}
+	}
+
+	s.SetResourcePolicy("list.repeat", ResourcePolicy{MaxExpansion: 2, Limits: map[string]int64{"copies": 3}})
+	if err := s.Call(context.Background(), "list.repeat", []int{1}, &reply); !strings.Contains(fmt.Sprint(err), "expansion") {
+		t.Errorf("Expected the handler to reject the expansion, got %v", err)
+	}
+}
+
+// codeNoFunds is registered at init, as the registry expects.
+var codeNoFunds = func() int {
+	ReserveErrorCodes("billing", 4000, 4999, "billing errors")
+	return RegisterErrorCode("billing", 4001, "NoFunds", "the balance is too low")
+}()
+
+func TestErrorCodeRegistry(t *testing.T) {
+	if codeNoFunds != 4001 {
+		t.Errorf("Expected the code returned, got %d", codeNoFunds)
+	}
+	if c, ok := LookupErrorCode(4001); !ok || c.Namespace != "billing" || c.Name != "NoFunds" {
+		t.Errorf("Expected the code registered, got %+v", c)
+	}
+	if c, ok := LookupErrorCode(CodeRateLimited); !ok || c.Namespace != "rpc" {
+		t.Errorf("Expected the codes of the package registered, got %+v", c)
+	}
+
+	for name, register := range map[string]func(){
+		"twice":              func() { RegisterErrorCode("billing", 4001, "Again", "") },
+		"other namespace":    func() { RegisterErrorCode("shipping", 4500, "Lost", "") },
+		"outside own ranges": func() { RegisterErrorCode("billing", 5000, "Late", "") },
+		"overlapping range":  func() { ReserveErrorCodes("shipping", 4900, 5900, "") },
+		"protocol range":     func() { RegisterErrorCode("shipping", -32050, "Lost", "") },
+		"inverted range":     func() { ReserveErrorCodes("shipping", 6000, 5000, "") },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%s: expected a panic", name)
+				}
+			}()
+			register()
+		}()
+	}
+
+	w := httptest.NewRecorder()
+	ErrorCodesHandler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+	var registry struct {
+		Ranges []ErrorCodeRange `json:"ranges"`
+		Codes  []ErrorCodeInfo  `json:"codes"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &registry); err != nil {
+		t.Fatal(err)
+	}
+	found := false
+	for _, c := range registry.Codes {
+		found = found || c.Code == 4001
+	}
+	if !found || len(registry.Ranges) < 2 {
+		t.Errorf("Expected the registry exported, got %s", w.Body)
+	}
+}
+
+type lifecycleService struct {
+	inits, warmups int32
+	fail           int32 // number of Init calls to fail
+	panics         int32 // number of Warmup calls to panic
+	order          []string
+	mutex          sync.Mutex
+}
+
+func (l *lifecycleService) Init(ctx context.Context) error {
+	l.mutex.Lock()
+	l.order = append(l.order, "init")
+	l.mutex.Unlock()
+	if atomic.AddInt32(&l.inits, 1) <= atomic.LoadInt32(&l.fail) {
+		return errors.New("no database")
+	}
+	return nil
+}
+
+func (l *lifecycleService) Warmup(ctx context.Context) error {
+	l.mutex.Lock()
+	l.order = append(l.order, "warmup")
+	l.mutex.Unlock()
+	if atomic.AddInt32(&l.warmups, 1) <= atomic.LoadInt32(&l.panics) {
+		panic("no cache")
+	}
+	return nil
+}
+
+func (l *lifecycleService) Echo(ctx context.Context, args *int) (*int, error) {
+	return args, nil
+}
+
+func TestLifecycle(t *testing.T) {
+	s := NewServer()
+	eager, lazy := new(lifecycleService), new(lifecycleService)
+	if err := s.RegisterService(eager, "eager"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(lazy, "lazy", LazyInit()); err != nil {
+		t.Fatal(err)
+	}
+	ready := s.ReadyHandler()
+	w := httptest.NewRecorder()
+	ready.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	if s.Ready() || w.Code != http.StatusServiceUnavailable {
+		t.Errorf("Expected the server not ready before Start, got %d", w.Code)
+	}
+
+	if err := s.Start(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	w = httptest.NewRecorder()
+	ready.ServeHTTP(w, httptest.NewRequest("GET", "/ready", nil))
+	if !s.Ready() || w.Code != http.StatusOK {
+		t.Errorf("Expected the server ready after Start, got %d", w.Code)
+	}
+	if eager.inits != 1 || eager.warmups != 1 || strings.Join(eager.order, ",") != "init,warmup" {
+		t.Errorf("Expected Init then Warmup, got %v", eager.order)
+	}
+	if lazy.inits != 0 {
+		t.Errorf("Expected the lazy service not initialized by Start")
+	}
+
+	// The first call initializes the lazy service, retrying after a failure.
+	lazy.fail = 1
+	var n int
+	if err := s.Call(context.Background(), "lazy.Echo", 1, &n); err == nil || !strings.Contains(err.Error(), "no database") {
+		t.Errorf("Expected the failed initialization to be reported, got %v", err)
+	} else if code, _ := ErrorCode(err); code != CodeUnavailable {
+		t.Errorf("Expected a CodeUnavailable error, got %v", err)
+	}
+	for i := 0; i < 2; i++ {
+		if err := s.Call(context.Background(), "lazy.Echo", 2, &n); err != nil || n != 2 {
+			t.Errorf("Expected 2, got %d: %v", n, err)
+		}
+	}
+	if lazy.inits != 2 || lazy.warmups != 1 || eager.inits != 1 {
+		t.Errorf("Expected a single successful initialization, got %d inits, %d warmups", lazy.inits, lazy.warmups)
+	}
+
+	s = NewServer()
+	failing := &lifecycleService{fail: 1}
+	s.RegisterService(failing, "failing")
+	if err := s.Start(context.Background()); err == nil || s.Ready() {
+		t.Errorf("Expected Start to fail, got %v", err)
+	}
+
+	// A panicking initialization fails, and is retried by the next call.
+	s = NewServer()
+	panicking := &lifecycleService{panics: 1}
+	s.RegisterService(panicking, "panicking", LazyInit())
+	err := s.Call(context.Background(), "panicking.Echo", 1, &n)
+	if err == nil || !strings.Contains(err.Error(), "panicked") || strings.Contains(err.Error(), "no cache") {
+		t.Errorf("Expected the panic to be reported without its value, got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := s.Call(ctx, "panicking.Echo", 2, &n); err != nil || n != 2 {
+		t.Errorf("Expected 2 after the panic, got %d: %v", n, err)
+	}
+}
+
+type healthService struct {
+	mutex sync.Mutex
+	down  error
+}
+
+func (h *healthService) setDown(err error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	h.down = err
+}
+
+func (h *healthService) Healthy(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.down
+}
+
+func (h *healthService) Echo(ctx context.Context, args *int) (*int, error) {
+	return args, nil
+}
+
+func TestHealth(t *testing.T) {
+	s := NewServer()
+	db := new(healthService)
+	db.setDown(errors.New("database unreachable"))
+	if err := s.RegisterService(db, "db"); err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterFunc("plain.echo", func(ctx context.Context, args *int) (*int, error) { return args, nil })
+
+	var n int
+	if err := s.Call(context.Background(), "db.Echo", 1, &n); err != nil {
+		t.Errorf("Expected calls served without the health gate, got %v", err)
+	}
+	s.SetHealthGate(true)
+	if err := s.Call(context.Background(), "db.Echo", 1, &n); err != nil {
+		t.Errorf("Expected calls served before any check, got %v", err)
+	}
+
+	w := httptest.NewRecorder()
+	s.HealthHandler().ServeHTTP(w, httptest.NewRequest("GET", "/health", nil))
+	var report HealthReport
+	if err := json.Unmarshal(w.Body.Bytes(), &report); err != nil || w.Code != http.StatusServiceUnavailable {
+		t.Fatalf("Expected a 503 report, got %d %s", w.Code, w.Body)
+	}
+	if report.Healthy || report.Services["db"].Healthy || report.Services["db"].Error != "database unreachable" {
+		t.Errorf("Expected db reported unhealthy, got %+v", report)
+	}
+	if err := s.Call(context.Background(), "db.Echo", 1, &n); err == nil {
+		t.Error("Expected calls to an unhealthy service to fail")
+	} else if code, _ := ErrorCode(err); code != CodeServiceUnhealthy {
+		t.Errorf("Expected a CodeServiceUnhealthy error, got %v", err)
+	}
+	if err := s.Call(context.Background(), "plain.echo", 1, &n); err != nil {
+		t.Errorf("Expected other services served, got %v", err)
+	}
+
+	db.setDown(nil)
+	if report := s.Health(context.Background()); !report.Healthy {
+		t.Errorf("Expected the server healthy, got %+v", report)
+	}
+	if err := s.Call(context.Background(), "db.Echo", 1, &n); err != nil {
+		t.Errorf("Expected calls served once healthy again, got %v", err)
+	}
+
+	// A check cancelled by the caller doesn't mark the service unhealthy.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	s.Health(ctx)
+	if err := s.Call(context.Background(), "db.Echo", 1, &n); err != nil {
+		t.Errorf("Expected calls served after a cancelled check, got %v", err)
+	}
+}
+
+type SchemaNode struct {
+	Name     string        `json:"name" rpc:"required,max=20"`
+	Children []*SchemaNode `json:"children,omitempty"`
+}
+
+type SchemaArgs struct {
+	SchemaEmbedded
+	ID      uint           `json:"id"`
+	Tags    []string       `json:"tags" rpc:"min=1"`
+	Root    *SchemaNode    `json:"root"`
+	Data    []byte         `json:"data"`
+	At      time.Time      `json:"at"`
+	Extra   map[string]int `json:"extra"`
+	Any     interface{}    `json:"any"`
+	Skipped int            `json:"-"`
+	hidden  int
+}
+
+type SchemaEmbedded struct {
+	Score float64 `rpc:"min=0,max=1"`
+}
+
+func TestSchema(t *testing.T) {
+	s := NewServer()
+	err := s.RegisterFunc("tree.put", func(ctx context.Context, args *SchemaArgs) (*bool, error) {
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := s.Schema("tree.put")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"$defs":{"SchemaArgs":{"properties":{"Score":{"maximum":1,"minimum":0,"type":"number"},"any":{},` +
+		`"at":{"format":"date-time","type":"string"},"data":{"contentEncoding":"base64","type":"string"},` +
+		`"extra":{"additionalProperties":{"type":"integer"},"type":"object"},"id":{"minimum":0,"type":"integer"},` +
+		`"root":{"$ref":"#/$defs/SchemaNode"},"tags":{"items":{"type":"string"},"minItems":1,"type":"array"}},"type":"object"},` +
+		`"SchemaNode":{"properties":{"children":{"items":{"$ref":"#/$defs/SchemaNode"},"type":"array"},` +
+		`"name":{"maxLength":20,"type":"string"}},"required":["name"],"type":"object"}},` +
+		`"$ref":"#/$defs/SchemaArgs","$schema":"https://json-schema.org/draft/2020-12/schema"}`
+	if string(schema.Params) != expected {
+		t.Errorf("Unexpected params schema:\n%s\nexpected:\n%s", schema.Params, expected)
+	}
+	if string(schema.Result) != `{"$schema":"https://json-schema.org/draft/2020-12/schema","type":"boolean"}` {
+		t.Errorf("Unexpected result schema %s", schema.Result)
+	}
+	if _, err := s.Schema("tree.missing"); err == nil {
+		t.Error("Expected an error for an unknown method")
+	}
+}
+
+type replicaService struct{}
+
+func (replicaService) Get(ctx context.Context, args *int) (*int, error) {
+	return args, nil
+}
+
+func (replicaService) Put(ctx context.Context, args *int) (*int, error) {
+	return args, nil
+}
+
+func TestReplica(t *testing.T) {
+	s := NewServer()
+	if err := s.RegisterService(replicaService{}, "kv", ReadOnlyMethods("Get")); err != nil {
+		t.Fatal(err)
+	}
+	s.RegisterFunc("kv2.get", func(ctx context.Context, args *int) (*int, error) { return args, nil })
+	if err := s.MarkReadOnly("kv2.get"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.RegisterService(replicaService{}, "bad", ReadOnlyMethods("Missing")); err == nil {
+		t.Error("Expected marking an unknown method read-only to fail")
+	}
+
+	var n int
+	if err := s.Call(context.Background(), "kv.Put", 1, &n); err != nil {
+		t.Errorf("Expected every method served by a primary, got %v", err)
+	}
+	s.SetReplicaOf("https://primary.example.com/rpc")
+	for _, method := range []string{"kv.Get", "kv2.get"} {
+		if err := s.Call(context.Background(), method, 1, &n); err != nil {
+			t.Errorf("Expected %s served by the replica, got %v", method, err)
+		}
+	}
+	err := s.Call(context.Background(), "kv.Put", 1, &n)
+	if code, _ := ErrorCode(err); code != CodeReadOnlyReplica {
+		t.Fatalf("Expected a CodeReadOnlyReplica error, got %v", err)
+	}
+	if redirect, ok := err.(*Error).Data.(*ReplicaRedirect); !ok || redirect.Primary != "https://primary.example.com/rpc" {
+		t.Errorf("Expected the primary in the error data, got %#v", err.(*Error).Data)
+	}
+	s.SetReplicaOf("")
+	if err := s.Call(context.Background(), "kv.Put", 1, &n); err != nil {
+		t.Errorf("Expected every method served again, got %v", err)
+	}
+}
+
+func TestSaga(t *testing.T) {
+	var log []string
+	step := func(name string, err error) func(context.Context) error {
+		return func(ctx context.Context) error {
+			log = append(log, name)
+			return err
+		}
+	}
+
+	var saga Saga
+	saga.Step("reserve", step("reserve", nil), step("release", nil))
+	saga.Step("notify", step("notify", nil), nil)
+	saga.Step("charge", step("charge", nil), step("refund", nil))
+	if err := saga.Run(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if expected := []string{"reserve", "notify", "charge"}; !reflect.DeepEqual(log, expected) {
+		t.Errorf("Expected %v, got %v", expected, log)
+	}
+
+	log = nil
+	declined := &Error{Code: CodePreconditionFailed, Message: "card declined"}
+	saga = Saga{}
+	saga.Step("reserve", step("reserve", nil), step("release", nil))
+	saga.Step("notify", step("notify", nil), nil)
+	saga.Step("charge", step("charge", declined), step("refund", nil))
+	saga.Step("ship", step("ship", nil), nil)
+	err := saga.Run(context.Background())
+	if expected := []string{"reserve", "notify", "charge", "release"}; !reflect.DeepEqual(log, expected) {
+		t.Errorf("Expected %v, got %v", expected, log)
+	}
+	sagaErr, ok := err.(*SagaError)
+	if !ok || sagaErr.Step != "charge" || !errors.Is(err, declined) || !reflect.DeepEqual(sagaErr.Compensated, []string{"reserve"}) {
+		t.Fatalf("Unexpected error %#v", err)
+	}
+	if code, _ := ErrorCode(err); code != CodePreconditionFailed {
+		t.Errorf("Expected the code of the step error, got %d", code)
+	}
+
+	log = nil
+	saga = Saga{}
+	saga.Step("reserve", step("reserve", nil), step("release", errors.New("stock service down")))
+	saga.Step("charge", step("charge", errors.New("card declined")), nil)
+	err = saga.Run(context.Background())
+	if code, _ := ErrorCode(err); code != CodePartialFailure {
+		t.Errorf("Expected CodePartialFailure, got %d", code)
+	}
+	data, _ := json.Marshal(err.(*SagaError).ErrorData())
+	expected := `{"step":"charge","error":"card declined","compensated":[],"compensationErrors":{"reserve":"stock service down"}}`
+	if string(data) != expected {
+		t.Errorf("Expected %s, got %s", expected, data)
+	}
+	if msg := err.Error(); msg != `rpc: saga step "charge" failed: card declined; compensations failed: "reserve": stock service down` {
+		t.Errorf("Unexpected message %q", msg)
+	}
+}
+
+func TestBytes(t *testing.T) {
+	type Blob struct {
+		Data Bytes  `json:"data"`
+		Opt  *Bytes `json:"opt,omitempty"`
+	}
+	b, err := json.Marshal(Blob{Data: Bytes{0xfb, 0xff}})
+	if err != nil || string(b) != `{"data":"+/8="}` {
+		t.Errorf("Expected standard base64, got %s %v", b, err)
+	}
+	for _, encoded := range []string{`"+/8="`, `"+/8"`, `"-_8="`, `"-_8"`} {
+		var data Bytes
+		if err := json.Unmarshal([]byte(encoded), &data); err != nil || !bytes.Equal(data, []byte{0xfb, 0xff}) {
+			t.Errorf("%s: expected fbff, got %x %v", encoded, []byte(data), err)
+		}
+	}
+	var blob Blob
+	if err := json.Unmarshal([]byte(`{"data":null}`), &blob); err != nil || blob.Data != nil {
+		t.Errorf("Expected null decoded as nil, got %v %v", blob.Data, err)
+	}
+	if err := json.Unmarshal([]byte(`{"data":"%%"}`), &blob); err == nil {
+		t.Error("Expected invalid base64 rejected")
+	}
+	if err := json.Unmarshal([]byte(`{"data":[1]}`), &blob); err == nil {
+		t.Error("Expected an array rejected")
+	}
+
+	g := newSchemaGenerator("#/$defs/")
+	g.schema(reflect.TypeOf(Blob{}))
+	schema, _ := json.Marshal(g.defs)
+	if !strings.Contains(string(schema), `"data":{"contentEncoding":"base64","type":"string"}`) {
+		t.Errorf("Expected the schema of a base64 string, got %s", schema)
+	}
+}
@@ -0,0 +1,155 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"unicode/utf8"
+)
+
+// ----------------------------------------------------------------------------
+// Serverless
+// ----------------------------------------------------------------------------
+
+// ServerlessEvent is an HTTP event of a serverless platform, in the API
+// Gateway proxy format, version 1.0 or 2.0.
+type ServerlessEvent struct {
+	HTTPMethod      string            `json:"httpMethod"`
+	Path            string            `json:"path"`
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+	// MultiValueHeaders is set by version 1.0 along with Headers.
+	MultiValueHeaders map[string][]string `json:"multiValueHeaders"`
+	RequestContext    struct {
+		// HTTP is set by version 2.0.
+		HTTP struct {
+			Method   string `json:"method"`
+			Path     string `json:"path"`
+			SourceIP string `json:"sourceIp"`
+		} `json:"http"`
+		// Identity is set by version 1.0.
+		Identity struct {
+			SourceIP string `json:"sourceIp"`
+		} `json:"identity"`
+	} `json:"requestContext"`
+}
+
+// ServerlessResponse is the response to a ServerlessEvent.
+type ServerlessResponse struct {
+	StatusCode      int               `json:"statusCode"`
+	Headers         map[string]string `json:"headers"`
+	Body            string            `json:"body"`
+	IsBase64Encoded bool              `json:"isBase64Encoded"`
+}
+
+// HandleServerless serves an HTTP event of a serverless platform, without
+// an HTTP listener, e.g. as the handler of an AWS Lambda function:
+//
+//	lambda.Start(s.HandleServerless)
+//
+// Binary response bodies, such as compressed ones, are base64 encoded.
+func (s *Server) HandleServerless(ctx context.Context, event *ServerlessEvent) (*ServerlessResponse, error) {
+	method, path, sourceIP := event.HTTPMethod, event.Path, event.RequestContext.Identity.SourceIP
+	if method == "" {
+		method, path, sourceIP = event.RequestContext.HTTP.Method, event.RequestContext.HTTP.Path, event.RequestContext.HTTP.SourceIP
+	}
+	if path == "" {
+		path = "/"
+	}
+	body := []byte(event.Body)
+	if event.IsBase64Encoded {
+		var err error
+		if body, err = base64.StdEncoding.DecodeString(event.Body); err != nil {
+			return &ServerlessResponse{StatusCode: 400, Body: "rpc: invalid base64 body"}, nil
+		}
+	}
+	r, err := http.NewRequest(method, "https://serverless"+path, bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range event.Headers {
+		r.Header.Set(k, v)
+	}
+	for k, v := range event.MultiValueHeaders {
+		r.Header[http.CanonicalHeaderKey(k)] = v
+	}
+	r.RemoteAddr = sourceIP
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r.WithContext(ctx))
+
+	res := &ServerlessResponse{
+		StatusCode: w.Code,
+		Headers:    make(map[string]string, len(w.Header())),
+	}
+	for k, v := range w.Header() {
+		res.Headers[k] = strings.Join(v, ",")
+	}
+	if b := w.Body.Bytes(); w.Header().Get("Content-Encoding") != "" || !utf8.Valid(b) {
+		res.Body = base64.StdEncoding.EncodeToString(b)
+		res.IsBase64Encoded = true
+	} else {
+		res.Body = string(b)
+	}
+	return res, nil
+}
+
+// LambdaHandler returns the handler of an AWS Lambda function serving s,
+// for lambda.Start, so that the same services run without an HTTP listener:
+//
+//	lambda.Start(rpc.LambdaHandler(s))
+//
+// It accepts API Gateway proxy events, as HandleServerless, as well as
+// direct invocations whose payload is a JSON request or batch, e.g. from the
+// Invoke API, whose result is then the response, or null for notifications.
+func LambdaHandler(s *Server) func(context.Context, json.RawMessage) (json.RawMessage, error) {
+	return func(ctx context.Context, payload json.RawMessage) (json.RawMessage, error) {
+		if isDirectInvocation(payload) {
+			r, err := http.NewRequest("POST", "lambda://invoke", bytes.NewReader(payload))
+			if err != nil {
+				return nil, err
+			}
+			r.Header.Set("Content-Type", "application/json")
+			w := httptest.NewRecorder()
+			s.ServeHTTP(w, r.WithContext(ctx))
+			if w.Code >= http.StatusBadRequest {
+				return nil, fmt.Errorf("rpc: %s", strings.TrimSpace(w.Body.String()))
+			}
+			if response := bytes.TrimSpace(w.Body.Bytes()); len(response) > 0 {
+				return response, nil
+			}
+			return json.RawMessage("null"), nil
+		}
+		event := new(ServerlessEvent)
+		if err := json.Unmarshal(payload, event); err != nil {
+			return nil, err
+		}
+		res, err := s.HandleServerless(ctx, event)
+		if err != nil {
+			return nil, err
+		}
+		return json.Marshal(res)
+	}
+}
+
+// isDirectInvocation returns true if payload is a JSON-RPC request or batch
+// rather than an HTTP event.
+func isDirectInvocation(payload []byte) bool {
+	payload = bytes.TrimSpace(payload)
+	if len(payload) > 0 && payload[0] == '[' {
+		return true
+	}
+	var envelope struct {
+		Method *string `json:"method"`
+	}
+	return json.Unmarshal(payload, &envelope) == nil && envelope.Method != nil
+}
@@ -0,0 +1,137 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"hash/fnv"
+	"sort"
+	"strconv"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// Sharded dispatch
+// ----------------------------------------------------------------------------
+
+// ShardKeyer is implemented by args types whose calls are routed to a shard
+// by key once SetShards is called. Calls with the same key run one at a
+// time, in arrival order, on the goroutine of their shard.
+type ShardKeyer interface {
+	ShardKey() string
+}
+
+// shardReplicas is the number of points of each shard on the hash ring.
+const shardReplicas = 64
+
+// shardQueueSize is the number of calls queued for each shard.
+const shardQueueSize = 64
+
+// shards dispatches calls to per-shard goroutines through a consistent hash
+// ring, so that changing the number of shards moves few keys.
+type shards struct {
+	ring   []uint32 // sorted points
+	owners map[uint32]int
+	queues []chan func()
+}
+
+// shardKey is the context key of the shard running a call.
+type shardKey struct{}
+
+// SetShards routes the calls whose args implement ShardKeyer to one of n
+// shards, each served by its own goroutine, so that the calls with the same
+// key are serialized while calls with other keys run in parallel. Handlers
+// can keep per-shard state without locking, indexed by CurrentShard.
+//
+// In-process calls made with Server.Call are routed too; a handler must not
+// wait for a call routed to another shard that may wait for its own.
+//
+// A value of n below 1 stops the shards. It must not be called while
+// serving requests.
+func (s *Server) SetShards(n int) {
+	if s.shards != nil {
+		for _, queue := range s.shards.queues {
+			close(queue)
+		}
+		s.shards = nil
+	}
+	if n < 1 {
+		return
+	}
+	sh := &shards{owners: make(map[uint32]int, n*shardReplicas)}
+	for i := 0; i < n; i++ {
+		for r := 0; r < shardReplicas; r++ {
+			point := hashKey(strconv.Itoa(i) + "-" + strconv.Itoa(r))
+			if _, ok := sh.owners[point]; !ok {
+				sh.owners[point] = i
+				sh.ring = append(sh.ring, point)
+			}
+		}
+		queue := make(chan func(), shardQueueSize)
+		sh.queues = append(sh.queues, queue)
+		go func() {
+			for call := range queue {
+				call()
+			}
+		}()
+	}
+	sort.Slice(sh.ring, func(i, j int) bool { return sh.ring[i] < sh.ring[j] })
+	s.shards = sh
+}
+
+// CurrentShard returns the shard running a call, with ctx the context of
+// the request passed to the handler, if it was routed to one.
+func CurrentShard(ctx context.Context) (int, bool) {
+	shard, ok := ctx.Value(shardKey{}).(int)
+	return shard, ok
+}
+
+// shard returns the shard of key.
+func (sh *shards) shard(key string) int {
+	h := hashKey(key)
+	i := sort.Search(len(sh.ring), func(i int) bool { return sh.ring[i] >= h })
+	if i == len(sh.ring) {
+		i = 0
+	}
+	return sh.owners[sh.ring[i]]
+}
+
+// do runs call on the shard of key, with the context of the shard, and
+// waits for it. It gives up if ctx is done before the call starts.
+func (sh *shards) do(ctx context.Context, key string, call func(context.Context)) error {
+	shard := sh.shard(key)
+	if current, ok := CurrentShard(ctx); ok && current == shard {
+		// An in-process call from the shard itself.
+		call(ctx)
+		return nil
+	}
+	var wg sync.WaitGroup
+	wg.Add(1)
+	run := func() {
+		defer wg.Done()
+		call(context.WithValue(ctx, shardKey{}, shard))
+	}
+	select {
+	case sh.queues[shard] <- run:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	wg.Wait()
+	return nil
+}
+
+// hashKey hashes a key onto the ring. FNV spreads similar keys poorly, as
+// the points of the shards are, so its hash goes through a final mix.
+func hashKey(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
@@ -0,0 +1,144 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+// StatsDMetrics sends the server measurements to a StatsD or DogStatsD
+// endpoint:
+//
+//	<prefix>calls        counter, per method and error code
+//	<prefix>call_time    timer in milliseconds, per method
+//	<prefix>batch_size   histogram
+//	<prefix>inflight     gauge of batches being processed
+//
+// With DogStatsD the method and code are sent as tags; plain StatsD has no
+// tags, so they are appended to the metric name instead. The calls of
+// methods not served are reported under the method "unknown".
+type StatsDMetrics struct {
+	// Prefix is prepended to every metric name, e.g. "myapp.rpc.".
+	Prefix string
+	// DogStatsD enables the DogStatsD tag extension.
+	DogStatsD bool
+	// Tags are added to every metric, as "key:value". DogStatsD only.
+	Tags []string
+
+	mutex    sync.Mutex
+	w        io.Writer
+	inflight int64
+}
+
+// NewStatsDMetrics returns StatsDMetrics writing one packet per metric to w.
+func NewStatsDMetrics(w io.Writer, prefix string) *StatsDMetrics {
+	return &StatsDMetrics{Prefix: prefix, w: w}
+}
+
+// DialStatsD returns StatsDMetrics sending to the StatsD daemon listening
+// on the UDP address addr.
+func DialStatsD(addr, prefix string) (*StatsDMetrics, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return NewStatsDMetrics(conn, prefix), nil
+}
+
+// BatchStarted implements Metrics.
+func (m *StatsDMetrics) BatchStarted(n int) {
+	m.mutex.Lock()
+	m.inflight++
+	inflight := m.inflight
+	m.mutex.Unlock()
+	m.send("batch_size", fmt.Sprint(n), "h", nil)
+	m.send("inflight", fmt.Sprint(inflight), "g", nil)
+}
+
+// BatchDone implements Metrics.
+func (m *StatsDMetrics) BatchDone(n int) {
+	m.mutex.Lock()
+	m.inflight--
+	inflight := m.inflight
+	m.mutex.Unlock()
+	m.send("inflight", fmt.Sprint(inflight), "g", nil)
+}
+
+// CallDone implements Metrics.
+func (m *StatsDMetrics) CallDone(method string, err error, elapsed time.Duration) {
+	if method == "" {
+		method = "unknown"
+	}
+	code := "ok"
+	if err != nil {
+		code = errorLabel(err)
+	}
+	ms := float64(elapsed) / float64(time.Millisecond)
+	m.send("calls", "1", "c", []string{"method:" + method, "code:" + code})
+	m.send("call_time", fmt.Sprintf("%g", ms), "ms", []string{"method:" + method})
+}
+
+// send writes a single metric.
+func (m *StatsDMetrics) send(name, value, kind string, tags []string) {
+	var b strings.Builder
+	b.WriteString(m.Prefix)
+	b.WriteString(name)
+	if !m.DogStatsD {
+		for _, tag := range tags {
+			b.WriteByte('.')
+			b.WriteString(statsdSanitize(tag[strings.IndexByte(tag, ':')+1:]))
+		}
+	}
+	b.WriteByte(':')
+	b.WriteString(value)
+	b.WriteByte('|')
+	b.WriteString(kind)
+	if m.DogStatsD && len(m.Tags)+len(tags) > 0 {
+		b.WriteString("|#")
+		b.WriteString(strings.Join(m.Tags, ","))
+		for i, tag := range tags {
+			if i > 0 || len(m.Tags) > 0 {
+				b.WriteByte(',')
+			}
+			key, value, _ := strings.Cut(tag, ":")
+			b.WriteString(key)
+			b.WriteByte(':')
+			b.WriteString(dogstatsdSanitize(value))
+		}
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	// Metrics are best effort: write errors are ignored.
+	io.WriteString(m.w, b.String())
+}
+
+// statsdSanitize replaces the characters that have a meaning in a StatsD
+// metric name.
+func statsdSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '.', ':', '|', '@', '#', ' ':
+			return '_'
+		}
+		return r
+	}, s)
+}
+
+// dogstatsdSanitize replaces the characters that have a meaning in a
+// DogStatsD tag value.
+func dogstatsdSanitize(s string) string {
+	return strings.Map(func(r rune) rune {
+		switch r {
+		case '|', ',', '#', '@', ' ', '\n', '\r':
+			return '_'
+		}
+		return r
+	}, s)
+}
@@ -0,0 +1,35 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"io"
+	"os"
+)
+
+// ----------------------------------------------------------------------------
+// Standard streams
+// ----------------------------------------------------------------------------
+
+// ServeStdio serves JSON-RPC requests read from the standard input, writing
+// the responses to the standard output, with the Content-Length headers of
+// FrameHeader as in the Language Server Protocol. It returns once the input
+// is closed or fails, or with the error of ctx when a request is read after
+// it is done.
+//
+// Nothing else may write to the standard output meanwhile: logs should go
+// to the standard error.
+func (s *Server) ServeStdio(ctx context.Context) error {
+	return s.ServeStream(ctx, os.Stdin, os.Stdout)
+}
+
+// ServeStream serves requests read from in, writing the responses to out,
+// framed with Content-Length headers as ServeStdio. The requests are served
+// in order, with ctx as their context.
+func (s *Server) ServeStream(ctx context.Context, in io.Reader, out io.Writer) error {
+	l := &ConnListener{Framing: FrameHeader}
+	return l.serveStream(ctx, s, in, out, "stdio://", "stdio")
+}
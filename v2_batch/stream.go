@@ -0,0 +1,135 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"io"
+	"net/http"
+	"sync/atomic"
+)
+
+// ----------------------------------------------------------------------------
+// Batch streaming
+// ----------------------------------------------------------------------------
+
+// StreamCodec is implemented by codecs that can decode and answer a batch
+// incrementally, bounding memory use independently of the batch size.
+type StreamCodec interface {
+	Codec
+	// NewStream starts processing the batch in the body of r. It returns a
+	// nil BatchStream, leaving the body untouched, if the body is not a
+	// batch.
+	NewStream(r *http.Request, w http.ResponseWriter) (BatchStream, error)
+}
+
+// BatchStream decodes the requests of a batch and writes their replies in
+// chunks.
+type BatchStream interface {
+	// Next decodes up to n requests. It returns io.EOF once the batch is
+	// exhausted. Malformed entries are returned as requests whose Error
+	// method reports the problem.
+	Next(n int) ([]CodecRequest, error)
+	// WriteReplies writes the replies of the requests returned by the last
+	// call to Next, in order.
+	WriteReplies(replies []interface{}) error
+	// Close terminates the response.
+	Close() error
+}
+
+// SetBatchChunking makes the server process batches whose body is larger
+// than threshold bytes, or of unknown length, in chunks of chunkSize
+// requests: a chunk is decoded, executed and written before the next one is
+// read. It only applies to codecs implementing StreamCodec.
+//
+// A chunkSize of 0 disables chunking, which is the default.
+func (s *Server) SetBatchChunking(threshold int64, chunkSize int) {
+	s.chunkThreshold = threshold
+	s.chunkSize = chunkSize
+}
+
+// streamable reports whether the request must be processed in chunks.
+func (s *Server) streamable(r *http.Request) bool {
+	return s.chunkSize > 0 && (r.ContentLength < 0 || r.ContentLength > s.chunkThreshold)
+}
+
+// serveChunk processes the requests of a chunk and writes their replies. It
+// returns false if processing of the batch must stop. For metrics, each chunk
+// counts as a batch.
+func (s *Server) serveChunk(r *http.Request, stream BatchStream, codecReqArray []CodecRequest, b *batch) bool {
+	if s.metrics != nil {
+		s.metrics.BatchStarted(len(codecReqArray))
+		defer s.metrics.BatchDone(len(codecReqArray))
+	}
+	codecRepArray, ok := s.serveRequests(r, codecReqArray, b)
+	if !ok {
+		return false
+	}
+	return stream.WriteReplies(compactReplies(codecRepArray)) == nil
+}
+
+// serveStream processes a batch chunk by chunk. It returns false if the
+// batch couldn't be answered completely. The limits adapted to the caller
+// apply as to other batches, see SetAdaptiveBatchLimits.
+func (s *Server) serveStream(r *http.Request, codec Codec, stream BatchStream) bool {
+	caller := s.Caller(r)
+	maxSize, concurrency := s.BatchLimits(caller)
+	hard := s.batchSizeLimit()
+	limit := hard
+	if maxSize > 0 && (limit == 0 || maxSize < limit) {
+		limit = maxSize
+	}
+	// Truncation is not applied to streamed responses.
+	b := &batch{concurrency: concurrency}
+	var pending []CodecRequest
+	var err error
+	if limit > 0 {
+		// Read up to the limit to reject the batch before dispatching.
+		pending, err = stream.Next(limit + 1)
+		if len(pending) > limit {
+			if limit != hard {
+				s.recordBatch(caller, len(pending), len(pending), r.ContentLength)
+			}
+			replier, ok := codec.(ErrorReplier)
+			if !ok {
+				stream.Close()
+				return false
+			}
+			err = stream.WriteReplies([]interface{}{replier.ErrorReply(batchTooLarge(limit))})
+			return stream.Close() == nil && err == nil
+		}
+	}
+	calls := 0
+	defer func() {
+		s.recordBatch(caller, calls, int(atomic.LoadInt32(&b.failed)), r.ContentLength)
+	}()
+	for {
+		var codecReqArray []CodecRequest
+		if len(pending) > 0 {
+			n := s.chunkSize
+			if n > len(pending) {
+				n = len(pending)
+			}
+			codecReqArray, pending = pending[:n], pending[n:]
+		} else if err == nil {
+			codecReqArray, err = stream.Next(s.chunkSize)
+		}
+		calls += len(codecReqArray)
+		if len(codecReqArray) > 0 && !s.serveChunk(r, stream, codecReqArray, b) {
+			stream.Close()
+			return false
+		}
+		if len(pending) > 0 {
+			continue
+		}
+		if err == io.EOF {
+			return stream.Close() == nil
+		}
+		if err != nil {
+			// A broken body can't be answered further.
+			stream.Close()
+			return false
+		}
+	}
+}
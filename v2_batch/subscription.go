@@ -0,0 +1,307 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ----------------------------------------------------------------------------
+// Subscriptions
+// ----------------------------------------------------------------------------
+
+// ConnectionHeader is the request header naming the connection of the
+// SubscriptionHandler that receives the notifications of the subscriptions
+// created by the call.
+const ConnectionHeader = "Rpc-Connection"
+
+// unsubscribeMethod is the built-in method cancelling a subscription.
+const unsubscribeMethod = "subscription.unsubscribe"
+
+// ErrNoConnection is returned by NewSubscription when the call doesn't name
+// a connection of the SubscriptionHandler.
+var ErrNoConnection = errors.New("rpc: subscriptions need a connection, see ConnectionHeader")
+
+// subscriptionHub holds the connections of the SubscriptionHandler.
+type subscriptionHub struct {
+	mutex sync.Mutex
+	conns map[string]*subscriptionConn
+}
+
+// subscriptionConn is a connection of the SubscriptionHandler and its
+// subscriptions.
+type subscriptionConn struct {
+	server *Server
+	id     string
+	events chan []byte
+	subs   map[string]*subscription
+}
+
+// subscription is the state of a Subscription.
+type subscription struct {
+	id     string
+	method string
+	conn   *subscriptionConn
+	done   chan struct{}
+}
+
+// subscriptionKey is the context key of the connection of a call.
+type subscriptionKey struct{}
+
+// Subscription is a stream of notifications to a client, created by a
+// method with NewSubscription and returned as its reply, which encodes as
+// the subscription id:
+//
+//	func (s *Chain) NewHeads(ctx context.Context, args *Args) (*rpc.Subscription, error) {
+//		sub, err := rpc.NewSubscription(ctx)
+//		if err != nil {
+//			return nil, err
+//		}
+//		go func() {
+//			for head := range s.heads() {
+//				if sub.Notify(head) != nil {
+//					return
+//				}
+//			}
+//		}()
+//		return &sub, nil
+//	}
+//
+// Each notification calls the "subscription" method of the service, as in
+// "Chain.subscription", with the subscription id and the result:
+//
+//	{"jsonrpc":"2.0","method":"Chain.subscription","params":{"subscription":"<id>","result":<result>}}
+type Subscription struct {
+	sub *subscription
+}
+
+// EnableSubscriptions registers the built-in "subscription.unsubscribe"
+// method, taking a subscription id and returning whether it was cancelled.
+// Serve the connections delivering the notifications with the
+// SubscriptionHandler.
+func (s *Server) EnableSubscriptions() error {
+	return s.RegisterFunc(unsubscribeMethod, func(r *http.Request, id *string) (*bool, error) {
+		conn := s.subscriptions.conn(r.Header.Get(ConnectionHeader))
+		ok := conn != nil && conn.unsubscribe(*id)
+		return &ok, nil
+	})
+}
+
+// SubscriptionHandler returns a handler opening a connection delivering the
+// notifications of subscriptions, as Server-Sent Events. The first event,
+// of type "connection", carries the connection id, to be sent in the
+// ConnectionHeader of the calls creating subscriptions. The notifications
+// follow as "message" events.
+//
+// The subscriptions of a connection are cancelled when it is closed.
+func (s *Server) SubscriptionHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			WriteError(w, 500, "rpc: streaming unsupported")
+			return
+		}
+		conn := s.subscriptions.open(s)
+		defer s.subscriptions.close(conn)
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.WriteHeader(200)
+		fmt.Fprintf(w, "event: connection\ndata: %s\n\n", conn.id)
+		flusher.Flush()
+		for {
+			select {
+			case event := <-conn.events:
+				if _, err := fmt.Fprintf(w, "data: %s\n\n", event); err != nil {
+					return
+				}
+				flusher.Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	})
+}
+
+// NewSubscription creates a subscription from a method, with ctx the
+// context of the request passed to it, delivering to the connection named
+// by the ConnectionHeader of the call. The method returns it as its reply;
+// if the method fails instead, it must Unsubscribe.
+func NewSubscription(ctx context.Context) (Subscription, error) {
+	conn, ok := ctx.Value(subscriptionKey{}).(*subscriptionConn)
+	if !ok {
+		return Subscription{}, ErrNoConnection
+	}
+	method, _ := CurrentMethod(ctx)
+	if i := strings.Index(method, "."); i >= 0 {
+		method = method[:i]
+	}
+	sub := &subscription{
+		id:     conn.server.NewID(),
+		method: method + ".subscription",
+		conn:   conn,
+		done:   make(chan struct{}),
+	}
+	hub := &conn.server.subscriptions
+	hub.mutex.Lock()
+	defer hub.mutex.Unlock()
+	if conn.subs == nil {
+		// The connection is closed.
+		close(sub.done)
+		return Subscription{}, ErrNoConnection
+	}
+	conn.subs[sub.id] = sub
+	return Subscription{sub}, nil
+}
+
+// ID returns the id of the subscription.
+func (s Subscription) ID() string {
+	if s.sub == nil {
+		return ""
+	}
+	return s.sub.id
+}
+
+// MarshalJSON encodes the subscription as its id.
+func (s Subscription) MarshalJSON() ([]byte, error) {
+	return json.Marshal(s.ID())
+}
+
+// closedChan is the Done channel of the zero Subscription.
+var closedChan = make(chan struct{})
+
+func init() {
+	close(closedChan)
+}
+
+// Done is closed when the subscription is cancelled, by the client or
+// because its connection closed. It is closed for the zero Subscription.
+func (s Subscription) Done() <-chan struct{} {
+	if s.sub == nil {
+		return closedChan
+	}
+	return s.sub.done
+}
+
+// Notify sends a notification with result to the client. It fails if the
+// subscription is cancelled or the connection buffer, of EventBufferSize
+// notifications, is full, and for the zero Subscription.
+func (s Subscription) Notify(result interface{}) error {
+	if s.sub == nil {
+		return fmt.Errorf("rpc: no subscription")
+	}
+	data, err := json.Marshal(&notification{
+		Version: "2.0",
+		Method:  s.sub.method,
+		Params: map[string]interface{}{
+			"subscription": s.sub.id,
+			"result":       result,
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("rpc: can't encode notification: %v", err)
+	}
+	select {
+	case <-s.sub.done:
+		return fmt.Errorf("rpc: subscription %q cancelled", s.sub.id)
+	default:
+	}
+	select {
+	case s.sub.conn.events <- data:
+		return nil
+	default:
+		return fmt.Errorf("rpc: subscription %q falling behind", s.sub.id)
+	}
+}
+
+// Unsubscribe cancels the subscription. It does nothing for the zero
+// Subscription.
+func (s Subscription) Unsubscribe() {
+	if s.sub == nil {
+		return
+	}
+	s.sub.conn.unsubscribe(s.sub.id)
+}
+
+// withConnection returns r carrying the connection named by its
+// ConnectionHeader, if any.
+func (s *Server) withConnection(r *http.Request) *http.Request {
+	id := r.Header.Get(ConnectionHeader)
+	if id == "" {
+		return r
+	}
+	conn := s.subscriptions.conn(id)
+	if conn == nil {
+		return r
+	}
+	return r.WithContext(context.WithValue(r.Context(), subscriptionKey{}, conn))
+}
+
+func (h *subscriptionHub) open(s *Server) *subscriptionConn {
+	conn := &subscriptionConn{
+		server: s,
+		id:     s.NewID(),
+		events: make(chan []byte, EventBufferSize),
+		subs:   make(map[string]*subscription),
+	}
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	if h.conns == nil {
+		h.conns = make(map[string]*subscriptionConn)
+	}
+	h.conns[conn.id] = conn
+	return conn
+}
+
+// close cancels the subscriptions of a connection and forgets it.
+func (h *subscriptionHub) close(conn *subscriptionConn) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	delete(h.conns, conn.id)
+	for _, sub := range conn.subs {
+		close(sub.done)
+	}
+	conn.subs = nil
+}
+
+// broadcast sends an event to every connection, dropping it for those
+// whose buffer is full.
+func (h *subscriptionHub) broadcast(data []byte) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for _, conn := range h.conns {
+		select {
+		case conn.events <- data:
+		default:
+		}
+	}
+}
+
+func (h *subscriptionHub) conn(id string) *subscriptionConn {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	return h.conns[id]
+}
+
+// unsubscribe cancels a subscription of the connection, returning false if
+// there is none with this id.
+func (c *subscriptionConn) unsubscribe(id string) bool {
+	h := &c.server.subscriptions
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	sub, ok := c.subs[id]
+	if !ok {
+		return false
+	}
+	delete(c.subs, id)
+	close(sub.done)
+	return true
+}
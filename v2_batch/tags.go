@@ -0,0 +1,231 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+)
+
+// ----------------------------------------------------------------------------
+// Tag validation
+// ----------------------------------------------------------------------------
+
+// fieldRules are the validation rules of a struct field, from its rpc tag.
+type fieldRules struct {
+	required bool
+	min, max *float64
+	pattern  *regexp.Regexp
+}
+
+// taggedField is a field of a struct walked by checkTags.
+type taggedField struct {
+	index    int
+	name     string      // as encoded in JSON
+	embedded bool        // promoted fields, named as those of the outer struct
+	rules    *fieldRules // nil without rules
+}
+
+// structFields caches the taggedFields of the struct types.
+var structFields sync.Map // reflect.Type -> []taggedField
+
+// parseRules parses the rpc tag of a field of type t, see Validator.
+func parseRules(tag string, t reflect.Type) (*fieldRules, error) {
+	rules := new(fieldRules)
+	kind := indirect(t).Kind()
+	for tag != "" {
+		var rule string
+		if strings.HasPrefix(tag, "pattern=") {
+			rule, tag = tag, ""
+		} else if i := strings.Index(tag, ","); i >= 0 {
+			rule, tag = tag[:i], tag[i+1:]
+		} else {
+			rule, tag = tag, ""
+		}
+		name, value, _ := strings.Cut(rule, "=")
+		switch name {
+		case "required":
+			rules.required = true
+		case "min", "max":
+			switch kind {
+			case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+				reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr,
+				reflect.Float32, reflect.Float64, reflect.String, reflect.Slice, reflect.Array, reflect.Map:
+			default:
+				return nil, fmt.Errorf("rule %q doesn't apply to %s", name, t)
+			}
+			n, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %q", rule)
+			}
+			if name == "min" {
+				rules.min = &n
+			} else {
+				rules.max = &n
+			}
+		case "pattern":
+			if kind != reflect.String {
+				return nil, fmt.Errorf("rule %q doesn't apply to %s", name, t)
+			}
+			re, err := regexp.Compile(value)
+			if err != nil {
+				return nil, fmt.Errorf("invalid rule %q: %v", rule, err)
+			}
+			rules.pattern = re
+		case "":
+		default:
+			return nil, fmt.Errorf("unknown rule %q", name)
+		}
+	}
+	return rules, nil
+}
+
+// fieldsOf returns the fields of struct type t walked by checkTags.
+func fieldsOf(t reflect.Type) []taggedField {
+	if fields, ok := structFields.Load(t); ok {
+		return fields.([]taggedField)
+	}
+	var fields []taggedField
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		field := taggedField{index: i, name: strings.Split(tag, ",")[0]}
+		if field.name == "" {
+			field.embedded = f.Anonymous && indirect(f.Type).Kind() == reflect.Struct
+			field.name = f.Name
+		}
+		if tag, ok := f.Tag.Lookup("rpc"); ok {
+			// Invalid tags are reported at registration.
+			field.rules, _ = parseRules(tag, f.Type)
+		}
+		if field.rules != nil || field.embedded || mayHoldStruct(f.Type) {
+			fields = append(fields, field)
+		}
+	}
+	structFields.Store(t, fields)
+	return fields
+}
+
+// mayHoldStruct returns true if values of type t may hold structs.
+func mayHoldStruct(t reflect.Type) bool {
+	seen := make(map[reflect.Type]bool)
+	for !seen[t] {
+		seen[t] = true
+		switch t.Kind() {
+		case reflect.Struct, reflect.Interface:
+			return true
+		case reflect.Ptr, reflect.Slice, reflect.Array, reflect.Map:
+			t = t.Elem()
+		default:
+			return false
+		}
+	}
+	return false
+}
+
+// checkTags walks v, named path, adding the fields breaking the rules of
+// their rpc tags to violations.
+func checkTags(v reflect.Value, path string, seen map[uintptr]bool, violations *[]FieldViolation) {
+	switch v.Kind() {
+	case reflect.Ptr, reflect.Interface:
+		if v.IsNil() {
+			return
+		}
+		if v.Kind() == reflect.Ptr {
+			if seen[v.Pointer()] {
+				return
+			}
+			seen[v.Pointer()] = true
+		}
+		checkTags(v.Elem(), path, seen, violations)
+	case reflect.Struct:
+		for _, f := range fieldsOf(v.Type()) {
+			fv := v.Field(f.index)
+			if f.embedded {
+				checkTags(fv, path, seen, violations)
+				continue
+			}
+			name := f.name
+			if path != "" {
+				name = path + "." + name
+			}
+			if f.rules != nil {
+				if problem := f.rules.check(fv); problem != "" {
+					*violations = append(*violations, FieldViolation{Field: name, Description: problem})
+					continue
+				}
+			}
+			checkTags(fv, name, seen, violations)
+		}
+	case reflect.Slice, reflect.Array:
+		if !mayHoldStruct(v.Type().Elem()) {
+			return
+		}
+		for i := 0; i < v.Len(); i++ {
+			checkTags(v.Index(i), fmt.Sprintf("%s[%d]", path, i), seen, violations)
+		}
+	case reflect.Map:
+		if !mayHoldStruct(v.Type().Elem()) {
+			return
+		}
+		iter := v.MapRange()
+		for iter.Next() {
+			checkTags(iter.Value(), fmt.Sprintf("%s[%v]", path, iter.Key()), seen, violations)
+		}
+	}
+}
+
+// check returns the rule broken by v, if any. Rules other than required
+// don't apply to nil pointers, which optional fields can be.
+func (r *fieldRules) check(v reflect.Value) string {
+	if r.required && v.IsZero() {
+		return "is required"
+	}
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	// Lengths are counted in units.
+	var n float64
+	var units string
+	switch v.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		n = float64(v.Int())
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		n = float64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		n = v.Float()
+	case reflect.String:
+		n, units = float64(utf8.RuneCountInString(v.String())), "characters"
+	case reflect.Slice, reflect.Array, reflect.Map:
+		n, units = float64(v.Len()), "elements"
+	}
+	switch {
+	case r.min != nil && n < *r.min && units != "":
+		return fmt.Sprintf("must have at least %g %s", *r.min, units)
+	case r.min != nil && n < *r.min:
+		return fmt.Sprintf("must be at least %g", *r.min)
+	case r.max != nil && n > *r.max && units != "":
+		return fmt.Sprintf("must have at most %g %s", *r.max, units)
+	case r.max != nil && n > *r.max:
+		return fmt.Sprintf("must be at most %g", *r.max)
+	case r.pattern != nil && !r.pattern.MatchString(v.String()):
+		return fmt.Sprintf("must match %q", r.pattern)
+	}
+	return ""
+}
@@ -0,0 +1,191 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Hard timeouts
+// ----------------------------------------------------------------------------
+
+// StuckCall describes a handler abandoned past its deadline which hasn't
+// returned yet.
+type StuckCall struct {
+	Method  string
+	Started time.Time
+}
+
+// stuckCalls holds the abandoned handlers still running.
+type stuckCalls struct {
+	mutex sync.Mutex
+	calls map[*StuckCall]struct{}
+}
+
+// SetHardTimeout makes the server abandon the handlers still running d
+// after their call started, or past the deadline of the request context if
+// earlier: the call is answered right away with a CodeDeadlineExceeded
+// error and the result of the handler, once it returns, is discarded. The
+// context of the handler is cancelled at the deadline. The timeout is
+// measured by the server clock, see SetClock.
+//
+// A call whose request context is cancelled before the deadline, e.g. as
+// the client went away, is answered right away with the cancellation
+// error; its handler is left to return on its own.
+//
+// The goroutine of an abandoned handler can't be stopped: it is logged and
+// reported by StuckCalls until it returns. Handlers then get copies of
+// their args. A d of 0 turns hard timeouts off, which is the default.
+func (s *Server) SetHardTimeout(d time.Duration) {
+	s.hardTimeout = d
+}
+
+// StuckCalls returns the handlers abandoned past their deadline which
+// haven't returned yet.
+func (s *Server) StuckCalls() []StuckCall {
+	s.stuck.mutex.Lock()
+	defer s.stuck.mutex.Unlock()
+	calls := make([]StuckCall, 0, len(s.stuck.calls))
+	for call := range s.stuck.calls {
+		calls = append(calls, *call)
+	}
+	return calls
+}
+
+// callAbortable runs call in its own goroutine, with its own args and
+// reply, and returns when it does or at the deadline.
+func (s *Server) callAbortable(r *http.Request, method string, args, reply reflect.Value, call func(r *http.Request, args, reply reflect.Value) error) error {
+	ctx, cancel := withClockTimeout(r.Context(), s.clock, s.hardTimeout)
+	defer cancel()
+	ownArgs := reflect.New(args.Type().Elem())
+	ownArgs.Elem().Set(args.Elem())
+	ownReply := reflect.New(reply.Type().Elem())
+
+	started := s.clock.Now()
+	done := make(chan error, 1)
+	var mutex sync.Mutex
+	var stuck *StuckCall
+	go func() {
+		err := call(r.WithContext(ctx), ownArgs, ownReply)
+		done <- err
+		mutex.Lock()
+		defer mutex.Unlock()
+		if stuck != nil {
+			s.stuck.remove(stuck)
+			s.log(LevelInfo, "rpc: abandoned handler returned",
+				Field{"rpc.method", method}, Field{"rpc.duration", s.clock.Now().Sub(started)})
+		}
+	}()
+	finish := func(err error) error {
+		if err == nil {
+			reply.Elem().Set(ownReply.Elem())
+		}
+		return err
+	}
+	select {
+	case err := <-done:
+		return finish(err)
+	case <-ctx.Done():
+	}
+	mutex.Lock()
+	select {
+	case err := <-done:
+		// Returned just in time.
+		mutex.Unlock()
+		return finish(err)
+	default:
+	}
+	if err := ctx.Err(); err != context.DeadlineExceeded {
+		mutex.Unlock()
+		return fmt.Errorf("rpc: %s cancelled: %w", method, err)
+	}
+	stuck = &StuckCall{Method: method, Started: started}
+	s.stuck.add(stuck)
+	mutex.Unlock()
+	s.log(LevelWarn, "rpc: handler abandoned past its deadline", Field{"rpc.method", method})
+	return &Error{
+		Code:    CodeDeadlineExceeded,
+		Message: fmt.Sprintf("rpc: %s abandoned: %v", method, ctx.Err()),
+	}
+}
+
+// clockContext is a context done at a deadline measured by a Clock, or
+// with its parent.
+type clockContext struct {
+	context.Context
+	deadline time.Time
+	done     chan struct{}
+
+	mutex sync.Mutex
+	err   error
+}
+
+// withClockTimeout returns a copy of parent done once clock has advanced
+// by d, as context.WithTimeout does with the system time.
+func withClockTimeout(parent context.Context, clock Clock, d time.Duration) (context.Context, context.CancelFunc) {
+	ctx := &clockContext{
+		Context:  parent,
+		deadline: clock.Now().Add(d),
+		done:     make(chan struct{}),
+	}
+	timer := clock.After(d)
+	go func() {
+		select {
+		case <-timer:
+			ctx.cancel(context.DeadlineExceeded)
+		case <-parent.Done():
+			ctx.cancel(parent.Err())
+		case <-ctx.done:
+		}
+	}()
+	return ctx, func() { ctx.cancel(context.Canceled) }
+}
+
+func (c *clockContext) cancel(err error) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.err == nil {
+		c.err = err
+		close(c.done)
+	}
+}
+
+func (c *clockContext) Deadline() (time.Time, bool) {
+	if deadline, ok := c.Context.Deadline(); ok && deadline.Before(c.deadline) {
+		return deadline, true
+	}
+	return c.deadline, true
+}
+
+func (c *clockContext) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *clockContext) Err() error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.err
+}
+
+func (c *stuckCalls) add(call *StuckCall) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.calls == nil {
+		c.calls = make(map[*StuckCall]struct{})
+	}
+	c.calls[call] = struct{}{}
+}
+
+func (c *stuckCalls) remove(call *StuckCall) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	delete(c.calls, call)
+}
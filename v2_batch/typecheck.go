@@ -0,0 +1,225 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+// ----------------------------------------------------------------------------
+// Registration checks
+// ----------------------------------------------------------------------------
+
+// TypeProblem is a problem found in the args or reply type of a method at
+// registration, which would make its calls fail to encode or decode.
+type TypeProblem struct {
+	// Method is the method name, in dotted notation as in "Service.Method".
+	Method string
+	// Path names the offending field, as in "args.Items[].Ch".
+	Path string
+	// Problem describes it.
+	Problem string
+}
+
+func (p TypeProblem) String() string {
+	return fmt.Sprintf("%s: %s: %s", p.Method, p.Path, p.Problem)
+}
+
+// RegistrationError is returned when registering methods whose args or
+// reply types have problems, reporting all of them.
+type RegistrationError struct {
+	Service  string
+	Problems []TypeProblem
+}
+
+func (e *RegistrationError) Error() string {
+	lines := make([]string, len(e.Problems))
+	for i, p := range e.Problems {
+		lines[i] = "\n\t" + p.String()
+	}
+	return fmt.Sprintf("rpc: %q has %d type problems:%s", e.Service, len(e.Problems), strings.Join(lines, ""))
+}
+
+var (
+	jsonUnmarshalerType = reflect.TypeOf((*json.Unmarshaler)(nil)).Elem()
+	textUnmarshalerType = reflect.TypeOf((*encoding.TextUnmarshaler)(nil)).Elem()
+)
+
+// checkMethods checks the args and reply types of the methods of a service,
+// returning a *RegistrationError if any has problems.
+func checkMethods(service string, methods map[string]*serviceMethod) error {
+	var problems []TypeProblem
+	for name, m := range methods {
+		method := service + "." + name
+		report := func(path, problem string) {
+			problems = append(problems, TypeProblem{Method: method, Path: path, Problem: problem})
+		}
+		checkType(m.argsType, "args", make(map[reflect.Type]bool), report)
+		checkType(m.replyType, "reply", make(map[reflect.Type]bool), report)
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	sort.Slice(problems, func(i, j int) bool {
+		if problems[i].Method != problems[j].Method {
+			return problems[i].Method < problems[j].Method
+		}
+		return problems[i].Path < problems[j].Path
+	})
+	return &RegistrationError{Service: service, Problems: problems}
+}
+
+// checkType walks t, named path, reporting the types that can't be encoded
+// or decoded as JSON. Types marshaling themselves are trusted.
+func checkType(t reflect.Type, path string, seen map[reflect.Type]bool, report func(path, problem string)) {
+	if marshalsItself(t) || seen[t] {
+		return
+	}
+	seen[t] = true
+	defer delete(seen, t)
+	switch t.Kind() {
+	case reflect.Complex64, reflect.Complex128, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		report(path, "unsupported type "+t.String())
+	case reflect.Ptr, reflect.Slice, reflect.Array:
+		elemPath := path
+		if t.Kind() != reflect.Ptr {
+			elemPath += "[]"
+		}
+		checkType(t.Elem(), elemPath, seen, report)
+	case reflect.Map:
+		switch key := t.Key(); key.Kind() {
+		case reflect.String, reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+			reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64, reflect.Uintptr:
+		default:
+			if !key.Implements(textMarshalerType) {
+				report(path, "unsupported map key type "+key.String())
+			}
+		}
+		checkType(t.Elem(), path+"[]", seen, report)
+	case reflect.Struct:
+		fields := jsonFields(t, path, report)
+		for _, f := range fields {
+			checkType(f.Type, path+"."+f.Name, seen, report)
+		}
+		// As with encoding/json, the shallowest fields of a name win over
+		// promoted ones, then a single tagged one over untagged ones.
+		// Otherwise they are all dropped.
+		byName := make(map[string][]jsonField)
+		var names []string
+		for _, f := range fields {
+			if byName[f.name] == nil {
+				names = append(names, f.name)
+			}
+			byName[f.name] = append(byName[f.name], f)
+		}
+		for _, name := range names {
+			// The fields are in order of depth.
+			var shallowest, tagged []string
+			for _, f := range byName[name] {
+				if f.depth > byName[name][0].depth {
+					break
+				}
+				shallowest = append(shallowest, f.goPath)
+				if f.tagged {
+					tagged = append(tagged, f.goPath)
+				}
+			}
+			if len(shallowest) == 1 || len(tagged) == 1 {
+				continue
+			}
+			if len(tagged) > 1 {
+				shallowest = tagged
+			}
+			report(path, fmt.Sprintf("fields %s both encode as %q and are dropped", strings.Join(shallowest, " and "), name))
+		}
+	}
+}
+
+// jsonField is a field of a struct encoded by encoding/json, possibly
+// promoted from an embedded struct.
+type jsonField struct {
+	reflect.StructField
+	name   string // encoded name
+	goPath string // e.g. "Embedded.Name" if promoted
+	depth  int    // of embedding
+	tagged bool   // if name is given by the json tag
+}
+
+// jsonFields returns the fields of struct t encoded by encoding/json,
+// including the promoted ones of any depth, checking their rpc tags.
+func jsonFields(t reflect.Type, path string, report func(path, problem string)) []jsonField {
+	type embedded struct {
+		t      reflect.Type
+		goPath string
+	}
+	var fields []jsonField
+	visited := make(map[reflect.Type]bool)
+	next := []embedded{{t: t}}
+	for depth := 0; len(next) > 0; depth++ {
+		current := next
+		next = nil
+		for _, e := range current {
+			if visited[e.t] {
+				continue
+			}
+			visited[e.t] = true
+			for i := 0; i < e.t.NumField(); i++ {
+				f := e.t.Field(i)
+				if f.PkgPath != "" && !f.Anonymous {
+					continue
+				}
+				tag := f.Tag.Get("json")
+				if tag == "-" {
+					continue
+				}
+				if rules, ok := f.Tag.Lookup("rpc"); ok {
+					if _, err := parseRules(rules, f.Type); err != nil {
+						report(path+"."+f.Name, "invalid rpc tag: "+err.Error())
+					}
+				}
+				goPath := e.goPath + f.Name
+				name := strings.Split(tag, ",")[0]
+				if name == "" && f.Anonymous && indirect(f.Type).Kind() == reflect.Struct {
+					// Embedded fields are promoted.
+					next = append(next, embedded{indirect(f.Type), goPath + "."})
+					continue
+				}
+				if f.PkgPath != "" {
+					continue
+				}
+				field := jsonField{StructField: f, name: name, goPath: goPath, depth: depth, tagged: name != ""}
+				if name == "" {
+					field.name = f.Name
+				}
+				fields = append(fields, field)
+			}
+		}
+	}
+	return fields
+}
+
+// marshalsItself returns true if t or *t encodes and decodes itself.
+func marshalsItself(t reflect.Type) bool {
+	for _, t := range []reflect.Type{t, reflect.PtrTo(t)} {
+		if t.Implements(jsonMarshalerType) || t.Implements(jsonUnmarshalerType) ||
+			t.Implements(textMarshalerType) || t.Implements(textUnmarshalerType) {
+			return true
+		}
+	}
+	return false
+}
+
+// indirect returns the type pointed to by t, if it is a pointer.
+func indirect(t reflect.Type) reflect.Type {
+	if t.Kind() == reflect.Ptr {
+		return t.Elem()
+	}
+	return t
+}
@@ -0,0 +1,89 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+)
+
+// ----------------------------------------------------------------------------
+// Unix domain sockets
+// ----------------------------------------------------------------------------
+
+// UnixOption configures the socket created by ListenUnix.
+type UnixOption func(*unixOptions)
+
+// unixOptions are the options of ListenUnix.
+type unixOptions struct {
+	mode os.FileMode
+	gid  int
+}
+
+// SocketMode sets the permissions of the socket file. Defaults to 0600,
+// giving access to the owner only.
+func SocketMode(mode os.FileMode) UnixOption {
+	return func(o *unixOptions) {
+		o.mode = mode
+	}
+}
+
+// SocketGroup sets the group owning the socket file, e.g. to give access to
+// the members of the group with SocketMode(0660).
+func SocketGroup(gid int) UnixOption {
+	return func(o *unixOptions) {
+		o.gid = gid
+	}
+}
+
+// ListenUnix returns a listener serving HTTP on a Unix domain socket at
+// path, for sidecars and local agents. A stale socket left at path by a
+// process that died is replaced; the socket is removed on shutdown.
+func ListenUnix(path string, opts ...UnixOption) (*HTTPListener, error) {
+	options := unixOptions{mode: 0600, gid: -1}
+	for _, opt := range opts {
+		opt(&options)
+	}
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("rpc: %s exists and is not a socket", path)
+		}
+		if conn, err := net.Dial("unix", path); err == nil {
+			conn.Close()
+			return nil, fmt.Errorf("rpc: %s is in use", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	l.(*net.UnixListener).SetUnlinkOnClose(true)
+	if err := os.Chmod(path, options.mode); err != nil {
+		l.Close()
+		return nil, err
+	}
+	if options.gid >= 0 {
+		if err := os.Chown(path, -1, options.gid); err != nil {
+			l.Close()
+			return nil, err
+		}
+	}
+	return &HTTPListener{Listener: l}, nil
+}
+
+// ListenAndServeUnix serves s over HTTP on a Unix domain socket at path, as
+// with ListenUnix, until ctx is done.
+func ListenAndServeUnix(ctx context.Context, path string, s *Server, opts ...UnixOption) error {
+	l, err := ListenUnix(path, opts...)
+	if err != nil {
+		return err
+	}
+	return Serve(ctx, s, l)
+}
@@ -0,0 +1,136 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ----------------------------------------------------------------------------
+// Usage analytics
+// ----------------------------------------------------------------------------
+
+// usageWindow is the number of one-minute buckets used to compute rates.
+const usageWindow = 60
+
+// Usage is the usage of a method by a caller.
+type Usage struct {
+	Caller    string    `json:"caller"`
+	Method    string    `json:"method"`
+	Calls     int64     `json:"calls"`
+	FirstSeen time.Time `json:"first_seen"`
+	LastSeen  time.Time `json:"last_seen"`
+	// PerMinute is the average number of calls per minute over the last
+	// hour.
+	PerMinute float64 `json:"per_minute"`
+}
+
+type usageEntry struct {
+	Usage
+	buckets [usageWindow]int64
+	minutes [usageWindow]int64
+}
+
+// usageTracker counts the calls per caller and method.
+type usageTracker struct {
+	mutex   sync.Mutex
+	enabled bool
+	entries map[[2]string]*usageEntry
+}
+
+// EnableUsageTracking turns on counting calls per caller, as identified by
+// the caller function, and method. See UsageReport.
+func (s *Server) EnableUsageTracking() {
+	s.usage.mutex.Lock()
+	defer s.usage.mutex.Unlock()
+	s.usage.enabled = true
+}
+
+// unknownMethod is the method under which the calls of methods neither
+// registered nor retired are tracked, so that the names sent by clients
+// can't grow the usage without bound.
+const unknownMethod = "unknown"
+
+// trackUsage counts a call of a canonical method name, if tracking is
+// enabled.
+func (s *Server) trackUsage(r *http.Request, method string) {
+	s.usage.mutex.Lock()
+	enabled := s.usage.enabled
+	s.usage.mutex.Unlock()
+	if !enabled {
+		return
+	}
+	if !s.knownMethod(method) {
+		method = unknownMethod
+	}
+	caller := s.Caller(r)
+	now := s.clock.Now()
+	minute := now.Unix() / 60
+
+	s.usage.mutex.Lock()
+	defer s.usage.mutex.Unlock()
+	if s.usage.entries == nil {
+		s.usage.entries = make(map[[2]string]*usageEntry)
+	}
+	key := [2]string{caller, method}
+	entry := s.usage.entries[key]
+	if entry == nil {
+		entry = &usageEntry{Usage: Usage{Caller: caller, Method: method, FirstSeen: now}}
+		s.usage.entries[key] = entry
+	}
+	entry.Calls++
+	entry.LastSeen = now
+	i := minute % usageWindow
+	if entry.minutes[i] != minute {
+		entry.minutes[i] = minute
+		entry.buckets[i] = 0
+	}
+	entry.buckets[i]++
+}
+
+// UsageReport returns the tracked usage, sorted by method and caller. If
+// method is not empty, only the usage of that method is returned, e.g. to
+// find who still calls a deprecated method. The calls of methods neither
+// registered nor retired are reported under the method "unknown".
+func (s *Server) UsageReport(method string) []Usage {
+	minute := s.clock.Now().Unix() / 60
+	s.usage.mutex.Lock()
+	defer s.usage.mutex.Unlock()
+	var report []Usage
+	for _, entry := range s.usage.entries {
+		if method != "" && entry.Method != method {
+			continue
+		}
+		usage := entry.Usage
+		var recent int64
+		for i, m := range entry.minutes {
+			if m > minute-usageWindow && m <= minute {
+				recent += entry.buckets[i]
+			}
+		}
+		usage.PerMinute = float64(recent) / usageWindow
+		report = append(report, usage)
+	}
+	sort.Slice(report, func(i, j int) bool {
+		if report[i].Method != report[j].Method {
+			return report[i].Method < report[j].Method
+		}
+		return report[i].Caller < report[j].Caller
+	})
+	return report
+}
+
+// UsageHandler returns an admin handler serving the usage report as JSON.
+// The query "?method=Service.Method" restricts it to a method.
+func (s *Server) UsageHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		json.NewEncoder(w).Encode(s.UsageReport(r.URL.Query().Get("method")))
+	})
+}
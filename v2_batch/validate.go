@@ -0,0 +1,178 @@
+// Copyright 2012 The Gorilla Authors. All rights reserved.
+// Use of this source code is governed by a BSD-style
+// license that can be found in the LICENSE file.
+
+package rpc
+
+import (
+	"encoding"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"reflect"
+)
+
+// ReplyValidator is implemented by reply types able to check their own
+// contents, e.g. against a schema. It is used in strict reply mode.
+type ReplyValidator interface {
+	ValidateReply() error
+}
+
+// Validator is implemented by args types checking their own contents. The
+// server calls Validate once the args are decoded, and answers the calls
+// whose args fail with a CodeInvalidRequest error without serving them.
+//
+// The data of the error replied are those of the error returned, if it has
+// any, as a BadRequest does; otherwise they are a BadRequest detail with
+// its message.
+//
+// Before Validate, the fields of the args are checked against the rules of
+// their rpc tags, as in:
+//
+//	type TransferArgs struct {
+//		Amount int     `rpc:"required,min=1"`
+//		Memo   *string `rpc:"max=140"`
+//		IBAN   string  `rpc:"required,pattern=^[A-Z]{2}[0-9]{2}[A-Z0-9]+$"`
+//	}
+//
+// The rules, separated by commas, are:
+//
+//	required     the value isn't zero
+//	min=N        numbers are at least N; strings have at least N
+//	             characters, slices and maps N elements
+//	max=N        numbers are at most N; strings have at most N characters,
+//	             slices and maps N elements
+//	pattern=RE   strings match the regular expression RE, which runs to the
+//	             end of the tag and may hold commas
+//
+// The rules other than required don't apply to nil pointers, for optional
+// fields. Nested structs are checked too, and the calls breaking rules are
+// answered with a BadRequest detail listing the fields, by JSON name as in
+// "Items[0].Price". Invalid tags are reported at registration.
+type Validator interface {
+	Validate(r *http.Request) error
+}
+
+// validateArgs checks the args of a call against the rules of their tags,
+// then with their Validate method if they implement Validator.
+func validateArgs(r *http.Request, args interface{}) error {
+	var violations []FieldViolation
+	checkTags(reflect.ValueOf(args), "", make(map[uintptr]bool), &violations)
+	if len(violations) > 0 {
+		return invalidArgs(&BadRequest{FieldViolations: violations})
+	}
+	v, ok := args.(Validator)
+	if !ok {
+		return nil
+	}
+	if err := v.Validate(r); err != nil {
+		return invalidArgs(err)
+	}
+	return nil
+}
+
+// invalidArgs returns the error replied for args failing validation with
+// err.
+func invalidArgs(err error) error {
+	e := &Error{Code: CodeInvalidRequest, Message: "rpc: invalid args: " + err.Error()}
+	switch err := err.(type) {
+	case *BadRequest:
+		e.Data = &ErrorDetails{Details: []ErrorDetail{err}}
+	case interface{ ErrorData() interface{} }:
+		e.Data = err.ErrorData()
+	}
+	if e.Data == nil {
+		e.Data = &ErrorDetails{Details: []ErrorDetail{&BadRequest{
+			FieldViolations: []FieldViolation{{Description: err.Error()}},
+		}}}
+	}
+	return e
+}
+
+// SetStrictReplies enables checking each reply before it is encoded, for
+// development: a reply holding values no codec can encode, such as
+// channels, functions or non-finite floats, or failing its ValidateReply
+// method, is replaced by a CodeInternalError error naming the offending
+// field.
+func (s *Server) SetStrictReplies(strict bool) {
+	s.strictReplies = strict
+}
+
+var (
+	jsonMarshalerType = reflect.TypeOf((*json.Marshaler)(nil)).Elem()
+	textMarshalerType = reflect.TypeOf((*encoding.TextMarshaler)(nil)).Elem()
+)
+
+// validateReply checks a reply in strict reply mode.
+func validateReply(reply reflect.Value) error {
+	if err := validateValue(reply.Elem(), "reply", make(map[uintptr]bool)); err != nil {
+		return err
+	}
+	if v, ok := reply.Interface().(ReplyValidator); ok {
+		if err := v.ValidateReply(); err != nil {
+			return &Error{Code: CodeInternalError, Message: "rpc: invalid reply: " + err.Error()}
+		}
+	}
+	return nil
+}
+
+// validateValue walks v, named path, looking for values that can't be
+// encoded. Values marshaling themselves are trusted.
+func validateValue(v reflect.Value, path string, seen map[uintptr]bool) error {
+	invalid := func(what string) error {
+		return &Error{
+			Code:    CodeInternalError,
+			Message: fmt.Sprintf("rpc: invalid reply field %s: %s", path, what),
+		}
+	}
+	if !v.IsValid() {
+		return nil
+	}
+	if v.Type().Implements(jsonMarshalerType) || v.Type().Implements(textMarshalerType) {
+		return nil
+	}
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		if f := v.Float(); math.IsNaN(f) || math.IsInf(f, 0) {
+			return invalid(fmt.Sprintf("non-finite float %v", f))
+		}
+	case reflect.Complex64, reflect.Complex128, reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		return invalid("unsupported type " + v.Type().String())
+	case reflect.Ptr:
+		if v.IsNil() {
+			return nil
+		}
+		if seen[v.Pointer()] {
+			return invalid("cycle")
+		}
+		seen[v.Pointer()] = true
+		defer delete(seen, v.Pointer())
+		return validateValue(v.Elem(), path, seen)
+	case reflect.Interface:
+		return validateValue(v.Elem(), path, seen)
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			if f := t.Field(i); f.PkgPath == "" {
+				if err := validateValue(v.Field(i), path+"."+f.Name, seen); err != nil {
+					return err
+				}
+			}
+		}
+	case reflect.Slice, reflect.Array:
+		for i := 0; i < v.Len(); i++ {
+			if err := validateValue(v.Index(i), fmt.Sprintf("%s[%d]", path, i), seen); err != nil {
+				return err
+			}
+		}
+	case reflect.Map:
+		iter := v.MapRange()
+		for iter.Next() {
+			if err := validateValue(iter.Value(), fmt.Sprintf("%s[%v]", path, iter.Key()), seen); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}